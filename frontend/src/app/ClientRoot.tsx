@@ -1,23 +1,55 @@
 "use client";
 
-import { ReactNode, useCallback, useEffect, useRef, useState } from "react";
+import { MutableRefObject, ReactNode, useCallback, useEffect, useRef, useState } from "react";
 import { Dropdown } from "./dropdown/dropdown";
 import { Canvas } from "./canvas/canvas";
 import { ColorPanel } from "@/app/canvas/color-panel/color-panel";
 import { ProfileAvatar } from "@/app/profile-avatar/profile-avatar";
 import { ColorCoord } from "./canvas/canva-coord/canva-coord";
-import CanvasListener, { ChunkUpdate } from "@/gcloud/CanvasListener";
+import CanvasListener, { CanvasBounds, ChunkUpdate } from "@/gcloud/CanvasListener";
 import { CanvasChunk } from "@/gcloud/types";
 import { paintPixel } from "@/app/canvas/canva-pixel/canva-pixel";
 import { COLORS_PANEL } from "@/constants/constants";
+import { useAppContext } from "@/app/context/AppContext";
 
 type ClientRootProps = {
   children: ReactNode;
 };
 
+// Color of the pixels nobody painted, as drawn by CanvaPixel.
+const BLANK_COLOR = "#e4e4e4ff";
+
+// paintChunk repaints a chunk from the documents holding it: the chunk
+// document and, when it is split, its shards. Shards past the count recorded
+// on the chunk document are left over from an earlier split and ignored.
+function paintChunk(
+  canvasRef: MutableRefObject<HTMLCanvasElement | null>,
+  docs: CanvasChunk[],
+  chunkX: number,
+  chunkY: number,
+  size: number
+) {
+  for (let y = 0; y < size; y++) {
+    for (let x = 0; x < size; x++) {
+      paintPixel(canvasRef, chunkX * size + x, chunkY * size + y, BLANK_COLOR);
+    }
+  }
+  const first = docs.find((doc) => doc.shard === 0);
+  if (!first) return;
+  docs
+    .filter((doc) => doc.shard < first.shards)
+    .forEach((doc) => {
+      doc.pixels.forEach((pixel) => {
+        const color = COLORS_PANEL[pixel.color as unknown as number];
+        paintPixel(canvasRef, chunkX * size + pixel.x, chunkY * size + pixel.y, color as string);
+      });
+    });
+}
+
 export default function ClientRoot({ children }: ClientRootProps) {
   const [chunks, setChunks] = useState<Record<string, CanvasChunk>>({});
   const canvasRef = useRef<HTMLCanvasElement | null>(null);
+  const { gridWidth, gridHeight, setGridSize } = useAppContext();
 
   useEffect(() => {
     const canvas = document.querySelector("canvas");
@@ -28,31 +60,44 @@ export default function ClientRoot({ children }: ClientRootProps) {
 
   const handleChunkUpdate = useCallback((update: ChunkUpdate) => {
     setChunks((prev) => {
+      const next = { ...prev };
       if (update.type === "removed") {
-        const copy = { ...prev };
-        delete copy[update.id];
-        return copy;
+        delete next[update.id];
+      } else {
+        next[update.id] = update.data;
       }
 
-      const chunkX = update.data.chunkX;
-      const chunkY = update.data.chunkY;
-      const size = update.data.size;
-
-      update.data.pixels.forEach((pixel) => {
-        const color = COLORS_PANEL[pixel.color as unknown as number];
-        paintPixel(canvasRef, chunkX * size + pixel.x, chunkY * size + pixel.y, color as string);
-      });
+      const { chunkId, chunkX, chunkY, size } = update.data;
+      const docs = Object.values(next).filter((doc) => doc.chunkId === chunkId);
+      paintChunk(canvasRef, docs, chunkX, chunkY, size);
 
-      return {
-        ...prev,
-        [update.id]: update.data,
-      };
+      return next;
     });
   }, []);
 
+  const handleBoundsUpdate = useCallback(
+    ({ width, height }: CanvasBounds) => setGridSize(width, height),
+    [setGridSize]
+  );
+
+  // Resizing the canvas element when the canvas is expanded wipes it: paint
+  // the chunks again.
+  useEffect(() => {
+    const byChunk: Record<string, CanvasChunk[]> = {};
+    Object.values(chunks).forEach((doc) => {
+      (byChunk[doc.chunkId] ??= []).push(doc);
+    });
+    Object.values(byChunk).forEach((docs) => {
+      const { chunkX, chunkY, size } = docs[0];
+      paintChunk(canvasRef, docs, chunkX, chunkY, size);
+    });
+    // Chunk updates paint themselves.
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, [gridWidth, gridHeight]);
+
   return (
     <>
-      <CanvasListener onChunkUpdate={handleChunkUpdate} />
+      <CanvasListener onChunkUpdate={handleChunkUpdate} onBoundsUpdate={handleBoundsUpdate} />
       <Dropdown />
       <Canvas />
       <ColorCoord />
@@ -37,14 +37,14 @@ export function paintPixel(
 }
 
 export function CanvaPixel({ canvasRef }: CanvaPixelProps) {
-  const { pixels } = useAppContext();
+  const { pixels, gridWidth, gridHeight } = useAppContext();
 
   useEffect(() => {
     const canvas = canvasRef.current;
     if (!canvas) return;
 
-    canvas.width = GRID_SIZE * PIXEL_SIZE;
-    canvas.height = GRID_SIZE * PIXEL_SIZE;
+    canvas.width = gridWidth * PIXEL_SIZE;
+    canvas.height = gridHeight * PIXEL_SIZE;
 
     const ctx = canvas.getContext("2d");
     if (!ctx) return;
@@ -62,7 +62,7 @@ export function CanvaPixel({ canvasRef }: CanvaPixelProps) {
         PIXEL_SIZE
       );
     });
-  }, [canvasRef, pixels]);
+  }, [canvasRef, pixels, gridWidth, gridHeight]);
 
   return (
     <div>
@@ -4,7 +4,6 @@ import { useEffect, useRef, MouseEvent } from "react";
 import { CanvaPixel, coordsToId } from "./canva-pixel/canva-pixel";
 import { useAppContext } from "../context/AppContext";
 import {
-  GRID_SIZE,
   PIXEL_SIZE,
   MAX_ZOOM,
   MIN_ZOOM,
@@ -13,9 +12,15 @@ import {
 const CLICK_DISTANCE_THRESHOLD = 5;
 const ZOOM_FACTOR = 0.05;
 
-function clampPosition(x: number, y: number, scale: number) {
-  const canvasWidth = GRID_SIZE * PIXEL_SIZE * scale;
-  const canvasHeight = GRID_SIZE * PIXEL_SIZE * scale;
+function clampPosition(
+  x: number,
+  y: number,
+  scale: number,
+  gridWidth: number,
+  gridHeight: number
+) {
+  const canvasWidth = gridWidth * PIXEL_SIZE * scale;
+  const canvasHeight = gridHeight * PIXEL_SIZE * scale;
 
   const cellSize = PIXEL_SIZE * scale;
 
@@ -38,6 +43,8 @@ export function Canvas() {
     setShouldZoom,
     targetPixel,
     setTargetPixel,
+    gridWidth,
+    gridHeight,
   } = useAppContext();
 
   const isDraggingRef = useRef(false);
@@ -77,7 +84,7 @@ export function Canvas() {
       const nextX = canvasPosition.x * scaleRatio;
       const nextY = canvasPosition.y * scaleRatio;
       setCanvasScale(newScale);
-      setCanvasPosition(clampPosition(nextX, nextY, newScale));
+      setCanvasPosition(clampPosition(nextX, nextY, newScale, gridWidth, gridHeight));
     }
   };
 
@@ -96,7 +103,7 @@ export function Canvas() {
     const dy = e.clientY - lastPosRef.current.y;
 
     setCanvasPosition((prev) =>
-      clampPosition(prev.x + dx, prev.y + dy, canvasScale)
+      clampPosition(prev.x + dx, prev.y + dy, canvasScale, gridWidth, gridHeight)
     );
 
     if (dragStartRef.current) {
@@ -139,7 +146,7 @@ export function Canvas() {
     const dy = touch.clientY - lastPosRef.current.y;
 
     setCanvasPosition((prev) =>
-      clampPosition(prev.x + dx, prev.y + dy, canvasScale)
+      clampPosition(prev.x + dx, prev.y + dy, canvasScale, gridWidth, gridHeight)
     );
 
     lastPosRef.current = { x: touch.clientX, y: touch.clientY };
@@ -195,7 +202,7 @@ export function Canvas() {
 
       setCanvasScale(newScale);
 
-      setCanvasPosition(clampPosition(newX, newY, newScale));
+      setCanvasPosition(clampPosition(newX, newY, newScale, gridWidth, gridHeight));
 
       if (t < 1) {
         animationRef.current = requestAnimationFrame(step);
@@ -209,9 +216,8 @@ export function Canvas() {
 
   useEffect(() => {
     if (shouldZoom && targetPixel) {
-      const centerIndex = (GRID_SIZE - 1) / 2;
-      const dx = targetPixel.x - centerIndex;
-      const dy = targetPixel.y - centerIndex;
+      const dx = targetPixel.x - (gridWidth - 1) / 2;
+      const dy = targetPixel.y - (gridHeight - 1) / 2;
 
       const TARGET_SCALE = MAX_ZOOM;
 
@@ -222,7 +228,7 @@ export function Canvas() {
       animateViewTo(targetX, targetY, TARGET_SCALE);
       setShouldZoom(false);
     }
-  }, [shouldZoom, targetPixel, animateViewTo, canvasScale]);
+  }, [shouldZoom, targetPixel, animateViewTo, canvasScale, gridWidth, gridHeight]);
 
   const handleCanvasClick = (e: MouseEvent<HTMLDivElement>) => {
     const canvas = canvasRef.current;
@@ -239,7 +245,7 @@ export function Canvas() {
     ) {
       return;
     }
-    const cellSizeScreen = rect.width / GRID_SIZE;
+    const cellSizeScreen = rect.width / gridWidth;
 
     const relativeX = clickX - rect.left;
     const relativeY = clickY - rect.top;
@@ -247,12 +253,11 @@ export function Canvas() {
     const cellX = Math.floor(relativeX / cellSizeScreen);
     const cellY = Math.floor(relativeY / cellSizeScreen);
 
-    if (cellX < 0 || cellX >= GRID_SIZE || cellY < 0 || cellY >= GRID_SIZE) {
+    if (cellX < 0 || cellX >= gridWidth || cellY < 0 || cellY >= gridHeight) {
       return;
     }
-    const centerIndex = (GRID_SIZE - 1) / 2;
-    const dx = cellX - centerIndex;
-    const dy = cellY - centerIndex;
+    const dx = cellX - (gridWidth - 1) / 2;
+    const dy = cellY - (gridHeight - 1) / 2;
 
     const TARGET_SCALE = canvasScale;
 
@@ -284,7 +289,7 @@ export function Canvas() {
       return;
     }
 
-    const canvasPixelWidth = GRID_SIZE * PIXEL_SIZE;
+    const canvasPixelWidth = gridWidth * PIXEL_SIZE;
     const scale = rect.width / canvasPixelWidth;
 
     const relativeX = centerX - rect.left;
@@ -293,14 +298,14 @@ export function Canvas() {
     const cellX = Math.floor(relativeX / (PIXEL_SIZE * scale));
     const cellY = Math.floor(relativeY / (PIXEL_SIZE * scale));
 
-    if (cellX < 0 || cellX >= GRID_SIZE || cellY < 0 || cellY >= GRID_SIZE) {
+    if (cellX < 0 || cellX >= gridWidth || cellY < 0 || cellY >= gridHeight) {
       setTargetPixel(null);
       return;
     }
 
     const id = coordsToId(cellX, cellY);
     setTargetPixel({ x: cellX, y: cellY, zoom: scale });
-  }, [canvasPosition, canvasScale, setTargetPixel]);
+  }, [canvasPosition, canvasScale, setTargetPixel, gridWidth, gridHeight]);
 
   const centralCellSize = PIXEL_SIZE * canvasScale;
 
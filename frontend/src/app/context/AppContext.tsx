@@ -4,6 +4,7 @@ import {
   createContext,
   useContext,
   useState,
+  useCallback,
   ReactNode,
   useEffect,
 } from "react";
@@ -42,6 +43,9 @@ type AppContextType = {
   setTargetPixel: (
     position: Coord | null | ((prev: Coord | null) => Coord | null)
   ) => void;
+  gridWidth: number;
+  gridHeight: number;
+  setGridSize: (width: number, height: number) => void;
   pixels: PixelData[];
   addPixel: (pixel: PixelData) => void;
   resetCanvas: () => void;
@@ -65,6 +69,7 @@ export function AppProvider({ children }: { children: ReactNode }) {
   const [canvasScale, setCanvasScale] = useState<number>(0);
   const [shouldZoom, setShouldZoom] = useState(false);
   const [targetPixel, setTargetPixel] = useState<Coord | null>(null);
+  const [gridSize, setGridSizeState] = useState({ width: GRID_SIZE, height: GRID_SIZE });
   const [pixels, setPixels] = useState<PixelData[]>([]);
   const [isLoaded, setIsLoaded] = useState(false);
   const [discordToken, setDiscordToken] = useState<string | null>(null);
@@ -106,6 +111,12 @@ export function AppProvider({ children }: { children: ReactNode }) {
     });
   };
 
+  const setGridSize = useCallback((width: number, height: number) => {
+    setGridSizeState((prev) =>
+      prev.width === width && prev.height === height ? prev : { width, height }
+    );
+  }, []);
+
   const resetCanvas = () => {
     clearCanvasState();
     setPixels([]);
@@ -137,6 +148,9 @@ export function AppProvider({ children }: { children: ReactNode }) {
         setShouldZoom,
         targetPixel,
         setTargetPixel,
+        gridWidth: gridSize.width,
+        gridHeight: gridSize.height,
+        setGridSize,
         pixels,
         addPixel,
         resetCanvas,
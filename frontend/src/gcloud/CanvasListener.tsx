@@ -1,6 +1,7 @@
 "use client";
 import {
   collection,
+  doc,
   query,
   onSnapshot,
   DocumentChange,
@@ -8,6 +9,7 @@ import {
 } from "firebase/firestore";
 import { db } from "./firebase";
 import { CanvasChunk } from "./types";
+import { decodeChunkPixels, parseChunkId } from "./chunks";
 import { useEffect } from "react";
 
 export interface ChunkUpdate {
@@ -16,51 +18,63 @@ export interface ChunkUpdate {
   data: CanvasChunk;
 }
 
+// Bounds of the canvas, as recorded by draw on its metadata document and grown
+// when the canvas is expanded.
+export interface CanvasBounds {
+  width: number;
+  height: number;
+}
+
 interface Props {
   onChunkUpdate: (update: ChunkUpdate) => void;
+  onBoundsUpdate?: (bounds: CanvasBounds) => void;
 }
 
-export default function CanvasListener({ onChunkUpdate }: Props) {
+export default function CanvasListener({ onChunkUpdate, onBoundsUpdate }: Props) {
+useEffect(() => {
+  if (!onBoundsUpdate) return;
+  const unsub = onSnapshot(
+    doc(db, "canvases", "_default"),
+    (snapshot) => {
+      const width = Number(snapshot.get("width"));
+      const height = Number(snapshot.get("height"));
+      // Unbounded canvases record no bounds.
+      if (width > 0 && height > 0) {
+        onBoundsUpdate({ width, height });
+      }
+    },
+    (error) => {
+      console.error("Firestore canvas listener error:", error);
+    }
+  );
+
+  return () => unsub();
+  }, [onBoundsUpdate]);
+
 useEffect(() => {
   const q = query(collection(db, "canvas_chunks"));
   const unsub = onSnapshot(
     q,
     (snapshot) => {
       snapshot.docChanges().forEach((change) => {
-        if (change.type === "added" || change.type === "modified") {
+        // Documents removed, as when the canvas is cleared, still carry their
+        // last data, so the chunk they held is repainted without them.
+        {
             const raw = change.doc.data() as {
               pixels?: Record<string, { color?: unknown; Color?: unknown }>;
+              format?: string;
+              shards?: unknown;
               lastUpdated?: unknown;
               updatedAt?: unknown;
               size?: unknown;
             };
 
             const docId = change.doc.id;
-            let chunkX = 0;
-            let chunkY = 0;
-            const suffix = docId.replace("canvas_chunks_", "");
-            const [xStr, yStr] = suffix.split("_");
-            if (xStr !== undefined && yStr !== undefined) {
-              const parsedX = Number(xStr);
-              const parsedY = Number(yStr);
-              if (!Number.isNaN(parsedX)) chunkX = parsedX;
-              if (!Number.isNaN(parsedY)) chunkY = parsedY;
-            }
+            const parsed = parseChunkId(docId);
+            if (!parsed) return;
+            const { chunkId, chunkX, chunkY, shard } = parsed;
 
-            const pixelsEntries = Object.entries(
-              (raw?.pixels as Record<string, { color?: unknown; Color?: unknown }>) || {}
-            );
-            const pixels = pixelsEntries.map(([key, value]) => {
-              const [pxStr, pyStr] = key.split("_");
-              const px = Number(pxStr);
-              const py = Number(pyStr);
-              const color = value?.color ?? value?.Color ?? "";
-              return {
-                x: Number.isNaN(px) ? 0 : px,
-                y: Number.isNaN(py) ? 0 : py,
-                color: String(color),
-              };
-            });
+            const pixels = decodeChunkPixels(raw);
 
             let updatedAt = 0;
             const ts = raw?.lastUpdated ?? raw?.updatedAt;
@@ -72,6 +86,9 @@ useEffect(() => {
 
             const data: CanvasChunk = {
               id: docId,
+              chunkId,
+              shard,
+              shards: Number(raw?.shards) > 1 ? Number(raw?.shards) : 1,
               chunkX,
               chunkY,
               pixels,
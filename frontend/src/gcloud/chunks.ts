@@ -0,0 +1,83 @@
+// chunks.ts
+import { Bytes, DocumentData } from "firebase/firestore";
+import { Pixel } from "./types";
+
+// Widths of the entries of the arrays of a packed chunk.
+const OWNER_WIDTH = 4;
+const PLACED_AT_WIDTH = 8;
+
+const CHUNK_ID = /^canvas_chunks_(-?\d+)_(-?\d+)(?:_s(\d+))?$/;
+
+export interface ChunkDocument {
+  chunkId: string;
+  chunkX: number;
+  chunkY: number;
+  shard: number;
+}
+
+// parseChunkId returns the chunk a document belongs to, with its shard: 0 for
+// the chunk document itself, n for the "_sn" documents holding the other rows
+// of a chunk split in several. It returns null for other documents.
+export function parseChunkId(id: string): ChunkDocument | null {
+  const match = CHUNK_ID.exec(id);
+  if (!match) return null;
+  const shard = Number(match[3] ?? 0);
+  if (match[3] !== undefined && shard <= 0) return null;
+  return {
+    chunkId: `canvas_chunks_${match[1]}_${match[2]}`,
+    chunkX: Number(match[1]),
+    chunkY: Number(match[2]),
+    shard,
+  };
+}
+
+function bytesOf(value: unknown): Uint8Array {
+  if (value instanceof Bytes) return value.toUint8Array();
+  if (value instanceof Uint8Array) return value;
+  return new Uint8Array();
+}
+
+// decodeChunkPixels returns the pixels of a chunk document written by draw,
+// with coordinates within the chunk. Its pixels are kept either in a "pixels"
+// map of "x_y" keys, or, when its format is "packed", in arrays indexed by
+// y*size+x: a color byte, a little-endian uint32 owner (0 when blank) and a
+// little-endian int64 placedAt per pixel.
+export function decodeChunkPixels(raw: DocumentData): Pixel[] {
+  if (raw?.format === "packed") {
+    return unpackPixels(raw);
+  }
+
+  const entries = Object.entries(
+    (raw?.pixels as Record<string, { color?: unknown; Color?: unknown }>) || {}
+  );
+  return entries.map(([key, value]) => {
+    const [pxStr, pyStr] = key.split("_");
+    const px = Number(pxStr);
+    const py = Number(pyStr);
+    const color = value?.color ?? value?.Color ?? "";
+    return {
+      x: Number.isNaN(px) ? 0 : px,
+      y: Number.isNaN(py) ? 0 : py,
+      color: String(color),
+    };
+  });
+}
+
+function unpackPixels(raw: DocumentData): Pixel[] {
+  const size = Number(raw.size);
+  const n = size * size;
+  const colors = bytesOf(raw.colors);
+  const owners = bytesOf(raw.owners);
+  if (!(size > 0) || colors.length !== n || owners.length !== n * OWNER_WIDTH || bytesOf(raw.placedAt).length !== n * PLACED_AT_WIDTH) {
+    console.error(`Invalid packed chunk: arrays do not match size ${raw.size}`);
+    return [];
+  }
+
+  const ownerView = new DataView(owners.buffer, owners.byteOffset, owners.byteLength);
+  const pixels: Pixel[] = [];
+  for (let i = 0; i < n; i++) {
+    if (ownerView.getUint32(i * OWNER_WIDTH, true) === 0) continue;
+    pixels.push({ x: i % size, y: Math.floor(i / size), color: String(colors[i]) });
+  }
+  return pixels;
+}
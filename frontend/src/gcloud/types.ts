@@ -7,6 +7,9 @@ export interface Pixel {
   
   export interface CanvasChunk {
     id?: string; // firestore doc ID (added later)
+    chunkId: string; // ID of the chunk document, the same for all its shards
+    shard: number; // 0 for the chunk document, n for its "_sn" shards
+    shards: number; // documents of the chunk, as recorded on each of them
     chunkX: number;
     chunkY: number;
     size: number;
@@ -355,6 +355,16 @@ deploy_service() {
         return 0
     fi
     
+    # Go functions pull sibling modules (e.g. src/functions/shared) through
+    # local replace directives that are not part of the uploaded source.
+    if [ -f "$SOURCE_DIR/go.mod" ] && grep -q "=> \.\./" "$SOURCE_DIR/go.mod"; then
+        print_info "Vendoring local Go modules..."
+        if ! (cd "$SOURCE_DIR" && go mod vendor); then
+            print_error "go mod vendor failed"
+            return 1
+        fi
+    fi
+
     # Build the deployment command
     local deploy_cmd="gcloud run deploy \"$FUNCTION_NAME\" \
         --source \"$SOURCE_DIR\" \
@@ -735,6 +745,11 @@ if [ "$DEPLOYMENT_MODE" = "update" ]; then
     echo ""
 fi
 print_info "Enter environment variables. Leave KEY empty to finish."
+# The draw service prunes the backlog of the update subscriptions once a
+# chunk update is older than PRUNE_MAX_AGE (default 5m) or PRUNE_MAX_BACKLOG
+# updates were written, at most once per PRUNE_INTERVAL (default 1m). It needs
+# TRIGGER_RESET_NAME; PRUNE_MAX_AGE=0 without PRUNE_MAX_BACKLOG turns pruning off.
+print_info "draw: pruning defaults to PRUNE_MAX_AGE=5m, PRUNE_INTERVAL=1m; set PRUNE_MAX_AGE=0 to turn it off"
 ENV_VARS=""
 ENV_COUNT=0
 
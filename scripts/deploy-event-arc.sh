@@ -319,6 +319,7 @@ if [[ "$EVENT_TYPE" == google.cloud.firestore.document.* ]]; then
     echo ""
     print_info "Enter the document or collection path relative to 'documents/', e.g.:"
     print_info "  canvas_chunks/{docId}"
+    print_info "  canvases/{canvas}/chunks/{docId}  (chunks of the other canvases)"
     USER_DOC_PATH=$(get_input "Enter Firestore document path" "canvas_chunks/{docId}")
     FULL_DOC_PATH="projects/${PROJECT_ID}/databases/${DB_NAME}/documents/${USER_DOC_PATH}"
     EVENT_FILTERS+=("document=${FULL_DOC_PATH}")
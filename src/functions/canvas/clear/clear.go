@@ -0,0 +1,422 @@
+// Package clear wipes canvases at the end of a season, after archiving them.
+// Deploy it requiring authentication: it is an admin operation.
+package clear
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"example.com/shared/bus"
+	"example.com/shared/canvas"
+	"example.com/shared/logging"
+	"example.com/shared/message"
+	"example.com/shared/metrics"
+	"example.com/shared/store"
+	"example.com/shared/tracing"
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	projectId         string
+	firestoreDatabase string
+	userCollection    string
+	topicID           string
+	storeBackend      string
+	sqlitePath        string
+	busBackend        string
+	natsURL           string
+	metricsExporter   string
+	tracesExporter    string
+	canvases          canvas.Canvases
+	canvasesErr       error
+	logger            *slog.Logger
+)
+
+var (
+	// errSeasonArchived is returned when the season has an archive the clear
+	// may not use.
+	errSeasonArchived = errors.New("season already archived")
+
+	// errNotStarted is returned when resuming the clear of a season no clear
+	// was started for.
+	errNotStarted = errors.New("no clear of the season to resume")
+)
+
+// clearStore is the store of the canvases and their archives.
+type clearStore interface {
+	store.CanvasStore
+	store.Archiver
+}
+
+// openStore opens the canvas store holding the canvases and archives.
+var openStore = func(ctx context.Context) (clearStore, error) {
+	st, err := store.Open(ctx, store.Config{
+		Backend:        storeBackend,
+		ProjectID:      projectId,
+		Database:       firestoreDatabase,
+		UserCollection: userCollection,
+		SQLitePath:     sqlitePath,
+	})
+	if err != nil {
+		return nil, err
+	}
+	cs, ok := st.(clearStore)
+	if !ok {
+		st.Close()
+		return nil, fmt.Errorf("store backend %q cannot archive canvases", storeBackend)
+	}
+	return cs, nil
+}
+
+// openBus connects to the message bus the clients are notified on.
+var openBus = func(ctx context.Context) (bus.Publisher, error) {
+	return bus.Open(ctx, bus.Config{
+		Backend:   busBackend,
+		ProjectID: projectId,
+		NATSURL:   natsURL,
+	})
+}
+
+func init() {
+	projectId = os.Getenv("PROJECT_ID")
+	firestoreDatabase = os.Getenv("FIRESTORE_DATABASE")
+	userCollection = os.Getenv("USER_COLLECTION")
+	topicID = os.Getenv("PIXEL_UPDATE_TOPIC")
+	storeBackend = os.Getenv("STORE_BACKEND")
+	sqlitePath = os.Getenv("SQLITE_PATH")
+	busBackend = os.Getenv("BUS_BACKEND")
+	natsURL = os.Getenv("NATS_URL")
+	metricsExporter = os.Getenv("METRICS_EXPORTER")
+	tracesExporter = os.Getenv("TRACES_EXPORTER")
+	logger = logging.New(logging.ConfigFromEnv(projectId, "clear"))
+	if err := metrics.Setup(context.Background(), metrics.Config{Exporter: metricsExporter, ServiceName: "clear"}); err != nil {
+		logger.Error("Error setting up metrics", "error", err)
+	}
+	if err := tracing.Setup(context.Background(), tracing.Config{Exporter: tracesExporter, ServiceName: "clear"}); err != nil {
+		logger.Error("Error setting up tracing", "error", err)
+	}
+	if canvases, canvasesErr = canvas.FromEnv(); canvasesErr != nil {
+		logger.Error("Error reading canvases", "error", canvasesErr)
+	}
+	log.SetFlags(0)
+
+	functions.HTTP("clearCanvas", clearCanvas)
+}
+
+// clearRequest is the body of a clearCanvas request, such as
+// {"canvas": "season-2", "season": "2025-spring", "reason": "end of season",
+// "requestedBy": "admin@example.com", "resetCooldowns": true}.
+type clearRequest struct {
+	// Canvas is the ID of the canvas to clear, empty for the default one.
+	Canvas string `json:"canvas"`
+
+	// Season names the archive the canvas is copied to before being
+	// cleared, following the rules of canvas IDs. Each season is archived
+	// once: a clear of a season that has an archive is refused, unless
+	// Resume is set.
+	Season string `json:"season"`
+
+	// Resume finishes a clear of the canvas that failed, reusing the archive
+	// of the season it created, and without archiving again what is left of
+	// the canvas if the chunks were copied. Only resume a clear that
+	// returned an error: one still running would be done twice.
+	Resume bool `json:"resume"`
+
+	// Reason and RequestedBy are recorded in the audit entry of the clear.
+	Reason      string `json:"reason"`
+	RequestedBy string `json:"requestedBy"`
+
+	// ResetCooldowns lets every user place a pixel at once on the cleared
+	// canvas.
+	ResetCooldowns bool `json:"resetCooldowns"`
+
+	// ResetBounds returns the cleared canvas to the bounds it is configured
+	// with, dropping the expansions applied or scheduled. Otherwise it keeps
+	// its bounds. Its chunk size is kept either way.
+	ResetBounds bool `json:"resetBounds"`
+}
+
+// clearCanvas archives the chunks of a canvas to the archive of a season,
+// deletes them, optionally deletes its users to reset their cooldowns and
+// resets its bounds, and publishes a message.CanvasCleared on
+// PIXEL_UPDATE_TOPIC. The archive records the chunk size and bounds of the
+// canvas. A canvas being rechunked is not cleared. Each clear is recorded in
+// the audit collection under the ID "clear-{season}". Placements accepted
+// while it runs may be lost, or kept on the cleared canvas: pause the proxy
+// first for an exact archive.
+func clearCanvas(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Tracer().Start(tracing.ExtractHTTP(r.Context(), r), "clearCanvas",
+		trace.WithSpanKind(trace.SpanKindServer))
+	ctx = logging.With(ctx, logging.HTTPRequest(r))
+
+	reason := metrics.ReasonOK
+	defer func() {
+		metrics.Handled(ctx, "clear", reason)
+		tracing.EndWithReason(span, reason)
+	}()
+
+	if projectId == "" || firestoreDatabase == "" || topicID == "" {
+		reason = "config_error"
+		http.Error(w, "Environment variables are not set", http.StatusInternalServerError)
+		return
+	}
+	if canvasesErr != nil {
+		logger.ErrorContext(ctx, "Error reading canvases", "error", canvasesErr)
+		reason = "config_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error while reading the request body", "error", err)
+		reason = "read_error"
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var req clearRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		logger.WarnContext(ctx, "Invalid request body", "error", err)
+		reason = "invalid_body"
+		http.Error(w, "Bad Request: invalid body", http.StatusBadRequest)
+		return
+	}
+	if req.Season == "" || req.Reason == "" || req.RequestedBy == "" {
+		logger.WarnContext(ctx, "Incomplete clear request", "season", req.Season)
+		reason = "invalid_body"
+		http.Error(w, "Bad Request: season, reason and requestedBy are required", http.StatusBadRequest)
+		return
+	}
+	if !canvas.ValidID(req.Season) {
+		logger.WarnContext(ctx, "Invalid season", "season", req.Season)
+		reason = "invalid_body"
+		http.Error(w, "Bad Request: season must be lowercase letters, digits and dashes", http.StatusBadRequest)
+		return
+	}
+	ctx = logging.With(ctx, "canvas", req.Canvas, "season", req.Season)
+	cfg, err := canvases.Get(req.Canvas)
+	if err != nil {
+		logger.WarnContext(ctx, "Unknown canvas", "error", err)
+		reason = "unknown_canvas"
+		http.Error(w, "Bad Request: unknown canvas", http.StatusBadRequest)
+		return
+	}
+
+	st, err := openStore(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error opening canvas store", "error", err)
+		reason = "store_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer st.Close()
+
+	msgBus, err := openBus(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error connecting to message bus", "error", err)
+		reason = "bus_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer msgBus.Close()
+
+	meta, err := st.GetCanvasMeta(ctx, req.Canvas)
+	if errors.Is(err, store.ErrNotFound) {
+		meta, err = nil, nil
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "Error reading canvas metadata", "error", err)
+		reason = "store_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if meta != nil && meta.Rechunk != nil {
+		logger.WarnContext(ctx, "Canvas is being rechunked", "chunkSize", meta.ChunkSize, "to", meta.Rechunk.To)
+		reason = "rechunk_in_progress"
+		http.Error(w, "Conflict: the canvas is being rechunked", http.StatusConflict)
+		return
+	}
+
+	// The season is claimed before the clear is recorded or anything is
+	// copied: of two clears of the same season, one fails to create the
+	// archive and is turned away.
+	archive, err := claimArchive(ctx, st, req, meta, meta.Bounds(cfg.Bounds, time.Now()))
+	switch {
+	case errors.Is(err, errSeasonArchived):
+		logger.WarnContext(ctx, "Season already archived", "error", err)
+		reason = "season_archived"
+		http.Error(w, "Conflict: season already archived; set resume to finish a clear that failed", http.StatusConflict)
+		return
+	case errors.Is(err, errNotStarted):
+		logger.WarnContext(ctx, "No clear to resume", "error", err)
+		reason = "not_started"
+		http.Error(w, "Not Found: no clear of the season to resume", http.StatusNotFound)
+		return
+	case err != nil:
+		logger.ErrorContext(ctx, "Error creating archive", "error", err)
+		reason = "store_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	entry := &store.AuditEntry{
+		ID:          "clear-" + req.Season,
+		Operation:   "clear",
+		Canvas:      req.Canvas,
+		RequestedBy: req.RequestedBy,
+		Reason:      req.Reason,
+		At:          time.Now(),
+		Details:     map[string]string{"season": req.Season},
+	}
+	if err := st.RecordAudit(ctx, entry); err != nil {
+		logger.ErrorContext(ctx, "Error recording clear", "error", err)
+		reason = "store_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.InfoContext(ctx, "Clearing canvas", "requestedBy", req.RequestedBy, "reason", req.Reason)
+
+	err = clearChunks(ctx, st, msgBus, req, cfg.Bounds, archive, entry.Details)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if recordErr := st.RecordAudit(ctx, entry); recordErr != nil {
+		logger.ErrorContext(ctx, "Error recording the outcome of the clear", "error", recordErr)
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "Error clearing canvas", "error", err)
+		reason = "clear_error"
+		http.Error(w, "Internal server error; call again with the same season and resume set to finish", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Canvas cleared, archived as %s", req.Season)
+}
+
+// claimArchive creates the archive of the season, recording the chunk size
+// and bounds of the canvas, or returns the one a failed clear of the canvas
+// created when req resumes it.
+func claimArchive(ctx context.Context, st store.Archiver, req clearRequest, meta *store.CanvasMeta, bounds canvas.Bounds) (*store.Archive, error) {
+	if req.Resume {
+		archive, err := st.GetArchive(ctx, req.Season)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, errNotStarted
+		}
+		if err != nil {
+			return nil, err
+		}
+		if archive.ClearedAt != nil || archive.Canvas != req.Canvas {
+			return nil, fmt.Errorf("%w: canvas %q cleared at %v", errSeasonArchived, archive.Canvas, archive.ClearedAt)
+		}
+		return archive, nil
+	}
+
+	archive := &store.Archive{Canvas: req.Canvas, CreatedAt: time.Now()}
+	if meta != nil {
+		archive.ChunkSize = meta.ChunkSize
+	}
+	if bounds.Sized() {
+		archive.Width, archive.Height = bounds.Width, bounds.Height
+	}
+	if err := st.CreateArchive(ctx, req.Season, archive); errors.Is(err, store.ErrExists) {
+		return nil, errSeasonArchived
+	} else if err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// clearChunks archives the chunks of the canvas to the season archive, unless
+// a previous attempt did, deletes them and the users if asked, resets the
+// bounds to configured if asked, then notifies the clients. It records what
+// it did in details.
+func clearChunks(ctx context.Context, st clearStore, pub bus.Publisher, req clearRequest, configured canvas.Bounds, archive *store.Archive, details map[string]string) error {
+	if archive.ArchivedAt == nil {
+		documents, err := st.ArchiveChunks(ctx, req.Canvas, req.Season)
+		if err != nil {
+			return err
+		}
+		archive.Documents = documents
+		logger.InfoContext(ctx, "Canvas archived", "documents", documents)
+	} else {
+		logger.InfoContext(ctx, "Resuming clear of archived canvas", "documents", archive.Documents)
+	}
+	details["archived"] = strconv.Itoa(archive.Documents)
+
+	deleted, err := st.DeleteChunks(ctx, req.Canvas)
+	if err != nil {
+		return err
+	}
+	details["chunksDeleted"] = strconv.Itoa(deleted)
+	if req.ResetCooldowns {
+		users, err := st.DeleteUsers(ctx, req.Canvas)
+		if err != nil {
+			return err
+		}
+		details["usersDeleted"] = strconv.Itoa(users)
+	}
+
+	var meta *store.CanvasMeta
+	if req.ResetBounds {
+		// The configured bounds are recorded rather than dropped, so they
+		// stay authoritative whether or not draw records them again.
+		meta, err = st.UpdateCanvasMeta(ctx, req.Canvas, func(meta *store.CanvasMeta) error {
+			if configured.Sized() {
+				meta.Width, meta.Height = configured.Width, configured.Height
+			}
+			meta.Expansion = nil
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		details["boundsReset"] = "true"
+	} else if meta, err = st.GetCanvasMeta(ctx, req.Canvas); errors.Is(err, store.ErrNotFound) {
+		meta = nil
+	} else if err != nil {
+		return err
+	}
+
+	clearedAt := time.Now()
+	cleared := message.CanvasCleared{
+		Canvas:         req.Canvas,
+		Archive:        req.Season,
+		CooldownsReset: req.ResetCooldowns,
+		At:             clearedAt.UTC().Format(time.RFC3339),
+	}
+	if bounds := meta.Bounds(configured, clearedAt); bounds.Sized() {
+		cleared.Width, cleared.Height = bounds.Width, bounds.Height
+	}
+	data, err := json.Marshal(cleared)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	msgID, err := pub.Publish(ctx, topicID, &bus.Message{
+		Data:       data,
+		Attributes: message.EventAttributes(req.Canvas, message.EventCanvasCleared),
+	})
+	metrics.Published(ctx, "clear", topicID, start, err)
+	if err != nil {
+		return fmt.Errorf("error publishing clear: %w", err)
+	}
+
+	// Recorded last, so a clear failing before can be resumed.
+	if err := st.SetArchiveCleared(ctx, req.Season, clearedAt); err != nil {
+		return err
+	}
+	logger.InfoContext(ctx, "Canvas cleared", "chunksDeleted", deleted, "messageId", msgID)
+	return nil
+}
@@ -0,0 +1,330 @@
+package clear
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/shared/bus"
+	"example.com/shared/canvas"
+	"example.com/shared/message"
+	"example.com/shared/store"
+)
+
+// recorder records the messages published, after failing the first fail
+// publishes.
+type recorder struct {
+	mu       sync.Mutex
+	fail     int
+	messages []*bus.Message
+}
+
+func (r *recorder) Publish(_ context.Context, _ string, msg *bus.Message) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fail > 0 {
+		r.fail--
+		return "", errors.New("bus unavailable")
+	}
+	r.messages = append(r.messages, msg)
+	return "1", nil
+}
+
+func (r *recorder) Close() error {
+	return nil
+}
+
+// cleared returns the CanvasCleared messages published.
+func (r *recorder) cleared(t *testing.T) []message.CanvasCleared {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var out []message.CanvasCleared
+	for _, msg := range r.messages {
+		var m message.CanvasCleared
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			t.Fatalf("published %q: %v", msg.Data, err)
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// setup configures the handler to clear the canvases of a new memory store,
+// holding two chunks and two users on canvas s2 and one of each on the
+// default canvas, and to publish on the returned recorder.
+func setup(t *testing.T) (*store.MemoryStore, *recorder) {
+	t.Helper()
+	st, pub := store.NewMemory(), &recorder{}
+	savedStore, savedBus, savedCanvases := openStore, openBus, canvases
+	saved := []string{projectId, firestoreDatabase, topicID}
+	t.Cleanup(func() {
+		openStore, openBus, canvases = savedStore, savedBus, savedCanvases
+		projectId, firestoreDatabase, topicID = saved[0], saved[1], saved[2]
+	})
+	openStore = func(context.Context) (clearStore, error) { return st, nil }
+	openBus = func(context.Context) (bus.Publisher, error) { return pub, nil }
+	projectId, firestoreDatabase, topicID = "p", "(default)", "updates"
+	canvases = canvas.Canvases{
+		canvas.Default: {Bounds: canvas.Bounds{Unbounded: true}},
+		"s2":           {Bounds: canvas.Bounds{Width: 16, Height: 16}},
+	}
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		canvas string
+		x, y   int
+	}{{"", 0, 0}, {"s2", 0, 0}, {"s2", 1, 0}} {
+		if _, err := st.SetChunkPixels(ctx, []store.ChunkUpdate{{
+			Canvas: c.canvas,
+			ID:     canvas.ChunkID(c.x, c.y),
+			Size:   8,
+			Pixels: map[string]store.Pixel{canvas.PixelKey(1, 1): {Color: 3, User: 42, PlacedAt: 7}},
+		}}); err != nil {
+			t.Fatalf("SetChunkPixels: %v", err)
+		}
+	}
+	for _, u := range []struct{ canvas, id string }{{"", "42"}, {"s2", "42"}, {"s2", "43"}} {
+		if err := st.UpdateUser(ctx, u.canvas, u.id); err != nil {
+			t.Fatalf("UpdateUser: %v", err)
+		}
+	}
+	if err := st.SetCanvasMeta(ctx, "s2", &store.CanvasMeta{ChunkSize: 8, Width: 32, Height: 16}); err != nil {
+		t.Fatalf("SetCanvasMeta: %v", err)
+	}
+	return st, pub
+}
+
+// post sends a clear request with the given body.
+func post(body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	clearCanvas(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	return w
+}
+
+const clearS2 = `{"canvas": "s2", "season": "2025", "reason": "end of season", "requestedBy": "admin", "resetCooldowns": true}`
+
+func TestClearCanvas(t *testing.T) {
+	st, pub := setup(t)
+	ctx := context.Background()
+
+	if w := post(clearS2); w.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+
+	if ids, _ := st.ChunkIDs(ctx, "s2"); len(ids) != 0 {
+		t.Errorf("chunks left on the cleared canvas: %v", ids)
+	}
+	if _, err := st.GetChunk(ctx, "", canvas.ChunkID(0, 0)); err != nil {
+		t.Errorf("GetChunk of the default canvas: %v", err)
+	}
+	if _, err := st.GetUser(ctx, "s2", "42"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("GetUser on the cleared canvas = %v, want the cooldown reset", err)
+	}
+	if _, err := st.GetUser(ctx, "", "42"); err != nil {
+		t.Errorf("GetUser on the default canvas: %v", err)
+	}
+	if chunk, err := st.ArchivedChunk(ctx, "2025", canvas.ChunkID(1, 0)); err != nil || len(chunk.Pixels) != 1 {
+		t.Errorf("ArchivedChunk = %+v, %v, want the chunk copied", chunk, err)
+	}
+
+	archive, err := st.GetArchive(ctx, "2025")
+	if err != nil {
+		t.Fatalf("GetArchive: %v", err)
+	}
+	if archive.Canvas != "s2" || archive.ChunkSize != 8 || archive.Width != 32 || archive.Height != 16 ||
+		archive.Documents != 2 || archive.ClearedAt == nil {
+		t.Errorf("archive = %+v, want the 32x16 canvas in chunks of 8 archived and cleared", archive)
+	}
+	entry, err := st.GetAuditEntry(ctx, "clear-2025")
+	if err != nil {
+		t.Fatalf("GetAuditEntry: %v", err)
+	}
+	if entry.Canvas != "s2" || entry.Error != "" || entry.Details["archived"] != "2" ||
+		entry.Details["chunksDeleted"] != "2" || entry.Details["usersDeleted"] != "2" {
+		t.Errorf("audit entry = %+v, want the clear recorded", entry)
+	}
+
+	// The canvas keeps its bounds: the clients are told the expanded ones.
+	cleared := pub.cleared(t)
+	if len(cleared) != 1 {
+		t.Fatalf("published %d messages, want 1", len(cleared))
+	}
+	if m := cleared[0]; m.Canvas != "s2" || m.Archive != "2025" || !m.CooldownsReset || m.Width != 32 || m.Height != 16 {
+		t.Errorf("published %+v, want the clear of the 32x16 canvas", m)
+	}
+	if got := pub.messages[0].Attributes[message.EventAttribute]; got != message.EventCanvasCleared {
+		t.Errorf("event attribute = %q, want %q", got, message.EventCanvasCleared)
+	}
+
+	// The season is used: clearing or resuming it again is refused.
+	for _, body := range []string{clearS2, strings.Replace(clearS2, "{", `{"resume": true, `, 1)} {
+		if w := post(body); w.Code != http.StatusConflict {
+			t.Errorf("status of %s once cleared = %d, want 409", body, w.Code)
+		}
+	}
+	if n := len(pub.cleared(t)); n != 1 {
+		t.Errorf("published %d messages, want the first clear only", n)
+	}
+}
+
+func TestClearCanvasResetBounds(t *testing.T) {
+	st, pub := setup(t)
+	ctx := context.Background()
+	if _, err := st.UpdateCanvasMeta(ctx, "s2", func(meta *store.CanvasMeta) error {
+		meta.Expansion = &store.Expansion{Width: 64, Height: 64, At: time.Now().Add(time.Hour)}
+		return nil
+	}); err != nil {
+		t.Fatalf("UpdateCanvasMeta: %v", err)
+	}
+
+	if w := post(strings.Replace(clearS2, "{", `{"resetBounds": true, `, 1)); w.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+	meta, err := st.GetCanvasMeta(ctx, "s2")
+	if err != nil {
+		t.Fatalf("GetCanvasMeta: %v", err)
+	}
+	if meta.Width != 16 || meta.Height != 16 || meta.Expansion != nil || meta.ChunkSize != 8 {
+		t.Errorf("metadata = %+v, want the configured 16x16 recorded, no expansion and the chunk size kept", meta)
+	}
+	if cleared := pub.cleared(t); len(cleared) != 1 || cleared[0].Width != 16 || cleared[0].Height != 16 {
+		t.Errorf("published %+v, want the clear of the 16x16 canvas", cleared)
+	}
+	if archive, err := st.GetArchive(ctx, "2025"); err != nil || archive.Width != 32 {
+		t.Errorf("archive = %+v, %v, want the bounds before the reset", archive, err)
+	}
+}
+
+func TestClearCanvasConcurrently(t *testing.T) {
+	st, pub := setup(t)
+
+	const n = 8
+	codes := make(chan int, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Go(func() { codes <- post(clearS2).Code })
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusConflict] != n-1 {
+		t.Errorf("statuses = %v, want one clear and the others refused", counts)
+	}
+	if archive, err := st.GetArchive(context.Background(), "2025"); err != nil || archive.Documents != 2 {
+		t.Errorf("archive = %+v, %v, want the 2 chunks archived once", archive, err)
+	}
+	if got := len(pub.cleared(t)); got != 1 {
+		t.Errorf("published %d messages, want 1", got)
+	}
+}
+
+func TestClearCanvasResume(t *testing.T) {
+	st, pub := setup(t)
+	ctx := context.Background()
+	pub.fail = 1
+
+	if w := post(clearS2); w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500 when the clear cannot be published", w.Code)
+	}
+	archive, err := st.GetArchive(ctx, "2025")
+	if err != nil {
+		t.Fatalf("GetArchive: %v", err)
+	}
+	if archive.ArchivedAt == nil || archive.ClearedAt != nil {
+		t.Fatalf("archive after the failure = %+v, want it archived but not cleared", archive)
+	}
+	if entry, err := st.GetAuditEntry(ctx, "clear-2025"); err != nil || entry.Error == "" {
+		t.Errorf("audit entry = %+v, %v, want the failure recorded", entry, err)
+	}
+
+	// Calling again without resume is taken for another clear of the season.
+	if w := post(clearS2); w.Code != http.StatusConflict {
+		t.Errorf("status without resume = %d, want 409", w.Code)
+	}
+
+	if w := post(strings.Replace(clearS2, "{", `{"resume": true, `, 1)); w.Code != http.StatusOK {
+		t.Fatalf("status of the resume = %d (%s), want 200", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+	archive, err = st.GetArchive(ctx, "2025")
+	if err != nil {
+		t.Fatalf("GetArchive: %v", err)
+	}
+	// The canvas was wiped by the first attempt: archiving it again would
+	// have lost the copies.
+	if archive.Documents != 2 || archive.ClearedAt == nil {
+		t.Errorf("archive after the resume = %+v, want the 2 chunks of the first attempt and cleared", archive)
+	}
+	if chunk, err := st.ArchivedChunk(ctx, "2025", canvas.ChunkID(0, 0)); err != nil || len(chunk.Pixels) != 1 {
+		t.Errorf("ArchivedChunk = %+v, %v, want the copy of the first attempt", chunk, err)
+	}
+	if entry, err := st.GetAuditEntry(ctx, "clear-2025"); err != nil || entry.Error != "" {
+		t.Errorf("audit entry = %+v, %v, want the resumed clear recorded", entry, err)
+	}
+	if got := len(pub.cleared(t)); got != 1 {
+		t.Errorf("published %d messages, want 1", got)
+	}
+}
+
+func TestClearCanvasRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		meta   *store.CanvasMeta
+		status int
+	}{
+		{name: "invalid JSON", body: `{"season":`, status: http.StatusBadRequest},
+		{name: "no season", body: `{"reason": "r", "requestedBy": "admin"}`, status: http.StatusBadRequest},
+		{name: "season with a slash", body: `{"season": "a/b", "reason": "r", "requestedBy": "admin"}`, status: http.StatusBadRequest},
+		{name: "dot season", body: `{"season": "..", "reason": "r", "requestedBy": "admin"}`, status: http.StatusBadRequest},
+		{name: "overlong season", body: `{"season": "` + strings.Repeat("a", 64) + `", "reason": "r", "requestedBy": "admin"}`, status: http.StatusBadRequest},
+		{name: "no reason", body: `{"season": "2025", "requestedBy": "admin"}`, status: http.StatusBadRequest},
+		{name: "unknown canvas", body: `{"canvas": "nope", "season": "2025", "reason": "r", "requestedBy": "admin"}`, status: http.StatusBadRequest},
+		{name: "nothing to resume", body: `{"canvas": "s2", "season": "2025", "reason": "r", "requestedBy": "admin", "resume": true}`, status: http.StatusNotFound},
+		{
+			name:   "being rechunked",
+			body:   clearS2,
+			meta:   &store.CanvasMeta{ChunkSize: 8, Rechunk: &store.Rechunk{To: 16, Phase: "copy"}},
+			status: http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, pub := setup(t)
+			ctx := context.Background()
+			if tt.meta != nil {
+				if err := st.SetCanvasMeta(ctx, "s2", tt.meta); err != nil {
+					t.Fatalf("SetCanvasMeta: %v", err)
+				}
+			}
+
+			if w := post(tt.body); w.Code != tt.status {
+				t.Fatalf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.status)
+			}
+			if ids, _ := st.ChunkIDs(ctx, "s2"); len(ids) != 2 {
+				t.Errorf("chunks left = %v, want the canvas untouched", ids)
+			}
+			if _, err := st.GetArchive(ctx, "2025"); !errors.Is(err, store.ErrNotFound) {
+				t.Errorf("GetArchive = %v, want no archive created", err)
+			}
+			if _, err := st.GetAuditEntry(ctx, "clear-2025"); !errors.Is(err, store.ErrNotFound) {
+				t.Errorf("GetAuditEntry = %v, want nothing recorded", err)
+			}
+			if len(pub.messages) != 0 {
+				t.Errorf("published %d messages, want none", len(pub.messages))
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+// Package expand grows bounded canvases at runtime. Deploy it requiring
+// authentication: it is an admin operation, called by hand or by a Cloud
+// Scheduler job with an OIDC token.
+package expand
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"example.com/shared/bus"
+	"example.com/shared/canvas"
+	"example.com/shared/logging"
+	"example.com/shared/message"
+	"example.com/shared/metrics"
+	"example.com/shared/store"
+	"example.com/shared/tracing"
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	projectId         string
+	firestoreDatabase string
+	topicID           string
+	storeBackend      string
+	sqlitePath        string
+	busBackend        string
+	natsURL           string
+	metricsExporter   string
+	tracesExporter    string
+	canvases          canvas.Canvases
+	canvasesErr       error
+	logger            *slog.Logger
+)
+
+var (
+	// errNotBounded is returned when expanding a canvas with no size.
+	errNotBounded = errors.New("canvas is not bounded")
+
+	// errNotLarger is returned when expanding a canvas to bounds that do not
+	// contain those it has.
+	errNotLarger = errors.New("size is not larger than the canvas")
+)
+
+// openStore opens the canvas store holding the metadata of the canvases.
+var openStore = func(ctx context.Context) (store.CanvasStore, error) {
+	return store.Open(ctx, store.Config{
+		Backend:    storeBackend,
+		ProjectID:  projectId,
+		Database:   firestoreDatabase,
+		SQLitePath: sqlitePath,
+	})
+}
+
+// openBus connects to the message bus the clients are notified on.
+var openBus = func(ctx context.Context) (bus.Publisher, error) {
+	return bus.Open(ctx, bus.Config{
+		Backend:   busBackend,
+		ProjectID: projectId,
+		NATSURL:   natsURL,
+	})
+}
+
+func init() {
+	projectId = os.Getenv("PROJECT_ID")
+	firestoreDatabase = os.Getenv("FIRESTORE_DATABASE")
+	topicID = os.Getenv("PIXEL_UPDATE_TOPIC")
+	storeBackend = os.Getenv("STORE_BACKEND")
+	sqlitePath = os.Getenv("SQLITE_PATH")
+	busBackend = os.Getenv("BUS_BACKEND")
+	natsURL = os.Getenv("NATS_URL")
+	metricsExporter = os.Getenv("METRICS_EXPORTER")
+	tracesExporter = os.Getenv("TRACES_EXPORTER")
+	logger = logging.New(logging.ConfigFromEnv(projectId, "expand"))
+	if err := metrics.Setup(context.Background(), metrics.Config{Exporter: metricsExporter, ServiceName: "expand"}); err != nil {
+		logger.Error("Error setting up metrics", "error", err)
+	}
+	if err := tracing.Setup(context.Background(), tracing.Config{Exporter: tracesExporter, ServiceName: "expand"}); err != nil {
+		logger.Error("Error setting up tracing", "error", err)
+	}
+	if canvases, canvasesErr = canvas.FromEnv(); canvasesErr != nil {
+		logger.Error("Error reading canvases", "error", canvasesErr)
+	}
+	log.SetFlags(0)
+
+	functions.HTTP("expandCanvas", expandCanvas)
+}
+
+// expandRequest is the body of an expandCanvas request, such as
+// {"canvas": "season-2", "width": 512, "height": 256, "at": "2025-06-01T18:00:00Z"}.
+type expandRequest struct {
+	// Canvas is the ID of the canvas to expand, empty for the default one.
+	Canvas string `json:"canvas"`
+
+	// Width and Height are the bounds to grow the canvas to, a zero one
+	// being left as it is. Size sets both. Without any, the due expansions
+	// of every canvas are applied instead.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	Size   int `json:"size"`
+
+	// At schedules the expansion, in RFC 3339 format. The expansion is
+	// applied at once if it is empty or past.
+	At string `json:"at"`
+}
+
+// expandCanvas expands a bounded canvas, at once or at a scheduled time, and
+// publishes a message.CanvasResized on PIXEL_UPDATE_TOPIC when the expansion
+// is applied. Proxy and draw accept placements within the new size as soon
+// as it is due, whether or not it was applied yet; applying it notifies the
+// clients. A request without a size applies the due expansions, so a Cloud
+// Scheduler job calling it every minute or so notifies the clients of
+// scheduled expansions, and retries those whose notification failed.
+func expandCanvas(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Tracer().Start(tracing.ExtractHTTP(r.Context(), r), "expandCanvas",
+		trace.WithSpanKind(trace.SpanKindServer))
+	ctx = logging.With(ctx, logging.HTTPRequest(r))
+
+	reason := metrics.ReasonOK
+	defer func() {
+		metrics.Handled(ctx, "expand", reason)
+		tracing.EndWithReason(span, reason)
+	}()
+
+	if projectId == "" || firestoreDatabase == "" || topicID == "" {
+		reason = "config_error"
+		http.Error(w, "Environment variables are not set", http.StatusInternalServerError)
+		return
+	}
+	if canvasesErr != nil {
+		logger.ErrorContext(ctx, "Error reading canvases", "error", canvasesErr)
+		reason = "config_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error while reading the request body", "error", err)
+		reason = "read_error"
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var req expandRequest
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			logger.WarnContext(ctx, "Invalid request body", "error", err)
+			reason = "invalid_body"
+			http.Error(w, "Bad Request: invalid body", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Width == 0 {
+		req.Width = req.Size
+	}
+	if req.Height == 0 {
+		req.Height = req.Size
+	}
+	now := time.Now()
+	at := now
+	if req.At != "" {
+		if at, err = time.Parse(time.RFC3339, req.At); err != nil {
+			logger.WarnContext(ctx, "Invalid expansion time", "error", err)
+			reason = "invalid_body"
+			http.Error(w, "Bad Request: invalid time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	st, err := openStore(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error opening canvas store", "error", err)
+		reason = "store_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer st.Close()
+
+	msgBus, err := openBus(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error connecting to message bus", "error", err)
+		reason = "bus_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer msgBus.Close()
+
+	if req.Width == 0 && req.Height == 0 {
+		applied := 0
+		for id, c := range canvases {
+			ok, err := applyExpansion(ctx, st, msgBus, id, c.Bounds, now)
+			if err != nil {
+				logger.ErrorContext(ctx, "Error applying expansion", "canvas", id, "error", err)
+				reason = "apply_error"
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if ok {
+				applied++
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Expansions applied: %d", applied)
+		return
+	}
+
+	ctx = logging.With(ctx, "canvas", req.Canvas)
+	canvasConfig, err := canvases.Get(req.Canvas)
+	if err != nil {
+		logger.WarnContext(ctx, "Unknown canvas", "error", err)
+		reason = "unknown_canvas"
+		http.Error(w, "Bad Request: unknown canvas", http.StatusBadRequest)
+		return
+	}
+
+	e, err := scheduleExpansion(ctx, st, req.Canvas, canvasConfig.Bounds, req.Width, req.Height, at, now)
+	if err != nil {
+		if errors.Is(err, errNotBounded) || errors.Is(err, errNotLarger) {
+			logger.WarnContext(ctx, "Invalid expansion", "error", err)
+			reason = "invalid_size"
+			http.Error(w, "Bad Request: invalid size", http.StatusBadRequest)
+			return
+		}
+		logger.ErrorContext(ctx, "Error recording expansion", "error", err)
+		reason = "store_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if at.After(now) {
+		logger.InfoContext(ctx, "Expansion scheduled", "width", e.Width, "height", e.Height, "at", at)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Expansion to %dx%d scheduled at %s", e.Width, e.Height, at.Format(time.RFC3339))
+		return
+	}
+
+	if _, err := applyExpansion(ctx, st, msgBus, req.Canvas, canvasConfig.Bounds, now); err != nil {
+		// The canvas is already expanded, only the clients were not told.
+		logger.ErrorContext(ctx, "Error applying expansion", "error", err)
+		reason = "apply_error"
+		http.Error(w, "Canvas expanded, but clients could not be notified; call again without a size to retry", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Canvas expanded to %dx%d", e.Width, e.Height)
+}
+
+// scheduleExpansion records the expansion of the canvas to width and height
+// at the given time, replacing any expansion scheduled before, and returns
+// it. A zero width or height keeps the one the canvas has at now; the bounds
+// must contain those and differ from them.
+func scheduleExpansion(ctx context.Context, st store.CanvasStore, canvasID string, bounds canvas.Bounds, width, height int, at, now time.Time) (*store.Expansion, error) {
+	if !bounds.Sized() {
+		return nil, errNotBounded
+	}
+	var e *store.Expansion
+	_, err := st.UpdateCanvasMeta(ctx, canvasID, func(meta *store.CanvasMeta) error {
+		current := meta.Bounds(bounds, now)
+		e = &store.Expansion{Width: width, Height: height, At: at}
+		if e.Width == 0 {
+			e.Width = current.Width
+		}
+		if e.Height == 0 {
+			e.Height = current.Height
+		}
+		if e.Width < current.Width || e.Height < current.Height || (e.Width == current.Width && e.Height == current.Height) {
+			return fmt.Errorf("%w: %dx%d is not larger than %dx%d", errNotLarger, e.Width, e.Height, current.Width, current.Height)
+		}
+		meta.Expansion = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// applyExpansion notifies the clients of the expansion of the canvas due by
+// now, if any, then records its bounds as those of the canvas. It reports
+// whether there was one. The notification is sent again if recording fails,
+// which clients ignore as it carries the bounds to grow to.
+func applyExpansion(ctx context.Context, st store.CanvasStore, pub bus.Publisher, canvasID string, bounds canvas.Bounds, now time.Time) (bool, error) {
+	meta, err := st.GetCanvasMeta(ctx, canvasID)
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	e := meta.Expansion
+	if e == nil || e.At.After(now) {
+		return false, nil
+	}
+
+	meta.Expansion = nil
+	previous := meta.Bounds(bounds, now)
+	data, err := json.Marshal(message.CanvasResized{
+		Canvas:         canvasID,
+		Width:          max(previous.Width, e.Width),
+		Height:         max(previous.Height, e.Height),
+		PreviousWidth:  previous.Width,
+		PreviousHeight: previous.Height,
+		At:             e.At.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return false, err
+	}
+	start := time.Now()
+	msgID, err := pub.Publish(ctx, topicID, &bus.Message{
+		Data:       data,
+		Attributes: message.EventAttributes(canvasID, message.EventCanvasResized),
+	})
+	metrics.Published(ctx, "expand", topicID, start, err)
+	if err != nil {
+		return false, fmt.Errorf("error publishing expansion: %w", err)
+	}
+
+	if _, err := st.UpdateCanvasMeta(ctx, canvasID, func(meta *store.CanvasMeta) error {
+		// Left for the next call if it was rescheduled meanwhile.
+		if r := meta.Expansion; r == nil || r.Width != e.Width || r.Height != e.Height || !r.At.Equal(e.At) {
+			return nil
+		}
+		grown := meta.Bounds(bounds, now)
+		meta.Width, meta.Height = grown.Width, grown.Height
+		meta.Expansion = nil
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	logger.InfoContext(ctx, "Canvas expanded", "canvas", canvasID, "width", e.Width, "height", e.Height,
+		"previousWidth", previous.Width, "previousHeight", previous.Height, "messageId", msgID)
+	return true, nil
+}
@@ -0,0 +1,112 @@
+package expand
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"example.com/shared/bus"
+	"example.com/shared/canvas"
+	"example.com/shared/message"
+	"example.com/shared/store"
+)
+
+// recorder records the messages published.
+type recorder struct {
+	messages []*bus.Message
+}
+
+func (r *recorder) Publish(_ context.Context, _ string, msg *bus.Message) (string, error) {
+	r.messages = append(r.messages, msg)
+	return "1", nil
+}
+
+func (r *recorder) Close() error {
+	return nil
+}
+
+func TestScheduleExpansion(t *testing.T) {
+	now := time.Unix(1000, 0).UTC()
+	bounds := canvas.Bounds{Width: 256, Height: 128}
+	tests := []struct {
+		name          string
+		bounds        canvas.Bounds
+		meta          *store.CanvasMeta
+		width, height int
+		want          *store.Expansion
+		err           error
+	}{
+		{name: "both", bounds: bounds, width: 512, height: 256, want: &store.Expansion{Width: 512, Height: 256, At: now}},
+		{name: "width only", bounds: bounds, width: 512, want: &store.Expansion{Width: 512, Height: 128, At: now}},
+		{name: "from the recorded bounds", bounds: bounds, meta: &store.CanvasMeta{Width: 300, Height: 300}, height: 400, want: &store.Expansion{Width: 300, Height: 400, At: now}},
+		{name: "same bounds", bounds: bounds, width: 256, height: 128, err: errNotLarger},
+		{name: "shrinking one side", bounds: bounds, width: 512, height: 64, err: errNotLarger},
+		{name: "unbounded", bounds: canvas.Bounds{Unbounded: true}, width: 512, err: errNotBounded},
+		{name: "width not limited", bounds: canvas.Bounds{Height: 128}, height: 256, err: errNotBounded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			st := store.NewMemory()
+			if tt.meta != nil {
+				if err := st.SetCanvasMeta(ctx, "s2", tt.meta); err != nil {
+					t.Fatalf("SetCanvasMeta: %v", err)
+				}
+			}
+			got, err := scheduleExpansion(ctx, st, "s2", tt.bounds, tt.width, tt.height, now, now)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("scheduleExpansion = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("scheduleExpansion: %v", err)
+			}
+			if *got != *tt.want {
+				t.Errorf("scheduleExpansion = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyExpansion(t *testing.T) {
+	defer func(id string) { topicID = id }(topicID)
+	topicID = "updates"
+	ctx := context.Background()
+	now := time.Unix(1000, 0).UTC()
+	bounds := canvas.Bounds{Width: 256, Height: 128}
+	st := store.NewMemory()
+	pub := &recorder{}
+
+	if _, err := scheduleExpansion(ctx, st, "s2", bounds, 512, 0, now.Add(time.Minute), now); err != nil {
+		t.Fatalf("scheduleExpansion: %v", err)
+	}
+	if ok, err := applyExpansion(ctx, st, pub, "s2", bounds, now); ok || err != nil {
+		t.Fatalf("applyExpansion before it is due = %v, %v, want nothing applied", ok, err)
+	}
+	if ok, err := applyExpansion(ctx, st, pub, "s2", bounds, now.Add(time.Minute)); !ok || err != nil {
+		t.Fatalf("applyExpansion once due = %v, %v, want it applied", ok, err)
+	}
+
+	meta, err := st.GetCanvasMeta(ctx, "s2")
+	if err != nil {
+		t.Fatalf("GetCanvasMeta: %v", err)
+	}
+	if meta.Width != 512 || meta.Height != 128 || meta.Expansion != nil {
+		t.Errorf("metadata = %+v, want 512x128 recorded and no expansion left", meta)
+	}
+	if len(pub.messages) != 1 {
+		t.Fatalf("published %d messages, want 1", len(pub.messages))
+	}
+	var resized message.CanvasResized
+	if err := json.Unmarshal(pub.messages[0].Data, &resized); err != nil {
+		t.Fatalf("published %q: %v", pub.messages[0].Data, err)
+	}
+	want := message.CanvasResized{Canvas: "s2", Width: 512, Height: 128, PreviousWidth: 256, PreviousHeight: 128, At: "1970-01-01T00:17:40Z"}
+	if resized != want {
+		t.Errorf("published %+v, want %+v", resized, want)
+	}
+}
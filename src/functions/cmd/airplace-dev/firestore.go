@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// documentWrite describes a committed change to a single document. Before is
+// nil for a newly created document and After is nil for a deleted one.
+type documentWrite struct {
+	Name   string
+	Before *firestorepb.Document
+	After  *firestorepb.Document
+}
+
+// documentStore is an in-memory implementation of the subset of the Firestore
+// gRPC API used by the functions and tools: document reads and listings,
+// commits, transactions and BulkWriter batches.
+type documentStore struct {
+	firestorepb.UnimplementedFirestoreServer
+
+	mu   sync.Mutex
+	docs map[string]*firestorepb.Document
+
+	// transactions holds, for each open transaction, the documents it read
+	// as they were then, nil for missing ones. Every write replaces the
+	// stored document, so a transaction conflicts if any of them changed.
+	transactions map[string]map[string]*firestorepb.Document
+	nextTx       int
+
+	// onWrite is called after every committed write, outside of the store lock.
+	onWrite func(documentWrite)
+
+	server *grpc.Server
+	Addr   string
+}
+
+func newDocumentStore(onWrite func(documentWrite)) (*documentStore, error) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen: %w", err)
+	}
+
+	s := &documentStore{
+		docs:         make(map[string]*firestorepb.Document),
+		transactions: make(map[string]map[string]*firestorepb.Document),
+		onWrite:      onWrite,
+		server:       grpc.NewServer(),
+		Addr:         lis.Addr().String(),
+	}
+	firestorepb.RegisterFirestoreServer(s.server, s)
+	go s.server.Serve(lis)
+
+	return s, nil
+}
+
+func (s *documentStore) Close() {
+	s.server.Stop()
+}
+
+func (s *documentStore) GetDocument(_ context.Context, req *firestorepb.GetDocumentRequest) (*firestorepb.Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, ok := s.docs[req.GetName()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "document %s not found", req.GetName())
+	}
+	return proto.Clone(doc).(*firestorepb.Document), nil
+}
+
+func (s *documentStore) BatchGetDocuments(req *firestorepb.BatchGetDocumentsRequest, stream firestorepb.Firestore_BatchGetDocumentsServer) error {
+	s.mu.Lock()
+	readTime := timestamppb.Now()
+
+	txID := req.GetTransaction()
+	if req.GetNewTransaction() != nil {
+		txID = s.beginTransaction()
+	}
+	reads, inTx := s.transactions[string(txID)]
+	if len(txID) > 0 && !inTx {
+		s.mu.Unlock()
+		return status.Errorf(codes.InvalidArgument, "unknown transaction %q", txID)
+	}
+
+	responses := make([]*firestorepb.BatchGetDocumentsResponse, 0, len(req.GetDocuments()))
+	for i, name := range req.GetDocuments() {
+		resp := &firestorepb.BatchGetDocumentsResponse{ReadTime: readTime}
+		if i == 0 && req.GetNewTransaction() != nil {
+			resp.Transaction = txID
+		}
+		if inTx {
+			reads[name] = s.docs[name]
+		}
+		if doc, ok := s.docs[name]; ok {
+			resp.Result = &firestorepb.BatchGetDocumentsResponse_Found{Found: proto.Clone(doc).(*firestorepb.Document)}
+		} else {
+			resp.Result = &firestorepb.BatchGetDocumentsResponse_Missing{Missing: name}
+		}
+		responses = append(responses, resp)
+	}
+	s.mu.Unlock()
+
+	for _, resp := range responses {
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *documentStore) BeginTransaction(_ context.Context, _ *firestorepb.BeginTransactionRequest) (*firestorepb.BeginTransactionResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &firestorepb.BeginTransactionResponse{Transaction: s.beginTransaction()}, nil
+}
+
+func (s *documentStore) Rollback(_ context.Context, req *firestorepb.RollbackRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.transactions, string(req.GetTransaction()))
+	return &emptypb.Empty{}, nil
+}
+
+// beginTransaction must be called with the lock held.
+func (s *documentStore) beginTransaction() []byte {
+	s.nextTx++
+	id := fmt.Sprintf("tx-%d", s.nextTx)
+	s.transactions[id] = make(map[string]*firestorepb.Document)
+	return []byte(id)
+}
+
+func (s *documentStore) Commit(_ context.Context, req *firestorepb.CommitRequest) (*firestorepb.CommitResponse, error) {
+	now := timestamppb.Now()
+
+	s.mu.Lock()
+	if txID := string(req.GetTransaction()); txID != "" {
+		reads, ok := s.transactions[txID]
+		if !ok {
+			s.mu.Unlock()
+			return nil, status.Errorf(codes.InvalidArgument, "unknown transaction %q", txID)
+		}
+		delete(s.transactions, txID)
+		for name, doc := range reads {
+			if s.docs[name] != doc {
+				s.mu.Unlock()
+				return nil, status.Errorf(codes.Aborted, "document %s changed during the transaction", name)
+			}
+		}
+	}
+	// Commits are atomic: validate every write against a scratch copy first.
+	changes := make([]documentWrite, 0, len(req.GetWrites()))
+	staged := make(map[string]*firestorepb.Document)
+	for _, w := range req.GetWrites() {
+		change, err := s.applyWrite(w, now, staged)
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	results := make([]*firestorepb.WriteResult, 0, len(changes))
+	for _, change := range changes {
+		s.store(change)
+		results = append(results, &firestorepb.WriteResult{UpdateTime: now})
+	}
+	s.mu.Unlock()
+
+	s.notify(changes)
+	return &firestorepb.CommitResponse{WriteResults: results, CommitTime: now}, nil
+}
+
+// ListDocuments returns the documents of a collection in a single page,
+// ordered by name.
+func (s *documentStore) ListDocuments(_ context.Context, req *firestorepb.ListDocumentsRequest) (*firestorepb.ListDocumentsResponse, error) {
+	prefix := req.GetParent() + "/" + req.GetCollectionId() + "/"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &firestorepb.ListDocumentsResponse{}
+	for name, doc := range s.docs {
+		if id, ok := strings.CutPrefix(name, prefix); ok && !strings.Contains(id, "/") {
+			resp.Documents = append(resp.Documents, proto.Clone(doc).(*firestorepb.Document))
+		}
+	}
+	slices.SortFunc(resp.Documents, func(a, b *firestorepb.Document) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
+	return resp, nil
+}
+
+func (s *documentStore) BatchWrite(_ context.Context, req *firestorepb.BatchWriteRequest) (*firestorepb.BatchWriteResponse, error) {
+	now := timestamppb.Now()
+	resp := &firestorepb.BatchWriteResponse{}
+
+	s.mu.Lock()
+	// Unlike Commit, each write in a batch succeeds or fails on its own.
+	var changes []documentWrite
+	for _, w := range req.GetWrites() {
+		change, err := s.applyWrite(w, now, nil)
+		if err != nil {
+			st, _ := status.FromError(err)
+			resp.WriteResults = append(resp.WriteResults, &firestorepb.WriteResult{})
+			resp.Status = append(resp.Status, st.Proto())
+			continue
+		}
+		s.store(change)
+		changes = append(changes, change)
+		resp.WriteResults = append(resp.WriteResults, &firestorepb.WriteResult{UpdateTime: now})
+		resp.Status = append(resp.Status, status.New(codes.OK, "").Proto())
+	}
+	s.mu.Unlock()
+
+	s.notify(changes)
+	return resp, nil
+}
+
+func (s *documentStore) store(change documentWrite) {
+	if change.After == nil {
+		delete(s.docs, change.Name)
+		return
+	}
+	s.docs[change.Name] = change.After
+}
+
+func (s *documentStore) notify(changes []documentWrite) {
+	if s.onWrite == nil {
+		return
+	}
+	for _, change := range changes {
+		s.onWrite(change)
+	}
+}
+
+// applyWrite computes the result of w without storing it. staged holds the
+// documents already written earlier in the same commit, if any.
+func (s *documentStore) applyWrite(w *firestorepb.Write, now *timestamppb.Timestamp, staged map[string]*firestorepb.Document) (documentWrite, error) {
+	var name string
+	switch op := w.GetOperation().(type) {
+	case *firestorepb.Write_Update:
+		name = op.Update.GetName()
+	case *firestorepb.Write_Delete:
+		name = op.Delete
+	default:
+		return documentWrite{}, status.Errorf(codes.Unimplemented, "unsupported write operation %T", op)
+	}
+
+	before, ok := staged[name]
+	if !ok {
+		before = s.docs[name]
+	}
+
+	if pre := w.GetCurrentDocument(); pre != nil {
+		if exists, ok := pre.GetConditionType().(*firestorepb.Precondition_Exists); ok && exists.Exists != (before != nil) {
+			if exists.Exists {
+				return documentWrite{}, status.Errorf(codes.NotFound, "document %s not found", name)
+			}
+			return documentWrite{}, status.Errorf(codes.AlreadyExists, "document %s already exists", name)
+		}
+	}
+
+	change := documentWrite{Name: name, Before: before}
+	if _, ok := w.GetOperation().(*firestorepb.Write_Delete); ok {
+		if staged != nil {
+			staged[name] = nil
+		}
+		return change, nil
+	}
+
+	update := w.GetUpdate()
+	var fields map[string]*firestorepb.Value
+	if w.GetUpdateMask() == nil {
+		fields = cloneFields(update.GetFields())
+	} else {
+		if before != nil {
+			fields = cloneFields(before.GetFields())
+		} else {
+			fields = make(map[string]*firestorepb.Value)
+		}
+		for _, path := range w.GetUpdateMask().GetFieldPaths() {
+			segments, err := parseFieldPath(path)
+			if err != nil {
+				return documentWrite{}, err
+			}
+			if v := lookupField(update.GetFields(), segments); v != nil {
+				setField(fields, segments, proto.Clone(v).(*firestorepb.Value))
+			} else {
+				deleteField(fields, segments)
+			}
+		}
+	}
+
+	for _, t := range w.GetUpdateTransforms() {
+		if t.GetSetToServerValue() != firestorepb.DocumentTransform_FieldTransform_REQUEST_TIME {
+			return documentWrite{}, status.Errorf(codes.Unimplemented, "unsupported transform on %s", t.GetFieldPath())
+		}
+		segments, err := parseFieldPath(t.GetFieldPath())
+		if err != nil {
+			return documentWrite{}, err
+		}
+		setField(fields, segments, &firestorepb.Value{ValueType: &firestorepb.Value_TimestampValue{TimestampValue: now}})
+	}
+
+	createTime := now
+	if before != nil {
+		createTime = before.GetCreateTime()
+	}
+	change.After = &firestorepb.Document{
+		Name:       name,
+		Fields:     fields,
+		CreateTime: createTime,
+		UpdateTime: now,
+	}
+	if staged != nil {
+		staged[name] = change.After
+	}
+	return change, nil
+}
+
+func cloneFields(fields map[string]*firestorepb.Value) map[string]*firestorepb.Value {
+	out := make(map[string]*firestorepb.Value, len(fields))
+	for k, v := range fields {
+		out[k] = proto.Clone(v).(*firestorepb.Value)
+	}
+	return out
+}
+
+func lookupField(fields map[string]*firestorepb.Value, segments []string) *firestorepb.Value {
+	v, ok := fields[segments[0]]
+	if !ok || len(segments) == 1 {
+		return v
+	}
+	return lookupField(v.GetMapValue().GetFields(), segments[1:])
+}
+
+func setField(fields map[string]*firestorepb.Value, segments []string, v *firestorepb.Value) {
+	if len(segments) == 1 {
+		fields[segments[0]] = v
+		return
+	}
+	child := fields[segments[0]]
+	if child.GetMapValue() == nil {
+		child = &firestorepb.Value{ValueType: &firestorepb.Value_MapValue{MapValue: &firestorepb.MapValue{}}}
+		fields[segments[0]] = child
+	}
+	mv := child.GetMapValue()
+	if mv.Fields == nil {
+		mv.Fields = make(map[string]*firestorepb.Value)
+	}
+	setField(mv.Fields, segments[1:], v)
+}
+
+func deleteField(fields map[string]*firestorepb.Value, segments []string) {
+	if len(segments) == 1 {
+		delete(fields, segments[0])
+		return
+	}
+	if child := fields[segments[0]].GetMapValue(); child != nil {
+		deleteField(child.Fields, segments[1:])
+	}
+}
+
+// parseFieldPath splits a service field path such as "pixels.`3_4`.color"
+// into its components, unquoting backtick-quoted segments.
+func parseFieldPath(path string) ([]string, error) {
+	var segments []string
+	var cur strings.Builder
+	quoted, escaped := false, false
+	for _, r := range path {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '`':
+			quoted = !quoted
+		case !quoted && r == '.':
+			segments = append(segments, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if quoted || escaped {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid field path %q", path)
+	}
+	segments = append(segments, cur.String())
+	for _, seg := range segments {
+		if seg == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid field path %q", path)
+		}
+	}
+	return segments, nil
+}
+
+// documentPath returns the path of a document relative to the database root,
+// e.g. "canvas_chunks/canvas_chunks_0_0".
+func documentPath(name string) string {
+	if _, rest, ok := strings.Cut(name, "/documents/"); ok {
+		return rest
+	}
+	return name
+}
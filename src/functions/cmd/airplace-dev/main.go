@@ -0,0 +1,315 @@
+// Command airplace-dev runs every AirPlace function in a single process
+// against in-memory Pub/Sub and Firestore emulators, so the whole draw flow
+// can be exercised locally without GCP:
+//
+//	cd src/functions/cmd/airplace-dev && go run .
+//	curl -X POST localhost:8080/proxyInterface -d '{"x":1,"y":2,"color":3,"user":"42"}'
+//
+// Push subscriptions and Firestore triggers are emulated: DRAW_PIXEL_TOPIC is
+// pushed to drawPixel, ADD_USER_TOPIC to addUser, chunk writes fire
+// updatedPixel and trigger writes fire resetPixel. Messages on
+// PIXEL_UPDATE_TOPIC and DEAD_LETTER_TOPIC are logged, and metrics are served
+// for Prometheus on localhost:9464/metrics. The emulator addresses are logged
+// at startup for tools like cmd/migrate-chunks.
+//
+// The functions take their usual configuration; the server fills in a local
+// default for the required variables. In addition:
+//
+//	BUS_BACKEND=memory  carry messages on the in-process bus.MemoryBus
+//	                    instead of the Pub/Sub emulator
+//	DRAW_WORKER=true    consume DRAW_PIXEL_TOPIC with the draw worker of
+//	                    cmd/draw-worker instead of pushing it to drawPixel
+//	STORE_BACKEND=sqlite
+//	                    keep the canvas in SQLITE_PATH across restarts, its
+//	                    writes polled to fire the triggers
+//
+// Seeks of resetPixel are acknowledged without being emulated, and resets
+// asking for Pub/Sub snapshots fail locally.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"example.com/shared/canvas"
+	"example.com/shared/logging"
+	"github.com/GoogleCloudPlatform/functions-framework-go/funcframework"
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/protobuf/proto"
+
+	"example.com/draw"
+
+	_ "example.com/add_user"
+	_ "example.com/clear"
+	_ "example.com/expand"
+	_ "example.com/proxy"
+	_ "example.com/reset"
+	_ "example.com/update"
+)
+
+// childEnv marks the re-executed process, see ensureEnv.
+const childEnv = "AIRPLACE_DEV_CHILD"
+
+// defaultEnv holds the configuration used for any variable not already set.
+var defaultEnv = [][2]string{
+	{"PROJECT_ID", "airplace-dev"},
+	{"FIRESTORE_DATABASE", "(default)"},
+	{"USER_COLLECTION", "users"},
+	{"RATE_LIMIT", "5s"},
+	{"CHUNK_SIZE", "64"},
+	{"DRAW_PIXEL_TOPIC", "draw-pixel"},
+	{"ADD_USER_TOPIC", "add-user"},
+	{"PIXEL_UPDATE_TOPIC", "pixel-update"},
+	{"TRIGGER_RESET_NAME", "trigger-reset"},
+	{"DEAD_LETTER_TOPIC", "dead-letter"},
+	{"DRAW_SUBSCRIPTION", "draw-pixel-pull"},
+	{"METRICS_EXPORTER", "prometheus"},
+}
+
+var eventID atomic.Int64
+
+func main() {
+	host := flag.String("host", "localhost", "host to listen on")
+	port := flag.String("port", envOr("PORT", "8080"), "port to listen on")
+	metricsPort := flag.String("metrics-port", "9464", "port serving Prometheus metrics, when METRICS_EXPORTER is prometheus")
+	flag.Parse()
+
+	ensureEnv()
+	log.SetFlags(0)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, *host, *port, *metricsPort); err != nil {
+		logging.Error("dev", "Dev server stopped", err)
+		os.Exit(1)
+	}
+}
+
+// ensureEnv fills in defaultEnv and re-executes the binary. The functions read
+// their configuration in init(), which has already run by the time main starts.
+func ensureEnv() {
+	if os.Getenv(childEnv) != "" {
+		return
+	}
+	for _, kv := range defaultEnv {
+		if _, ok := os.LookupEnv(kv[0]); !ok {
+			os.Setenv(kv[0], kv[1])
+		}
+	}
+	// Serve every registered function instead of a single target at "/".
+	os.Unsetenv("FUNCTION_TARGET")
+	os.Setenv(childEnv, "1")
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("os.Executable: %v", err)
+	}
+	log.Fatalf("syscall.Exec: %v", syscall.Exec(exe, os.Args, os.Environ()))
+}
+
+func run(ctx context.Context, host, port, metricsPort string) error {
+	projectID := os.Getenv("PROJECT_ID")
+	database := os.Getenv("FIRESTORE_DATABASE")
+	baseURL := fmt.Sprintf("http://localhost:%s", port)
+
+	bus, err := newMessageBus(ctx, os.Getenv("BUS_BACKEND"), projectID)
+	if err != nil {
+		return fmt.Errorf("newMessageBus: %w", err)
+	}
+	defer bus.Close()
+
+	source := fmt.Sprintf("//firestore.googleapis.com/projects/%s/databases/%s", projectID, database)
+	docs, err := newDocumentStore(func(w documentWrite) {
+		go routeDocumentWrite(ctx, baseURL, source, w)
+	})
+	if err != nil {
+		return fmt.Errorf("newDocumentStore: %w", err)
+	}
+	defer docs.Close()
+
+	// The client libraries pick these up each time a function creates a client.
+	os.Setenv("FIRESTORE_EMULATOR_HOST", docs.Addr)
+	if addr := bus.Addr(); addr != "" {
+		os.Setenv("PUBSUB_EMULATOR_HOST", addr)
+		logging.InfoF("dev", "Emulating Pub/Sub on %s and Firestore on %s", addr, docs.Addr)
+	} else {
+		logging.InfoF("dev", "Carrying messages in process, emulating Firestore on %s", docs.Addr)
+	}
+
+	if os.Getenv("STORE_BACKEND") == "sqlite" {
+		go func() {
+			if err := watchSQLite(ctx, os.Getenv("SQLITE_PATH"), baseURL, projectID, database); err != nil {
+				logging.ErrorF("dev", "Watching SQLite writes stopped: %v", err)
+			}
+		}()
+	}
+
+	drawTopic := os.Getenv("DRAW_PIXEL_TOPIC")
+	addUserTopic := os.Getenv("ADD_USER_TOPIC")
+	updateTopic := os.Getenv("PIXEL_UPDATE_TOPIC")
+	deadLetterTopic := os.Getenv("DEAD_LETTER_TOPIC")
+	for _, topic := range []string{drawTopic, addUserTopic, updateTopic, deadLetterTopic} {
+		if err := bus.CreateTopic(ctx, topic); err != nil {
+			return fmt.Errorf("creating topic %s: %w", topic, err)
+		}
+	}
+
+	type subscription struct {
+		topic, sub, endpoint string
+	}
+	subscriptions := []subscription{
+		{addUserTopic, addUserTopic + "-push", baseURL + "/addUser"},
+		{updateTopic, updateTopic + "-tail", ""},
+		{deadLetterTopic, deadLetterTopic + "-tail", ""},
+	}
+	if os.Getenv("DRAW_WORKER") == "true" {
+		drawSub := os.Getenv("DRAW_SUBSCRIPTION")
+		if err := bus.CreateSubscription(ctx, drawTopic, drawSub); err != nil {
+			return fmt.Errorf("creating subscription %s: %w", drawSub, err)
+		}
+		go func() {
+			if err := draw.RunWorker(ctx); err != nil {
+				logging.ErrorF("dev", "Draw worker stopped: %v", err)
+			}
+		}()
+	} else {
+		subscriptions = append(subscriptions, subscription{drawTopic, drawTopic + "-push", baseURL + "/drawPixel"})
+	}
+	for _, s := range subscriptions {
+		if err := bus.CreateSubscription(ctx, s.topic, s.sub); err != nil {
+			return fmt.Errorf("creating subscription %s: %w", s.sub, err)
+		}
+		go func() {
+			var err error
+			if s.endpoint == "" {
+				err = bus.Tail(ctx, s.topic, s.sub)
+			} else {
+				err = bus.Push(ctx, s.topic, s.sub, s.endpoint)
+			}
+			if err != nil {
+				logging.ErrorF("dev", "Subscription %s stopped: %v", s.sub, err)
+			}
+		}()
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- funcframework.StartHostPort(host, port)
+	}()
+	logging.InfoF("dev", "Serving functions on http://%s:%s", host, port)
+
+	if os.Getenv("METRICS_EXPORTER") == "prometheus" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			errc <- http.ListenAndServe(net.JoinHostPort(host, metricsPort), mux)
+		}()
+		logging.InfoF("dev", "Serving metrics on http://%s/metrics", net.JoinHostPort(host, metricsPort))
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errc:
+		return err
+	}
+}
+
+// routeDocumentWrite emulates the Eventarc Firestore triggers deployed in
+// production by delivering the change as a CloudEvent to the matching function.
+func routeDocumentWrite(ctx context.Context, baseURL, source string, w documentWrite) {
+	path := documentPath(w.Name)
+	collection, _, _ := strings.Cut(path, "/")
+
+	var endpoint string
+	if _, _, _, err := canvas.ParseChunkPath(path); err == nil {
+		endpoint = baseURL + "/updatedPixel"
+	} else if collection == os.Getenv("TRIGGER_RESET_NAME") {
+		endpoint = baseURL + "/resetPixel"
+	} else {
+		return
+	}
+
+	if err := postDocumentEvent(ctx, endpoint, source, path, w); err != nil {
+		logging.ErrorF("dev", "Delivering event for %s to %s failed: %v", path, endpoint, err)
+	}
+}
+
+func postDocumentEvent(ctx context.Context, endpoint, source, path string, w documentWrite) error {
+	data, err := documentEventData(w)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/protobuf")
+	req.Header.Set("ce-specversion", "1.0")
+	req.Header.Set("ce-id", fmt.Sprintf("%d", eventID.Add(1)))
+	req.Header.Set("ce-source", source)
+	req.Header.Set("ce-subject", "documents/"+path)
+	req.Header.Set("ce-type", "google.cloud.firestore.document.v1.written")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// documentEventData encodes w the way Eventarc does. The Firestore API and
+// event documents share the same wire format, so they are converted by
+// round-tripping through their binary encoding.
+func documentEventData(w documentWrite) ([]byte, error) {
+	var data firestoredata.DocumentEventData
+	convert := func(doc *firestorepb.Document) (*firestoredata.Document, error) {
+		if doc == nil {
+			return nil, nil
+		}
+		raw, err := proto.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		var out firestoredata.Document
+		if err := proto.Unmarshal(raw, &out); err != nil {
+			return nil, err
+		}
+		return &out, nil
+	}
+
+	var err error
+	if data.Value, err = convert(w.After); err != nil {
+		return nil, fmt.Errorf("converting new value: %w", err)
+	}
+	if data.OldValue, err = convert(w.Before); err != nil {
+		return nil, fmt.Errorf("converting old value: %w", err)
+	}
+	return proto.Marshal(&data)
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
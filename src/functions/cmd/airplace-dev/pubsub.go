@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/v2/pstest"
+	"example.com/shared/bus"
+	"example.com/shared/logging"
+	"example.com/shared/message"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// messageBus is the bus of the functions, an in-memory Pub/Sub server or the
+// in-process MemoryBus, with helpers to emulate push subscriptions against the
+// locally served functions.
+type messageBus struct {
+	// Either server and pubsub, or memory, are set.
+	server    *pstest.Server
+	pubsub    *bus.PubSubBus
+	memory    *bus.MemoryBus
+	projectID string
+}
+
+// newMessageBus returns the bus of the backend: "memory" for the MemoryBus
+// the functions reach through BUS_BACKEND=memory, anything else for a Pub/Sub
+// emulator they reach through PUBSUB_EMULATOR_HOST.
+func newMessageBus(ctx context.Context, backend, projectID string) (*messageBus, error) {
+	if backend == "memory" {
+		return &messageBus{memory: bus.ProcessMemory(), projectID: projectID}, nil
+	}
+	srv := pstest.NewServer(pstest.ServerReactorOption{FuncName: "Seek", Reactor: seekReactor{}})
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		srv.Close()
+		return nil, fmt.Errorf("grpc.NewClient: %w", err)
+	}
+	b, err := bus.NewPubSub(ctx, projectID, option.WithGRPCConn(conn))
+	if err != nil {
+		srv.Close()
+		return nil, fmt.Errorf("bus.NewPubSub: %w", err)
+	}
+	return &messageBus{server: srv, pubsub: b, projectID: projectID}, nil
+}
+
+// Addr returns the address of the Pub/Sub emulator, empty for the MemoryBus.
+func (b *messageBus) Addr() string {
+	if b.server == nil {
+		return ""
+	}
+	return b.server.Addr
+}
+
+func (b *messageBus) Close() {
+	if b.server == nil {
+		return
+	}
+	b.pubsub.Close()
+	b.server.Close()
+}
+
+// subscriber returns the bus subscriptions are read from.
+func (b *messageBus) subscriber() bus.Subscriber {
+	if b.memory != nil {
+		return b.memory
+	}
+	return b.pubsub
+}
+
+// CreateTopic creates the topic on the emulator. Topics of the MemoryBus need
+// no creation.
+func (b *messageBus) CreateTopic(ctx context.Context, topicID string) error {
+	if b.memory != nil {
+		return nil
+	}
+	_, err := b.pubsub.Client().TopicAdminClient.CreateTopic(ctx, &pubsubpb.Topic{
+		Name: fmt.Sprintf("projects/%s/topics/%s", b.projectID, topicID),
+	})
+	return err
+}
+
+func (b *messageBus) CreateSubscription(ctx context.Context, topicID, subID string) error {
+	if b.memory != nil {
+		b.memory.CreateSubscription(topicID, subID)
+		return nil
+	}
+	_, err := b.pubsub.Client().SubscriptionAdminClient.CreateSubscription(ctx, &pubsubpb.Subscription{
+		Name:               fmt.Sprintf("projects/%s/subscriptions/%s", b.projectID, subID),
+		Topic:              fmt.Sprintf("projects/%s/topics/%s", b.projectID, topicID),
+		AckDeadlineSeconds: 10,
+	})
+	return err
+}
+
+// Push delivers every message of the subscription to endpoint the way a
+// Pub/Sub push subscription would: a 2xx response acks the message, anything
+// else nacks it so it is redelivered.
+func (b *messageBus) Push(ctx context.Context, topicID, subID, endpoint string) error {
+	subName := fmt.Sprintf("projects/%s/subscriptions/%s", b.projectID, subID)
+	return b.subscriber().Subscribe(ctx, topicID, subID, func(ctx context.Context, m *bus.Message) error {
+		var env message.PubSubMessage
+		env.Message.Data = base64.StdEncoding.EncodeToString(m.Data)
+		env.Message.Attributes = m.Attributes
+		env.Message.MessageID = m.ID
+		env.Message.PublishTime = m.PublishTime.UTC().Format(time.RFC3339Nano)
+		env.Subscription = subName
+
+		body, err := json.Marshal(env)
+		if err != nil {
+			logging.Error("dev", "Error marshalling push envelope", err)
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			logging.Error("dev", "Error building push request", err)
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			logging.ErrorF("dev", "Push to %s failed: %v", endpoint, err)
+			backoff(ctx)
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			logging.WarningF("dev", "Push to %s returned %d, message %s will be redelivered", endpoint, resp.StatusCode, m.ID)
+			backoff(ctx)
+			return fmt.Errorf("push returned %d", resp.StatusCode)
+		}
+		return nil
+	})
+}
+
+// Tail logs every message published on the subscription, with its attributes.
+func (b *messageBus) Tail(ctx context.Context, topicID, subID string) error {
+	return b.subscriber().Subscribe(ctx, topicID, subID, func(ctx context.Context, m *bus.Message) error {
+		logging.InfoF("dev", "%s received message %s: %s %v", subID, m.ID, m.Data, m.Attributes)
+		return nil
+	})
+}
+
+// seekReactor acknowledges Seek requests without replaying anything. The
+// fake server redelivers every message published after the target, from any
+// topic and without its content, which crashes it as soon as a placement
+// races a reset.
+type seekReactor struct{}
+
+func (seekReactor) React(req any) (bool, any, error) {
+	if req, ok := req.(*pubsubpb.SeekRequest); ok {
+		logging.InfoF("dev", "Seek of %s is not emulated, its backlog is left as is", req.GetSubscription())
+	}
+	return true, &pubsubpb.SeekResponse{}, nil
+}
+
+// backoff slows down redelivery of nacked messages, which Pub/Sub would
+// otherwise retry immediately.
+func backoff(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+	}
+}
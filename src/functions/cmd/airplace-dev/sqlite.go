@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"example.com/shared/canvas"
+	"example.com/shared/logging"
+	"example.com/shared/store"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// sqlitePollInterval is how often watchSQLite looks for new writes.
+const sqlitePollInterval = 200 * time.Millisecond
+
+// watchSQLite emulates the Firestore triggers on the SQLite backend, which
+// nothing watches: it polls the chunks and trigger documents written since
+// it started, and delivers each write to updatedPixel or resetPixel as the
+// event of the Firestore document it stands for.
+func watchSQLite(ctx context.Context, path, baseURL, projectID, database string) error {
+	st, err := store.NewSQLite(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	last, err := st.LastChange(ctx)
+	if err != nil {
+		return err
+	}
+	source := fmt.Sprintf("//firestore.googleapis.com/projects/%s/databases/%s", projectID, database)
+	root := fmt.Sprintf("projects/%s/databases/%s/documents/", projectID, database)
+
+	ticker := time.NewTicker(sqlitePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		changes, err := st.Changes(ctx, last)
+		if err != nil {
+			logging.ErrorF("dev", "Polling SQLite writes failed: %v", err)
+			continue
+		}
+		last = changes.Last
+		for _, chunk := range changes.Chunks {
+			routeDocumentWrite(ctx, baseURL, source, documentWrite{
+				Name:  root + chunkPath(chunk.Canvas, chunk.ID),
+				After: chunkDocument(root, chunk),
+			})
+		}
+		for _, t := range changes.Triggers {
+			routeDocumentWrite(ctx, baseURL, source, documentWrite{
+				Name:  root + t.Name + "/" + t.Name,
+				After: triggerDocument(root, t),
+			})
+		}
+	}
+}
+
+// chunkPath returns the path of the Firestore document of the chunk.
+func chunkPath(canvasID, id string) string {
+	if canvasID == canvas.Default {
+		return canvas.ChunkCollection + "/" + id
+	}
+	return canvas.CanvasCollection + "/" + canvasID + "/" + canvas.CanvasChunks + "/" + id
+}
+
+// chunkDocument returns the chunk as the Firestore backend writes it in the
+// map encoding.
+func chunkDocument(root string, chunk *store.Chunk) *firestorepb.Document {
+	pixels := make(map[string]*firestorepb.Value, len(chunk.Pixels))
+	for key, p := range chunk.Pixels {
+		pixels[key] = mapValue(map[string]*firestorepb.Value{
+			"color":    {ValueType: &firestorepb.Value_IntegerValue{IntegerValue: int64(p.Color)}},
+			"user":     {ValueType: &firestorepb.Value_IntegerValue{IntegerValue: p.User}},
+			"placedAt": {ValueType: &firestorepb.Value_IntegerValue{IntegerValue: p.PlacedAt}},
+		})
+	}
+	return &firestorepb.Document{
+		Name: root + chunkPath(chunk.Canvas, chunk.ID),
+		Fields: map[string]*firestorepb.Value{
+			"size":        {ValueType: &firestorepb.Value_IntegerValue{IntegerValue: int64(chunk.Size)}},
+			"pixels":      mapValue(pixels),
+			"lastUpdated": timestampValue(chunk.LastUpdated),
+			"trace":       {ValueType: &firestorepb.Value_StringValue{StringValue: chunk.Trace}},
+		},
+	}
+}
+
+// triggerDocument returns the trigger document as the Firestore backend
+// writes it.
+func triggerDocument(root string, t store.Trigger) *firestorepb.Document {
+	fields := map[string]*firestorepb.Value{
+		"reason":        {ValueType: &firestorepb.Value_StringValue{StringValue: t.Request.Reason}},
+		"requestedBy":   {ValueType: &firestorepb.Value_StringValue{StringValue: t.Request.RequestedBy}},
+		"lastTriggered": timestampValue(t.LastTriggered),
+	}
+	if !t.Request.Time.IsZero() {
+		fields["time"] = timestampValue(t.Request.Time)
+	}
+	if t.Request.Prune {
+		fields["prune"] = &firestorepb.Value{ValueType: &firestorepb.Value_BooleanValue{BooleanValue: true}}
+	}
+	return &firestorepb.Document{Name: root + t.Name + "/" + t.Name, Fields: fields}
+}
+
+func mapValue(fields map[string]*firestorepb.Value) *firestorepb.Value {
+	return &firestorepb.Value{ValueType: &firestorepb.Value_MapValue{MapValue: &firestorepb.MapValue{Fields: fields}}}
+}
+
+func timestampValue(t time.Time) *firestorepb.Value {
+	return &firestorepb.Value{ValueType: &firestorepb.Value_TimestampValue{TimestampValue: timestamppb.New(t)}}
+}
@@ -0,0 +1,43 @@
+// Command draw-worker runs the draw function as a long-running worker that
+// pulls placements from a Pub/Sub subscription instead of receiving them one
+// push request at a time. It is configured like drawPixel, plus:
+//
+//	DRAW_SUBSCRIPTION    pull subscription of DRAW_PIXEL_TOPIC to consume
+//	DRAW_FLUSH_INTERVAL  how long the placements on a chunk are merged
+//	                     before it is written (default 1s)
+//	DRAW_MAX_PENDING     most placements buffered before every chunk is
+//	                     written early (default 500)
+//
+// The subscription must not also be pushed to drawPixel. The worker stops on
+// SIGINT or SIGTERM after writing the chunks still buffered.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"example.com/draw"
+	"example.com/shared/metrics"
+	"example.com/shared/tracing"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := draw.RunWorker(ctx)
+
+	shutdownCtx := context.WithoutCancel(ctx)
+	if err := metrics.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error flushing metrics: %v", err)
+	}
+	if err := tracing.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error flushing traces: %v", err)
+	}
+	if err != nil {
+		log.Fatalf("Draw worker failed: %v", err)
+	}
+}
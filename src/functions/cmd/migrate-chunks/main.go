@@ -0,0 +1,116 @@
+// Command migrate-chunks migrates the chunk documents of every canvas kept in
+// Firestore. It is configured like the functions by PROJECT_ID,
+// FIRESTORE_DATABASE and CANVASES.
+//
+//	migrate-chunks format -to packed
+//	migrate-chunks resize [-canvas ID] [-from 64] -to 128
+//
+// format rewrites each chunk in the given encoding, "map" or "packed" (see
+// store.ChunkFormat), leaving its pixels as they are. Chunks already in that
+// encoding are skipped, so an interrupted run is resumed by running it again.
+// Set CHUNK_FORMAT of draw to the same encoding first, or draw converts the
+// chunks back as it writes them.
+//
+// resize re-chunks a canvas to chunks of -to pixels a side, written with
+// CHUNK_FORMAT and CHUNK_SHARD_THRESHOLD. The chunks are copied to a staging
+// canvas at the new size, verified, swapped in place of the old ones and
+// verified again, the progress being recorded in the metadata document of the
+// canvas; an interrupted or failed run is resumed by running it again. -from
+// is only needed for a canvas whose size no function has recorded yet. The
+// staging canvas is named after the canvas and size, like rechunk-128 for the
+// default canvas; resize refuses to run if a canvas of CANVASES has that ID,
+// or to start if it already has chunks.
+//
+// Stop draw before resizing, e.g. by detaching its subscription, as
+// placements written meanwhile may be lost; placements queue up until it is
+// redeployed with the new CHUNK_SIZE, which it refuses to write with until
+// the migration is done. update publishes the staged chunks under the ID of
+// the staging canvas, which clients of the canvas ignore.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"example.com/shared/canvas"
+	"example.com/shared/logging"
+	"example.com/shared/store"
+)
+
+var logger *slog.Logger
+
+func main() {
+	projectID := os.Getenv("PROJECT_ID")
+	logger = logging.New(logging.ConfigFromEnv(projectID, "migrate-chunks"))
+
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: migrate-chunks format -to map|packed")
+		fmt.Fprintln(os.Stderr, "       migrate-chunks resize [-canvas ID] [-from SIZE] -to SIZE")
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "format":
+		err = runFormat(ctx, projectID, args)
+	case "resize":
+		err = runResize(ctx, projectID, args)
+	default:
+		fmt.Fprintf(os.Stderr, "migrate-chunks: unknown command %q\n", cmd)
+		os.Exit(2)
+	}
+	if err != nil {
+		logger.Error("Migration failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// runFormat converts the chunks of every canvas to the format given by -to.
+func runFormat(ctx context.Context, projectID string, args []string) error {
+	fs := flag.NewFlagSet("format", flag.ExitOnError)
+	to := fs.String("to", string(store.FormatPacked), "chunk format to convert to, map or packed")
+	fs.Parse(args)
+
+	format, err := store.ParseChunkFormat(*to)
+	if err != nil {
+		return err
+	}
+	canvases, err := canvas.FromEnv()
+	if err != nil {
+		return err
+	}
+	st, err := store.NewFirestore(ctx, projectID, os.Getenv("FIRESTORE_DATABASE"), os.Getenv("USER_COLLECTION"))
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	for canvasID := range canvases {
+		ids, err := st.ChunkIDs(ctx, canvasID)
+		if err != nil {
+			return fmt.Errorf("canvas %q: %w", canvasID, err)
+		}
+		converted := 0
+		for _, id := range ids {
+			ok, err := st.ConvertChunk(ctx, canvasID, id, format)
+			if err != nil {
+				return fmt.Errorf("canvas %q: %w", canvasID, err)
+			}
+			if ok {
+				converted++
+				logger.DebugContext(ctx, "Chunk converted", "canvas", canvasID, "chunk", id)
+			}
+		}
+		logger.InfoContext(ctx, "Canvas converted", "canvas", canvasID, "format", format,
+			"chunks", len(ids), "converted", converted)
+	}
+	return nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+
+	"example.com/shared/canvas"
+	"example.com/shared/store"
+)
+
+// Phases of a resize, run in order. Each one can be interrupted and resumed:
+// those walking chunks checkpoint the last one done in the metadata, and the
+// others are idempotent.
+const (
+	// phaseCopy merges the pixels of every chunk into the chunks of the new
+	// size of the staging canvas.
+	phaseCopy = "copy"
+
+	// phaseVerify checks that every pixel of the canvas is in the staging
+	// canvas.
+	phaseVerify = "verify"
+
+	// phaseSwap replaces the chunks of the canvas by the staged ones.
+	phaseSwap = "swap"
+
+	// phasePrune deletes the chunks of the old size that no staged chunk
+	// replaced.
+	phasePrune = "prune"
+
+	// phaseCheck checks that the canvas now holds exactly the staged pixels.
+	phaseCheck = "check"
+
+	// phaseCleanup deletes the staging canvas.
+	phaseCleanup = "cleanup"
+)
+
+var phases = []string{phaseCopy, phaseVerify, phaseSwap, phasePrune, phaseCheck, phaseCleanup}
+
+// errMismatch is returned by a verification phase that found pixels missing.
+var errMismatch = errors.New("pixels do not match")
+
+// runResize migrates the canvas given by -canvas to chunks of size -to.
+func runResize(ctx context.Context, projectID string, args []string) error {
+	fs := flag.NewFlagSet("resize", flag.ExitOnError)
+	canvasID := fs.String("canvas", canvas.Default, "ID of the canvas to migrate, the default canvas if empty")
+	from := fs.Int("from", 0, "current chunk size, required if the canvas has no metadata")
+	to := fs.Int("to", 0, "chunk size to migrate to")
+	fs.Parse(args)
+
+	if *to <= 0 {
+		return errors.New("-to must be a positive chunk size")
+	}
+	canvases, err := canvas.FromEnv()
+	if err != nil {
+		return err
+	}
+	if _, err := canvases.Get(*canvasID); err != nil {
+		return err
+	}
+	staging := stagingID(*canvasID, *to)
+	if !canvas.ValidID(staging) {
+		return fmt.Errorf("invalid staging canvas ID %q", staging)
+	}
+	if _, err := canvases.Get(staging); err == nil {
+		return fmt.Errorf("staging canvas %q of the migration is a configured canvas", staging)
+	}
+
+	format, err := store.ParseChunkFormat(os.Getenv("CHUNK_FORMAT"))
+	if err != nil {
+		return err
+	}
+	threshold := 0
+	if v := os.Getenv("CHUNK_SHARD_THRESHOLD"); v != "" {
+		if threshold, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid CHUNK_SHARD_THRESHOLD %q: %w", v, err)
+		}
+	}
+	if err := store.CheckChunkSize(format, *to, threshold); err != nil {
+		return err
+	}
+
+	st, err := store.NewFirestore(ctx, projectID, os.Getenv("FIRESTORE_DATABASE"), os.Getenv("USER_COLLECTION"))
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	st.ChunkFormat = format
+	st.ShardThreshold = threshold
+
+	meta, err := st.GetCanvasMeta(ctx, *canvasID)
+	if errors.Is(err, store.ErrNotFound) {
+		meta, err = &store.CanvasMeta{}, nil
+	}
+	switch {
+	case err != nil:
+		return err
+	case meta.ChunkSize == 0:
+		if *from <= 0 {
+			return fmt.Errorf("canvas %q has no chunk size recorded, give it with -from", *canvasID)
+		}
+		meta.ChunkSize = *from
+	case *from > 0 && meta.ChunkSize != *from:
+		return fmt.Errorf("canvas %q is stored in chunks of %d, not %d", *canvasID, meta.ChunkSize, *from)
+	}
+
+	switch {
+	case meta.Rechunk != nil && meta.Rechunk.To != *to:
+		return fmt.Errorf("canvas %q is being migrated to chunks of %d, finish that migration first", *canvasID, meta.Rechunk.To)
+	case meta.Rechunk != nil:
+		logger.InfoContext(ctx, "Resuming migration", "canvas", *canvasID, "phase", meta.Rechunk.Phase, "after", meta.Rechunk.After)
+	case meta.ChunkSize == *to:
+		logger.InfoContext(ctx, "Canvas already in chunks of that size", "canvas", *canvasID, "chunkSize", *to)
+		return nil
+	default:
+		if err := checkStagingEmpty(ctx, st, staging); err != nil {
+			return err
+		}
+		meta.Rechunk = &store.Rechunk{To: *to, Phase: phaseCopy}
+		if err := st.SetCanvasMeta(ctx, *canvasID, meta); err != nil {
+			return err
+		}
+		logger.InfoContext(ctx, "Starting migration", "canvas", *canvasID, "from", meta.ChunkSize, "to", *to, "staging", staging)
+	}
+
+	r := &resizer{st: st, canvas: *canvasID, staging: staging, meta: meta}
+	return r.run(ctx)
+}
+
+// stagingID returns the ID of the canvas the chunks of canvasID are copied to
+// before replacing them. runResize refuses to run if a canvas is configured
+// with it.
+func stagingID(canvasID string, size int) string {
+	if canvasID == canvas.Default {
+		return fmt.Sprintf("rechunk-%d", size)
+	}
+	return fmt.Sprintf("%s-rechunk-%d", canvasID, size)
+}
+
+// checkStagingEmpty refuses to start a migration whose staging canvas already
+// has chunks, left by another migration or written by users, which would be
+// swapped into the canvas along with the copied ones.
+func checkStagingEmpty(ctx context.Context, st store.ChunkAdmin, staging string) error {
+	ids, err := st.ChunkIDs(ctx, staging)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		return fmt.Errorf("staging canvas %q already has %d chunks, delete them first", staging, len(ids))
+	}
+	return nil
+}
+
+// chunkStore is the store a resize runs on.
+type chunkStore interface {
+	store.CanvasStore
+	store.ChunkAdmin
+}
+
+// resizer runs the phases of the migration recorded in meta.
+type resizer struct {
+	st      chunkStore
+	canvas  string
+	staging string
+	meta    *store.CanvasMeta
+}
+
+// run runs the phases from the one recorded until the canvas is migrated.
+func (r *resizer) run(ctx context.Context) error {
+	from, to := r.meta.ChunkSize, r.meta.Rechunk.To
+	for r.meta.Rechunk != nil {
+		phase := r.meta.Rechunk.Phase
+		var err error
+		switch phase {
+		case phaseCopy:
+			err = r.forEach(ctx, r.canvas, r.copyChunk)
+		case phaseVerify:
+			err = r.verify(ctx, r.canvas, from, r.staging, to, phaseCopy)
+		case phaseSwap:
+			err = r.forEach(ctx, r.staging, r.swapChunk)
+		case phasePrune:
+			err = r.prune(ctx)
+		case phaseCheck:
+			err = r.verify(ctx, r.staging, to, r.canvas, to, phaseSwap)
+		case phaseCleanup:
+			err = r.forEach(ctx, r.staging, func(ctx context.Context, id string) error {
+				return r.st.DeleteChunk(ctx, r.staging, id)
+			})
+		default:
+			err = fmt.Errorf("unknown phase %q", phase)
+		}
+		if err != nil {
+			return fmt.Errorf("canvas %q: phase %s: %w", r.canvas, phase, err)
+		}
+		logger.InfoContext(ctx, "Phase done", "canvas", r.canvas, "phase", phase)
+
+		if i := slices.Index(phases, phase); i+1 < len(phases) {
+			r.meta.Rechunk = &store.Rechunk{To: to, Phase: phases[i+1]}
+		} else {
+			r.meta.ChunkSize, r.meta.Rechunk = to, nil
+		}
+		if err := r.st.SetCanvasMeta(ctx, r.canvas, r.meta); err != nil {
+			return err
+		}
+	}
+	logger.InfoContext(ctx, "Canvas migrated", "canvas", r.canvas, "from", from, "to", to)
+	return nil
+}
+
+// forEach calls fn on the chunks of canvasID in ID order, starting after the
+// last one done, and records each one done.
+func (r *resizer) forEach(ctx context.Context, canvasID string, fn func(ctx context.Context, id string) error) error {
+	ids, err := r.st.ChunkIDs(ctx, canvasID)
+	if err != nil {
+		return err
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		if id <= r.meta.Rechunk.After {
+			continue
+		}
+		if err := fn(ctx, id); err != nil {
+			return err
+		}
+		r.meta.Rechunk.After = id
+		if err := r.st.SetCanvasMeta(ctx, r.canvas, r.meta); err != nil {
+			return err
+		}
+		logger.DebugContext(ctx, "Chunk done", "canvas", r.canvas, "phase", r.meta.Rechunk.Phase, "chunk", id)
+	}
+	return nil
+}
+
+// copyChunk merges the pixels of the chunk into the staging canvas. Staged
+// pixels only give way to newer ones, so copying a chunk again is harmless.
+func (r *resizer) copyChunk(ctx context.Context, id string) error {
+	chunk, err := r.st.GetChunk(ctx, r.canvas, id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	updates := make(map[string]*store.ChunkUpdate)
+	for key, p := range chunk.Pixels {
+		newID, newKey, err := relocate(id, key, r.meta.ChunkSize, r.meta.Rechunk.To)
+		if err != nil {
+			return err
+		}
+		update, ok := updates[newID]
+		if !ok {
+			update = &store.ChunkUpdate{
+				Canvas: r.staging,
+				ID:     newID,
+				Size:   int32(r.meta.Rechunk.To),
+				Pixels: make(map[string]store.Pixel),
+				Trace:  chunk.Trace,
+			}
+			updates[newID] = update
+		}
+		update.Pixels[newKey] = p
+	}
+
+	batch := make([]store.ChunkUpdate, 0, len(updates))
+	for _, update := range updates {
+		batch = append(batch, *update)
+	}
+	_, err = r.st.SetChunkPixels(ctx, batch)
+	return err
+}
+
+// swapChunk replaces the chunk of the canvas with the same ID as the staged
+// chunk id, if any, by the staged one.
+func (r *resizer) swapChunk(ctx context.Context, id string) error {
+	staged, err := r.st.GetChunk(ctx, r.staging, id)
+	if err != nil {
+		return err
+	}
+	if err := r.st.DeleteChunk(ctx, r.canvas, id); err != nil {
+		return err
+	}
+	_, err = r.st.SetChunkPixels(ctx, []store.ChunkUpdate{{
+		Canvas: r.canvas,
+		ID:     id,
+		Size:   int32(r.meta.Rechunk.To),
+		Pixels: staged.Pixels,
+		Trace:  staged.Trace,
+	}})
+	return err
+}
+
+// prune deletes the chunks of the canvas that have no staged counterpart,
+// left over from the old size.
+func (r *resizer) prune(ctx context.Context) error {
+	staged, err := r.st.ChunkIDs(ctx, r.staging)
+	if err != nil {
+		return err
+	}
+	ids, err := r.st.ChunkIDs(ctx, r.canvas)
+	if err != nil {
+		return err
+	}
+	pruned := 0
+	for _, id := range ids {
+		if slices.Contains(staged, id) {
+			continue
+		}
+		if err := r.st.DeleteChunk(ctx, r.canvas, id); err != nil {
+			return err
+		}
+		pruned++
+	}
+	logger.InfoContext(ctx, "Old chunks pruned", "canvas", r.canvas, "chunks", pruned)
+	return nil
+}
+
+// verify checks that every pixel of the chunks of src, of srcSize pixels a
+// side, is in the chunks of dst, of dstSize, as placed or replaced by a newer
+// placement. On a mismatch the migration is rewound to the start of phase
+// retry, which writes dst again.
+func (r *resizer) verify(ctx context.Context, src string, srcSize int, dst string, dstSize int, retry string) error {
+	ids, err := r.st.ChunkIDs(ctx, src)
+	if err != nil {
+		return err
+	}
+	dstChunks := make(map[string]map[string]store.Pixel)
+	checked, mismatches := 0, 0
+	for _, id := range ids {
+		chunk, err := r.st.GetChunk(ctx, src, id)
+		if err != nil {
+			return err
+		}
+		for key, p := range chunk.Pixels {
+			dstID, dstKey, err := relocate(id, key, srcSize, dstSize)
+			if err != nil {
+				return err
+			}
+			pixels, ok := dstChunks[dstID]
+			if !ok {
+				dstChunk, err := r.st.GetChunk(ctx, dst, dstID)
+				switch {
+				case errors.Is(err, store.ErrNotFound):
+					pixels = map[string]store.Pixel{}
+				case err != nil:
+					return err
+				default:
+					pixels = dstChunk.Pixels
+				}
+				dstChunks[dstID] = pixels
+			}
+
+			checked++
+			got, ok := pixels[dstKey]
+			if !ok || got.PlacedAt < p.PlacedAt || (got.PlacedAt == p.PlacedAt && got != p) {
+				mismatches++
+				logger.WarnContext(ctx, "Pixel mismatch", "canvas", r.canvas, "from", src+"/"+id+"/"+key,
+					"to", dst+"/"+dstID+"/"+dstKey, "want", p, "got", got)
+			}
+		}
+	}
+	logger.InfoContext(ctx, "Pixels verified", "canvas", r.canvas, "from", src, "to", dst, "pixels", checked, "mismatches", mismatches)
+	if mismatches == 0 {
+		return nil
+	}
+
+	r.meta.Rechunk = &store.Rechunk{To: r.meta.Rechunk.To, Phase: retry}
+	if err := r.st.SetCanvasMeta(ctx, r.canvas, r.meta); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %d of %d pixels, rewound to phase %s, run again to resume", errMismatch, mismatches, checked, retry)
+}
+
+// relocate returns the chunk ID and pixel key, in chunks of toSize pixels a
+// side, of the pixel key of the chunk id of fromSize.
+func relocate(id, key string, fromSize, toSize int) (newID, newKey string, err error) {
+	chunkX, chunkY, err := canvas.ParseChunkID(id)
+	if err != nil {
+		return "", "", err
+	}
+	localX, localY, err := canvas.ParsePixelKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	chunkX, chunkY, localX, localY = canvas.Locate(chunkX*fromSize+localX, chunkY*fromSize+localY, toSize)
+	return canvas.ChunkID(chunkX, chunkY), canvas.PixelKey(localX, localY), nil
+}
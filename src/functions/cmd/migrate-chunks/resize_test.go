@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"example.com/shared/canvas"
+	"example.com/shared/store"
+)
+
+func TestMain(m *testing.M) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
+func TestRelocate(t *testing.T) {
+	id := canvas.ChunkID
+	tests := []struct {
+		id, key          string
+		fromSize, toSize int
+		wantID, wantKey  string
+	}{
+		{id(0, 0), "3_2", 4, 8, id(0, 0), "3_2"},
+		{id(1, 0), "3_2", 4, 8, id(0, 0), "7_2"},
+		{id(1, 1), "0_0", 4, 8, id(0, 0), "4_4"},
+		{id(2, 3), "1_1", 4, 8, id(1, 1), "1_5"},
+		{id(1, 1), "2_3", 8, 4, id(2, 2), "2_3"},
+		{id(0, 1), "7_1", 8, 4, id(1, 2), "3_1"},
+		{id(-1, 0), "3_0", 4, 8, id(-1, 0), "7_0"},
+		{id(-1, -1), "0_0", 8, 4, id(-2, -2), "0_0"},
+	}
+	for _, tt := range tests {
+		gotID, gotKey, err := relocate(tt.id, tt.key, tt.fromSize, tt.toSize)
+		if err != nil {
+			t.Errorf("relocate(%s, %s, %d, %d): %v", tt.id, tt.key, tt.fromSize, tt.toSize, err)
+			continue
+		}
+		if gotID != tt.wantID || gotKey != tt.wantKey {
+			t.Errorf("relocate(%s, %s, %d, %d) = %s, %s, want %s, %s", tt.id, tt.key, tt.fromSize, tt.toSize, gotID, gotKey, tt.wantID, tt.wantKey)
+		}
+	}
+	if _, _, err := relocate("nope", "0_0", 4, 8); err == nil {
+		t.Error("relocate of an invalid chunk ID succeeded")
+	}
+}
+
+// setPixel places a pixel of the given placement time at (x, y) of the canvas
+// in chunks of size.
+func setPixel(t *testing.T, st store.CanvasStore, canvasID string, size, x, y int, placedAt int64) {
+	t.Helper()
+	chunkX, chunkY, localX, localY := canvas.Locate(x, y, size)
+	_, err := st.SetChunkPixels(context.Background(), []store.ChunkUpdate{{
+		Canvas: canvasID,
+		ID:     canvas.ChunkID(chunkX, chunkY),
+		Size:   int32(size),
+		Pixels: map[string]store.Pixel{canvas.PixelKey(localX, localY): {Color: 1, User: 1, PlacedAt: placedAt}},
+	}})
+	if err != nil {
+		t.Fatalf("SetChunkPixels: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	type pixel struct {
+		x, y     int
+		placedAt int64
+	}
+	src := []pixel{{1, 1, 10}, {5, 2, 20}, {-3, 9, 30}}
+	tests := []struct {
+		name   string
+		staged []pixel
+		ok     bool
+	}{
+		{name: "all staged", staged: src, ok: true},
+		{name: "replaced by newer placements", staged: []pixel{{1, 1, 11}, {5, 2, 20}, {-3, 9, 31}}, ok: true},
+		{name: "missing", staged: src[:2]},
+		{name: "older staged", staged: []pixel{{1, 1, 10}, {5, 2, 19}, {-3, 9, 30}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			st := store.NewMemory()
+			for _, p := range src {
+				setPixel(t, st, canvas.Default, 4, p.x, p.y, p.placedAt)
+			}
+			for _, p := range tt.staged {
+				setPixel(t, st, "rechunk-8", 8, p.x, p.y, p.placedAt)
+			}
+			r := &resizer{st: st, canvas: canvas.Default, staging: "rechunk-8", meta: &store.CanvasMeta{
+				ChunkSize: 4,
+				Rechunk:   &store.Rechunk{To: 8, Phase: phaseVerify},
+			}}
+
+			err := r.verify(ctx, canvas.Default, 4, "rechunk-8", 8, phaseCopy)
+			if tt.ok {
+				if err != nil {
+					t.Errorf("verify: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, errMismatch) {
+				t.Fatalf("verify = %v, want %v", err, errMismatch)
+			}
+			meta, err := st.GetCanvasMeta(ctx, canvas.Default)
+			if err != nil {
+				t.Fatalf("GetCanvasMeta: %v", err)
+			}
+			if meta.Rechunk == nil || meta.Rechunk.Phase != phaseCopy || meta.Rechunk.After != "" {
+				t.Errorf("migration recorded as %+v, want rewound to the start of %s", meta.Rechunk, phaseCopy)
+			}
+		})
+	}
+}
+
+func TestCheckStagingEmpty(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemory()
+	if err := checkStagingEmpty(ctx, st, "rechunk-8"); err != nil {
+		t.Errorf("checkStagingEmpty of an empty staging canvas = %v, want nil", err)
+	}
+	setPixel(t, st, "rechunk-8", 8, 1, 1, 10)
+	if err := checkStagingEmpty(ctx, st, "rechunk-8"); err == nil {
+		t.Error("checkStagingEmpty of a staging canvas with chunks succeeded")
+	}
+}
+
+func TestResizerRun(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemory()
+	placed := map[[2]int]int64{{1, 1}: 10, {5, 2}: 20, {9, 13}: 30, {-3, 9}: 40}
+	for p, at := range placed {
+		setPixel(t, st, canvas.Default, 4, p[0], p[1], at)
+	}
+	meta := &store.CanvasMeta{ChunkSize: 4, Rechunk: &store.Rechunk{To: 8, Phase: phaseCopy}}
+	if err := st.SetCanvasMeta(ctx, canvas.Default, meta); err != nil {
+		t.Fatalf("SetCanvasMeta: %v", err)
+	}
+
+	r := &resizer{st: st, canvas: canvas.Default, staging: "rechunk-8", meta: meta}
+	if err := r.run(ctx); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	got, err := st.GetCanvasMeta(ctx, canvas.Default)
+	if err != nil {
+		t.Fatalf("GetCanvasMeta: %v", err)
+	}
+	if got.ChunkSize != 8 || got.Rechunk != nil {
+		t.Errorf("metadata = %+v, want chunks of 8 and no migration", got)
+	}
+	ids, err := st.ChunkIDs(ctx, canvas.Default)
+	if err != nil {
+		t.Fatalf("ChunkIDs: %v", err)
+	}
+	if len(ids) != 3 {
+		t.Errorf("canvas has chunks %v, want the 3 chunks of 8 holding the pixels", ids)
+	}
+	for p, at := range placed {
+		chunkX, chunkY, localX, localY := canvas.Locate(p[0], p[1], 8)
+		chunk, err := st.GetChunk(ctx, canvas.Default, canvas.ChunkID(chunkX, chunkY))
+		if err != nil {
+			t.Fatalf("GetChunk: %v", err)
+		}
+		if chunk.Size != 8 || chunk.Pixels[canvas.PixelKey(localX, localY)].PlacedAt != at {
+			t.Errorf("pixel (%d, %d) not moved to chunk %s of size 8", p[0], p[1], chunk.ID)
+		}
+	}
+	if staged, _ := st.ChunkIDs(ctx, "rechunk-8"); len(staged) != 0 {
+		t.Errorf("staging canvas left with chunks %v", staged)
+	}
+}
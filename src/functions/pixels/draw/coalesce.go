@@ -0,0 +1,274 @@
+package draw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"example.com/shared/bus"
+	"example.com/shared/canvas"
+	"example.com/shared/logging"
+	"example.com/shared/message"
+	"example.com/shared/metrics"
+	"example.com/shared/store"
+	"example.com/shared/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Defaults of DRAW_FLUSH_INTERVAL and DRAW_MAX_PENDING. Firestore sustains
+// about one write per second on a document.
+const (
+	defaultFlushInterval = time.Second
+	defaultMaxPending    = 500
+)
+
+// coalesceSettings reads DRAW_FLUSH_INTERVAL and DRAW_MAX_PENDING.
+func coalesceSettings() (interval time.Duration, maxPending int, err error) {
+	interval, maxPending = defaultFlushInterval, defaultMaxPending
+	if flushIntervalEnv != "" {
+		if interval, err = time.ParseDuration(flushIntervalEnv); err != nil || interval <= 0 {
+			return 0, 0, fmt.Errorf("invalid DRAW_FLUSH_INTERVAL %q", flushIntervalEnv)
+		}
+	}
+	if maxPendingEnv != "" {
+		if maxPending, err = strconv.Atoi(maxPendingEnv); err != nil || maxPending <= 0 {
+			return 0, 0, fmt.Errorf("invalid DRAW_MAX_PENDING %q", maxPendingEnv)
+		}
+	}
+	return interval, maxPending, nil
+}
+
+// placement is a pixel waiting for its chunk to be written. The result of
+// the write is sent on done.
+type placement struct {
+	ctx   context.Context
+	pixel message.PixelInfo
+	done  chan error
+}
+
+// pendingChunk holds the placements of a chunk until it is due.
+type pendingChunk struct {
+	placements []placement
+	due        time.Time
+}
+
+// coalescer buffers the placements of each chunk for a flush interval,
+// starting at the first one, and writes them all at once, so a chunk drawn
+// on continuously is written once per interval instead of once per pixel.
+// Callers are only answered once their chunk is written, so nothing buffered
+// is acknowledged before it is saved.
+type coalescer struct {
+	st         store.CanvasStore
+	pub        bus.Publisher
+	chunkSize  int
+	interval   time.Duration
+	maxPending int
+	placements chan placement
+
+	// writes tracks the chunk writes under way.
+	writes sync.WaitGroup
+
+	// stopped is closed once run returned.
+	stopped chan struct{}
+}
+
+// errStopped is returned for the placements added once the coalescer stopped.
+var errStopped = errors.New("draw: coalescer stopped")
+
+func newCoalescer(st store.CanvasStore, pub bus.Publisher, chunkSize int, interval time.Duration, maxPending int) *coalescer {
+	return &coalescer{
+		st:         st,
+		pub:        pub,
+		chunkSize:  chunkSize,
+		interval:   interval,
+		maxPending: maxPending,
+		placements: make(chan placement),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// add buffers the pixel and returns once its chunk is written. It fails
+// without waiting if ctx is done or the coalescer stopped before the pixel is
+// buffered.
+func (c *coalescer) add(ctx context.Context, pixel message.PixelInfo) error {
+	p := placement{ctx: ctx, pixel: pixel, done: make(chan error, 1)}
+	select {
+	case c.placements <- p:
+	case <-c.stopped:
+		return errStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-p.done
+}
+
+// run writes the buffered chunks as they become due until ctx is done, then
+// writes those still pending and waits for every write, so every buffered
+// placement gets a result. Once DRAW_MAX_PENDING placements are buffered,
+// every chunk is written without waiting.
+func (c *coalescer) run(ctx context.Context) {
+	defer close(c.stopped)
+	writeCtx := context.WithoutCancel(ctx)
+	pending := make(map[string]*pendingChunk)
+	buffered := 0
+	for {
+		var timer *time.Timer
+		var wake <-chan time.Time
+		if next, ok := nextDue(pending); ok {
+			timer = time.NewTimer(time.Until(next))
+			wake = timer.C
+		}
+
+		select {
+		case p := <-c.placements:
+			key := c.chunkKey(p.pixel)
+			pc, ok := pending[key]
+			if !ok {
+				pc = &pendingChunk{due: time.Now().Add(c.interval)}
+				pending[key] = pc
+			}
+			pc.placements = append(pc.placements, p)
+			if buffered++; buffered >= c.maxPending {
+				buffered -= c.flush(writeCtx, pending, time.Time{})
+			}
+		case now := <-wake:
+			buffered -= c.flush(writeCtx, pending, now)
+		case <-ctx.Done():
+			c.flush(writeCtx, pending, time.Time{})
+			c.writes.Wait()
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// chunkKey identifies the chunk of the pixel across canvases.
+func (c *coalescer) chunkKey(pixel message.PixelInfo) string {
+	chunkX, chunkY, _, _ := canvas.Locate(int(pixel.X), int(pixel.Y), c.chunkSize)
+	return pixel.Canvas + "/" + canvas.ChunkID(chunkX, chunkY)
+}
+
+// nextDue returns when the first pending chunk is due.
+func nextDue(pending map[string]*pendingChunk) (time.Time, bool) {
+	var next time.Time
+	for _, pc := range pending {
+		if next.IsZero() || pc.due.Before(next) {
+			next = pc.due
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// flush starts writing the chunks due by now, or all of them if now is zero,
+// and removes them from pending. The writes run in the background, so a slow
+// one does not hold up the placements received meanwhile; each placement gets
+// the result of the write of its own chunk. It returns the number of
+// placements flushed.
+func (c *coalescer) flush(ctx context.Context, pending map[string]*pendingChunk, now time.Time) int {
+	flushed := 0
+	for key, pc := range pending {
+		if !now.IsZero() && pc.due.After(now) {
+			continue
+		}
+		delete(pending, key)
+		flushed += len(pc.placements)
+		c.writes.Go(func() { c.write(ctx, key, pc.placements) })
+	}
+	return flushed
+}
+
+// write saves the placements of a chunk and reports the result to them.
+func (c *coalescer) write(ctx context.Context, key string, placements []placement) {
+	metrics.Coalesced(ctx, "draw", len(placements))
+	pixels := make([]message.PixelInfo, 0, len(placements))
+	links := make([]trace.Link, 0, len(placements))
+	for _, p := range placements {
+		pixels = append(pixels, p.pixel)
+		links = append(links, trace.LinkFromContext(p.ctx))
+	}
+
+	// The write continues the trace of none of its placements in particular,
+	// it links to all of them instead.
+	ctx, span := tracing.Tracer().Start(ctx, "drawBatch",
+		trace.WithNewRoot(),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			attribute.String("draw.batch.chunk", key),
+			attribute.Int("draw.batch.size", len(placements))))
+	ctx = logging.With(ctx, "chunk", key, "pixels", len(placements))
+	err := savePixels(ctx, c.st, c.pub, pixels, c.chunkSize)
+	tracing.End(span, err)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error saving batch", "error", err)
+	} else {
+		logger.InfoContext(ctx, "Batch saved")
+	}
+
+	for _, p := range placements {
+		p.done <- err
+	}
+}
+
+var (
+	sharedMu        sync.Mutex
+	sharedCoalescer *coalescer
+)
+
+// pushCoalescer returns the coalescer shared by the drawPixel requests served
+// by this instance, starting it on first use. It runs apart from any request,
+// so its logs and traces carry none in particular. It stops on SIGTERM, sent
+// when the instance is shut down, or SIGINT: the chunks still buffered are
+// written, its store and bus closed, and the signal raised again to terminate
+// the process as it would have. Placements received meanwhile fail, to be
+// redelivered to another instance.
+func pushCoalescer(chunkSize int) (*coalescer, error) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+
+	if sharedCoalescer != nil {
+		return sharedCoalescer, nil
+	}
+	interval, maxPending, err := coalesceSettings()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	st, err := openStore(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error opening canvas store: %w", err)
+	}
+	pub, err := openBus(ctx)
+	if err != nil {
+		st.Close()
+		return nil, fmt.Errorf("error connecting to message bus: %w", err)
+	}
+	c := newCoalescer(st, pub, chunkSize, interval, maxPending)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	runCtx, cancel := context.WithCancel(ctx)
+	go c.run(runCtx)
+	go func() {
+		sig := <-signals
+		cancel()
+		<-c.stopped
+		pub.Close()
+		st.Close()
+		logger.InfoContext(ctx, "Draw coalescer stopped", "signal", sig.String())
+		signal.Stop(signals)
+		if p, err := os.FindProcess(os.Getpid()); err == nil {
+			p.Signal(sig)
+		}
+	}()
+	sharedCoalescer = c
+	return c, nil
+}
@@ -0,0 +1,216 @@
+package draw
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/shared/message"
+	"example.com/shared/store"
+)
+
+// countingStore counts the writes of chunks, failing those of failCanvas.
+type countingStore struct {
+	*store.MemoryStore
+	failCanvas string
+
+	mu     sync.Mutex
+	writes int
+}
+
+func (s *countingStore) SetChunkPixels(ctx context.Context, updates []store.ChunkUpdate) (int, error) {
+	s.mu.Lock()
+	s.writes++
+	s.mu.Unlock()
+
+	for _, update := range updates {
+		if s.failCanvas != "" && update.Canvas == s.failCanvas {
+			return 0, errWrite
+		}
+	}
+	return s.MemoryStore.SetChunkPixels(ctx, updates)
+}
+
+func (s *countingStore) writeCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writes
+}
+
+// startCoalescer runs a coalescer over st until the test ends.
+func startCoalescer(t *testing.T, st store.CanvasStore, interval time.Duration, maxPending int) (*coalescer, *fakePublisher, context.CancelFunc) {
+	t.Helper()
+	pub := &fakePublisher{}
+	c := newCoalescer(st, pub, 8, interval, maxPending)
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.run(ctx)
+	t.Cleanup(func() {
+		cancel()
+		<-c.stopped
+	})
+	return c, pub, cancel
+}
+
+func TestNextDue(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	tests := []struct {
+		name    string
+		pending map[string]*pendingChunk
+		want    time.Time
+		ok      bool
+	}{
+		{name: "nothing pending", pending: map[string]*pendingChunk{}},
+		{name: "one chunk", pending: map[string]*pendingChunk{"a": {due: t0}}, want: t0, ok: true},
+		{name: "earliest chunk", pending: map[string]*pendingChunk{
+			"a": {due: t0.Add(time.Second)},
+			"b": {due: t0},
+			"c": {due: t0.Add(2 * time.Second)},
+		}, want: t0, ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := nextDue(tt.pending)
+			if ok != tt.ok || !got.Equal(tt.want) {
+				t.Errorf("nextDue = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	st := &countingStore{MemoryStore: store.NewMemory()}
+	c := newCoalescer(st, &fakePublisher{}, 8, time.Second, 100)
+	done := make(chan error, 3)
+	pending := map[string]*pendingChunk{
+		"/canvas_chunks_0_0": {due: t0, placements: []placement{
+			{ctx: context.Background(), pixel: pixel("", 1, 1, "1", 1), done: done},
+			{ctx: context.Background(), pixel: pixel("", 2, 2, "2", 2), done: done},
+		}},
+		"/canvas_chunks_1_0": {due: t0.Add(time.Second), placements: []placement{
+			{ctx: context.Background(), pixel: pixel("", 9, 1, "3", 3), done: done},
+		}},
+	}
+
+	if n := c.flush(context.Background(), pending, t0); n != 2 {
+		t.Errorf("flush of the due chunks wrote %d placements, want 2", n)
+	}
+	if _, ok := pending["/canvas_chunks_1_0"]; !ok || len(pending) != 1 {
+		t.Errorf("pending after flush = %v, want the chunk not due only", pending)
+	}
+	if n := c.flush(context.Background(), pending, time.Time{}); n != 1 {
+		t.Errorf("flush of every chunk wrote %d placements, want 1", n)
+	}
+	if len(pending) != 0 {
+		t.Errorf("pending after flushing everything = %v, want none", pending)
+	}
+	for range 3 {
+		if err := <-done; err != nil {
+			t.Errorf("placement result = %v, want nil", err)
+		}
+	}
+	if n := st.writeCount(); n != 2 {
+		t.Errorf("flushes wrote %d times, want once per chunk", n)
+	}
+}
+
+func TestCoalescerMergesChunk(t *testing.T) {
+	st := &countingStore{MemoryStore: store.NewMemory()}
+	c, pub, _ := startCoalescer(t, st, 50*time.Millisecond, 100)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := range 3 {
+		wg.Go(func() {
+			errs <- c.add(context.Background(), pixel("", int32(i), 0, strconv.Itoa(i+1), int64(i+1)))
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("add = %v, want nil", err)
+		}
+	}
+
+	if n := st.writeCount(); n != 1 {
+		t.Errorf("chunk written %d times, want once", n)
+	}
+	chunk, err := st.GetChunk(context.Background(), "", "canvas_chunks_0_0")
+	if err != nil {
+		t.Fatalf("GetChunk: %v", err)
+	}
+	if len(chunk.Pixels) != 3 {
+		t.Errorf("chunk has %d pixels, want 3", len(chunk.Pixels))
+	}
+	if n := len(pub.published(addUserTopicID)); n != 3 {
+		t.Errorf("published %d user messages, want 3", n)
+	}
+}
+
+func TestCoalescerMaxPending(t *testing.T) {
+	st := &countingStore{MemoryStore: store.NewMemory()}
+	// Never due within the test: only DRAW_MAX_PENDING has them written.
+	c, _, _ := startCoalescer(t, st, time.Hour, 2)
+
+	errs := make(chan error, 2)
+	go func() { errs <- c.add(context.Background(), pixel("", 0, 0, "1", 1)) }()
+	go func() { errs <- c.add(context.Background(), pixel("", 20, 20, "2", 2)) }()
+	for range 2 {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("add = %v, want nil", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("placements not written once DRAW_MAX_PENDING was reached")
+		}
+	}
+	if n := st.writeCount(); n != 2 {
+		t.Errorf("wrote %d times, want once per chunk", n)
+	}
+}
+
+func TestCoalescerReportsEachChunk(t *testing.T) {
+	st := &countingStore{MemoryStore: store.NewMemory(), failCanvas: "broken"}
+	c, pub, _ := startCoalescer(t, st, time.Hour, 2)
+
+	okc, failc := make(chan error, 1), make(chan error, 1)
+	go func() { okc <- c.add(context.Background(), pixel("", 0, 0, "1", 1)) }()
+	go func() { failc <- c.add(context.Background(), pixel("broken", 0, 0, "2", 2)) }()
+	if err := <-okc; err != nil {
+		t.Errorf("add on the written chunk = %v, want nil", err)
+	}
+	if err := <-failc; !errors.Is(err, errWrite) {
+		t.Errorf("add on the failed chunk = %v, want %v", err, errWrite)
+	}
+
+	// Only the user whose pixel was written starts a cooldown.
+	msgs := pub.published(addUserTopicID)
+	if len(msgs) != 1 || msgs[0].Attributes[message.CanvasAttribute] != "" {
+		t.Errorf("published %d user messages, want the one of the written chunk", len(msgs))
+	}
+}
+
+func TestCoalescerDrainsOnCancel(t *testing.T) {
+	st := &countingStore{MemoryStore: store.NewMemory()}
+	c, _, cancel := startCoalescer(t, st, time.Hour, 100)
+
+	p := placement{ctx: context.Background(), pixel: pixel("", 1, 1, "1", 1), done: make(chan error, 1)}
+	c.placements <- p
+	cancel()
+	if err := <-p.done; err != nil {
+		t.Errorf("buffered placement result = %v, want nil", err)
+	}
+	<-c.stopped
+	if _, err := st.GetChunk(context.Background(), "", "canvas_chunks_0_0"); err != nil {
+		t.Errorf("buffered placement not written: %v", err)
+	}
+	if err := c.add(context.Background(), pixel("", 2, 2, "2", 2)); !errors.Is(err, errStopped) {
+		t.Errorf("add once stopped = %v, want %v", err, errStopped)
+	}
+}
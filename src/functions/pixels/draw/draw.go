@@ -2,215 +2,444 @@ package draw
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
-	"example.com/logging"
+	"example.com/shared/bus"
+	"example.com/shared/canvas"
+	"example.com/shared/logging"
+	"example.com/shared/message"
+	"example.com/shared/metrics"
+	"example.com/shared/store"
+	"example.com/shared/tracing"
 
-	"cloud.google.com/go/firestore"
-	"cloud.google.com/go/pubsub/v2"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type PubSubMessage struct {
-	Message struct {
-		Data       string            `json:"data"`
-		Attributes map[string]string `json:"attributes"`
-		MessageID  string            `json:"messageId"`
-	} `json:"message"`
-	Subscription string `json:"subscription"`
-}
+var (
+	projectId          string
+	firestoreDatabase  string
+	chunkSizeEnv       string
+	chunkFormatEnv     string
+	shardThresholdEnv  string
+	topicID            string
+	drawTopicID        string
+	drawSubscription   string
+	flushIntervalEnv   string
+	maxPendingEnv      string
+	addUserTopicID     string
+	triggerResetName   string
+	pruneMaxAgeEnv     string
+	pruneMaxBacklogEnv string
+	pruneIntervalEnv   string
+	deadLetterTopicID  string
+	storeBackend       string
+	sqlitePath         string
+	busBackend         string
+	natsURL            string
+	metricsExporter    string
+	tracesExporter     string
+	canvases           canvas.Canvases
+	canvasesErr        error
+	chunkFormat        store.ChunkFormat
+	shardThreshold     int
+	chunkConfigErr     error
+	pruner             *backlogPruner
+	prunerErr          error
+	logger             *slog.Logger
+
+	// metaCache holds the metadata of the canvases, which bounds them once
+	// they were expanded.
+	metaCache = store.NewMetaCache(store.DefaultMetaTTL)
+)
 
-type PixelInfo struct {
-	X         int32  `firestore:"x" json:"x"`
-	Y         int32  `firestore:"y" json:"y"`
-	Color     uint8  `firestore:"color" json:"color"`
-	User      string `firestore:"user" json:"user"`
-	Timestamp string `firestore:"timestamp" json:"timestamp"`
+// openStore opens the canvas store the pixels are written to.
+var openStore = func(ctx context.Context) (store.CanvasStore, error) {
+	return store.Open(ctx, store.Config{
+		Backend:        storeBackend,
+		ProjectID:      projectId,
+		Database:       firestoreDatabase,
+		ChunkFormat:    chunkFormat,
+		ShardThreshold: shardThreshold,
+		SQLitePath:     sqlitePath,
+	})
 }
 
-type ChunkData struct {
-	StartX int32          `firestore:"startX" json:"startX"`
-	StartY int32          `firestore:"startY" json:"startY"`
-	Size   int32          `firestore:"size" json:"size"`
-	Pixels map[string]any `firestore:"pixels" json:"pixels"`
+// openBus connects to the message bus the placing users are published on.
+var openBus = func(ctx context.Context) (bus.Publisher, error) {
+	return openWorkerBus(ctx)
 }
 
-type UserInfo struct {
-	UserID string `firestore:"userID" json:"userID"`
+// openWorkerBus connects to the message bus the worker pulls placements from.
+var openWorkerBus = func(ctx context.Context) (bus.Bus, error) {
+	return bus.Open(ctx, bus.Config{
+		Backend:   busBackend,
+		ProjectID: projectId,
+		NATSURL:   natsURL,
+	})
 }
 
-var (
-	projectId         string
-	firestoreDatabase string
-	chunkSizeEnv      string
-	topicID           string
-	addUserTopicID    string
-	triggerResetName  string
-)
-
 func init() {
 	projectId = os.Getenv("PROJECT_ID")
 	firestoreDatabase = os.Getenv("FIRESTORE_DATABASE")
+	storeBackend = os.Getenv("STORE_BACKEND")
+	sqlitePath = os.Getenv("SQLITE_PATH")
+	busBackend = os.Getenv("BUS_BACKEND")
+	natsURL = os.Getenv("NATS_URL")
 	chunkSizeEnv = os.Getenv("CHUNK_SIZE")
+	chunkFormatEnv = os.Getenv("CHUNK_FORMAT")
+	shardThresholdEnv = os.Getenv("CHUNK_SHARD_THRESHOLD")
 	topicID = os.Getenv("PIXEL_UPDATE_TOPIC")
+	drawTopicID = os.Getenv("DRAW_PIXEL_TOPIC")
+	drawSubscription = os.Getenv("DRAW_SUBSCRIPTION")
+	flushIntervalEnv = os.Getenv("DRAW_FLUSH_INTERVAL")
+	maxPendingEnv = os.Getenv("DRAW_MAX_PENDING")
 	addUserTopicID = os.Getenv("ADD_USER_TOPIC")
 	triggerResetName = os.Getenv("TRIGGER_RESET_NAME")
+	pruneMaxAgeEnv = os.Getenv("PRUNE_MAX_AGE")
+	pruneMaxBacklogEnv = os.Getenv("PRUNE_MAX_BACKLOG")
+	pruneIntervalEnv = os.Getenv("PRUNE_INTERVAL")
+	deadLetterTopicID = os.Getenv("DEAD_LETTER_TOPIC")
+	metricsExporter = os.Getenv("METRICS_EXPORTER")
+	tracesExporter = os.Getenv("TRACES_EXPORTER")
+	logger = logging.New(logging.ConfigFromEnv(projectId, "draw"))
+	if err := metrics.Setup(context.Background(), metrics.Config{Exporter: metricsExporter, ServiceName: "draw"}); err != nil {
+		logger.Error("Error setting up metrics", "error", err)
+	}
+	if err := tracing.Setup(context.Background(), tracing.Config{Exporter: tracesExporter, ServiceName: "draw"}); err != nil {
+		logger.Error("Error setting up tracing", "error", err)
+	}
+	if canvases, canvasesErr = canvas.FromEnv(); canvasesErr != nil {
+		logger.Error("Error reading canvases", "error", canvasesErr)
+	}
+	if chunkConfigErr = checkChunkConfig(); chunkConfigErr != nil {
+		logger.Error("Invalid chunk configuration", "error", chunkConfigErr)
+	}
+	if pruner, prunerErr = newBacklogPruner(); prunerErr != nil {
+		logger.Error("Invalid backlog pruning policy", "error", prunerErr)
+	}
 	log.SetFlags(0)
 
 	functions.HTTP("drawPixel", drawPixel)
 }
 
 func drawPixel(w http.ResponseWriter, r *http.Request) {
-	if projectId == "" || firestoreDatabase == "" || chunkSizeEnv == "" || topicID == "" || addUserTopicID == "" || triggerResetName == "" {
+	reason := metrics.ReasonOK
+	defer func() { metrics.Handled(r.Context(), "draw", reason) }()
+
+	if projectId == "" || firestoreDatabase == "" || chunkSizeEnv == "" || topicID == "" || addUserTopicID == "" || (pruner != nil && triggerResetName == "") {
+		reason = "config_error"
 		http.Error(w, "Environement variable are not set", http.StatusInternalServerError)
 		return
 	}
 
-	logging.Info("draw", "Calling draw Pixel service...")
+	// Until the message is read, correlate with the push request itself.
+	ctx := tracing.ExtractHTTP(r.Context(), r)
+
+	logger.InfoContext(ctx, "Calling draw Pixel service...")
 	chunkSize, err := strconv.Atoi(chunkSizeEnv)
 	if err != nil {
-		logging.Error("draw", "Error parsing chunk size", err)
+		logger.ErrorContext(ctx, "Error parsing chunk size", "error", err)
+		reason = "config_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if canvasesErr != nil {
+		logger.ErrorContext(ctx, "Error reading canvases", "error", canvasesErr)
+		reason = "config_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if chunkConfigErr != nil {
+		logger.ErrorContext(ctx, "Invalid chunk configuration", "error", chunkConfigErr)
+		reason = "config_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if prunerErr != nil {
+		logger.ErrorContext(ctx, "Invalid backlog pruning policy", "error", prunerErr)
+		reason = "config_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Opened first, as rejected messages are published on the dead-letter topic.
+	msgBus, err := openBus(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error connecting to message bus", "error", err)
+		reason = "bus_error"
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	defer msgBus.Close()
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		logging.Error("draw", "Error while reading the request body", err)
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		logger.ErrorContext(ctx, "Error while reading the request body", "error", err)
+		reason = "read_error"
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
 		return
 	}
 	defer r.Body.Close()
 
-	logging.InfoF("draw", "Request body: %s", body)
+	logger.DebugContext(ctx, "Request body", "body", string(body))
 
 	// Read and deserialize the PubSubMessage
-	var msg PubSubMessage
-	if err := json.Unmarshal(body, &msg); err != nil {
-		logging.Error("draw", "Error while retrieving Pub Sub Message", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+	msg, err := message.ParsePush(body)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error while retrieving Pub Sub Message", "error", err)
+		reason = bus.RejectPush(ctx, w, logger, "draw", msgBus, deadLetterTopicID, "", &bus.Message{Data: body}, bus.Permanent("invalid_envelope", err))
 		return
 	}
 
-	logging.InfoF("draw", "PubSubMessage: %+v", msg)
+	// Continue the placement's trace, carried by the message.
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, msg.Message.Attributes), "drawPixel",
+		trace.WithSpanKind(trace.SpanKindConsumer))
+	defer func() { tracing.EndWithReason(span, reason) }()
+	ctx = logging.With(ctx, "messageId", msg.Message.MessageID)
+
+	logger.DebugContext(ctx, "PubSubMessage", "pubsubMessage", msg)
 
 	// Decode the base64 data
-	decodedData, err := base64.StdEncoding.DecodeString(msg.Message.Data)
+	decodedData, err := msg.Payload()
 	if err != nil {
-		logging.Error("draw", "Error decoding base64", err)
-		http.Error(w, "Bad request: invalid base64", http.StatusBadRequest)
+		logger.ErrorContext(ctx, "Error decoding base64", "error", err)
+		reason = bus.RejectPush(ctx, w, logger, "draw", msgBus, deadLetterTopicID, msg.Subscription, msg.BusMessage(), bus.Permanent("invalid_base64", err))
 		return
 	}
 
-	logging.InfoF("draw", "Decoded data: %s", decodedData)
+	logger.DebugContext(ctx, "Decoded data", "data", string(decodedData))
+
+	// With a flush interval set, the pixel is written along with the other
+	// placements on its chunk received by this instance in the meantime.
+	var c *coalescer
+	var st store.CanvasStore
+	if flushIntervalEnv != "" {
+		if c, err = pushCoalescer(chunkSize); err != nil {
+			logger.ErrorContext(ctx, "Error starting write coalescing", "error", err)
+			reason = "config_error"
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		st = c.st
+	} else {
+		if st, err = openStore(ctx); err != nil {
+			logger.ErrorContext(ctx, "Error opening canvas store", "error", err)
+			reason = "store_error"
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer st.Close()
+	}
+	if err := checkCanvasMeta(ctx, st, chunkSize); err != nil {
+		logger.ErrorContext(ctx, "Error checking canvas metadata", "error", err)
+		reason = metaReason(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
-	// Deserialize the PixelInfo
-	var pixelInfo PixelInfo
-	if err := json.Unmarshal(decodedData, &pixelInfo); err != nil {
-		logging.Error("draw", "Error while deserialize pixel info from body", err)
-		http.Error(w, "Bad Request: invalid body", http.StatusBadRequest)
+	publishTime, _ := time.Parse(time.RFC3339Nano, msg.Message.PublishTime)
+	pixelInfo, err := decodePixel(ctx, st, decodedData, publishTime)
+	if _, permanent := bus.AsPermanent(err); permanent {
+		logger.ErrorContext(ctx, "Error reading pixel", "error", err)
+		reason = bus.RejectPush(ctx, w, logger, "draw", msgBus, deadLetterTopicID, msg.Subscription, msg.BusMessage(), err)
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "Error reading canvas metadata", "error", err)
+		reason = "store_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	logging.InfoF("draw", "PixelInfo: %+v", pixelInfo)
+	ctx = logging.With(ctx, "user", pixelInfo.User, "canvas", pixelInfo.Canvas)
+	logger.DebugContext(ctx, "PixelInfo", "pixel", pixelInfo)
 
-	// Save to Firestore
-	if err := savePixelToFirestore([]PixelInfo{pixelInfo}, projectId, firestoreDatabase, chunkSize, topicID); err != nil {
-		logging.Error("draw", "Error saving pixel", err)
-		http.Error(w, "Internal Error", http.StatusBadRequest)
+	if c != nil {
+		err = c.add(ctx, pixelInfo)
+	} else {
+		err = savePixels(ctx, st, msgBus, []message.PixelInfo{pixelInfo}, chunkSize)
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "Error saving pixel", "error", err)
+		reason = "write_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	logging.InfoF("draw", "Pixel inserted successfully: x=%d, y=%d", pixelInfo.X, pixelInfo.Y)
+	logger.InfoContext(ctx, "Pixel inserted successfully", "x", pixelInfo.X, "y", pixelInfo.Y)
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Pixel inserted successfully")
 }
 
-func savePixelToFirestore(pixelInfo []PixelInfo, projectId string, firestoreDatabase string, chunkSize int, topicID string) error {
-	ctx := context.Background()
-	client, err := firestore.NewClientWithDatabase(ctx, projectId, firestoreDatabase)
+// checkChunkConfig reads CHUNK_FORMAT and CHUNK_SHARD_THRESHOLD, and refuses
+// a CHUNK_SIZE whose fully painted chunks could outgrow a Firestore document.
+func checkChunkConfig() error {
+	var err error
+	if chunkFormat, err = store.ParseChunkFormat(chunkFormatEnv); err != nil {
+		return err
+	}
+	if shardThresholdEnv != "" {
+		if shardThreshold, err = strconv.Atoi(shardThresholdEnv); err != nil {
+			return fmt.Errorf("invalid CHUNK_SHARD_THRESHOLD %q: %w", shardThresholdEnv, err)
+		}
+	}
+	if chunkSizeEnv == "" || (storeBackend != "" && storeBackend != "firestore") {
+		return nil
+	}
+	chunkSize, err := strconv.Atoi(chunkSizeEnv)
 	if err != nil {
-		return fmt.Errorf("error connecting to Firestore: %w", err)
+		return fmt.Errorf("invalid CHUNK_SIZE %q: %w", chunkSizeEnv, err)
 	}
-	defer client.Close()
+	return store.CheckChunkSize(chunkFormat, chunkSize, shardThreshold)
+}
 
-	c, err := pubsub.NewClient(ctx, projectId)
+// decodePixel reads the placement carried by a draw message published at
+// publishTime, checking it against the bounds of its canvas recorded in st.
+// Malformed or invalid placements are permanent errors.
+func decodePixel(ctx context.Context, st store.CanvasStore, data []byte, publishTime time.Time) (message.PixelInfo, error) {
+	var pixelInfo message.PixelInfo
+	if err := json.Unmarshal(data, &pixelInfo); err != nil {
+		return pixelInfo, bus.Permanent("invalid_body", err)
+	}
+
+	canvasConfig, err := canvases.Get(pixelInfo.Canvas)
 	if err != nil {
-		logging.Error("draw", "Error while retrieving Gcloud Profile", err)
-		return fmt.Errorf("error connecting to PubSub: %w", err)
+		return pixelInfo, bus.Permanent("unknown_canvas", err)
+	}
+	meta, err := metaCache.Get(ctx, st, pixelInfo.Canvas)
+	if err != nil {
+		return pixelInfo, fmt.Errorf("error reading canvas metadata: %w", err)
+	}
+	canvasConfig.Bounds = meta.Bounds(canvasConfig.Bounds, time.Now())
+	if err := pixelInfo.Validate(canvasConfig); err != nil {
+		return pixelInfo, bus.Permanent("invalid_pixel", err)
 	}
-	defer c.Close()
 
-	topic := c.Publisher(addUserTopicID)
-	topic.PublishSettings = pubsub.PublishSettings{
-		CountThreshold: 10,
-		DelayThreshold: 100 * time.Millisecond,
-		ByteThreshold:  1e6,
+	// Messages published before placements were stamped by the proxy are
+	// ordered by their publish time instead.
+	if pixelInfo.PlacedAt == 0 && !publishTime.IsZero() {
+		pixelInfo.PlacedAt = publishTime.UnixNano()
 	}
-	defer topic.Stop()
+	return pixelInfo, nil
+}
 
-	chunkUpdates := make(map[string]map[string]any)
+// savePixels merges the pixels into their chunks, then notifies the add user
+// topic of every user that placed one, so no cooldown starts for a pixel that
+// failed to be written. A pixel placed before the one already stored is
+// dropped, and so is one placed before another placement of the same pixel
+// in pixelInfo. Once written, the backlog of the update topic is pruned if
+// the pruning policy says it is due.
+func savePixels(ctx context.Context, st store.CanvasStore, pub bus.Publisher, pixelInfo []message.PixelInfo, chunkSize int) error {
+	chunkUpdates := make(map[string]*store.ChunkUpdate)
+	superseded := 0
 	for _, pixel := range pixelInfo {
-		localX := int(pixel.X) % chunkSize
-		localY := int(pixel.Y) % chunkSize
+		chunkX, chunkY, localX, localY := canvas.Locate(int(pixel.X), int(pixel.Y), chunkSize)
 		userID, err := strconv.ParseInt(pixel.User, 10, 64)
 		if err != nil {
 			return fmt.Errorf("error parsing user ID: %w", err)
 		}
-		pixelKey := fmt.Sprintf("%d_%d", localX, localY)
-
-		body, err := json.Marshal(UserInfo{
-			UserID: pixel.User,
-		})
-		if err != nil {
-			return fmt.Errorf("error marshalling user info: %w", err)
+		pixelKey := canvas.PixelKey(localX, localY)
+
+		chunkId := canvas.ChunkID(chunkX, chunkY)
+		updateKey := pixel.Canvas + "/" + chunkId
+		update, ok := chunkUpdates[updateKey]
+		if !ok {
+			update = &store.ChunkUpdate{
+				Canvas: pixel.Canvas,
+				ID:     chunkId,
+				Size:   int32(chunkSize),
+				Pixels: make(map[string]store.Pixel),
+				Trace:  tracing.TraceParent(ctx),
+			}
+			chunkUpdates[updateKey] = update
 		}
-		if _, err := topic.Publish(ctx, &pubsub.Message{
-			Data: body,
-		}).Get(ctx); err != nil {
-			logging.Error("draw", "Error publishing user message", err)
-			continue
+		p := store.Pixel{
+			Color:    pixel.Color,
+			User:     userID,
+			PlacedAt: pixel.PlacedAt,
 		}
-
-		chunkId := fmt.Sprintf("canvas_chunks_%d_%d", int(pixel.X)/chunkSize, int(pixel.Y)/chunkSize)
-		if chunkUpdates[chunkId] == nil {
-			chunkUpdates[chunkId] = map[string]any{
-				"size": int32(chunkSize),
-				"pixels": map[string]any{pixelKey: map[string]any{
-					"color": pixel.Color,
-					"user":  userID,
-				},
-				},
-				"lastUpdated": firestore.ServerTimestamp,
+		if old, ok := update.Pixels[pixelKey]; ok {
+			// One of the two placements of the pixel is dropped either way.
+			superseded++
+			if old.PlacedAt >= p.PlacedAt {
+				continue
 			}
 		}
+		update.Pixels[pixelKey] = p
+	}
 
+	updates := make([]store.ChunkUpdate, 0, len(chunkUpdates))
+	for _, update := range chunkUpdates {
+		updates = append(updates, *update)
+	}
+	start := time.Now()
+	written, err := st.SetChunkPixels(ctx, updates)
+	metrics.StoreOperation(ctx, "draw", "set_chunk_pixels", start, err)
+	if err != nil {
+		return err
+	}
+	metrics.PixelsWritten(ctx, "draw", written)
+	if superseded > 0 {
+		metrics.PixelsSkipped(ctx, "draw", metrics.SkipSuperseded, superseded)
+		logger.InfoContext(ctx, "Skipped pixels placed again later in the batch", "skipped", superseded)
+	}
+	if stale := len(pixelInfo) - superseded - written; stale > 0 {
+		metrics.PixelsSkipped(ctx, "draw", metrics.SkipStale, stale)
+		logger.InfoContext(ctx, "Skipped pixels older than the stored ones", "skipped", stale)
+	}
+	if written > 0 {
+		pruneBacklog(ctx, st, len(updates))
 	}
 
-	batch := client.BulkWriter(ctx)
+	// Redelivered if this fails: the pixels are skipped as already stored,
+	// and the users notified again.
+	return notifyUsers(ctx, pub, pixelInfo)
+}
 
-	for chunkId, chunkData := range chunkUpdates {
-		docRef := client.Collection("canvas_chunks").Doc(chunkId)
-		if _, err := batch.Set(docRef, chunkData, firestore.MergeAll); err != nil {
-			return fmt.Errorf("error queuing chunk %s: %w", chunkId, err)
-		}
+// notifyUsers publishes an add user message for each user that placed one of
+// the pixels, once per canvas, and waits for all of them to be published.
+func notifyUsers(ctx context.Context, pub bus.Publisher, pixelInfo []message.PixelInfo) error {
+	users := make(map[message.UserInfo]bool)
+	for _, pixel := range pixelInfo {
+		users[message.UserInfo{UserID: pixel.User, Canvas: pixel.Canvas}] = true
 	}
 
-	triggerRef := client.Collection(triggerResetName).Doc(triggerResetName)
-	if _, err := batch.Set(triggerRef, map[string]any{
-		"lastTriggered": firestore.ServerTimestamp,
-	}); err != nil {
-		return fmt.Errorf("error queuing trigger-reset document: %w", err)
+	var wg sync.WaitGroup
+	errs := make(chan error, len(users))
+	for user := range users {
+		body, err := json.Marshal(user)
+		if err != nil {
+			return fmt.Errorf("error marshalling user info: %w", err)
+		}
+		wg.Go(func() {
+			start := time.Now()
+			_, err := pub.Publish(ctx, addUserTopicID, &bus.Message{
+				Data:       body,
+				Attributes: message.CanvasAttributes(user.Canvas),
+			})
+			metrics.Published(ctx, "draw", addUserTopicID, start, err)
+			if err != nil {
+				errs <- fmt.Errorf("error publishing user message: %w", err)
+			}
+		})
 	}
+	wg.Wait()
+	close(errs)
 
-	batch.End()
-	return nil
+	var all []error
+	for err := range errs {
+		all = append(all, err)
+	}
+	return errors.Join(all...)
 }
@@ -0,0 +1,293 @@
+package draw
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/shared/bus"
+	"example.com/shared/canvas"
+	"example.com/shared/message"
+	"example.com/shared/store"
+)
+
+// setCanvases configures the canvases placements are checked against, and
+// forgets the metadata read for the previous ones.
+func setCanvases(t *testing.T, cs canvas.Canvases) {
+	t.Helper()
+	saved, savedCache := canvases, metaCache
+	t.Cleanup(func() { canvases, metaCache = saved, savedCache })
+	canvases, metaCache = cs, store.NewMetaCache(store.DefaultMetaTTL)
+}
+
+func TestDecodePixel(t *testing.T) {
+	setCanvases(t, canvas.Canvases{
+		canvas.Default: {Bounds: canvas.Bounds{Width: 16, Height: 16}, Palette: 8},
+		"big":          {Bounds: canvas.Bounds{Width: 16, Height: 16}},
+	})
+	ctx := context.Background()
+	st := store.NewMemory()
+	if err := st.SetCanvasMeta(ctx, "big", &store.CanvasMeta{Width: 32, Height: 32}); err != nil {
+		t.Fatalf("SetCanvasMeta: %v", err)
+	}
+	published := time.Unix(1000, 0)
+
+	tests := []struct {
+		name   string
+		data   string
+		want   message.PixelInfo
+		reason string
+	}{
+		{name: "valid", data: `{"x": 1, "y": 2, "color": 3, "user": "42", "placedAt": 7}`, want: message.PixelInfo{X: 1, Y: 2, Color: 3, User: "42", PlacedAt: 7}},
+		{name: "stamped by the publish time", data: `{"x": 1, "y": 2, "color": 3, "user": "42"}`, want: message.PixelInfo{X: 1, Y: 2, Color: 3, User: "42", PlacedAt: published.UnixNano()}},
+		{name: "expanded canvas", data: `{"x": 20, "y": 20, "user": "42", "canvas": "big", "placedAt": 7}`, want: message.PixelInfo{X: 20, Y: 20, User: "42", Canvas: "big", PlacedAt: 7}},
+		{name: "malformed", data: `{"x":`, reason: "invalid_body"},
+		{name: "unknown canvas", data: `{"x": 1, "y": 2, "user": "42", "canvas": "nope"}`, reason: "unknown_canvas"},
+		{name: "out of the canvas", data: `{"x": 20, "y": 2, "user": "42"}`, reason: "invalid_pixel"},
+		{name: "out of the palette", data: `{"x": 1, "y": 2, "color": 9, "user": "42"}`, reason: "invalid_pixel"},
+		{name: "user not numeric", data: `{"x": 1, "y": 2, "user": "bob"}`, reason: "invalid_pixel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodePixel(ctx, st, []byte(tt.data), published)
+			if tt.reason != "" {
+				if perr, ok := bus.AsPermanent(err); !ok || perr.Reason != tt.reason {
+					t.Errorf("decodePixel = %v, want a permanent %s error", err, tt.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodePixel: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("decodePixel = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakePublisher records the messages published, or fails with err.
+type fakePublisher struct {
+	mu       sync.Mutex
+	err      error
+	messages map[string][]*bus.Message
+}
+
+func (p *fakePublisher) Publish(_ context.Context, topic string, msg *bus.Message) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return "", p.err
+	}
+	if p.messages == nil {
+		p.messages = make(map[string][]*bus.Message)
+	}
+	p.messages[topic] = append(p.messages[topic], msg)
+	return strconv.Itoa(len(p.messages[topic])), nil
+}
+
+func (p *fakePublisher) published(topic string) []*bus.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.messages[topic]
+}
+
+func (p *fakePublisher) Close() error {
+	return nil
+}
+
+var errWrite = errors.New("write failed")
+
+// failingStore fails every write of chunks.
+type failingStore struct {
+	*store.MemoryStore
+}
+
+func (failingStore) SetChunkPixels(context.Context, []store.ChunkUpdate) (int, error) {
+	return 0, errWrite
+}
+
+func pixel(canvasID string, x, y int32, user string, placedAt int64) message.PixelInfo {
+	return message.PixelInfo{Canvas: canvasID, X: x, Y: y, Color: 1, User: user, PlacedAt: placedAt}
+}
+
+// pushRequest returns the push request of a draw message carrying data.
+func pushRequest(t *testing.T, data string) *http.Request {
+	t.Helper()
+	var msg message.PubSubMessage
+	msg.Message.Data = data
+	msg.Message.MessageID = "m1"
+	msg.Subscription = "projects/p/subscriptions/draw"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	return httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body)))
+}
+
+func TestDrawPixel(t *testing.T) {
+	setCanvases(t, canvas.Canvases{canvas.Default: {Bounds: canvas.Bounds{Width: 16, Height: 16}}})
+	saved := []string{projectId, firestoreDatabase, chunkSizeEnv, topicID, addUserTopicID, triggerResetName, deadLetterTopicID, flushIntervalEnv}
+	savedStore, savedBus := openStore, openBus
+	t.Cleanup(func() {
+		projectId, firestoreDatabase, chunkSizeEnv, topicID, addUserTopicID, triggerResetName, deadLetterTopicID, flushIntervalEnv =
+			saved[0], saved[1], saved[2], saved[3], saved[4], saved[5], saved[6], saved[7]
+		openStore, openBus = savedStore, savedBus
+		metaChecked = false
+	})
+	projectId, firestoreDatabase, chunkSizeEnv, topicID, addUserTopicID, triggerResetName, deadLetterTopicID, flushIntervalEnv =
+		"p", "(default)", "8", "updates", "add-user", "reset", "dead", ""
+
+	tests := []struct {
+		name       string
+		data       string
+		status     int
+		written    bool
+		deadReason string
+	}{
+		{name: "written", data: base64.StdEncoding.EncodeToString([]byte(`{"x": 9, "y": 2, "color": 3, "user": "42", "placedAt": 7}`)), status: http.StatusOK, written: true},
+		{name: "invalid base64", data: "%%%", status: http.StatusOK, deadReason: "invalid_base64"},
+		{name: "invalid pixel", data: base64.StdEncoding.EncodeToString([]byte(`{"x": 99, "y": 2, "user": "42"}`)), status: http.StatusOK, deadReason: "invalid_pixel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := store.NewMemory()
+			pub := &fakePublisher{}
+			openStore = func(context.Context) (store.CanvasStore, error) { return st, nil }
+			openBus = func(context.Context) (bus.Publisher, error) { return pub, nil }
+			metaChecked = false
+
+			w := httptest.NewRecorder()
+			drawPixel(w, pushRequest(t, tt.data))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.status)
+			}
+
+			chunk, err := st.GetChunk(context.Background(), canvas.Default, canvas.ChunkID(1, 0))
+			if tt.written {
+				if err != nil {
+					t.Fatalf("GetChunk: %v", err)
+				}
+				if p, ok := chunk.Pixels[canvas.PixelKey(1, 2)]; !ok || p.Color != 3 || p.User != 42 {
+					t.Errorf("chunk pixels = %v, want the placement at (1, 2)", chunk.Pixels)
+				}
+				if n := len(pub.published(addUserTopicID)); n != 1 {
+					t.Errorf("published %d user messages, want 1", n)
+				}
+			} else if !errors.Is(err, store.ErrNotFound) {
+				t.Errorf("GetChunk = %v, want nothing written", err)
+			}
+
+			dead := pub.published(deadLetterTopicID)
+			if tt.deadReason == "" {
+				if len(dead) != 0 {
+					t.Errorf("dead-lettered %d messages, want none", len(dead))
+				}
+				return
+			}
+			if len(dead) != 1 || dead[0].Attributes[bus.ReasonAttribute] != tt.deadReason {
+				t.Errorf("dead-lettered %d messages, want one for %s", len(dead), tt.deadReason)
+			}
+		})
+	}
+}
+
+func TestCheckCanvasMetaRecordsBounds(t *testing.T) {
+	t.Cleanup(func() { metaChecked = false })
+	ctx := context.Background()
+	st := store.NewMemory()
+	check := func(bounds canvas.Bounds) *store.CanvasMeta {
+		t.Helper()
+		setCanvases(t, canvas.Canvases{canvas.Default: {Bounds: bounds}, "free": {Bounds: canvas.Bounds{Unbounded: true}}})
+		metaChecked = false
+		if err := checkCanvasMeta(ctx, st, 8); err != nil {
+			t.Fatalf("checkCanvasMeta: %v", err)
+		}
+		meta, err := st.GetCanvasMeta(ctx, canvas.Default)
+		if err != nil {
+			t.Fatalf("GetCanvasMeta: %v", err)
+		}
+		return meta
+	}
+
+	if meta := check(canvas.Bounds{Width: 16, Height: 8}); meta.Width != 16 || meta.Height != 8 || meta.ChunkSize != 8 {
+		t.Errorf("metadata = %+v, want the configured bounds and chunk size recorded", meta)
+	}
+	// Redeployed with other bounds: those recorded stay authoritative.
+	meta := check(canvas.Bounds{Width: 32, Height: 32})
+	if got := meta.Bounds(canvases[canvas.Default].Bounds, time.Now()); got != (canvas.Bounds{Width: 16, Height: 8}) {
+		t.Errorf("bounds after a redeploy = %+v, want those recorded", got)
+	}
+	if free, err := st.GetCanvasMeta(ctx, "free"); err != nil || free.Width != 0 || free.Height != 0 {
+		t.Errorf("metadata of the unbounded canvas = %+v, %v, want no bounds", free, err)
+	}
+}
+
+func TestSavePixelsPublishesOnlyOnceWritten(t *testing.T) {
+	ctx := context.Background()
+	pixels := []message.PixelInfo{pixel("", 1, 1, "1", 1), pixel("", 2, 2, "2", 2)}
+
+	pub := &fakePublisher{}
+	failing := failingStore{MemoryStore: store.NewMemory()}
+	if err := savePixels(ctx, failing, pub, pixels, 8); !errors.Is(err, errWrite) {
+		t.Fatalf("savePixels on a failing store = %v, want %v", err, errWrite)
+	}
+	if n := len(pub.published(addUserTopicID)); n != 0 {
+		t.Errorf("published %d user messages for unwritten pixels, want 0", n)
+	}
+
+	if err := savePixels(ctx, store.NewMemory(), pub, pixels, 8); err != nil {
+		t.Fatalf("savePixels: %v", err)
+	}
+	if n := len(pub.published(addUserTopicID)); n != len(pixels) {
+		t.Errorf("published %d user messages, want %d", n, len(pixels))
+	}
+}
+
+func TestSavePixelsNotifiesEachUserOnce(t *testing.T) {
+	savedTopic := addUserTopicID
+	t.Cleanup(func() { addUserTopicID = savedTopic })
+	addUserTopicID = "add-user"
+	st, pub := store.NewMemory(), &fakePublisher{}
+
+	pixels := []message.PixelInfo{
+		{X: 1, Y: 1, User: "42", PlacedAt: 1},
+		{X: 1, Y: 1, User: "42", PlacedAt: 2},
+		{X: 9, Y: 1, User: "42", PlacedAt: 3},
+		{X: 1, Y: 1, User: "42", Canvas: "s2", PlacedAt: 4},
+		{X: 2, Y: 1, User: "43", PlacedAt: 5},
+	}
+	if err := savePixels(context.Background(), st, pub, pixels, 8); err != nil {
+		t.Fatalf("savePixels: %v", err)
+	}
+
+	got := map[message.UserInfo]int{}
+	for _, m := range pub.published(addUserTopicID) {
+		var u message.UserInfo
+		if err := json.Unmarshal(m.Data, &u); err != nil {
+			t.Fatalf("published %q: %v", m.Data, err)
+		}
+		got[u]++
+	}
+	want := map[message.UserInfo]int{{UserID: "42"}: 1, {UserID: "42", Canvas: "s2"}: 1, {UserID: "43"}: 1}
+	if !maps.Equal(got, want) {
+		t.Errorf("published users %v, want %v", got, want)
+	}
+
+	// A failed publish fails the save, to be redelivered.
+	pub.err = errors.New("bus unavailable")
+	if err := savePixels(context.Background(), st, pub, pixels[:1], 8); !errors.Is(err, pub.err) {
+		t.Errorf("savePixels with the bus failing = %v, want %v", err, pub.err)
+	}
+}
@@ -0,0 +1,78 @@
+package draw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"example.com/shared/store"
+)
+
+// errChunkSize is returned when a canvas is not stored in chunks of
+// CHUNK_SIZE, or is being migrated to another size.
+var errChunkSize = errors.New("canvas chunk size does not match CHUNK_SIZE")
+
+var (
+	metaMu      sync.Mutex
+	metaChecked bool
+)
+
+// checkCanvasMeta verifies, once per instance, that every canvas is stored in
+// chunks of chunkSize according to its metadata document, so an instance
+// deployed with another size, or during a re-chunking migration, does not
+// write pixels at the wrong place. The size of a canvas that has none
+// recorded yet is recorded as chunkSize, and so are the bounds it is
+// configured with, which the recorded ones replace from then on. A failed
+// check is retried on the next call.
+func checkCanvasMeta(ctx context.Context, st store.CanvasStore, chunkSize int) error {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+
+	if metaChecked {
+		return nil
+	}
+	for id, c := range canvases {
+		recorded, recordedBounds := false, false
+		meta, err := st.UpdateCanvasMeta(ctx, id, func(meta *store.CanvasMeta) error {
+			if meta.ChunkSize == 0 {
+				meta.ChunkSize = chunkSize
+				recorded = true
+			}
+			if c.Sized() && (meta.Width == 0 || meta.Height == 0) {
+				meta.Width, meta.Height = c.Width, c.Height
+				recordedBounds = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if recorded {
+			logger.InfoContext(ctx, "Recorded canvas chunk size", "canvas", id, "chunkSize", chunkSize)
+		}
+		switch {
+		case recordedBounds:
+			logger.InfoContext(ctx, "Recorded canvas bounds", "canvas", id, "width", meta.Width, "height", meta.Height)
+		case c.Sized() && (meta.Width != c.Width || meta.Height != c.Height):
+			logger.WarnContext(ctx, "Canvas bounds differ from the configured ones, keeping those recorded; expand the canvas to grow it",
+				"canvas", id, "width", meta.Width, "height", meta.Height, "configuredWidth", c.Width, "configuredHeight", c.Height)
+		}
+		if meta.Rechunk != nil {
+			return fmt.Errorf("%w: canvas %q is being migrated from %d to %d", errChunkSize, id, meta.ChunkSize, meta.Rechunk.To)
+		}
+		if meta.ChunkSize != chunkSize {
+			return fmt.Errorf("%w: canvas %q is stored in chunks of %d, CHUNK_SIZE is %d", errChunkSize, id, meta.ChunkSize, chunkSize)
+		}
+	}
+	metaChecked = true
+	return nil
+}
+
+// metaReason returns the reason to record for an error of checkCanvasMeta.
+func metaReason(err error) string {
+	if errors.Is(err, errChunkSize) {
+		return "config_error"
+	}
+	return "store_error"
+}
@@ -0,0 +1,160 @@
+package draw
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"example.com/shared/metrics"
+	"example.com/shared/store"
+)
+
+const (
+	// defaultPruneMaxAge is the default of PRUNE_MAX_AGE.
+	defaultPruneMaxAge = 5 * time.Minute
+
+	// defaultPruneInterval is the default of PRUNE_INTERVAL.
+	defaultPruneInterval = time.Minute
+)
+
+// prunePolicy decides when the backlog of the subscriptions of the update
+// topic is pruned. Without a maximum age or backlog it is never pruned.
+type prunePolicy struct {
+	// maxAge is how old the oldest chunk update written since the last prune
+	// may get: past it, the updates older than maxAge are pruned.
+	maxAge time.Duration
+
+	// maxBacklog is how many chunk updates may be written since the last
+	// prune: past it, every update is pruned, the clients being too far
+	// behind to catch up.
+	maxBacklog int
+
+	// interval is the minimum time between two prunes, by any instance.
+	interval time.Duration
+}
+
+// prunePolicySettings reads PRUNE_MAX_AGE, PRUNE_MAX_BACKLOG and
+// PRUNE_INTERVAL. PRUNE_MAX_AGE defaults to defaultPruneMaxAge, so that the
+// backlog is pruned unless told otherwise; setting it to 0 without a
+// PRUNE_MAX_BACKLOG turns pruning off.
+func prunePolicySettings() (prunePolicy, error) {
+	policy := prunePolicy{maxAge: defaultPruneMaxAge, interval: defaultPruneInterval}
+	var err error
+	if pruneMaxAgeEnv != "" {
+		if policy.maxAge, err = time.ParseDuration(pruneMaxAgeEnv); err != nil || policy.maxAge < 0 {
+			return policy, fmt.Errorf("invalid PRUNE_MAX_AGE %q", pruneMaxAgeEnv)
+		}
+	}
+	if pruneMaxBacklogEnv != "" {
+		if policy.maxBacklog, err = strconv.Atoi(pruneMaxBacklogEnv); err != nil || policy.maxBacklog < 0 {
+			return policy, fmt.Errorf("invalid PRUNE_MAX_BACKLOG %q", pruneMaxBacklogEnv)
+		}
+	}
+	if pruneIntervalEnv != "" {
+		if policy.interval, err = time.ParseDuration(pruneIntervalEnv); err != nil || policy.interval <= 0 {
+			return policy, fmt.Errorf("invalid PRUNE_INTERVAL %q", pruneIntervalEnv)
+		}
+	}
+	return policy, nil
+}
+
+// newBacklogPruner returns the pruner applying the policy read from the
+// environment, nil if it never prunes. A pruner needs TRIGGER_RESET_NAME.
+func newBacklogPruner() (*backlogPruner, error) {
+	policy, err := prunePolicySettings()
+	if err != nil || (policy.maxAge == 0 && policy.maxBacklog == 0) {
+		return nil, err
+	}
+	return &backlogPruner{policy: policy}, nil
+}
+
+// backlogPruner applies a prunePolicy to the chunk updates written by the
+// instance. The thresholds apply to the writes of each instance, so with n
+// instances the backlog may reach n times PRUNE_MAX_BACKLOG, but the interval
+// is shared through the trigger document: the backlog is pruned at most once
+// per interval whatever the number of instances, and a prune by any of them
+// restarts the count of the others.
+type backlogPruner struct {
+	policy prunePolicy
+
+	mu      sync.Mutex
+	written int
+	first   time.Time
+	last    time.Time
+}
+
+// due records that n chunk updates were written at now, and returns the reset
+// request pruning the backlog if the policy says it is due. The count goes on
+// until pruned is called.
+func (p *backlogPruner) due(n int, now time.Time) (store.ResetRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.written == 0 && n > 0 {
+		p.first = now
+	}
+	p.written += n
+	if p.written == 0 || now.Sub(p.last) < p.policy.interval {
+		return store.ResetRequest{}, false
+	}
+
+	var req store.ResetRequest
+	switch {
+	case p.policy.maxBacklog > 0 && p.written >= p.policy.maxBacklog:
+		req = store.ResetRequest{
+			Reason: fmt.Sprintf("backlog of %d chunk updates", p.written),
+			Time:   now,
+		}
+	case p.policy.maxAge > 0 && now.Sub(p.first) >= p.policy.maxAge:
+		req = store.ResetRequest{
+			Reason: fmt.Sprintf("backlog older than %v", p.policy.maxAge),
+			Time:   now.Add(-p.policy.maxAge),
+		}
+	default:
+		return store.ResetRequest{}, false
+	}
+	req.RequestedBy = "draw"
+	req.Prune = true
+	return req, true
+}
+
+// pruned records that the backlog was last pruned at last, by this instance
+// or another one, restarting the count of the updates written.
+func (p *backlogPruner) pruned(last time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.written, p.first = 0, time.Time{}
+	p.last = last
+}
+
+// pruneBacklog records that n chunk updates were written, and has the reset
+// function prune the backlog of the update subscriptions if it is due, by
+// writing TRIGGER_RESET_NAME unless another instance did within the interval.
+// A failure is only logged: the pixels are written, and the next prune covers
+// the backlog left.
+func pruneBacklog(ctx context.Context, st store.CanvasStore, n int) {
+	if pruner == nil {
+		return
+	}
+	req, ok := pruner.due(n, time.Now())
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	last, written, err := st.WriteTrigger(ctx, triggerResetName, req, pruner.policy.interval)
+	metrics.StoreOperation(ctx, "draw", "write_trigger", start, err)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error requesting backlog pruning", "error", err)
+		return
+	}
+	pruner.pruned(last)
+	if !written {
+		logger.DebugContext(ctx, "Backlog already pruned by another instance", "at", last)
+		return
+	}
+	logger.InfoContext(ctx, "Requested backlog pruning", "reason", req.Reason, "time", req.Time)
+}
@@ -0,0 +1,157 @@
+package draw
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"example.com/shared/store"
+)
+
+func TestBacklogPrunerDue(t *testing.T) {
+	t0 := time.Unix(1000, 0).UTC()
+	type write struct {
+		n      int
+		at     time.Duration
+		pruned bool
+	}
+	tests := []struct {
+		name   string
+		policy prunePolicy
+		writes []write
+		want   store.ResetRequest
+		due    bool
+	}{{
+		name:   "below the backlog",
+		policy: prunePolicy{maxBacklog: 10, interval: time.Minute},
+		writes: []write{{n: 4, at: 0}, {n: 5, at: 2 * time.Minute}},
+	}, {
+		name:   "backlog reached",
+		policy: prunePolicy{maxBacklog: 10, interval: time.Minute},
+		writes: []write{{n: 4, at: 0}, {n: 6, at: 2 * time.Minute}},
+		want:   store.ResetRequest{Reason: "backlog of 10 chunk updates", RequestedBy: "draw", Time: t0.Add(2 * time.Minute), Prune: true},
+		due:    true,
+	}, {
+		name:   "younger than the maximum age",
+		policy: prunePolicy{maxAge: 5 * time.Minute, interval: time.Minute},
+		writes: []write{{n: 1, at: 0}, {n: 1, at: 4 * time.Minute}},
+	}, {
+		name:   "older than the maximum age",
+		policy: prunePolicy{maxAge: 5 * time.Minute, interval: time.Minute},
+		writes: []write{{n: 1, at: 0}, {n: 1, at: 6 * time.Minute}},
+		want:   store.ResetRequest{Reason: "backlog older than 5m0s", RequestedBy: "draw", Time: t0.Add(time.Minute), Prune: true},
+		due:    true,
+	}, {
+		name:   "within the interval of the last prune",
+		policy: prunePolicy{maxBacklog: 10, interval: time.Minute},
+		writes: []write{{pruned: true, at: 0}, {n: 20, at: 30 * time.Second}},
+	}, {
+		name:   "after the interval of the last prune",
+		policy: prunePolicy{maxBacklog: 10, interval: time.Minute},
+		writes: []write{{pruned: true, at: 0}, {n: 20, at: 30 * time.Second}, {n: 0, at: time.Minute}},
+		want:   store.ResetRequest{Reason: "backlog of 20 chunk updates", RequestedBy: "draw", Time: t0.Add(time.Minute), Prune: true},
+		due:    true,
+	}, {
+		name:   "prune restarts the count",
+		policy: prunePolicy{maxBacklog: 10, interval: time.Minute},
+		writes: []write{{n: 9, at: 0}, {pruned: true, at: time.Minute}, {n: 9, at: 3 * time.Minute}},
+	}, {
+		name:   "prune restarts the age",
+		policy: prunePolicy{maxAge: 5 * time.Minute, interval: time.Minute},
+		writes: []write{{n: 1, at: 0}, {pruned: true, at: 4 * time.Minute}, {n: 1, at: 6 * time.Minute}, {n: 1, at: 10 * time.Minute}},
+	}, {
+		name:   "nothing written",
+		policy: prunePolicy{maxAge: time.Minute, maxBacklog: 1, interval: time.Minute},
+		writes: []write{{n: 0, at: 10 * time.Minute}},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &backlogPruner{policy: tt.policy}
+			var req store.ResetRequest
+			var due bool
+			for _, w := range tt.writes {
+				if w.pruned {
+					p.pruned(t0.Add(w.at))
+					continue
+				}
+				req, due = p.due(w.n, t0.Add(w.at))
+			}
+			if due != tt.due || req != tt.want {
+				t.Errorf("due = %+v, %v, want %+v, %v", req, due, tt.want, tt.due)
+			}
+		})
+	}
+}
+
+func TestPruneBacklogSharesInterval(t *testing.T) {
+	defer func(p *backlogPruner, name string) { pruner, triggerResetName = p, name }(pruner, triggerResetName)
+	triggerResetName = "trigger-reset"
+	ctx := context.Background()
+	st := store.NewMemory()
+	policy := prunePolicy{maxBacklog: 1, interval: time.Hour}
+
+	// Two instances over the backlog at once: only the first one prunes it.
+	first, second := &backlogPruner{policy: policy}, &backlogPruner{policy: policy}
+	pruner = first
+	pruneBacklog(ctx, st, 1)
+	triggered := st.LastTriggered(triggerResetName)
+	if triggered.IsZero() {
+		t.Fatal("first instance did not prune the backlog")
+	}
+	pruner = second
+	pruneBacklog(ctx, st, 1)
+	if got := st.LastTriggered(triggerResetName); !got.Equal(triggered) {
+		t.Errorf("second instance pruned again at %v, want the prune of %v only", got, triggered)
+	}
+	if second.written != 0 || !second.last.Equal(triggered) {
+		t.Errorf("second instance has %d updates since %v, want 0 since %v", second.written, second.last, triggered)
+	}
+}
+
+func TestPrunePolicySettings(t *testing.T) {
+	saved := [3]string{pruneMaxAgeEnv, pruneMaxBacklogEnv, pruneIntervalEnv}
+	t.Cleanup(func() { pruneMaxAgeEnv, pruneMaxBacklogEnv, pruneIntervalEnv = saved[0], saved[1], saved[2] })
+
+	tests := []struct {
+		name               string
+		maxAge, maxBacklog string
+		want               prunePolicy
+		never              bool
+		wantErr            bool
+	}{{
+		name: "default",
+		want: prunePolicy{maxAge: defaultPruneMaxAge, interval: defaultPruneInterval},
+	}, {
+		name:       "backlog only",
+		maxAge:     "0",
+		maxBacklog: "500",
+		want:       prunePolicy{maxBacklog: 500, interval: defaultPruneInterval},
+	}, {
+		name:   "turned off",
+		maxAge: "0",
+		want:   prunePolicy{interval: defaultPruneInterval},
+		never:  true,
+	}, {
+		name:    "negative age",
+		maxAge:  "-1m",
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pruneMaxAgeEnv, pruneMaxBacklogEnv, pruneIntervalEnv = tt.maxAge, tt.maxBacklog, ""
+			got, err := prunePolicySettings()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("prunePolicySettings() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("prunePolicySettings() = %+v, want %+v", got, tt.want)
+			}
+			if p, _ := newBacklogPruner(); (p == nil) != tt.never {
+				t.Errorf("newBacklogPruner() = %v, want nil %v", p, tt.never)
+			}
+		})
+	}
+}
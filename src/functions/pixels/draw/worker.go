@@ -0,0 +1,105 @@
+package draw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"example.com/shared/bus"
+	"example.com/shared/logging"
+	"example.com/shared/metrics"
+)
+
+// RunWorker pulls placements from DRAW_SUBSCRIPTION until ctx is done, as an
+// alternative to the drawPixel push endpoint. The placements on a chunk
+// received within DRAW_FLUSH_INTERVAL of the first one are written together,
+// and are acknowledged only after that write succeeded; if it fails they are
+// all redelivered. When ctx is done, the chunks still buffered are written
+// before returning.
+func RunWorker(ctx context.Context) error {
+	if projectId == "" || firestoreDatabase == "" || chunkSizeEnv == "" || topicID == "" || addUserTopicID == "" || (pruner != nil && triggerResetName == "") || drawSubscription == "" {
+		return errors.New("environment variables are not set")
+	}
+	chunkSize, err := strconv.Atoi(chunkSizeEnv)
+	if err != nil {
+		return fmt.Errorf("invalid CHUNK_SIZE %q: %w", chunkSizeEnv, err)
+	}
+	if canvasesErr != nil {
+		return fmt.Errorf("error reading canvases: %w", canvasesErr)
+	}
+	if chunkConfigErr != nil {
+		return fmt.Errorf("invalid chunk configuration: %w", chunkConfigErr)
+	}
+	if prunerErr != nil {
+		return fmt.Errorf("invalid backlog pruning policy: %w", prunerErr)
+	}
+	interval, maxPending, err := coalesceSettings()
+	if err != nil {
+		return err
+	}
+
+	msgBus, err := openWorkerBus(ctx)
+	if err != nil {
+		return fmt.Errorf("error connecting to message bus: %w", err)
+	}
+	defer msgBus.Close()
+
+	st, err := openStore(ctx)
+	if err != nil {
+		return fmt.Errorf("error opening canvas store: %w", err)
+	}
+	defer st.Close()
+
+	if err := checkCanvasMeta(ctx, st, chunkSize); err != nil {
+		return fmt.Errorf("error checking canvas metadata: %w", err)
+	}
+
+	c := newCoalescer(st, msgBus, chunkSize, interval, maxPending)
+	done := make(chan struct{})
+	go func() {
+		c.run(ctx)
+		close(done)
+	}()
+
+	h := c.handle
+	if deadLetterTopicID == "" {
+		logger.WarnContext(ctx, "No dead-letter topic set, rejected messages will be dropped")
+	} else {
+		h = bus.WithDeadLetter(h, msgBus, deadLetterTopicID, drawSubscription)
+	}
+
+	logger.InfoContext(ctx, "Draw worker started", "subscription", drawSubscription, "interval", interval, "maxPending", maxPending)
+	err = msgBus.Subscribe(ctx, drawTopicID, drawSubscription, h)
+	<-done
+	logger.InfoContext(ctx, "Draw worker stopped")
+	return err
+}
+
+// handle decodes a draw message and waits for its placement to be saved.
+func (c *coalescer) handle(ctx context.Context, m *bus.Message) error {
+	reason := metrics.ReasonOK
+	defer func() { metrics.Handled(ctx, "draw", reason) }()
+
+	ctx = logging.With(ctx, "messageId", m.ID)
+	pixelInfo, err := decodePixel(ctx, c.st, m.Data, m.PublishTime)
+	if perr, permanent := bus.AsPermanent(err); permanent {
+		reason = perr.Reason
+		logger.ErrorContext(ctx, "Rejecting message", "reason", perr.Reason, "error", err)
+		return err
+	}
+	if err != nil {
+		reason = "store_error"
+		logger.ErrorContext(ctx, "Error reading canvas metadata", "error", err)
+		return err
+	}
+
+	ctx = logging.With(ctx, "user", pixelInfo.User, "canvas", pixelInfo.Canvas)
+	if err := c.add(ctx, pixelInfo); err != nil {
+		reason = "write_error"
+		return err
+	}
+
+	logger.InfoContext(ctx, "Pixel inserted successfully", "x", pixelInfo.X, "y", pixelInfo.Y)
+	return nil
+}
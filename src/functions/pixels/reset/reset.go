@@ -2,89 +2,537 @@ package reset
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"path"
+	"strconv"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/pubsub/v2"
-	pubsubadmin "cloud.google.com/go/pubsub/v2/apiv1"
 	adminpb "cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
-	"example.com/logging"
+	"example.com/shared/logging"
+	"example.com/shared/store"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
 	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var (
-	projectID string
-	topicName string
+	projectID         string
+	firestoreDatabase string
+	topicName         string
+	triggerResetName  string
+	storeBackend      string
+	sqlitePath        string
+	createSnapshotEnv string
+	logger            *slog.Logger
+	concurrencyEnv    string
 )
 
+// openStore opens the store the audit entries are recorded in.
+var openStore = func(ctx context.Context) (store.CanvasStore, error) {
+	return store.Open(ctx, store.Config{
+		Backend:    storeBackend,
+		ProjectID:  projectID,
+		Database:   firestoreDatabase,
+		SQLitePath: sqlitePath,
+	})
+}
+
+// defaultConcurrency is how many subscriptions are reset at once unless
+// RESET_CONCURRENCY says otherwise.
+const defaultConcurrency = 4
+
 func init() {
 	topicName = os.Getenv("PIXEL_UPDATE_TOPIC")
 	projectID = os.Getenv("PROJECT_ID")
+	logger = logging.New(logging.ConfigFromEnv(projectID, "reset"))
+	firestoreDatabase = os.Getenv("FIRESTORE_DATABASE")
+	triggerResetName = os.Getenv("TRIGGER_RESET_NAME")
+	storeBackend = os.Getenv("STORE_BACKEND")
+	sqlitePath = os.Getenv("SQLITE_PATH")
+	createSnapshotEnv = os.Getenv("RESET_CREATE_SNAPSHOT")
+	concurrencyEnv = os.Getenv("RESET_CONCURRENCY")
 	log.SetFlags(0)
 
 	functions.CloudEvent("resetPixel", resetPixel)
 }
 
+// resetEventTypes are the types of the events resetPixel handles: a trigger
+// document deleted asks for nothing.
+var resetEventTypes = map[string]bool{
+	"google.cloud.firestore.document.v1.written": true,
+	"google.cloud.firestore.document.v1.created": true,
+	"google.cloud.firestore.document.v1.updated": true,
+}
+
+// Fields of the trigger document read by resetPixel.
+const (
+	// reasonField and requestedByField are why the reset is asked for and
+	// by whom. A write of the trigger document lacking either is ignored.
+	reasonField      = "reason"
+	requestedByField = "requestedBy"
+
+	// createSnapshotField snapshots every subscription before seeking it,
+	// overriding RESET_CREATE_SNAPSHOT.
+	createSnapshotField = "createSnapshot"
+
+	// snapshotField names the snapshot set to seek the subscriptions to,
+	// instead of now.
+	snapshotField = "snapshot"
+
+	// timeField is the time to seek the subscriptions to, instead of now.
+	timeField = "time"
+
+	// includeField and excludeField are arrays of patterns, as matched by
+	// path.Match, selecting subscriptions by ID.
+	includeField = "include"
+	excludeField = "exclude"
+
+	// includeLabelsField and excludeLabelsField are maps selecting
+	// subscriptions by labels.
+	includeLabelsField = "includeLabels"
+	excludeLabelsField = "excludeLabels"
+
+	// dryRunField only reports what would be reset.
+	dryRunField = "dryRun"
+
+	// concurrencyField overrides RESET_CONCURRENCY.
+	concurrencyField = "concurrency"
+
+	// pruneField marks the requests of draw pruning the backlog.
+	pruneField = "prune"
+)
+
+// resetRequest is what a write of the trigger document asks for.
+type resetRequest struct {
+	// Reason and RequestedBy are recorded in the audit entry of the reset.
+	Reason      string
+	RequestedBy string
+
+	// CreateSnapshot snapshots every subscription before seeking it, so the
+	// reset can be rolled back by seeking to the snapshot set logged.
+	CreateSnapshot bool
+
+	// Snapshot is the snapshot set to seek to: each subscription is seeked
+	// to its own snapshot in the set. Empty to seek to Time.
+	Snapshot string
+
+	// Time is the time to seek to, zero for now. Seeking to a past time
+	// replays the messages published since, as far as the subscription
+	// retains them.
+	Time time.Time
+
+	// Include, if not empty, limits the reset to the subscriptions whose ID
+	// matches one of its patterns, and Exclude leaves out those matching
+	// one of its own.
+	Include []string
+	Exclude []string
+
+	// IncludeLabels, if not empty, limits the reset to the subscriptions
+	// having all of its labels, and ExcludeLabels leaves out those having
+	// any of its own.
+	IncludeLabels map[string]string
+	ExcludeLabels map[string]string
+
+	// DryRun reports the subscriptions that would be reset without
+	// touching them.
+	DryRun bool
+
+	// Concurrency is how many subscriptions are reset at once.
+	Concurrency int
+
+	// Prune asks to drop the backlog only: the subscriptions retaining
+	// acknowledged messages are skipped, as seeking them to Time would
+	// redeliver the messages acknowledged since.
+	Prune bool
+}
+
+// Outcomes of the reset of a subscription.
+const (
+	outcomeSeeked   = "seeked"
+	outcomeDryRun   = "dry_run"
+	outcomeFailed   = "failed"
+	outcomeExcluded = "excluded"
+	outcomeSkipped  = "skipped"
+)
+
+// subscriptionResult is the outcome of the reset of a subscription.
+type subscriptionResult struct {
+	Subscription string
+	Outcome      string
+
+	// Snapshot is the snapshot taken before seeking, if any.
+	Snapshot string
+
+	Err error
+}
+
+// resetPixel seeks the subscriptions of PIXEL_UPDATE_TOPIC as asked by the
+// write of the trigger document it is fired by: to now by default, dropping
+// every pending chunk update. Events of another type, for another document
+// or another database, and writes not saying why and by whom the reset is
+// asked for, are ignored. A subscription failing does not stop the others;
+// the failures are reported together once all are done. Every reset is
+// recorded in the audit collection under the ID of its event, before it
+// starts so none goes unrecorded, and again with its outcome.
 func resetPixel(ctx context.Context, e event.Event) error {
-	if projectID == "" || topicName == "" {
+	if projectID == "" || firestoreDatabase == "" || topicName == "" || triggerResetName == "" {
 		return fmt.Errorf("environment variables are not set")
 	}
 
-	if err := seekAllSubscriptionsToNow(ctx, topicName); err != nil {
-		return fmt.Errorf("failed to seek subscriptions: %v", err)
+	ctx = logging.With(ctx, "eventId", e.ID())
+	if err := checkEvent(e); err != nil {
+		logger.WarnContext(ctx, "Ignoring event", "error", err)
+		return nil
 	}
+	req, err := parseResetRequest(e.Data())
+	if err != nil {
+		// Redelivering the event would not make it valid.
+		logger.ErrorContext(ctx, "Ignoring invalid reset request", "error", err)
+		return nil
+	}
+
+	st, err := openStore(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %v", err)
+	}
+	defer st.Close()
+
+	entry := &store.AuditEntry{
+		ID:          e.ID(),
+		Operation:   "reset",
+		RequestedBy: req.RequestedBy,
+		Reason:      req.Reason,
+		At:          time.Now(),
+	}
+	if err := st.RecordAudit(ctx, entry); err != nil {
+		return fmt.Errorf("failed to record reset: %v", err)
+	}
+	logger.InfoContext(ctx, "Reset requested", "requestedBy", req.RequestedBy, "reason", req.Reason)
+
+	results, err := seekSubscriptions(ctx, topicName, req)
+	if err != nil {
+		err = fmt.Errorf("failed to seek subscriptions: %v", err)
+	} else {
+		err = reportResults(ctx, entry, results)
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	// The reset is done: failing to record its outcome must not redo it.
+	if recordErr := st.RecordAudit(ctx, entry); recordErr != nil {
+		logger.ErrorContext(ctx, "Error recording the outcome of the reset", "error", recordErr)
+	}
+	return err
+}
 
-	logging.InfoF("reset", "Successfully cleared messages from topic: %s", topicName)
+// checkEvent returns why e is not a write of the trigger document, if it is
+// not.
+func checkEvent(e event.Event) error {
+	if !resetEventTypes[e.Type()] {
+		return fmt.Errorf("unexpected type %q", e.Type())
+	}
+	if want := fmt.Sprintf("//firestore.googleapis.com/projects/%s/databases/%s", projectID, firestoreDatabase); e.Source() != want {
+		return fmt.Errorf("unexpected source %q", e.Source())
+	}
+	if want := fmt.Sprintf("documents/%s/%s", triggerResetName, triggerResetName); e.Subject() != want {
+		return fmt.Errorf("unexpected document %q", e.Subject())
+	}
 	return nil
 }
 
-func seekAllSubscriptionsToNow(ctx context.Context, topicName string) error {
-	client, err := pubsub.NewClient(ctx, projectID)
-	if err != nil {
-		return fmt.Errorf("pubsub.NewClient: %v", err)
+// reportResults logs the outcome of the reset of each subscription and
+// records it in entry. It returns the failures joined.
+func reportResults(ctx context.Context, entry *store.AuditEntry, results []subscriptionResult) error {
+	counts := make(map[string]int)
+	entry.Details = make(map[string]string, len(results))
+	var errs []error
+	for _, r := range results {
+		counts[r.Outcome]++
+		detail := r.Outcome
+		if r.Err != nil {
+			logger.ErrorContext(ctx, "Error resetting subscription", "subscription", r.Subscription, "outcome", r.Outcome, "error", r.Err)
+			errs = append(errs, fmt.Errorf("%s: %w", r.Subscription, r.Err))
+			detail += ": " + r.Err.Error()
+		} else if r.Snapshot != "" {
+			logger.InfoContext(ctx, "Subscription reset", "subscription", r.Subscription, "outcome", r.Outcome, "snapshot", r.Snapshot)
+			detail += ", snapshot " + r.Snapshot
+		} else {
+			logger.InfoContext(ctx, "Subscription reset", "subscription", r.Subscription, "outcome", r.Outcome)
+		}
+		entry.Details[path.Base(r.Subscription)] = detail
 	}
-	defer client.Close()
+	logger.InfoContext(ctx, "Reset done", "topic", topicName,
+		outcomeSeeked, counts[outcomeSeeked], outcomeDryRun, counts[outcomeDryRun], outcomeExcluded, counts[outcomeExcluded],
+		outcomeSkipped, counts[outcomeSkipped], outcomeFailed, counts[outcomeFailed])
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to reset %d subscriptions: %w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
 
-	subAdmin, err := pubsubadmin.NewSubscriptionAdminClient(ctx)
-	if err != nil {
-		return fmt.Errorf("apiv1.NewSubscriptionAdminClient: %v", err)
+// parseResetRequest reads the reset request from the trigger document written.
+func parseResetRequest(data []byte) (resetRequest, error) {
+	req := resetRequest{Concurrency: defaultConcurrency}
+	if createSnapshotEnv != "" {
+		v, err := strconv.ParseBool(createSnapshotEnv)
+		if err != nil {
+			return req, fmt.Errorf("invalid RESET_CREATE_SNAPSHOT %q: %w", createSnapshotEnv, err)
+		}
+		req.CreateSnapshot = v
+	}
+	if concurrencyEnv != "" {
+		v, err := strconv.Atoi(concurrencyEnv)
+		if err != nil || v <= 0 {
+			return req, fmt.Errorf("invalid RESET_CONCURRENCY %q", concurrencyEnv)
+		}
+		req.Concurrency = v
 	}
-	defer subAdmin.Close()
 
-	req := &adminpb.ListTopicSubscriptionsRequest{
-		Topic: fmt.Sprintf("projects/%s/topics/%s", projectID, topicName),
+	var doc firestoredata.DocumentEventData
+	if err := (proto.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, &doc); err != nil {
+		return req, fmt.Errorf("proto.Unmarshal: %w", err)
+	}
+	if doc.GetValue() == nil {
+		return req, fmt.Errorf("trigger document deleted")
 	}
-	it := client.TopicAdminClient.ListTopicSubscriptions(ctx, req)
+	fields := doc.GetValue().GetFields()
+	req.Reason = fields[reasonField].GetStringValue()
+	req.RequestedBy = fields[requestedByField].GetStringValue()
+	if req.Reason == "" || req.RequestedBy == "" {
+		return req, fmt.Errorf("%s and %s are required", reasonField, requestedByField)
+	}
+	if v, ok := fields[createSnapshotField]; ok {
+		req.CreateSnapshot = v.GetBooleanValue()
+	}
+	req.Snapshot = fields[snapshotField].GetStringValue()
+	if v, ok := fields[timeField]; ok {
+		switch {
+		case v.GetTimestampValue() != nil:
+			req.Time = v.GetTimestampValue().AsTime()
+		case v.GetStringValue() != "":
+			t, err := time.Parse(time.RFC3339, v.GetStringValue())
+			if err != nil {
+				return req, fmt.Errorf("invalid %s: %w", timeField, err)
+			}
+			req.Time = t
+		}
+	}
+	if req.Snapshot != "" && !req.Time.IsZero() {
+		return req, fmt.Errorf("both %s and %s are set", snapshotField, timeField)
+	}
+
+	var err error
+	if req.Include, err = patternsField(fields, includeField); err != nil {
+		return req, err
+	}
+	if req.Exclude, err = patternsField(fields, excludeField); err != nil {
+		return req, err
+	}
+	req.IncludeLabels = labelsField(fields, includeLabelsField)
+	req.ExcludeLabels = labelsField(fields, excludeLabelsField)
+	req.DryRun = fields[dryRunField].GetBooleanValue()
+	req.Prune = fields[pruneField].GetBooleanValue()
+	if v, ok := fields[concurrencyField]; ok {
+		// Numbers written from JSON, as by the console, are doubles.
+		n := v.GetIntegerValue()
+		if n == 0 {
+			n = int64(v.GetDoubleValue())
+		}
+		if n <= 0 {
+			return req, fmt.Errorf("invalid %s %v", concurrencyField, v)
+		}
+		req.Concurrency = int(n)
+	}
+	return req, nil
+}
+
+// patternsField reads an array of subscription ID patterns.
+func patternsField(fields map[string]*firestoredata.Value, name string) ([]string, error) {
+	var patterns []string
+	for _, v := range fields[name].GetArrayValue().GetValues() {
+		pattern := v.GetStringValue()
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", name, pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// labelsField reads a map of labels.
+func labelsField(fields map[string]*firestoredata.Value, name string) map[string]string {
+	values := fields[name].GetMapValue().GetFields()
+	if len(values) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(values))
+	for k, v := range values {
+		labels[k] = v.GetStringValue()
+	}
+	return labels
+}
+
+// matchesAny reports whether the subscription ID matches one of patterns.
+func matchesAny(patterns []string, subID string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, subID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// selected reports whether the subscription with the given ID and labels is
+// selected by the filters of req.
+func (req resetRequest) selected(subID string, labels map[string]string) bool {
+	if len(req.Include) > 0 && !matchesAny(req.Include, subID) {
+		return false
+	}
+	if matchesAny(req.Exclude, subID) {
+		return false
+	}
+	for k, v := range req.IncludeLabels {
+		if labels[k] != v {
+			return false
+		}
+	}
+	for k, v := range req.ExcludeLabels {
+		if l, ok := labels[k]; ok && l == v {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshotName returns the name of the snapshot of the subscription subName
+// in the snapshot set.
+func snapshotName(set, subName string) string {
+	return fmt.Sprintf("projects/%s/snapshots/%s-%s", projectID, set, path.Base(subName))
+}
 
-	now := timestamppb.New(time.Now())
+// seekSubscriptions seeks the subscriptions of the topic selected by req, up
+// to req.Concurrency at once, snapshotting them first if it asks for it. It
+// returns the outcome for every subscription of the topic, and an error only
+// if they could not be listed.
+func seekSubscriptions(ctx context.Context, topicName string, req resetRequest) ([]subscriptionResult, error) {
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub.NewClient: %v", err)
+	}
+	defer client.Close()
 
+	listReq := &adminpb.ListTopicSubscriptionsRequest{
+		Topic: fmt.Sprintf("projects/%s/topics/%s", projectID, topicName),
+	}
+	it := client.TopicAdminClient.ListTopicSubscriptions(ctx, listReq)
+	var subNames []string
 	for {
 		subName, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("error listing topic subscriptions: %w", err)
+			return nil, fmt.Errorf("error listing topic subscriptions: %w", err)
 		}
+		subNames = append(subNames, subName)
+	}
 
-		logging.InfoF("reset", "Seeking subscription %s to %v", subName, now.AsTime())
+	now := time.Now()
+	target := req.Time
+	if target.IsZero() {
+		target = now
+	}
 
-		_, err = subAdmin.Seek(ctx, &adminpb.SeekRequest{
-			Subscription: subName,
-			Target: &adminpb.SeekRequest_Time{
-				Time: now,
-			},
+	// Snapshots of one reset share a set name, as a snapshot belongs to a
+	// single subscription.
+	var set string
+	if req.CreateSnapshot && !req.DryRun {
+		set = "reset-" + now.UTC().Format("20060102t150405")
+		logger.InfoContext(ctx, "Snapshotting subscriptions", "snapshotSet", set)
+	}
+
+	return seekAll(subNames, req.Concurrency, func(subName string) subscriptionResult {
+		return seekSubscription(ctx, client, subName, req, set, target)
+	}), nil
+}
+
+// seekAll calls seek for every subscription, up to concurrency at once, and
+// returns their results in the order of subNames.
+func seekAll(subNames []string, concurrency int, seek func(subName string) subscriptionResult) []subscriptionResult {
+	results := make([]subscriptionResult, len(subNames))
+	sem := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
+	for i, subName := range subNames {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = seek(subName)
 		})
-		if err != nil {
-			// Decide whether to continue on error or fail fast.
-			return fmt.Errorf("failed to seek subscription %s: %w", subName, err)
+	}
+	wg.Wait()
+	return results
+}
+
+// seekSubscription resets the subscription subName if req selects it,
+// snapshotting it in set first if set is not empty. Subscriptions retaining
+// acknowledged messages are skipped when pruning.
+func seekSubscription(ctx context.Context, client *pubsub.Client, subName string, req resetRequest, set string, target time.Time) subscriptionResult {
+	result := subscriptionResult{Subscription: subName}
+
+	sub := &adminpb.Subscription{Name: subName}
+	if len(req.IncludeLabels) > 0 || len(req.ExcludeLabels) > 0 || req.Prune {
+		var err error
+		if sub, err = client.SubscriptionAdminClient.GetSubscription(ctx, &adminpb.GetSubscriptionRequest{Subscription: subName}); err != nil {
+			result.Outcome, result.Err = outcomeFailed, fmt.Errorf("error reading subscription: %w", err)
+			return result
 		}
 	}
+	if !req.selected(path.Base(subName), sub.GetLabels()) {
+		result.Outcome = outcomeExcluded
+		return result
+	}
+	if req.Prune && sub.GetRetainAckedMessages() {
+		result.Outcome = outcomeSkipped
+		return result
+	}
+	if req.DryRun {
+		result.Outcome = outcomeDryRun
+		return result
+	}
 
-	return nil
+	if set != "" {
+		result.Snapshot = snapshotName(set, subName)
+		if _, err := client.SubscriptionAdminClient.CreateSnapshot(ctx, &adminpb.CreateSnapshotRequest{
+			Name:         result.Snapshot,
+			Subscription: subName,
+		}); err != nil {
+			// Not seeked: it could not be rolled back.
+			result.Outcome, result.Snapshot, result.Err = outcomeFailed, "", fmt.Errorf("error snapshotting: %w", err)
+			return result
+		}
+	}
+
+	seek := &adminpb.SeekRequest{Subscription: subName}
+	if req.Snapshot != "" {
+		logger.InfoContext(ctx, "Seeking subscription to snapshot set", "subscription", subName, "snapshotSet", req.Snapshot)
+		seek.Target = &adminpb.SeekRequest_Snapshot{Snapshot: snapshotName(req.Snapshot, subName)}
+	} else {
+		logger.InfoContext(ctx, "Seeking subscription", "subscription", subName, "time", target)
+		seek.Target = &adminpb.SeekRequest_Time{Time: timestamppb.New(target)}
+	}
+	if _, err := client.SubscriptionAdminClient.Seek(ctx, seek); err != nil {
+		result.Outcome, result.Err = outcomeFailed, fmt.Errorf("error seeking: %w", err)
+		return result
+	}
+	result.Outcome = outcomeSeeked
+	return result
 }
@@ -0,0 +1,377 @@
+package reset
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	adminpb "cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/v2/pstest"
+	"example.com/shared/store"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// setConfig sets the configuration read by the function for the test.
+func setConfig(t *testing.T) {
+	t.Helper()
+	saved := []string{projectID, firestoreDatabase, topicName, triggerResetName, createSnapshotEnv, concurrencyEnv}
+	t.Cleanup(func() {
+		projectID, firestoreDatabase, topicName, triggerResetName, createSnapshotEnv, concurrencyEnv =
+			saved[0], saved[1], saved[2], saved[3], saved[4], saved[5]
+	})
+	projectID, firestoreDatabase, topicName, triggerResetName = "p", "(default)", "updates", "trigger"
+	createSnapshotEnv, concurrencyEnv = "", ""
+}
+
+func stringValue(s string) *firestoredata.Value {
+	return &firestoredata.Value{ValueType: &firestoredata.Value_StringValue{StringValue: s}}
+}
+
+func boolValue(b bool) *firestoredata.Value {
+	return &firestoredata.Value{ValueType: &firestoredata.Value_BooleanValue{BooleanValue: b}}
+}
+
+func arrayValue(values ...string) *firestoredata.Value {
+	array := &firestoredata.ArrayValue{}
+	for _, v := range values {
+		array.Values = append(array.Values, stringValue(v))
+	}
+	return &firestoredata.Value{ValueType: &firestoredata.Value_ArrayValue{ArrayValue: array}}
+}
+
+func mapValue(labels map[string]string) *firestoredata.Value {
+	fields := make(map[string]*firestoredata.Value, len(labels))
+	for k, v := range labels {
+		fields[k] = stringValue(v)
+	}
+	return &firestoredata.Value{ValueType: &firestoredata.Value_MapValue{MapValue: &firestoredata.MapValue{Fields: fields}}}
+}
+
+// triggerData encodes a write of the trigger document with the given fields,
+// or its deletion if fields is nil.
+func triggerData(t *testing.T, fields map[string]*firestoredata.Value) []byte {
+	t.Helper()
+	data := &firestoredata.DocumentEventData{}
+	if fields != nil {
+		data.Value = &firestoredata.Document{Fields: fields}
+	}
+	b, err := proto.Marshal(data)
+	if err != nil {
+		t.Fatalf("proto.Marshal: %v", err)
+	}
+	return b
+}
+
+func TestCheckEvent(t *testing.T) {
+	setConfig(t)
+	source := "//firestore.googleapis.com/projects/p/databases/(default)"
+	tests := []struct {
+		name, typ, source, subject string
+		ok                         bool
+	}{
+		{"written", "google.cloud.firestore.document.v1.written", source, "documents/trigger/trigger", true},
+		{"created", "google.cloud.firestore.document.v1.created", source, "documents/trigger/trigger", true},
+		{"updated", "google.cloud.firestore.document.v1.updated", source, "documents/trigger/trigger", true},
+		{"deleted", "google.cloud.firestore.document.v1.deleted", source, "documents/trigger/trigger", false},
+		{"other database", "google.cloud.firestore.document.v1.written", "//firestore.googleapis.com/projects/p/databases/other", "documents/trigger/trigger", false},
+		{"other project", "google.cloud.firestore.document.v1.written", "//firestore.googleapis.com/projects/q/databases/(default)", "documents/trigger/trigger", false},
+		{"other document", "google.cloud.firestore.document.v1.written", source, "documents/trigger/other", false},
+		{"chunk", "google.cloud.firestore.document.v1.written", source, "documents/canvas_chunks/canvas_chunks_0_0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := event.New()
+			e.SetType(tt.typ)
+			e.SetSource(tt.source)
+			e.SetSubject(tt.subject)
+			if err := checkEvent(e); (err == nil) != tt.ok {
+				t.Errorf("checkEvent = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseResetRequest(t *testing.T) {
+	setConfig(t)
+	at := time.Date(2025, 6, 1, 18, 0, 0, 0, time.UTC)
+	base := func(extra map[string]*firestoredata.Value) map[string]*firestoredata.Value {
+		fields := map[string]*firestoredata.Value{
+			reasonField:      stringValue("replay"),
+			requestedByField: stringValue("admin"),
+		}
+		for k, v := range extra {
+			fields[k] = v
+		}
+		return fields
+	}
+	tests := []struct {
+		name        string
+		fields      map[string]*firestoredata.Value
+		snapshotEnv string
+		want        resetRequest
+		wantErr     bool
+	}{{
+		name:   "defaults",
+		fields: base(nil),
+		want:   resetRequest{Reason: "replay", RequestedBy: "admin", Concurrency: defaultConcurrency},
+	}, {
+		name:    "deleted",
+		wantErr: true,
+	}, {
+		name:    "missing reason",
+		fields:  map[string]*firestoredata.Value{requestedByField: stringValue("admin")},
+		wantErr: true,
+	}, {
+		name:    "missing requester",
+		fields:  map[string]*firestoredata.Value{reasonField: stringValue("replay")},
+		wantErr: true,
+	}, {
+		name:   "time as timestamp",
+		fields: base(map[string]*firestoredata.Value{timeField: {ValueType: &firestoredata.Value_TimestampValue{TimestampValue: timestamppb.New(at)}}}),
+		want:   resetRequest{Reason: "replay", RequestedBy: "admin", Concurrency: defaultConcurrency, Time: at},
+	}, {
+		name:   "time as string",
+		fields: base(map[string]*firestoredata.Value{timeField: stringValue("2025-06-01T18:00:00Z")}),
+		want:   resetRequest{Reason: "replay", RequestedBy: "admin", Concurrency: defaultConcurrency, Time: at},
+	}, {
+		name:    "invalid time",
+		fields:  base(map[string]*firestoredata.Value{timeField: stringValue("yesterday")}),
+		wantErr: true,
+	}, {
+		name:    "snapshot and time",
+		fields:  base(map[string]*firestoredata.Value{snapshotField: stringValue("reset-1"), timeField: stringValue("2025-06-01T18:00:00Z")}),
+		wantErr: true,
+	}, {
+		name:        "snapshot from the environment, overridden",
+		fields:      base(map[string]*firestoredata.Value{createSnapshotField: boolValue(false)}),
+		snapshotEnv: "true",
+		want:        resetRequest{Reason: "replay", RequestedBy: "admin", Concurrency: defaultConcurrency},
+	}, {
+		name:        "snapshot from the environment",
+		fields:      base(nil),
+		snapshotEnv: "true",
+		want:        resetRequest{Reason: "replay", RequestedBy: "admin", Concurrency: defaultConcurrency, CreateSnapshot: true},
+	}, {
+		name: "filters",
+		fields: base(map[string]*firestoredata.Value{
+			includeField:       arrayValue("web-*"),
+			excludeField:       arrayValue("web-debug"),
+			includeLabelsField: mapValue(map[string]string{"env": "prod"}),
+			excludeLabelsField: mapValue(map[string]string{"keep": "true"}),
+			dryRunField:        boolValue(true),
+			pruneField:         boolValue(true),
+		}),
+		want: resetRequest{
+			Reason: "replay", RequestedBy: "admin", Concurrency: defaultConcurrency,
+			Include: []string{"web-*"}, Exclude: []string{"web-debug"},
+			IncludeLabels: map[string]string{"env": "prod"}, ExcludeLabels: map[string]string{"keep": "true"},
+			DryRun: true, Prune: true,
+		},
+	}, {
+		name:    "invalid pattern",
+		fields:  base(map[string]*firestoredata.Value{includeField: arrayValue("[")}),
+		wantErr: true,
+	}, {
+		name:   "concurrency as integer",
+		fields: base(map[string]*firestoredata.Value{concurrencyField: {ValueType: &firestoredata.Value_IntegerValue{IntegerValue: 8}}}),
+		want:   resetRequest{Reason: "replay", RequestedBy: "admin", Concurrency: 8},
+	}, {
+		name:   "concurrency as double",
+		fields: base(map[string]*firestoredata.Value{concurrencyField: {ValueType: &firestoredata.Value_DoubleValue{DoubleValue: 2}}}),
+		want:   resetRequest{Reason: "replay", RequestedBy: "admin", Concurrency: 2},
+	}, {
+		name:    "invalid concurrency",
+		fields:  base(map[string]*firestoredata.Value{concurrencyField: {ValueType: &firestoredata.Value_IntegerValue{IntegerValue: -1}}}),
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			createSnapshotEnv = tt.snapshotEnv
+			got, err := parseResetRequest(triggerData(t, tt.fields))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseResetRequest = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseResetRequest: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseResetRequest = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelected(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    resetRequest
+		subID  string
+		labels map[string]string
+		want   bool
+	}{
+		{name: "no filter", subID: "web-1", want: true},
+		{name: "included", req: resetRequest{Include: []string{"web-*"}}, subID: "web-1", want: true},
+		{name: "not included", req: resetRequest{Include: []string{"web-*"}}, subID: "mobile-1", want: false},
+		{name: "excluded", req: resetRequest{Include: []string{"web-*"}, Exclude: []string{"web-debug"}}, subID: "web-debug", want: false},
+		{name: "labels included", req: resetRequest{IncludeLabels: map[string]string{"env": "prod"}}, subID: "a", labels: map[string]string{"env": "prod", "team": "x"}, want: true},
+		{name: "label missing", req: resetRequest{IncludeLabels: map[string]string{"env": "prod"}}, subID: "a", labels: map[string]string{"team": "x"}, want: false},
+		{name: "label differs", req: resetRequest{IncludeLabels: map[string]string{"env": "prod"}}, subID: "a", labels: map[string]string{"env": "dev"}, want: false},
+		{name: "labels excluded", req: resetRequest{ExcludeLabels: map[string]string{"keep": "true"}}, subID: "a", labels: map[string]string{"keep": "true"}, want: false},
+		{name: "excluded label differs", req: resetRequest{ExcludeLabels: map[string]string{"keep": "true"}}, subID: "a", labels: map[string]string{"keep": "false"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.req.selected(tt.subID, tt.labels); got != tt.want {
+				t.Errorf("selected = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeekAllBoundsConcurrency(t *testing.T) {
+	var subNames []string
+	for i := range 20 {
+		subNames = append(subNames, fmt.Sprintf("projects/p/subscriptions/s%d", i))
+	}
+	var mu sync.Mutex
+	running, peak := 0, 0
+	results := seekAll(subNames, 3, func(subName string) subscriptionResult {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return subscriptionResult{Subscription: subName, Outcome: outcomeSeeked}
+	})
+	if peak > 3 {
+		t.Errorf("%d subscriptions seeked at once, want at most 3", peak)
+	}
+	for i, r := range results {
+		if r.Subscription != subNames[i] {
+			t.Errorf("result %d is for %s, want %s", i, r.Subscription, subNames[i])
+		}
+	}
+}
+
+// failingSeeks fails the seeks of the subscriptions whose ID starts with
+// "broken", and acknowledges the others.
+type failingSeeks struct{}
+
+func (failingSeeks) React(req any) (bool, any, error) {
+	seek, ok := req.(*adminpb.SeekRequest)
+	if !ok {
+		return false, nil, nil
+	}
+	if strings.HasPrefix(path.Base(seek.GetSubscription()), "broken") {
+		return true, nil, status.Error(codes.FailedPrecondition, "seek failed")
+	}
+	return true, &adminpb.SeekResponse{}, nil
+}
+
+// fakePubSub serves the topic with the given subscriptions from an in-process
+// Pub/Sub server, found by seekSubscriptions through PUBSUB_EMULATOR_HOST.
+func fakePubSub(t *testing.T, subs map[string]*adminpb.Subscription) {
+	t.Helper()
+	srv := pstest.NewServer(pstest.ServerReactorOption{FuncName: "Seek", Reactor: failingSeeks{}})
+	t.Cleanup(func() { srv.Close() })
+	t.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		t.Fatalf("pubsub.NewClient: %v", err)
+	}
+	defer client.Close()
+	topic := fmt.Sprintf("projects/%s/topics/%s", projectID, topicName)
+	if _, err := client.TopicAdminClient.CreateTopic(ctx, &adminpb.Topic{Name: topic}); err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	for id, sub := range subs {
+		sub.Name = fmt.Sprintf("projects/%s/subscriptions/%s", projectID, id)
+		sub.Topic = topic
+		if _, err := client.SubscriptionAdminClient.CreateSubscription(ctx, sub); err != nil {
+			t.Fatalf("CreateSubscription: %v", err)
+		}
+	}
+}
+
+// outcomes returns the outcome of each subscription by ID.
+func outcomes(results []subscriptionResult) map[string]string {
+	out := make(map[string]string, len(results))
+	for _, r := range results {
+		out[path.Base(r.Subscription)] = r.Outcome
+	}
+	return out
+}
+
+func TestSeekSubscriptions(t *testing.T) {
+	setConfig(t)
+	fakePubSub(t, map[string]*adminpb.Subscription{
+		"web-1":    {},
+		"web-2":    {Labels: map[string]string{"keep": "true"}},
+		"retained": {RetainAckedMessages: true},
+		"broken-1": {},
+		"broken-2": {},
+	})
+	ctx := context.Background()
+
+	t.Run("dry run", func(t *testing.T) {
+		results, err := seekSubscriptions(ctx, topicName, resetRequest{DryRun: true, Include: []string{"web-*"}, Concurrency: 2})
+		if err != nil {
+			t.Fatalf("seekSubscriptions: %v", err)
+		}
+		want := map[string]string{"web-1": outcomeDryRun, "web-2": outcomeDryRun, "retained": outcomeExcluded, "broken-1": outcomeExcluded, "broken-2": outcomeExcluded}
+		if got := outcomes(results); !reflect.DeepEqual(got, want) {
+			t.Errorf("outcomes = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("failures reported together", func(t *testing.T) {
+		results, err := seekSubscriptions(ctx, topicName, resetRequest{
+			ExcludeLabels: map[string]string{"keep": "true"},
+			Prune:         true,
+			Concurrency:   2,
+		})
+		if err != nil {
+			t.Fatalf("seekSubscriptions: %v", err)
+		}
+		want := map[string]string{"web-1": outcomeSeeked, "web-2": outcomeExcluded, "retained": outcomeSkipped, "broken-1": outcomeFailed, "broken-2": outcomeFailed}
+		if got := outcomes(results); !reflect.DeepEqual(got, want) {
+			t.Errorf("outcomes = %v, want %v", got, want)
+		}
+
+		entry := &store.AuditEntry{}
+		err = reportResults(ctx, entry, results)
+		if err == nil || !strings.Contains(err.Error(), "failed to reset 2 subscriptions") {
+			t.Fatalf("reportResults = %v, want both failures", err)
+		}
+		for _, id := range []string{"broken-1", "broken-2"} {
+			if !strings.Contains(err.Error(), id) {
+				t.Errorf("error %q does not name %s", err, id)
+			}
+			if !strings.HasPrefix(entry.Details[id], outcomeFailed+": ") {
+				t.Errorf("audit detail of %s = %q, want the failure", id, entry.Details[id])
+			}
+		}
+		if entry.Details["web-1"] != outcomeSeeked {
+			t.Errorf("audit detail of web-1 = %q, want %s", entry.Details["web-1"], outcomeSeeked)
+		}
+	})
+}
@@ -2,38 +2,77 @@ package update
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"path"
 	"strconv"
-	"strings"
 	"time"
 
-	pubsub "cloud.google.com/go/pubsub/v2"
-	"example.com/logging"
+	"example.com/shared/bus"
+	"example.com/shared/canvas"
+	"example.com/shared/logging"
+	"example.com/shared/message"
+	"example.com/shared/metrics"
+	"example.com/shared/store"
+	"example.com/shared/tracing"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/cloudevents/sdk-go/v2/event"
 	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 )
 
 var (
-	projectID string
-	topicID   string
+	projectID       string
+	topicID         string
+	busBackend      string
+	natsURL         string
+	deadLetterTopic string
+	metricsExporter string
+	tracesExporter  string
+	logger          *slog.Logger
 )
 
+// openBus connects to the message bus the chunk updates are published on.
+var openBus = func(ctx context.Context) (bus.Publisher, error) {
+	return bus.Open(ctx, bus.Config{
+		Backend:   busBackend,
+		ProjectID: projectID,
+		NATSURL:   natsURL,
+	})
+}
+
 func init() {
 	projectID = os.Getenv("PROJECT_ID")
 	topicID = os.Getenv("PIXEL_UPDATE_TOPIC")
+	busBackend = os.Getenv("BUS_BACKEND")
+	natsURL = os.Getenv("NATS_URL")
+	deadLetterTopic = os.Getenv("DEAD_LETTER_TOPIC")
+	metricsExporter = os.Getenv("METRICS_EXPORTER")
+	tracesExporter = os.Getenv("TRACES_EXPORTER")
+	logger = logging.New(logging.ConfigFromEnv(projectID, "update"))
+	if err := metrics.Setup(context.Background(), metrics.Config{Exporter: metricsExporter, ServiceName: "update"}); err != nil {
+		logger.Error("Error setting up metrics", "error", err)
+	}
+	if err := tracing.Setup(context.Background(), tracing.Config{Exporter: tracesExporter, ServiceName: "update"}); err != nil {
+		logger.Error("Error setting up tracing", "error", err)
+	}
 	log.SetFlags(0)
 
 	functions.CloudEvent("updatedPixel", updatedPixel)
 }
 
 func updatedPixel(ctx context.Context, event event.Event) error {
+	reason := metrics.ReasonOK
+	defer func() { metrics.Handled(ctx, "update", reason) }()
+
 	if projectID == "" || topicID == "" {
+		reason = "config_error"
 		return fmt.Errorf("environment variables are not set")
 	}
 
@@ -45,53 +84,75 @@ func updatedPixel(ctx context.Context, event event.Event) error {
 	err := options.Unmarshal(event.Data(), &data)
 
 	if err != nil {
-		return fmt.Errorf("proto.Unmarshal: %w", err)
+		reason = "invalid_event"
+		return reject(ctx, event, bus.Permanent(reason, fmt.Errorf("proto.Unmarshal: %w", err)))
 	}
 
-	logging.InfoF("update", "Function triggered by change to: %v", event.Source())
-
+	// Chunks record the trace of the placement that last wrote them.
 	doc := data.GetValue()
+	ctx = tracing.Extract(ctx, map[string]string{
+		logging.TraceParentAttribute: doc.GetFields()["trace"].GetStringValue(),
+	})
+	ctx, span := tracing.Tracer().Start(ctx, "updatedPixel", trace.WithSpanKind(trace.SpanKindConsumer))
+	defer func() { tracing.EndWithReason(span, reason) }()
+
+	logger.InfoContext(ctx, "Function triggered by document change", "source", event.Source(), "subject", event.Subject())
+
 	if doc == nil {
-		logging.Info("update", "No new document value; nothing to publish")
+		logger.InfoContext(ctx, "No new document value; nothing to publish")
+		reason = "no_document"
 		return nil
 	}
+	ctx = logging.With(ctx, "chunk", path.Base(doc.GetName()))
+
+	canvasID, _, _, err := canvas.ParseChunkPath(doc.GetName())
+	if err != nil {
+		reason = "invalid_document"
+		return reject(ctx, event, bus.Permanent(reason, err))
+	}
+	ctx = logging.With(ctx, "canvas", canvasID)
 
 	jsonBytes, err := protojson.Marshal(doc)
 	if err != nil {
-		return fmt.Errorf("protojson.Marshal: %w", err)
+		reason = "invalid_document"
+		return reject(ctx, event, bus.Permanent(reason, fmt.Errorf("protojson.Marshal: %w", err)))
 	}
 
 	payload, err := buildChunkPayload(jsonBytes)
 	if err != nil {
-		return fmt.Errorf("buildChunkPayload: %w", err)
+		reason = "invalid_document"
+		return reject(ctx, event, bus.Permanent(reason, fmt.Errorf("buildChunkPayload: %w", err)))
 	}
 
-	logging.InfoF("update", "Payload: %s", payload)
+	logger.DebugContext(ctx, "Payload", "payload", string(payload))
 
-	if err := publishChunk(ctx, payload, projectID, topicID); err != nil {
+	if err := publishChunk(ctx, payload, topicID, canvasID); err != nil {
+		reason = "publish_error"
 		return fmt.Errorf("publishChunk: %w", err)
 	}
 
 	return nil
 }
 
-func parseChunkName(name string) (int, int, error) {
-	base := strings.TrimPrefix(name, "canvas_chunks_")
-	parts := strings.Split(base, "_")
-	if len(parts) != 2 {
-		return 0, 0, fmt.Errorf("invalid chunk name: %s", name)
-	}
-
-	x, err := strconv.Atoi(parts[0])
-	if err != nil {
-		return 0, 0, fmt.Errorf("invalid x in chunk name: %w", err)
-	}
-	y, err := strconv.Atoi(parts[1])
-	if err != nil {
-		return 0, 0, fmt.Errorf("invalid y in chunk name: %w", err)
+// reject acknowledges an event that failed permanently, so it is not retried,
+// after publishing its data on the dead-letter topic. If that publish fails
+// the error is returned for the event to be retried.
+func reject(ctx context.Context, event event.Event, err error) error {
+	logger.ErrorContext(ctx, "Rejecting event", "error", err)
+	var pub bus.Publisher
+	if deadLetterTopic != "" {
+		msgBus, err := openBus(ctx)
+		if err != nil {
+			return fmt.Errorf("openBus: %w", err)
+		}
+		defer msgBus.Close()
+		pub = msgBus
 	}
-
-	return x, y, nil
+	_, err = bus.Reject(ctx, logger, "update", pub, deadLetterTopic, event.Source(), &bus.Message{
+		ID:   event.ID(),
+		Data: event.Data(),
+	}, err)
+	return err
 }
 
 func buildChunkPayload(docJSON []byte) ([]byte, error) {
@@ -101,17 +162,9 @@ func buildChunkPayload(docJSON []byte) ([]byte, error) {
 	}
 
 	docName, _ := root["name"].(string)
-	var chunkX, chunkY int
-	if docName != "" {
-		lastSlash := strings.LastIndex(docName, "/")
-		shortName := docName
-		if lastSlash != -1 && lastSlash+1 < len(docName) {
-			shortName = docName[lastSlash+1:]
-		}
-
-		if x, y, err := parseChunkName(shortName); err == nil {
-			chunkX, chunkY = x, y
-		}
+	canvasID, chunkX, chunkY, err := canvas.ParseChunkPath(docName)
+	if err != nil {
+		return nil, err
 	}
 
 	fields, ok := root["fields"].(map[string]any)
@@ -128,8 +181,12 @@ func buildChunkPayload(docJSON []byte) ([]byte, error) {
 		}
 	}
 
-	pixels := map[string]any{}
-	if pField, ok := fields["pixels"].(map[string]any); ok {
+	pixels := map[string]message.ChunkPixel{}
+	if stringField(fields, "format") == string(store.FormatPacked) {
+		if pixels, err = packedPixels(fields, size); err != nil {
+			return nil, err
+		}
+	} else if pField, ok := fields["pixels"].(map[string]any); ok {
 		mv, ok := pField["mapValue"].(map[string]any)
 		if !ok {
 			mv, _ = pField["map_value"].(map[string]any)
@@ -169,15 +226,27 @@ func buildChunkPayload(docJSON []byte) ([]byte, error) {
 						}
 					}
 
-					pixels[key] = map[string]any{
-						"color": colorVal,
-						"user":  userVal,
+					pixels[key] = message.ChunkPixel{
+						Color: uint8(colorVal),
+						User:  userVal,
 					}
 				}
 			}
 		}
 	}
 
+	var shards, shard int
+	if f, ok := fields["shards"].(map[string]any); ok {
+		if v, err := toInt64(f["integerValue"]); err == nil {
+			shards = int(v)
+		}
+	}
+	if f, ok := fields["shard"].(map[string]any); ok {
+		if v, err := toInt64(f["integerValue"]); err == nil {
+			shard = int(v)
+		}
+	}
+
 	lastUpdated := ""
 	if lv, ok := fields["lastUpdated"].(map[string]any); ok {
 		if ts, ok := lv["timestampValue"].(string); ok {
@@ -192,18 +261,81 @@ func buildChunkPayload(docJSON []byte) ([]byte, error) {
 		}
 	}
 
-	out := map[string]any{
-		"size":   size,
-		"pixels": pixels,
-		"chunkX": chunkX,
-		"chunkY": chunkY,
+	return json.Marshal(message.ChunkUpdate{
+		Canvas:      canvasID,
+		ChunkX:      chunkX,
+		ChunkY:      chunkY,
+		Size:        size,
+		Pixels:      pixels,
+		LastUpdated: lastUpdated,
+		Shards:      shards,
+		Shard:       shard,
+	})
+}
+
+// packedPixels decodes the pixels of a chunk document in the packed format.
+func packedPixels(fields map[string]any, size int32) (map[string]message.ChunkPixel, error) {
+	c := &store.PackedChunk{Size: size}
+	var err error
+	if c.Colors, err = bytesField(fields, "colors"); err != nil {
+		return nil, err
+	}
+	if c.Owners, err = bytesField(fields, "owners"); err != nil {
+		return nil, err
+	}
+	if c.PlacedAt, err = bytesField(fields, "placedAt"); err != nil {
+		return nil, err
+	}
+	if uField, ok := fields["users"].(map[string]any); ok {
+		av, ok := uField["arrayValue"].(map[string]any)
+		if !ok {
+			av, _ = uField["array_value"].(map[string]any)
+		}
+		values, _ := av["values"].([]any)
+		for _, v := range values {
+			vm, _ := v.(map[string]any)
+			user, err := toInt64(vm["integerValue"])
+			if err != nil {
+				user, _ = toInt64(vm["integer_value"])
+			}
+			c.Users = append(c.Users, user)
+		}
+	}
+
+	stored, err := c.Unpack()
+	if err != nil {
+		return nil, err
+	}
+	pixels := make(map[string]message.ChunkPixel, len(stored))
+	for key, p := range stored {
+		pixels[key] = message.ChunkPixel{Color: p.Color, User: p.User}
 	}
+	return pixels, nil
+}
 
-	if lastUpdated != "" {
-		out["lastUpdated"] = lastUpdated
+// stringField returns the string value of a document field, if any.
+func stringField(fields map[string]any, name string) string {
+	f, _ := fields[name].(map[string]any)
+	if v, ok := f["stringValue"].(string); ok {
+		return v
 	}
+	v, _ := f["string_value"].(string)
+	return v
+}
 
-	return json.Marshal(out)
+// bytesField returns the bytes value of a document field, base64 encoded in
+// the document JSON.
+func bytesField(fields map[string]any, name string) ([]byte, error) {
+	f, _ := fields[name].(map[string]any)
+	v, ok := f["bytesValue"].(string)
+	if !ok {
+		v, _ = f["bytes_value"].(string)
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return b, nil
 }
 
 func toInt64(v any) (int64, error) {
@@ -224,25 +356,25 @@ func toInt64(v any) (int64, error) {
 	}
 }
 
-func publishChunk(ctx context.Context, payload []byte, projectID string, topicID string) error {
-	client, err := pubsub.NewClient(ctx, projectID)
+func publishChunk(ctx context.Context, payload []byte, topicID, canvasID string) error {
+	msgBus, err := openBus(ctx)
 	if err != nil {
-		return fmt.Errorf("pubsub.NewClient: %w", err)
+		return fmt.Errorf("openBus: %w", err)
 	}
-	defer client.Close()
-
-	logging.InfoF("update", "Publishing chunk to topic %s", topicID)
+	defer msgBus.Close()
 
-	topic := client.Publisher(topicID)
-	defer topic.Stop()
+	logger.InfoContext(ctx, "Publishing chunk", "topic", topicID)
 
-	msgID, err := topic.Publish(ctx, &pubsub.Message{
-		Data: payload,
-	}).Get(ctx)
+	start := time.Now()
+	msgID, err := msgBus.Publish(ctx, topicID, &bus.Message{
+		Data:       payload,
+		Attributes: message.CanvasAttributes(canvasID),
+	})
+	metrics.Published(ctx, "update", topicID, start, err)
 	if err != nil {
-		return fmt.Errorf("topic.Publish: %w", err)
+		return fmt.Errorf("bus.Publish: %w", err)
 	}
 
-	logging.InfoF("update", "Published chunk with message ID: %s", msgID)
+	logger.InfoContext(ctx, "Published chunk", "messageId", msgID)
 	return nil
 }
@@ -1,53 +1,91 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"time"
 
-	"cloud.google.com/go/firestore"
-	"cloud.google.com/go/pubsub/v2"
-	"example.com/logging"
+	"example.com/shared/bus"
+	"example.com/shared/canvas"
+	"example.com/shared/logging"
+	"example.com/shared/message"
+	"example.com/shared/metrics"
+	"example.com/shared/store"
+	"example.com/shared/tracing"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type PubSubMessage struct {
-	Message struct {
-		Data       string            `json:"data"`
-		Attributes map[string]string `json:"attributes"`
-		MessageID  string            `json:"messageId"`
-	} `json:"message"`
-	Subscription string `json:"subscription"`
-}
-
-type PixelInfo struct {
-	X         int32  `json:"x"`
-	Y         int32  `json:"y"`
-	Color     uint32 `json:"color"`
-	User      string `json:"user"`
-	Timestamp string `json:"timestamp"`
-}
-
 var (
 	projectId         string
 	firestoreDatabase string
 	userCollection    string
 	rateLimit         string
-	rateLimitDuration time.Duration
 	drawPixelTopicID  string
+	storeBackend      string
+	sqlitePath        string
+	busBackend        string
+	natsURL           string
+	metricsExporter   string
+	tracesExporter    string
+	canvases          canvas.Canvases
+	canvasesErr       error
+	logger            *slog.Logger
+
+	// metaCache holds the metadata of the canvases, which bounds them once
+	// they were expanded.
+	metaCache = store.NewMetaCache(store.DefaultMetaTTL)
 )
 
+// openStore opens the canvas store used to look up users.
+var openStore = func(ctx context.Context) (store.CanvasStore, error) {
+	return store.Open(ctx, store.Config{
+		Backend:        storeBackend,
+		ProjectID:      projectId,
+		Database:       firestoreDatabase,
+		UserCollection: userCollection,
+		SQLitePath:     sqlitePath,
+	})
+}
+
+// openBus connects to the message bus the draw requests are published on.
+var openBus = func(ctx context.Context) (bus.Publisher, error) {
+	return bus.Open(ctx, bus.Config{
+		Backend:   busBackend,
+		ProjectID: projectId,
+		NATSURL:   natsURL,
+	})
+}
+
 func init() {
 	projectId = os.Getenv("PROJECT_ID")
 	firestoreDatabase = os.Getenv("FIRESTORE_DATABASE")
+	storeBackend = os.Getenv("STORE_BACKEND")
+	sqlitePath = os.Getenv("SQLITE_PATH")
+	busBackend = os.Getenv("BUS_BACKEND")
+	natsURL = os.Getenv("NATS_URL")
 	userCollection = os.Getenv("USER_COLLECTION")
 	rateLimit = os.Getenv("RATE_LIMIT")
 	drawPixelTopicID = os.Getenv("DRAW_PIXEL_TOPIC")
-	rateLimitDuration = time.Duration(0)
+	metricsExporter = os.Getenv("METRICS_EXPORTER")
+	tracesExporter = os.Getenv("TRACES_EXPORTER")
+	logger = logging.New(logging.ConfigFromEnv(projectId, "proxy"))
+	if err := metrics.Setup(context.Background(), metrics.Config{Exporter: metricsExporter, ServiceName: "proxy"}); err != nil {
+		logger.Error("Error setting up metrics", "error", err)
+	}
+	if err := tracing.Setup(context.Background(), tracing.Config{Exporter: tracesExporter, ServiceName: "proxy"}); err != nil {
+		logger.Error("Error setting up tracing", "error", err)
+	}
+	if canvases, canvasesErr = canvas.FromEnv(); canvasesErr != nil {
+		logger.Error("Error reading canvases", "error", canvasesErr)
+	}
 
 	log.SetFlags(0)
 	functions.HTTP("proxyInterface", publishDraw)
@@ -65,115 +103,167 @@ func publishDraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx, span := tracing.Tracer().Start(tracing.ExtractHTTP(r.Context(), r), "proxyInterface",
+		trace.WithSpanKind(trace.SpanKindServer))
+	ctx = logging.With(ctx, logging.HTTPRequest(r))
+
+	reason := metrics.ReasonOK
+	defer func() {
+		metrics.Handled(ctx, "proxy", reason)
+		tracing.EndWithReason(span, reason)
+	}()
+
 	if projectId == "" || firestoreDatabase == "" || userCollection == "" || rateLimit == "" {
+		reason = "config_error"
 		http.Error(w, "Environment variables are not set", http.StatusInternalServerError)
 		return
 	}
 
-	if rateLimitDuration == 0 {
-		var err error
-		rateLimitDuration, err = time.ParseDuration(rateLimit)
-		if err != nil {
-			logging.Error("proxy", "Error parsing rate limit", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
+	if canvasesErr != nil {
+		logger.ErrorContext(ctx, "Error reading canvases", "error", canvasesErr)
+		reason = "config_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
-	logging.Info("proxy", "Publish Draw function started")
-	ctx := r.Context()
-	c, err := pubsub.NewClient(ctx, projectId)
+	logger.InfoContext(ctx, "Publish Draw function started")
+	msgBus, err := openBus(ctx)
 	if err != nil {
-		logging.Error("proxy", "Error while retrieving Gcloud Profile", err)
+		logger.ErrorContext(ctx, "Error connecting to message bus", "error", err)
+		reason = "bus_error"
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	defer c.Close()
+	defer msgBus.Close()
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		logging.Error("proxy", "Error while reading the request body", err)
+		logger.ErrorContext(ctx, "Error while reading the request body", "error", err)
+		reason = "read_error"
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
 
 	if !json.Valid(body) {
-		logging.ErrorF("proxy", "Error: messageData is not valid JSON: %s", string(body))
+		logger.ErrorContext(ctx, "Error: messageData is not valid JSON", "size", len(body))
+		reason = "invalid_json"
+		logger.DebugContext(ctx, "Invalid request body", "body", string(body))
 		http.Error(w, "Invalid JSON data", http.StatusBadRequest)
 		return
 	}
 
-	var pixelInfo PixelInfo
+	var pixelInfo message.PixelInfo
 	if err := json.Unmarshal(body, &pixelInfo); err != nil {
-		logging.Error("proxy", "Error while deserialize pixel info from body", err)
+		logger.ErrorContext(ctx, "Error while deserialize pixel info from body", "error", err)
+		reason = "invalid_body"
 		http.Error(w, "Bad Request: invalid body", http.StatusBadRequest)
 		return
 	}
+	ctx = logging.With(ctx, "user", pixelInfo.User, "canvas", pixelInfo.Canvas)
+
+	canvasConfig, err := canvases.Get(pixelInfo.Canvas)
+	if err != nil {
+		logger.WarnContext(ctx, "Unknown canvas", "error", err)
+		reason = "unknown_canvas"
+		http.Error(w, "Bad Request: unknown canvas", http.StatusBadRequest)
+		return
+	}
 
-	firestoreClient, err := firestore.NewClientWithDatabase(ctx, projectId, firestoreDatabase)
+	st, err := openStore(ctx)
 	if err != nil {
-		logging.Error("proxy", "Error creating Firestore client", err)
+		logger.ErrorContext(ctx, "Error opening canvas store", "error", err)
+		reason = "store_error"
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	defer firestoreClient.Close()
+	defer st.Close()
 
-	userDoc, err := firestoreClient.Collection(userCollection).Doc(pixelInfo.User).Get(ctx)
+	meta, err := metaCache.Get(ctx, st, pixelInfo.Canvas)
 	if err != nil {
-		logging.InfoF("proxy", "User document not found for user %s, allowing request", pixelInfo.User)
-	} else {
-		lastUpdated, ok := userDoc.Data()["lastUpdated"]
-		if ok {
-			var lastUpdatedTime time.Time
-			switch v := lastUpdated.(type) {
-			case time.Time:
-				lastUpdatedTime = v
-			case *time.Time:
-				if v != nil {
-					lastUpdatedTime = *v
-				}
-			default:
-				logging.WarningF("proxy", "Unexpected type for lastUpdated: %T, value: %v", v, v)
-			}
-			if !lastUpdatedTime.IsZero() {
-				timeDiff := time.Since(lastUpdatedTime)
-				if timeDiff < rateLimitDuration {
-					logging.WarningF("proxy", "Rate limit exceeded: last update was %v ago (limit: %v)", timeDiff, rateLimitDuration)
-					data := map[string]any{
-						"lastUpdated": lastUpdatedTime.Format(time.RFC3339),
-					}
-					jsonData, err := json.Marshal(data)
-					if err != nil {
-						logging.Error("proxy", "Error marshalling data", err)
-						http.Error(w, "Internal server error", http.StatusInternalServerError)
-						return
-					}
-					http.Error(w, string(jsonData), http.StatusForbidden)
-					return
-				}
-			}
+		logger.ErrorContext(ctx, "Error reading canvas metadata", "error", err)
+		reason = "store_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	canvasConfig.Bounds = meta.Bounds(canvasConfig.Bounds, time.Now())
+
+	if err := pixelInfo.Validate(canvasConfig); err != nil {
+		logger.WarnContext(ctx, "Invalid pixel", "error", err)
+		reason = "invalid_pixel"
+		http.Error(w, "Bad Request: invalid pixel", http.StatusBadRequest)
+		return
+	}
+
+	if lastUpdated, limited := rateLimited(ctx, st, pixelInfo.Canvas, pixelInfo.User, canvasConfig.Cooldown); limited {
+		reason = "rate_limited"
+		data := map[string]any{
+			"lastUpdated": lastUpdated.Format(time.RFC3339),
+		}
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error marshalling data", "error", err)
+			reason = "internal_error"
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
+		http.Error(w, string(jsonData), http.StatusForbidden)
+		return
 	}
 
-	topic := c.Publisher(drawPixelTopicID)
-	topic.PublishSettings = pubsub.PublishSettings{
-		CountThreshold: 10,
-		DelayThreshold: 100 * time.Millisecond,
-		ByteThreshold:  1e6,
+	// Stamp the placement, so draw keeps the latest one of each pixel
+	// whatever order the messages are delivered in.
+	pixelInfo.PlacedAt = time.Now().UnixNano()
+	data, err := json.Marshal(pixelInfo)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error marshalling pixel info", "error", err)
+		reason = "internal_error"
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
-	defer topic.Stop()
 
-	msgId, err := topic.Publish(ctx, &pubsub.Message{
-		Data: body,
-	}).Get(ctx)
+	start := time.Now()
+	msgId, err := msgBus.Publish(ctx, drawPixelTopicID, &bus.Message{
+		Data:       data,
+		Attributes: message.CanvasAttributes(pixelInfo.Canvas),
+	})
+	metrics.Published(ctx, "proxy", drawPixelTopicID, start, err)
 	if err != nil {
-		logging.Error("proxy", "Error publishing message", err)
+		logger.ErrorContext(ctx, "Error publishing message", "error", err)
+		reason = "publish_error"
 		http.Error(w, "Failed to publish message", http.StatusInternalServerError)
 		return
 	}
 
-	logging.InfoF("proxy", "Message published successfully with ID: %s", msgId)
+	logger.InfoContext(ctx, "Message published successfully", "messageId", msgId)
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Message published: %s", msgId)
 }
+
+// rateLimited reports whether the user placed a pixel on the canvas less than
+// cooldown ago, along with the time of that placement. Users that cannot be
+// looked up are allowed through.
+func rateLimited(ctx context.Context, st store.CanvasStore, canvasID, userID string, cooldown time.Duration) (time.Time, bool) {
+	start := time.Now()
+	user, err := st.GetUser(ctx, canvasID, userID)
+	if errors.Is(err, store.ErrNotFound) {
+		metrics.StoreOperation(ctx, "proxy", "get_user", start, nil)
+		logger.InfoContext(ctx, "User document not found, allowing request")
+		return time.Time{}, false
+	}
+	metrics.StoreOperation(ctx, "proxy", "get_user", start, err)
+	if err != nil {
+		logger.WarnContext(ctx, "Error reading user, allowing request", "error", err)
+		return time.Time{}, false
+	}
+	if user.LastUpdated.IsZero() {
+		return time.Time{}, false
+	}
+
+	timeDiff := time.Since(user.LastUpdated)
+	if timeDiff < cooldown {
+		logger.WarnContext(ctx, "Rate limit exceeded", "sinceLastUpdate", timeDiff, "rateLimit", cooldown)
+		return user.LastUpdated, true
+	}
+	return user.LastUpdated, false
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/shared/bus"
+	"example.com/shared/canvas"
+	"example.com/shared/message"
+	"example.com/shared/store"
+)
+
+// recorder records the messages published by the handler.
+type recorder struct {
+	mu       sync.Mutex
+	messages []*bus.Message
+}
+
+func (r *recorder) Publish(_ context.Context, topic string, msg *bus.Message) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.messages = append(r.messages, msg)
+	return "1", nil
+}
+
+func (r *recorder) Close() error {
+	return nil
+}
+
+// setup configures the handler to read users from st and publish on the
+// returned recorder.
+func setup(t *testing.T, st store.CanvasStore) *recorder {
+	t.Helper()
+	pub := &recorder{}
+	savedStore, savedBus, savedCanvases, savedCache := openStore, openBus, canvases, metaCache
+	saved := []string{projectId, firestoreDatabase, userCollection, rateLimit, drawPixelTopicID}
+	t.Cleanup(func() {
+		openStore, openBus, canvases, metaCache = savedStore, savedBus, savedCanvases, savedCache
+		projectId, firestoreDatabase, userCollection, rateLimit, drawPixelTopicID = saved[0], saved[1], saved[2], saved[3], saved[4]
+	})
+	openStore = func(context.Context) (store.CanvasStore, error) { return st, nil }
+	openBus = func(context.Context) (bus.Publisher, error) { return pub, nil }
+	projectId, firestoreDatabase, userCollection, rateLimit, drawPixelTopicID = "p", "(default)", "users", "30s", "draw"
+	canvases = canvas.Canvases{
+		canvas.Default: {Bounds: canvas.Bounds{Width: 16, Height: 8}, Palette: 8, Cooldown: 30 * time.Second},
+		"s2":           {Bounds: canvas.Bounds{Width: 16, Height: 16}, Cooldown: time.Minute},
+	}
+	metaCache = store.NewMetaCache(store.DefaultMetaTTL)
+	return pub
+}
+
+// placed records a placement of the user on the canvas at the given time.
+func placed(t *testing.T, st *store.MemoryStore, canvasID, userID string, at time.Time) {
+	t.Helper()
+	st.Now = func() time.Time { return at }
+	if err := st.UpdateUser(context.Background(), canvasID, userID); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+}
+
+func TestPublishDraw(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		body      string
+		placed    map[string]time.Time
+		status    int
+		published bool
+	}{{
+		name:      "new user",
+		body:      `{"x": 1, "y": 2, "color": 3, "user": "42"}`,
+		status:    http.StatusOK,
+		published: true,
+	}, {
+		name:   "within the cooldown",
+		body:   `{"x": 1, "y": 2, "color": 3, "user": "42"}`,
+		placed: map[string]time.Time{"": now.Add(-10 * time.Second)},
+		status: http.StatusForbidden,
+	}, {
+		name:      "after the cooldown",
+		body:      `{"x": 1, "y": 2, "color": 3, "user": "42"}`,
+		placed:    map[string]time.Time{"": now.Add(-time.Minute)},
+		status:    http.StatusOK,
+		published: true,
+	}, {
+		name:   "cooldown of the canvas",
+		body:   `{"x": 1, "y": 2, "color": 3, "user": "42", "canvas": "s2"}`,
+		placed: map[string]time.Time{"s2": now.Add(-45 * time.Second)},
+		status: http.StatusForbidden,
+	}, {
+		name:      "cooldown on another canvas",
+		body:      `{"x": 1, "y": 2, "color": 3, "user": "42", "canvas": "s2"}`,
+		placed:    map[string]time.Time{"": now.Add(-10 * time.Second)},
+		status:    http.StatusOK,
+		published: true,
+	}, {
+		name:   "invalid JSON",
+		body:   `{"x": 1,`,
+		status: http.StatusBadRequest,
+	}, {
+		name:   "unknown canvas",
+		body:   `{"x": 1, "y": 2, "color": 3, "user": "42", "canvas": "nope"}`,
+		status: http.StatusBadRequest,
+	}, {
+		name:   "past the width",
+		body:   `{"x": 16, "y": 2, "color": 3, "user": "42"}`,
+		status: http.StatusBadRequest,
+	}, {
+		name:   "past the height",
+		body:   `{"x": 10, "y": 8, "color": 3, "user": "42"}`,
+		status: http.StatusBadRequest,
+	}, {
+		name:   "out of the palette",
+		body:   `{"x": 1, "y": 2, "color": 8, "user": "42"}`,
+		status: http.StatusBadRequest,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := store.NewMemory()
+			for canvasID, at := range tt.placed {
+				placed(t, st, canvasID, "42", at)
+			}
+			pub := setup(t, st)
+
+			w := httptest.NewRecorder()
+			publishDraw(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.status)
+			}
+			if got := len(pub.messages) == 1; got != tt.published {
+				t.Fatalf("published %d messages, want published %v", len(pub.messages), tt.published)
+			}
+			if tt.status == http.StatusForbidden {
+				var body struct {
+					LastUpdated string `json:"lastUpdated"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.LastUpdated == "" {
+					t.Errorf("rate limited body = %q, want the time of the last placement", w.Body.String())
+				}
+			}
+			if !tt.published {
+				return
+			}
+			var p message.PixelInfo
+			if err := json.Unmarshal(pub.messages[0].Data, &p); err != nil {
+				t.Fatalf("published %q: %v", pub.messages[0].Data, err)
+			}
+			if p.User != "42" || p.X != 1 || p.Y != 2 || p.Color != 3 || p.PlacedAt == 0 {
+				t.Errorf("published %+v, want the placement stamped", p)
+			}
+			if got := pub.messages[0].Attributes[message.CanvasAttribute]; got != p.Canvas {
+				t.Errorf("canvas attribute = %q, want %q", got, p.Canvas)
+			}
+		})
+	}
+}
+
+func TestPublishDrawConfigError(t *testing.T) {
+	pub := setup(t, store.NewMemory())
+	rateLimit = ""
+
+	w := httptest.NewRecorder()
+	publishDraw(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"x": 1, "y": 2, "user": "42"}`)))
+	if w.Code != http.StatusInternalServerError || len(pub.messages) != 0 {
+		t.Errorf("status = %d with %d messages published, want 500 with none", w.Code, len(pub.messages))
+	}
+}
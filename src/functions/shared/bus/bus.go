@@ -0,0 +1,82 @@
+// Package bus abstracts the message bus connecting the functions, so the
+// pipeline topics can be carried by Pub/Sub, NATS or an in-process bus.
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Message is a message published on or received from a topic.
+type Message struct {
+	ID          string
+	Data        []byte
+	Attributes  map[string]string
+	PublishTime time.Time
+}
+
+// Handler processes a received message. Returning nil or a PermanentError
+// acknowledges it; any other error asks for redelivery where the backend
+// supports it.
+type Handler func(ctx context.Context, msg *Message) error
+
+// Publisher publishes messages on topics.
+type Publisher interface {
+	// Publish sends msg on topic and returns the ID assigned by the bus.
+	Publish(ctx context.Context, topic string, msg *Message) (string, error)
+
+	Close() error
+}
+
+// maxOutstanding is how many handlers a subscription runs at once on the
+// backends dispatching messages themselves, as Pub/Sub does by default.
+const maxOutstanding = 1000
+
+// Subscriber delivers the messages of a subscription to a handler.
+type Subscriber interface {
+	// Subscribe calls h, concurrently, for every message received on the
+	// subscription of topic until ctx is done, then waits for the handlers
+	// running. Backends where subscriptions are bound to their topic ahead
+	// of time, like Pub/Sub, ignore topic.
+	Subscribe(ctx context.Context, topic, subscription string, h Handler) error
+
+	Close() error
+}
+
+// Bus is both a Publisher and a Subscriber.
+type Bus interface {
+	Publisher
+	Subscriber
+}
+
+// Config selects and configures the backend returned by Open.
+type Config struct {
+	// Backend is "pubsub" (the default), "nats" or "memory", the MemoryBus
+	// shared by the process.
+	Backend string
+
+	// ProjectID configures the Pub/Sub backend.
+	ProjectID string
+
+	// NATSURL is the server URL of the NATS backend.
+	NATSURL string
+}
+
+// Open connects to the backend selected by cfg.
+func Open(ctx context.Context, cfg Config) (Bus, error) {
+	switch cfg.Backend {
+	case "", "pubsub":
+		return NewPubSub(ctx, cfg.ProjectID)
+	case "nats":
+		if cfg.NATSURL == "" {
+			return nil, errors.New("bus: NATS backend requires a server URL")
+		}
+		return NewNATS(cfg.NATSURL)
+	case "memory":
+		return sharedMemory{processMemory}, nil
+	default:
+		return nil, fmt.Errorf("bus: unknown backend %q", cfg.Backend)
+	}
+}
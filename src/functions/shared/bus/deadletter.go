@@ -0,0 +1,137 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"time"
+
+	"example.com/shared/metrics"
+)
+
+// Attributes added to a dead-lettered message, on top of its own.
+const (
+	// ReasonAttribute is the Reason of the PermanentError.
+	ReasonAttribute = "reason"
+
+	// ErrorAttribute is the full error message.
+	ErrorAttribute = "error"
+
+	// SubscriptionAttribute is the subscription the message was received on.
+	SubscriptionAttribute = "subscription"
+
+	// MessageIDAttribute is the ID of the original message.
+	MessageIDAttribute = "originalMessageId"
+)
+
+// PermanentError is a failure that redelivering the message cannot fix,
+// like a malformed payload. Handlers return it to have the message
+// acknowledged instead of retried; any other error is transient.
+type PermanentError struct {
+	// Reason is a short machine-readable cause, like "invalid_body".
+	Reason string
+	Err    error
+}
+
+// Permanent marks err as a permanent failure for reason.
+func Permanent(reason string, err error) error {
+	return &PermanentError{Reason: reason, Err: err}
+}
+
+func (e *PermanentError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// AsPermanent returns the PermanentError in err's chain, if any.
+func AsPermanent(err error) (*PermanentError, bool) {
+	var perr *PermanentError
+	if errors.As(err, &perr) {
+		return perr, true
+	}
+	return nil, false
+}
+
+// IsPermanent reports whether err is a permanent failure.
+func IsPermanent(err error) bool {
+	_, ok := AsPermanent(err)
+	return ok
+}
+
+// DeadLetter publishes msg, received on subscription, on topic with the
+// reason it could not be processed, so it can be inspected and replayed once
+// acknowledged.
+func DeadLetter(ctx context.Context, pub Publisher, topic, subscription string, msg *Message, perr *PermanentError) error {
+	attrs := maps.Clone(msg.Attributes)
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	attrs[ReasonAttribute] = perr.Reason
+	attrs[ErrorAttribute] = perr.Error()
+	attrs[SubscriptionAttribute] = subscription
+	attrs[MessageIDAttribute] = msg.ID
+
+	if _, err := pub.Publish(ctx, topic, &Message{Data: msg.Data, Attributes: attrs}); err != nil {
+		return fmt.Errorf("error dead-lettering message %s on %s: %w", msg.ID, topic, err)
+	}
+	return nil
+}
+
+// WithDeadLetter wraps h to publish the messages it fails on permanently to
+// topic and acknowledge them. If that publish fails the message is retried.
+func WithDeadLetter(h Handler, pub Publisher, topic, subscription string) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		err := h(ctx, msg)
+		perr, ok := AsPermanent(err)
+		if !ok {
+			return err
+		}
+		return DeadLetter(ctx, pub, topic, subscription, msg, perr)
+	}
+}
+
+// Reject disposes of msg, received on subscription, which failed permanently
+// with err, for handlers acknowledging messages themselves: it is published
+// on the dead-letter topic, or dropped if topic is empty, and logged with
+// logger. The publish is recorded in the metrics of component. It returns the
+// reason to record for the message, and an error if it must be retried as the
+// publish failed.
+func Reject(ctx context.Context, logger *slog.Logger, component string, pub Publisher, topic, subscription string, msg *Message, err error) (string, error) {
+	perr, ok := AsPermanent(err)
+	if !ok {
+		perr = &PermanentError{Reason: "rejected", Err: err}
+	}
+	if topic == "" {
+		logger.WarnContext(ctx, "No dead-letter topic set, dropping message", "reason", perr.Reason)
+		return perr.Reason, nil
+	}
+
+	start := time.Now()
+	err = DeadLetter(ctx, pub, topic, subscription, msg, perr)
+	metrics.Published(ctx, component, topic, start, err)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error dead-lettering message", "error", err)
+		return "dead_letter_error", err
+	}
+	logger.WarnContext(ctx, "Message dead-lettered", "reason", perr.Reason, "topic", topic)
+	return perr.Reason, nil
+}
+
+// RejectPush is Reject for push endpoints: it answers the push request with
+// 200 to acknowledge the message, or 500 to have it retried.
+func RejectPush(ctx context.Context, w http.ResponseWriter, logger *slog.Logger, component string, pub Publisher, topic, subscription string, msg *Message, err error) string {
+	reason, err := Reject(ctx, logger, component, pub, topic, subscription, msg, err)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return reason
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Message rejected: %s", reason)
+	return reason
+}
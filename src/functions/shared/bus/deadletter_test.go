@@ -0,0 +1,130 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestReject(t *testing.T) {
+	ctx := context.Background()
+	msg := &Message{ID: "m1", Data: []byte("payload"), Attributes: map[string]string{"canvas": "s2"}}
+	perr := Permanent("invalid_body", errors.New("bad json"))
+
+	t.Run("no dead-letter topic", func(t *testing.T) {
+		reason, err := Reject(ctx, discard, "test", nil, "", "sub", msg, perr)
+		if reason != "invalid_body" || err != nil {
+			t.Errorf("Reject = %q, %v, want invalid_body, nil", reason, err)
+		}
+	})
+
+	t.Run("dead-lettered", func(t *testing.T) {
+		b := NewMemory()
+		b.CreateSubscription("dead", "dead-tail")
+		reason, err := Reject(ctx, discard, "test", b, "dead", "sub", msg, perr)
+		if reason != "invalid_body" || err != nil {
+			t.Fatalf("Reject = %q, %v, want invalid_body, nil", reason, err)
+		}
+		m := received(t, b, "dead", "dead-tail")
+		want := map[string]string{
+			"canvas":              "s2",
+			ReasonAttribute:       "invalid_body",
+			ErrorAttribute:        perr.Error(),
+			SubscriptionAttribute: "sub",
+			MessageIDAttribute:    "m1",
+		}
+		for k, v := range want {
+			if m.Attributes[k] != v {
+				t.Errorf("attribute %s = %q, want %q", k, m.Attributes[k], v)
+			}
+		}
+		if string(m.Data) != "payload" {
+			t.Errorf("data = %q, want payload", m.Data)
+		}
+	})
+
+	t.Run("dead-letter publish failed", func(t *testing.T) {
+		b := NewMemory()
+		b.Close()
+		reason, err := Reject(ctx, discard, "test", b, "dead", "sub", msg, perr)
+		if reason != "dead_letter_error" || !errors.Is(err, ErrClosed) {
+			t.Errorf("Reject = %q, %v, want dead_letter_error, %v", reason, err, ErrClosed)
+		}
+	})
+}
+
+func TestRejectPush(t *testing.T) {
+	ctx := context.Background()
+	perr := Permanent("invalid_body", errors.New("bad json"))
+	closed := NewMemory()
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		pub    Publisher
+		topic  string
+		status int
+		reason string
+	}{
+		{name: "acknowledged", pub: NewMemory(), topic: "dead", status: http.StatusOK, reason: "invalid_body"},
+		{name: "dropped", topic: "", status: http.StatusOK, reason: "invalid_body"},
+		{name: "retried", pub: closed, topic: "dead", status: http.StatusInternalServerError, reason: "dead_letter_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			reason := RejectPush(ctx, w, discard, "test", tt.pub, tt.topic, "sub", &Message{ID: "m1"}, perr)
+			if reason != tt.reason || w.Code != tt.status {
+				t.Errorf("RejectPush = %q with status %d, want %q with %d", reason, w.Code, tt.reason, tt.status)
+			}
+		})
+	}
+}
+
+func TestWithDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	msg := &Message{ID: "m1", Data: []byte("payload")}
+	transient := errors.New("try again")
+	closed := NewMemory()
+	closed.Close()
+
+	tests := []struct {
+		name       string
+		err        error
+		pub        *MemoryBus
+		want       error
+		deadLetter bool
+	}{
+		{name: "handled", pub: NewMemory()},
+		{name: "transient", err: transient, pub: NewMemory(), want: transient},
+		{name: "permanent", err: Permanent("invalid_body", errors.New("bad json")), pub: NewMemory(), deadLetter: true},
+		{name: "dead-letter publish failed", err: Permanent("invalid_body", errors.New("bad json")), pub: closed, want: ErrClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.pub.CreateSubscription("dead", "dead-tail")
+			h := WithDeadLetter(func(context.Context, *Message) error { return tt.err }, tt.pub, "dead", "sub")
+			if err := h(ctx, msg); !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("handler = %v, want %v", err, tt.want)
+			}
+			if tt.deadLetter {
+				m := received(t, tt.pub, "dead", "dead-tail")
+				if m.Attributes[ReasonAttribute] != "invalid_body" || m.Attributes[MessageIDAttribute] != "m1" {
+					t.Errorf("dead-lettered attributes = %v, want the reason and ID of m1", m.Attributes)
+				}
+				return
+			}
+			select {
+			case m := <-tt.pub.subscription("dead", "dead-tail"):
+				t.Errorf("dead-lettered %+v, want nothing", m)
+			default:
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"strconv"
+	"sync"
+	"time"
+
+	"example.com/shared/tracing"
+)
+
+// ErrClosed is returned when publishing on a closed MemoryBus.
+var ErrClosed = errors.New("bus: closed")
+
+// MemoryBus is an in-process Bus built on channels, for tests and local runs.
+// Like Pub/Sub, every subscription of a topic receives each message and
+// messages published before a subscription exists are not delivered to it.
+type MemoryBus struct {
+	// RetryDelay is how long a message whose handler failed waits before
+	// being redelivered. Defaults to one second.
+	RetryDelay time.Duration
+
+	mu     sync.Mutex
+	topics map[string]map[string]chan *Message
+	nextID int64
+	closed bool
+}
+
+var (
+	_ Bus = (*MemoryBus)(nil)
+	_ Bus = sharedMemory{}
+)
+
+// processMemory is the MemoryBus of the memory backend of Open.
+var processMemory = NewMemory()
+
+// ProcessMemory returns the MemoryBus Open connects to for the memory backend,
+// so that the functions served by one process talk through it.
+func ProcessMemory() *MemoryBus {
+	return processMemory
+}
+
+// sharedMemory is the ProcessMemory returned by Open. Closing it leaves the
+// bus open for the other functions of the process.
+type sharedMemory struct {
+	*MemoryBus
+}
+
+func (sharedMemory) Close() error {
+	return nil
+}
+
+// NewMemory returns an empty MemoryBus.
+func NewMemory() *MemoryBus {
+	return &MemoryBus{
+		RetryDelay: time.Second,
+		topics:     make(map[string]map[string]chan *Message),
+	}
+}
+
+// CreateSubscription registers a subscription on topic so that it retains
+// the messages published before Subscribe is called.
+func (b *MemoryBus) CreateSubscription(topic, subscription string) {
+	b.subscription(topic, subscription)
+}
+
+func (b *MemoryBus) subscription(topic, subscription string) chan *Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs, ok := b.topics[topic]
+	if !ok {
+		subs = make(map[string]chan *Message)
+		b.topics[topic] = subs
+	}
+	ch, ok := subs[subscription]
+	if !ok {
+		ch = make(chan *Message, 1024)
+		subs[subscription] = ch
+	}
+	return ch
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, topic string, msg *Message) (_ string, err error) {
+	ctx, span, attrs := startPublish(ctx, "memory", topic, msg)
+	defer func() { tracing.End(span, err) }()
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return "", ErrClosed
+	}
+	b.nextID++
+	id := strconv.FormatInt(b.nextID, 10)
+	subs := make([]chan *Message, 0, len(b.topics[topic]))
+	for _, ch := range b.topics[topic] {
+		subs = append(subs, ch)
+	}
+	b.mu.Unlock()
+
+	now := time.Now()
+	for _, ch := range subs {
+		m := &Message{
+			ID:          id,
+			Data:        msg.Data,
+			Attributes:  maps.Clone(attrs),
+			PublishTime: now,
+		}
+		select {
+		case ch <- m:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	return id, nil
+}
+
+func (b *MemoryBus) Subscribe(ctx context.Context, topic, subscription string, h Handler) error {
+	ch := b.subscription(topic, subscription)
+	sem := make(chan struct{}, maxOutstanding)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case sem <- struct{}{}:
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case m := <-ch:
+			wg.Go(func() {
+				defer func() { <-sem }()
+				msgCtx, span := startProcess(ctx, "memory", subscription, m)
+				err := h(msgCtx, m)
+				tracing.End(span, err)
+				if err != nil && !IsPermanent(err) {
+					go b.redeliver(ctx, ch, m)
+				}
+			})
+		}
+	}
+}
+
+func (b *MemoryBus) redeliver(ctx context.Context, ch chan *Message, m *Message) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(b.RetryDelay):
+	}
+	select {
+	case ch <- m:
+	case <-ctx.Done():
+	}
+}
+
+func (b *MemoryBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	return nil
+}
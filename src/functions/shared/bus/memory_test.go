@@ -0,0 +1,179 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// received returns the next message of the subscription, or fails the test.
+func received(t *testing.T, b *MemoryBus, topic, subscription string) *Message {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got := make(chan *Message, 1)
+	go b.Subscribe(ctx, topic, subscription, func(_ context.Context, m *Message) error {
+		select {
+		case got <- m:
+		default:
+		}
+		cancel()
+		return nil
+	})
+	select {
+	case m := <-got:
+		return m
+	case <-ctx.Done():
+		t.Fatalf("no message received on %s", subscription)
+		return nil
+	}
+}
+
+func TestMemoryBusPublish(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemory()
+	b.CreateSubscription("pixels", "a")
+	b.CreateSubscription("pixels", "b")
+	b.CreateSubscription("other", "c")
+
+	id, err := b.Publish(ctx, "pixels", &Message{Data: []byte("p1"), Attributes: map[string]string{"canvas": "s2"}})
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	for _, sub := range []string{"a", "b"} {
+		m := received(t, b, "pixels", sub)
+		if m.ID != id || string(m.Data) != "p1" || m.Attributes["canvas"] != "s2" {
+			t.Errorf("%s received %+v, want message %s", sub, m, id)
+		}
+		if m.PublishTime.IsZero() {
+			t.Errorf("%s received a message without publish time", sub)
+		}
+	}
+
+	// Subscriptions of other topics, or created after the publish, get
+	// nothing.
+	b.CreateSubscription("pixels", "late")
+	for _, sub := range []struct{ topic, name string }{{"other", "c"}, {"pixels", "late"}} {
+		select {
+		case m := <-b.subscription(sub.topic, sub.name):
+			t.Errorf("%s received %+v, want nothing", sub.name, m)
+		default:
+		}
+	}
+
+	b.Close()
+	if _, err := b.Publish(ctx, "pixels", &Message{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Publish once closed = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestMemoryBusSubscribeIsolatesAttributes(t *testing.T) {
+	b := NewMemory()
+	b.CreateSubscription("pixels", "a")
+	b.CreateSubscription("pixels", "b")
+	if _, err := b.Publish(context.Background(), "pixels", &Message{Attributes: map[string]string{"k": "v"}}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	received(t, b, "pixels", "a").Attributes["k"] = "changed"
+	if got := received(t, b, "pixels", "b").Attributes["k"]; got != "v" {
+		t.Errorf("attribute seen by b = %q, want v", got)
+	}
+}
+
+func TestMemoryBusRedelivery(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		deliveries int32
+	}{
+		{name: "acknowledged", err: nil, deliveries: 1},
+		{name: "failed", err: errors.New("try again"), deliveries: 3},
+		{name: "failed permanently", err: Permanent("invalid_body", errors.New("bad json")), deliveries: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMemory()
+			b.RetryDelay = time.Millisecond
+			b.CreateSubscription("pixels", "sub")
+			if _, err := b.Publish(context.Background(), "pixels", &Message{Data: []byte("p")}); err != nil {
+				t.Fatalf("Publish: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			var deliveries atomic.Int32
+			b.Subscribe(ctx, "pixels", "sub", func(context.Context, *Message) error {
+				if deliveries.Add(1) >= 3 {
+					// Stop failing so the message is acknowledged.
+					return nil
+				}
+				return tt.err
+			})
+			if got := deliveries.Load(); got != tt.deliveries {
+				t.Errorf("delivered %d times, want %d", got, tt.deliveries)
+			}
+		})
+	}
+}
+
+func TestMemoryBusSubscribeConcurrently(t *testing.T) {
+	const n = 4
+	b := NewMemory()
+	b.CreateSubscription("pixels", "sub")
+	for range n {
+		if _, err := b.Publish(context.Background(), "pixels", &Message{}); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+
+	// Each handler waits for all of them to run: a subscription handling
+	// messages one at a time never gets there.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var started, handled atomic.Int32
+	all := make(chan struct{})
+	b.Subscribe(ctx, "pixels", "sub", func(ctx context.Context, _ *Message) error {
+		if started.Add(1) == n {
+			close(all)
+		}
+		select {
+		case <-all:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if handled.Add(1) == n {
+			cancel()
+		}
+		return nil
+	})
+	if got := handled.Load(); got != n {
+		t.Errorf("handled %d messages concurrently, want %d", got, n)
+	}
+}
+
+func TestOpenMemory(t *testing.T) {
+	ctx := context.Background()
+	pub, err := Open(ctx, Config{Backend: "memory"})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	sub, err := Open(ctx, Config{Backend: "memory"})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	ProcessMemory().CreateSubscription("open-memory", "a")
+
+	// Closing one connection leaves the process bus open for the others.
+	if err := sub.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	id, err := pub.Publish(ctx, "open-memory", &Message{Data: []byte("p1")})
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if m := received(t, ProcessMemory(), "open-memory", "a"); m.ID != id {
+		t.Errorf("received %+v, want message %s", m, id)
+	}
+}
@@ -0,0 +1,113 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"example.com/shared/tracing"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// publishTimeHeader carries the publish time, which core NATS does not record.
+const publishTimeHeader = "Airplace-Publish-Time"
+
+// NATSBus is the Bus backed by a NATS server. Topics map to subjects and
+// subscriptions to queue groups, so each subscription receives a message once
+// however many subscribers it has. Core NATS delivers at most once: a message
+// whose handler fails is not redelivered.
+type NATSBus struct {
+	conn *nats.Conn
+}
+
+var _ Bus = (*NATSBus)(nil)
+
+// NewNATS connects to the NATS server at url.
+func NewNATS(url string) (*NATSBus, error) {
+	conn, err := nats.Connect(url, nats.Name("airplace"))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to NATS: %w", err)
+	}
+	return &NATSBus{conn: conn}, nil
+}
+
+func (b *NATSBus) Publish(ctx context.Context, topic string, msg *Message) (_ string, err error) {
+	ctx, span, attrs := startPublish(ctx, "nats", topic, msg)
+	defer func() { tracing.End(span, err) }()
+
+	id := nuid.Next()
+	m := nats.NewMsg(topic)
+	m.Data = msg.Data
+	for k, v := range attrs {
+		m.Header.Set(k, v)
+	}
+	m.Header.Set(nats.MsgIdHdr, id)
+	m.Header.Set(publishTimeHeader, time.Now().UTC().Format(time.RFC3339Nano))
+
+	if err := b.conn.PublishMsg(m); err != nil {
+		return "", fmt.Errorf("error publishing to %s: %w", topic, err)
+	}
+	if err := b.conn.FlushWithContext(ctx); err != nil {
+		return "", fmt.Errorf("error flushing publish to %s: %w", topic, err)
+	}
+	return id, nil
+}
+
+func (b *NATSBus) Subscribe(ctx context.Context, topic, subscription string, h Handler) error {
+	// NATS calls back one message at a time: the handlers run on their own
+	// goroutines, up to maxOutstanding at once.
+	sem := make(chan struct{}, maxOutstanding)
+	var (
+		mu      sync.Mutex
+		stopped bool
+		wg      sync.WaitGroup
+	)
+	sub, err := b.conn.QueueSubscribe(topic, subscription, func(m *nats.Msg) {
+		msg := &Message{
+			Data:       m.Data,
+			Attributes: make(map[string]string, len(m.Header)),
+		}
+		for k := range m.Header {
+			switch k {
+			case nats.MsgIdHdr:
+				msg.ID = m.Header.Get(k)
+			case publishTimeHeader:
+				msg.PublishTime, _ = time.Parse(time.RFC3339Nano, m.Header.Get(k))
+			default:
+				msg.Attributes[k] = m.Header.Get(k)
+			}
+		}
+
+		sem <- struct{}{}
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			<-sem
+			return
+		}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			// Nothing to nack: the message is dropped if the handler fails.
+			msgCtx, span := startProcess(ctx, "nats", subscription, msg)
+			tracing.End(span, h(msgCtx, msg))
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("error subscribing to %s: %w", topic, err)
+	}
+
+	<-ctx.Done()
+	mu.Lock()
+	stopped = true
+	mu.Unlock()
+	err = sub.Unsubscribe()
+	wg.Wait()
+	return err
+}
+
+func (b *NATSBus) Close() error {
+	b.conn.Close()
+	return nil
+}
@@ -0,0 +1,109 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	"example.com/shared/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/option"
+)
+
+// DefaultPublishSettings batches messages for up to 100ms or 10 messages.
+var DefaultPublishSettings = pubsub.PublishSettings{
+	CountThreshold: 10,
+	DelayThreshold: 100 * time.Millisecond,
+	ByteThreshold:  1e6,
+}
+
+// PubSubBus is the Bus backed by Google Cloud Pub/Sub.
+type PubSubBus struct {
+	client *pubsub.Client
+
+	// PublishSettings applies to the publishers created after it is set.
+	PublishSettings pubsub.PublishSettings
+
+	mu         sync.Mutex
+	publishers map[string]*pubsub.Publisher
+}
+
+var _ Bus = (*PubSubBus)(nil)
+
+// NewPubSub connects to Pub/Sub in the given project.
+func NewPubSub(ctx context.Context, projectID string, opts ...option.ClientOption) (*PubSubBus, error) {
+	client, err := pubsub.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to PubSub: %w", err)
+	}
+	return &PubSubBus{
+		client:          client,
+		PublishSettings: DefaultPublishSettings,
+		publishers:      make(map[string]*pubsub.Publisher),
+	}, nil
+}
+
+// Client returns the underlying Pub/Sub client, for administrative calls.
+func (b *PubSubBus) Client() *pubsub.Client {
+	return b.client
+}
+
+func (b *PubSubBus) publisher(topic string) *pubsub.Publisher {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p, ok := b.publishers[topic]
+	if !ok {
+		p = b.client.Publisher(topic)
+		p.PublishSettings = b.PublishSettings
+		b.publishers[topic] = p
+	}
+	return p
+}
+
+func (b *PubSubBus) Publish(ctx context.Context, topic string, msg *Message) (id string, err error) {
+	ctx, span, attrs := startPublish(ctx, "gcp_pubsub", topic, msg)
+	defer func() { tracing.End(span, err) }()
+
+	id, err = b.publisher(topic).Publish(ctx, &pubsub.Message{
+		Data:       msg.Data,
+		Attributes: attrs,
+	}).Get(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error publishing to %s: %w", topic, err)
+	}
+	span.SetAttributes(attribute.String("messaging.message.id", id))
+	return id, nil
+}
+
+func (b *PubSubBus) Subscribe(ctx context.Context, _, subscription string, h Handler) error {
+	return b.client.Subscriber(subscription).Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		msg := &Message{
+			ID:          m.ID,
+			Data:        m.Data,
+			Attributes:  m.Attributes,
+			PublishTime: m.PublishTime,
+		}
+		ctx, span := startProcess(ctx, "gcp_pubsub", subscription, msg)
+		err := h(ctx, msg)
+		tracing.End(span, err)
+		if err != nil && !IsPermanent(err) {
+			m.Nack()
+			return
+		}
+		m.Ack()
+	})
+}
+
+func (b *PubSubBus) Close() error {
+	b.mu.Lock()
+	for _, p := range b.publishers {
+		p.Stop()
+	}
+	b.publishers = make(map[string]*pubsub.Publisher)
+	b.mu.Unlock()
+
+	return b.client.Close()
+}
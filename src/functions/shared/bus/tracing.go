@@ -0,0 +1,44 @@
+package bus
+
+import (
+	"context"
+	"maps"
+
+	"example.com/shared/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startPublish starts the producer span of a publish of msg on topic and
+// returns the attributes to send, which carry the span's context.
+func startPublish(ctx context.Context, system, topic string, msg *Message) (context.Context, trace.Span, map[string]string) {
+	ctx, span := tracing.Tracer().Start(ctx, topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", system),
+			attribute.String("messaging.operation.type", "send"),
+			attribute.String("messaging.destination.name", topic),
+			attribute.Int("messaging.message.body.size", len(msg.Data)),
+		))
+
+	attrs := maps.Clone(msg.Attributes)
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	tracing.Inject(ctx, attrs)
+	return ctx, span, attrs
+}
+
+// startProcess starts the consumer span of the processing of msg received on
+// subscription, continuing the trace of its publish.
+func startProcess(ctx context.Context, system, subscription string, msg *Message) (context.Context, trace.Span) {
+	ctx = tracing.Extract(ctx, msg.Attributes)
+	return tracing.Tracer().Start(ctx, subscription+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", system),
+			attribute.String("messaging.operation.type", "process"),
+			attribute.String("messaging.destination.subscription.name", subscription),
+			attribute.String("messaging.message.id", msg.ID),
+		))
+}
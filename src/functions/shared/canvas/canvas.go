@@ -0,0 +1,212 @@
+// Package canvas maps canvas coordinates to the chunks storing them. Every
+// function locates pixels through it, so they agree on chunk IDs and local
+// keys for any coordinates, negative ones included.
+package canvas
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ChunkPrefix starts the ID of every chunk document.
+const ChunkPrefix = "canvas_chunks_"
+
+// Document layout of the canvases: the chunks of the default canvas are in
+// ChunkCollection, those of canvas c in CanvasCollection/c/CanvasChunks, and
+// likewise for users in CanvasCollection/c/CanvasUsers. The metadata of
+// canvas c is the document CanvasCollection/c, that of the default canvas
+// CanvasCollection/DefaultMetadataID.
+const (
+	ChunkCollection   = "canvas_chunks"
+	CanvasCollection  = "canvases"
+	CanvasChunks      = "chunks"
+	CanvasUsers       = "users"
+	DefaultMetadataID = "_default"
+)
+
+// ErrInvalidChunkID is returned when parsing a malformed chunk ID.
+var ErrInvalidChunkID = errors.New("canvas: invalid chunk ID")
+
+// FloorDiv returns a/b rounded towards negative infinity, so that every chunk
+// spans exactly b coordinates on both sides of zero. b must be positive.
+func FloorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// Mod returns the remainder of FloorDiv(a, b), always in [0, b).
+func Mod(a, b int) int {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
+
+// Locate returns the chunk holding the pixel at (x, y) on a canvas of chunks
+// of size pixels a side, and the pixel's coordinates within that chunk.
+func Locate(x, y, size int) (chunkX, chunkY, localX, localY int) {
+	return FloorDiv(x, size), FloorDiv(y, size), Mod(x, size), Mod(y, size)
+}
+
+// ChunkID returns the ID of the chunk at chunk coordinates (chunkX, chunkY).
+func ChunkID(chunkX, chunkY int) string {
+	return fmt.Sprintf("%s%d_%d", ChunkPrefix, chunkX, chunkY)
+}
+
+// ShardID returns the ID of the document holding shard shard of a chunk
+// split in several documents. The first shard is the chunk document itself.
+func ShardID(chunkID string, shard int) string {
+	if shard == 0 {
+		return chunkID
+	}
+	return fmt.Sprintf("%s_s%d", chunkID, shard)
+}
+
+// SplitShardID returns the chunk ID and shard of the ID of a document of a
+// chunk, shard 0 for the chunk document itself.
+func SplitShardID(id string) (chunkID string, shard int) {
+	i := strings.LastIndex(id, "_s")
+	if i < 0 {
+		return id, 0
+	}
+	shard, err := strconv.Atoi(id[i+2:])
+	if err != nil || shard <= 0 {
+		return id, 0
+	}
+	return id[:i], shard
+}
+
+// ParseChunkID returns the chunk coordinates of a chunk ID, or of the ID of
+// one of its shards.
+func ParseChunkID(id string) (chunkX, chunkY int, err error) {
+	chunkID, _ := SplitShardID(id)
+	rest, ok := strings.CutPrefix(chunkID, ChunkPrefix)
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidChunkID, id)
+	}
+	xs, ys, ok := strings.Cut(rest, "_")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidChunkID, id)
+	}
+	if chunkX, err = strconv.Atoi(xs); err != nil {
+		return 0, 0, fmt.Errorf("%w: %q: invalid x", ErrInvalidChunkID, id)
+	}
+	if chunkY, err = strconv.Atoi(ys); err != nil {
+		return 0, 0, fmt.Errorf("%w: %q: invalid y", ErrInvalidChunkID, id)
+	}
+	return chunkX, chunkY, nil
+}
+
+// ParseChunkPath returns the canvas and chunk coordinates of a chunk
+// document, given its path relative to the database root or its full
+// resource name.
+func ParseChunkPath(path string) (canvasID string, chunkX, chunkY int, err error) {
+	if _, rest, ok := strings.Cut(path, "/documents/"); ok {
+		path = rest
+	}
+	var chunkID string
+	switch parts := strings.Split(path, "/"); {
+	case len(parts) == 2 && parts[0] == ChunkCollection:
+		canvasID, chunkID = Default, parts[1]
+	case len(parts) == 4 && parts[0] == CanvasCollection && parts[2] == CanvasChunks && ValidID(parts[1]):
+		canvasID, chunkID = parts[1], parts[3]
+	default:
+		return "", 0, 0, fmt.Errorf("%w: %q is not a chunk document", ErrInvalidChunkID, path)
+	}
+	chunkX, chunkY, err = ParseChunkID(chunkID)
+	return canvasID, chunkX, chunkY, err
+}
+
+// PixelKey returns the key of the pixel at (localX, localY) within its chunk.
+func PixelKey(localX, localY int) string {
+	return fmt.Sprintf("%d_%d", localX, localY)
+}
+
+// ErrInvalidPixelKey is returned when parsing a malformed pixel key.
+var ErrInvalidPixelKey = errors.New("canvas: invalid pixel key")
+
+// ParsePixelKey returns the coordinates within its chunk of a pixel key.
+func ParsePixelKey(key string) (localX, localY int, err error) {
+	xs, ys, ok := strings.Cut(key, "_")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidPixelKey, key)
+	}
+	if localX, err = strconv.Atoi(xs); err != nil {
+		return 0, 0, fmt.Errorf("%w: %q: invalid x", ErrInvalidPixelKey, key)
+	}
+	if localY, err = strconv.Atoi(ys); err != nil {
+		return 0, 0, fmt.Errorf("%w: %q: invalid y", ErrInvalidPixelKey, key)
+	}
+	return localX, localY, nil
+}
+
+// Bounds limits where pixels can be placed.
+type Bounds struct {
+	// Unbounded accepts any coordinates, negative ones included, so the
+	// board grows as users draw outward.
+	Unbounded bool
+
+	// Width and Height limit x to [0, Width) and y to [0, Height) unless
+	// Unbounded. Zero leaves the coordinate unlimited upwards.
+	Width  int
+	Height int
+}
+
+// Contains reports whether a pixel can be placed at (x, y).
+func (b Bounds) Contains(x, y int) bool {
+	if b.Unbounded {
+		return true
+	}
+	if x < 0 || y < 0 {
+		return false
+	}
+	return (b.Width == 0 || x < b.Width) && (b.Height == 0 || y < b.Height)
+}
+
+// Sized reports whether the bounds limit both coordinates, which only then
+// describe a board of a given size.
+func (b Bounds) Sized() bool {
+	return !b.Unbounded && b.Width > 0 && b.Height > 0
+}
+
+// BoundsFromEnv reads the bounds from CANVAS_UNBOUNDED ("true" to accept any
+// coordinates), and CANVAS_WIDTH and CANVAS_HEIGHT, as read by the snapshot
+// function. CANVAS_SIZE sets both for a square canvas.
+func BoundsFromEnv() (Bounds, error) {
+	var b Bounds
+	if v := os.Getenv("CANVAS_UNBOUNDED"); v != "" {
+		unbounded, err := strconv.ParseBool(v)
+		if err != nil {
+			return Bounds{}, fmt.Errorf("invalid CANVAS_UNBOUNDED %q: %w", v, err)
+		}
+		b.Unbounded = unbounded
+	}
+	for _, dim := range []struct {
+		env  string
+		dims []*int
+	}{
+		{"CANVAS_SIZE", []*int{&b.Width, &b.Height}},
+		{"CANVAS_WIDTH", []*int{&b.Width}},
+		{"CANVAS_HEIGHT", []*int{&b.Height}},
+	} {
+		v := os.Getenv(dim.env)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return Bounds{}, fmt.Errorf("invalid %s %q", dim.env, v)
+		}
+		for _, d := range dim.dims {
+			*d = n
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,184 @@
+package canvas
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLocate(t *testing.T) {
+	tests := []struct {
+		x, y                           int
+		chunkX, chunkY, localX, localY int
+	}{
+		{0, 0, 0, 0, 0, 0},
+		{63, 64, 0, 1, 63, 0},
+		{-1, -1, -1, -1, 63, 63},
+		{-64, -65, -1, -2, 0, 63},
+		{-128, 130, -2, 2, 0, 2},
+	}
+	for _, tt := range tests {
+		chunkX, chunkY, localX, localY := Locate(tt.x, tt.y, 64)
+		if chunkX != tt.chunkX || chunkY != tt.chunkY || localX != tt.localX || localY != tt.localY {
+			t.Errorf("Locate(%d, %d, 64) = %d, %d, %d, %d, want %d, %d, %d, %d",
+				tt.x, tt.y, chunkX, chunkY, localX, localY, tt.chunkX, tt.chunkY, tt.localX, tt.localY)
+		}
+	}
+}
+
+func TestChunkIDRoundTrip(t *testing.T) {
+	for _, c := range [][2]int{{0, 0}, {3, 12}, {-1, 0}, {0, -7}, {-20, -3}} {
+		id := ChunkID(c[0], c[1])
+		x, y, err := ParseChunkID(id)
+		if err != nil || x != c[0] || y != c[1] {
+			t.Errorf("ParseChunkID(%q) = %d, %d, %v, want %d, %d", id, x, y, err, c[0], c[1])
+		}
+	}
+}
+
+func TestParseShardID(t *testing.T) {
+	if id := ShardID(ChunkID(2, -3), 0); id != ChunkID(2, -3) {
+		t.Errorf("ShardID(%q, 0) = %q, want the chunk ID", ChunkID(2, -3), id)
+	}
+	id := ShardID(ChunkID(2, -3), 4)
+	if x, y, err := ParseChunkID(id); err != nil || x != 2 || y != -3 {
+		t.Errorf("ParseChunkID(%q) = %d, %d, %v, want 2, -3", id, x, y, err)
+	}
+	if chunkID, shard := SplitShardID(id); chunkID != ChunkID(2, -3) || shard != 4 {
+		t.Errorf("SplitShardID(%q) = %q, %d, want %q, 4", id, chunkID, shard, ChunkID(2, -3))
+	}
+	if chunkID, shard := SplitShardID(ChunkID(2, -3)); chunkID != ChunkID(2, -3) || shard != 0 {
+		t.Errorf("SplitShardID(%q) = %q, %d, want the chunk ID and 0", ChunkID(2, -3), chunkID, shard)
+	}
+}
+
+func TestParseChunkIDErrors(t *testing.T) {
+	for _, id := range []string{"", "canvas_chunks_", "canvas_chunks_1", "canvas_chunks_1_", "canvas_chunks_a_1", "canvas_chunks_1_2_3", "canvas_chunks_1_2_s0", "canvas_chunks_1_2_sx", "canvas_chunks_1_s1", "users_1_2"} {
+		if _, _, err := ParseChunkID(id); !errors.Is(err, ErrInvalidChunkID) {
+			t.Errorf("ParseChunkID(%q) error = %v, want %v", id, err, ErrInvalidChunkID)
+		}
+	}
+}
+
+func TestParsePixelKey(t *testing.T) {
+	if x, y, err := ParsePixelKey(PixelKey(3, 60)); err != nil || x != 3 || y != 60 {
+		t.Errorf("ParsePixelKey(%q) = %d, %d, %v, want 3, 60", PixelKey(3, 60), x, y, err)
+	}
+	for _, key := range []string{"", "1", "1_", "a_1", "1_2_3"} {
+		if _, _, err := ParsePixelKey(key); !errors.Is(err, ErrInvalidPixelKey) {
+			t.Errorf("ParsePixelKey(%q) error = %v, want %v", key, err, ErrInvalidPixelKey)
+		}
+	}
+}
+
+func TestBoundsContains(t *testing.T) {
+	tests := []struct {
+		bounds Bounds
+		x, y   int
+		want   bool
+	}{
+		{Bounds{}, 5000, 0, true},
+		{Bounds{}, -1, 0, false},
+		{Bounds{Width: 100, Height: 100}, 99, 99, true},
+		{Bounds{Width: 100, Height: 100}, 100, 0, false},
+		{Bounds{Width: 200, Height: 100}, 150, 99, true},
+		{Bounds{Width: 200, Height: 100}, 150, 100, false},
+		{Bounds{Width: 200}, 150, 5000, true},
+		{Bounds{Unbounded: true}, -5000, 12, true},
+		{Bounds{Unbounded: true, Width: 100, Height: 100}, 200, -1, true},
+	}
+	for _, tt := range tests {
+		if got := tt.bounds.Contains(tt.x, tt.y); got != tt.want {
+			t.Errorf("%+v.Contains(%d, %d) = %v, want %v", tt.bounds, tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestBoundsFromEnv(t *testing.T) {
+	tests := []struct {
+		name                string
+		size, width, height string
+		want                Bounds
+		wantErr             bool
+	}{
+		{name: "unset"},
+		{name: "square", size: "100", want: Bounds{Width: 100, Height: 100}},
+		{name: "width and height", width: "200", height: "100", want: Bounds{Width: 200, Height: 100}},
+		{name: "size overridden", size: "100", height: "50", want: Bounds{Width: 100, Height: 50}},
+		{name: "invalid", width: "-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CANVAS_UNBOUNDED", "")
+			t.Setenv("CANVAS_SIZE", tt.size)
+			t.Setenv("CANVAS_WIDTH", tt.width)
+			t.Setenv("CANVAS_HEIGHT", tt.height)
+			got, err := BoundsFromEnv()
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("BoundsFromEnv() = %+v, %v, want %+v, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("CANVAS_SIZE", "")
+	t.Setenv("CANVAS_WIDTH", "1000")
+	t.Setenv("CANVAS_HEIGHT", "500")
+	t.Setenv("CANVAS_UNBOUNDED", "")
+	t.Setenv("CANVAS_PALETTE", "")
+	t.Setenv("RATE_LIMIT", "5s")
+	t.Setenv("CANVASES", `{"season-2": {"size": 256, "palette": 16, "cooldown": "30s"}, "season-3": {"width": 512, "height": 256}, "guild-42": {"unbounded": true}}`)
+
+	canvases, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	want := Canvases{
+		Default:    {Bounds: Bounds{Width: 1000, Height: 500}, Cooldown: 5 * time.Second},
+		"season-2": {Bounds: Bounds{Width: 256, Height: 256}, Palette: 16, Cooldown: 30 * time.Second},
+		"season-3": {Bounds: Bounds{Width: 512, Height: 256}},
+		"guild-42": {Bounds: Bounds{Unbounded: true}},
+	}
+	if !reflect.DeepEqual(canvases, want) {
+		t.Errorf("FromEnv() = %+v, want %+v", canvases, want)
+	}
+	if _, err := canvases.Get("other"); !errors.Is(err, ErrUnknownCanvas) {
+		t.Errorf("Get(other) error = %v, want %v", err, ErrUnknownCanvas)
+	}
+}
+
+func TestFromEnvRejectsInvalidIDs(t *testing.T) {
+	t.Setenv("CANVASES", `{"Season_2": {}}`)
+	if _, err := FromEnv(); err == nil {
+		t.Error("FromEnv accepted canvas ID Season_2")
+	}
+}
+
+func TestParseChunkPath(t *testing.T) {
+	tests := []struct {
+		path           string
+		canvas         string
+		chunkX, chunkY int
+		valid          bool
+	}{
+		{"canvas_chunks/canvas_chunks_1_-2", Default, 1, -2, true},
+		{"projects/p/databases/(default)/documents/canvases/season-2/chunks/canvas_chunks_0_3", "season-2", 0, 3, true},
+		{"users/42", "", 0, 0, false},
+		{"canvases/season-2/users/42", "", 0, 0, false},
+		{"canvases/Bad_ID/chunks/canvas_chunks_0_0", "", 0, 0, false},
+	}
+	for _, tt := range tests {
+		canvasID, chunkX, chunkY, err := ParseChunkPath(tt.path)
+		if !tt.valid {
+			if !errors.Is(err, ErrInvalidChunkID) {
+				t.Errorf("ParseChunkPath(%q) error = %v, want %v", tt.path, err, ErrInvalidChunkID)
+			}
+			continue
+		}
+		if err != nil || canvasID != tt.canvas || chunkX != tt.chunkX || chunkY != tt.chunkY {
+			t.Errorf("ParseChunkPath(%q) = %q, %d, %d, %v, want %q, %d, %d", tt.path, canvasID, chunkX, chunkY, err, tt.canvas, tt.chunkX, tt.chunkY)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package canvas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Default is the ID of the canvas of placements that name none. It is the
+// original canvas, kept in the canvas_chunks and users collections.
+const Default = ""
+
+var (
+	// ErrUnknownCanvas is returned for a canvas that is not configured.
+	ErrUnknownCanvas = errors.New("canvas: unknown canvas")
+
+	validID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+)
+
+// ValidID reports whether id can name a canvas: lowercase letters, digits
+// and dashes, so it is safe in document paths and message attributes.
+func ValidID(id string) bool {
+	return validID.MatchString(id)
+}
+
+// Config holds the settings of a canvas.
+type Config struct {
+	Bounds
+
+	// Palette is the number of colors, placements must use a color below
+	// it. Zero allows all 256.
+	Palette int
+
+	// Cooldown is how long a user waits between two placements on the
+	// canvas.
+	Cooldown time.Duration
+}
+
+// AllowsColor reports whether color is in the palette of the canvas.
+func (c Config) AllowsColor(color uint8) bool {
+	return c.Palette == 0 || int(color) < c.Palette
+}
+
+// UnmarshalJSON reads a canvas of CANVASES, such as
+// {"width": 256, "height": 128, "palette": 16, "cooldown": "30s"}, "size"
+// setting both the width and height of a square canvas.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Size      int    `json:"size"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+		Unbounded bool   `json:"unbounded"`
+		Palette   int    `json:"palette"`
+		Cooldown  string `json:"cooldown"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw.Size < 0 || raw.Width < 0 || raw.Height < 0 || raw.Palette < 0 || raw.Palette > 256 {
+		return fmt.Errorf("invalid size %d, width %d, height %d or palette %d", raw.Size, raw.Width, raw.Height, raw.Palette)
+	}
+	*c = Config{
+		Bounds:  Bounds{Unbounded: raw.Unbounded, Width: raw.Size, Height: raw.Size},
+		Palette: raw.Palette,
+	}
+	if raw.Width != 0 {
+		c.Width = raw.Width
+	}
+	if raw.Height != 0 {
+		c.Height = raw.Height
+	}
+	if raw.Cooldown != "" {
+		cooldown, err := time.ParseDuration(raw.Cooldown)
+		if err != nil {
+			return fmt.Errorf("invalid cooldown: %w", err)
+		}
+		c.Cooldown = cooldown
+	}
+	return nil
+}
+
+// Canvases maps canvas IDs to their settings.
+type Canvases map[string]Config
+
+// Get returns the settings of the canvas, or ErrUnknownCanvas.
+func (cs Canvases) Get(id string) (Config, error) {
+	c, ok := cs[id]
+	if !ok {
+		return Config{}, fmt.Errorf("%w: %q", ErrUnknownCanvas, id)
+	}
+	return c, nil
+}
+
+// FromEnv reads the canvases. The default canvas takes its bounds from
+// BoundsFromEnv, its palette from CANVAS_PALETTE and its
+// cooldown from RATE_LIMIT. CANVASES adds the other canvases as a JSON object
+// of Config by ID.
+func FromEnv() (Canvases, error) {
+	bounds, err := BoundsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	def := Config{Bounds: bounds}
+	if v := os.Getenv("CANVAS_PALETTE"); v != "" {
+		palette, err := strconv.Atoi(v)
+		if err != nil || palette < 0 || palette > 256 {
+			return nil, fmt.Errorf("invalid CANVAS_PALETTE %q", v)
+		}
+		def.Palette = palette
+	}
+	if v := os.Getenv("RATE_LIMIT"); v != "" {
+		cooldown, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RATE_LIMIT %q: %w", v, err)
+		}
+		def.Cooldown = cooldown
+	}
+
+	canvases := Canvases{Default: def}
+	if v := os.Getenv("CANVASES"); v != "" {
+		var others map[string]Config
+		if err := json.Unmarshal([]byte(v), &others); err != nil {
+			return nil, fmt.Errorf("invalid CANVASES: %w", err)
+		}
+		for id, c := range others {
+			if !ValidID(id) {
+				return nil, fmt.Errorf("invalid canvas ID %q in CANVASES", id)
+			}
+			canvases[id] = c
+		}
+	}
+	return canvases, nil
+}
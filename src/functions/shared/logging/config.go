@@ -0,0 +1,129 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// UserKeys are the attribute keys holding user identifiers, redacted by the
+// loggers returned by New.
+var UserKeys = []string{"user", "userID"}
+
+// Config configures the loggers returned by New.
+type Config struct {
+	// ProjectID qualifies the trace IDs found in the context.
+	ProjectID string
+	// Component is set on every entry.
+	Component string
+
+	// Level is the minimum severity logged: DEBUG, INFO (the default),
+	// WARNING, ERROR or CRITICAL. Request payloads are only logged at DEBUG.
+	Level string
+
+	// UserIDs is how user identifiers are logged: "hash" (the default),
+	// "redact" or "plain".
+	UserIDs string
+	// HashKey keys the hash of user identifiers.
+	HashKey string
+
+	// Sampling is "FIRST/THEREAFTER": past the first FIRST entries of a
+	// message each second, only one out of THEREAFTER is logged. WARNING and
+	// above are never sampled. Empty logs every entry.
+	Sampling string
+}
+
+// ConfigFromEnv returns the Config of component read from the LOG_LEVEL,
+// LOG_USER_IDS, LOG_HASH_KEY and LOG_SAMPLING environment variables.
+func ConfigFromEnv(projectID, component string) Config {
+	return Config{
+		ProjectID: projectID,
+		Component: component,
+		Level:     os.Getenv("LOG_LEVEL"),
+		UserIDs:   os.Getenv("LOG_USER_IDS"),
+		HashKey:   os.Getenv("LOG_HASH_KEY"),
+		Sampling:  os.Getenv("LOG_SAMPLING"),
+	}
+}
+
+// New returns a logger writing Cloud Logging entries, with their source
+// location, to the output of the standard logger. Invalid settings are
+// reported and replaced by their default.
+func New(cfg Config) *slog.Logger {
+	opts := &HandlerOptions{
+		ProjectID:  cfg.ProjectID,
+		AddSource:  true,
+		RedactKeys: UserKeys,
+		HashKey:    []byte(cfg.HashKey),
+	}
+
+	var invalid []error
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		invalid = append(invalid, err)
+	}
+	opts.Level = level
+
+	switch strings.ToLower(cfg.UserIDs) {
+	case "", "hash":
+		opts.Redaction = RedactHash
+	case "redact":
+		opts.Redaction = RedactRemove
+	case "plain":
+		opts.Redaction = RedactNone
+	default:
+		invalid = append(invalid, fmt.Errorf("unknown user ID mode %q", cfg.UserIDs))
+	}
+
+	if cfg.Sampling != "" {
+		sampling, err := parseSampling(cfg.Sampling)
+		if err != nil {
+			invalid = append(invalid, err)
+		} else {
+			opts.Sampling = sampling
+		}
+	}
+
+	logger := slog.New(NewHandler(log.Writer(), opts)).With(ComponentKey, cfg.Component)
+	for _, err := range invalid {
+		logger.Warn("Invalid logging configuration, using the default", "error", err)
+	}
+	return logger
+}
+
+// ParseLevel parses a Cloud Logging severity name. An empty name is INFO.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToUpper(name) {
+	case "DEBUG":
+		return slog.LevelDebug, nil
+	case "", "INFO":
+		return slog.LevelInfo, nil
+	case "WARNING", "WARN":
+		return slog.LevelWarn, nil
+	case "ERROR":
+		return slog.LevelError, nil
+	case "CRITICAL":
+		return LevelCritical, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+func parseSampling(s string) (*Sampling, error) {
+	first, thereafter, ok := strings.Cut(s, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid log sampling %q: expected FIRST/THEREAFTER", s)
+	}
+	f, err := strconv.Atoi(first)
+	if err != nil || f < 0 {
+		return nil, fmt.Errorf("invalid log sampling %q: bad FIRST", s)
+	}
+	t, err := strconv.Atoi(thereafter)
+	if err != nil || t < 0 {
+		return nil, fmt.Errorf("invalid log sampling %q: bad THEREAFTER", s)
+	}
+	return &Sampling{First: f, Thereafter: t}, nil
+}
@@ -0,0 +1,438 @@
+package logging
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Keys of the fields given a special meaning by Cloud Logging in structured
+// log entries.
+const (
+	MessageKey        = "message"
+	SeverityKey       = "severity"
+	TimeKey           = "time"
+	SourceLocationKey = "logging.googleapis.com/sourceLocation"
+	LabelsKey         = "logging.googleapis.com/labels"
+	TraceKey          = "logging.googleapis.com/trace"
+	SpanIDKey         = "logging.googleapis.com/spanId"
+	TraceSampledKey   = "logging.googleapis.com/trace_sampled"
+	HTTPRequestKey    = "httpRequest"
+
+	// ComponentKey is the field set by New, displayed by Logs Explorer as
+	// `jsonPayload.component`.
+	ComponentKey = "component"
+)
+
+// LevelCritical is the slog level mapped to the CRITICAL severity.
+const LevelCritical = slog.Level(12)
+
+// HandlerOptions configures a Handler.
+type HandlerOptions struct {
+	// ProjectID qualifies the trace IDs found in the context.
+	ProjectID string
+
+	// Level is the minimum level logged. Defaults to slog.LevelInfo.
+	Level slog.Leveler
+
+	// AddSource adds the source location of the log call to every entry.
+	AddSource bool
+
+	// RedactKeys lists the attribute keys, at any depth, whose values are
+	// rewritten according to Redaction.
+	RedactKeys []string
+	Redaction  Redaction
+	// HashKey keys the HMAC used by RedactHash, so hashed identifiers
+	// cannot be reversed by hashing every candidate.
+	HashKey []byte
+
+	// Sampling limits the entries below WARNING logged for a message.
+	// Nil logs every entry.
+	Sampling *Sampling
+}
+
+// Redaction is how the values of redacted attributes are logged.
+type Redaction int
+
+const (
+	// RedactHash replaces values by a keyed hash, which still allows
+	// following one user across entries.
+	RedactHash Redaction = iota
+	// RedactRemove replaces values by "[REDACTED]".
+	RedactRemove
+	// RedactNone logs values unchanged.
+	RedactNone
+)
+
+// Sampling logs, for each message and level, the First entries of every
+// Tick, then one entry out of Thereafter. A zero Thereafter drops them all.
+type Sampling struct {
+	First      int
+	Thereafter int
+	Tick       time.Duration
+}
+
+// Handler is a slog.Handler writing one JSON object per line in the format
+// of Cloud Logging structured logs. On top of the attributes of the logger
+// and the record, every entry carries the attributes and trace found in the
+// context passed to the logger.
+type Handler struct {
+	opts    HandlerOptions
+	mu      *sync.Mutex
+	w       io.Writer
+	attrs   []groupedAttr
+	groups  []string
+	redact  map[string]bool
+	sampler *sampler
+}
+
+// groupedAttr is an attribute bound with WithAttrs, under the groups opened
+// at that time.
+type groupedAttr struct {
+	groups []string
+	attr   slog.Attr
+}
+
+var _ slog.Handler = (*Handler)(nil)
+
+// NewHandler returns a Handler writing to w. A nil opts uses the defaults.
+func NewHandler(w io.Writer, opts *HandlerOptions) *Handler {
+	h := &Handler{mu: &sync.Mutex{}, w: w}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if len(h.opts.RedactKeys) > 0 && h.opts.Redaction != RedactNone {
+		h.redact = make(map[string]bool, len(h.opts.RedactKeys))
+		for _, k := range h.opts.RedactKeys {
+			h.redact[k] = true
+		}
+	}
+	if h.opts.Sampling != nil {
+		h.sampler = newSampler(*h.opts.Sampling)
+	}
+	return h
+}
+
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if h.opts.Level != nil {
+		minLevel = h.opts.Level.Level()
+	}
+	return level >= minLevel
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := *h
+	out.attrs = slices.Clip(h.attrs)
+	for _, a := range attrs {
+		out.attrs = append(out.attrs, groupedAttr{groups: h.groups, attr: a})
+	}
+	return &out
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	out := *h
+	out.groups = append(slices.Clip(h.groups), name)
+	return &out
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	if h.sampler != nil && r.Level < slog.LevelWarn && !h.sampler.allow(r.Level, r.Message, r.Time) {
+		return nil
+	}
+
+	e := entry{h: h, payload: map[string]any{}, labels: map[string]string{}}
+
+	// Attributes are applied from the least to the most specific, so the
+	// record overrides the logger, which overrides the context.
+	for _, a := range contextAttrs(ctx) {
+		e.add(nil, a)
+	}
+	for _, a := range h.attrs {
+		e.add(a.groups, a.attr)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		e.add(h.groups, a)
+		return true
+	})
+
+	e.payload[MessageKey] = r.Message
+	e.payload[SeverityKey] = severity(r.Level)
+	if !r.Time.IsZero() {
+		e.payload[TimeKey] = r.Time.Format(time.RFC3339Nano)
+	}
+	if h.opts.AddSource && r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		e.payload[SourceLocationKey] = map[string]string{
+			"file":     frame.File,
+			"line":     strconv.Itoa(frame.Line),
+			"function": frame.Function,
+		}
+	}
+	if tc, ok := spanTrace(ctx); ok {
+		e.payload[TraceKey] = fmt.Sprintf("projects/%s/traces/%s", h.opts.ProjectID, tc.TraceID)
+		if tc.SpanID != "" {
+			e.payload[SpanIDKey] = tc.SpanID
+		}
+		e.payload[TraceSampledKey] = tc.Sampled
+	}
+	if len(e.labels) > 0 {
+		e.payload[LabelsKey] = e.labels
+	}
+
+	out, err := json.Marshal(e.payload)
+	if err != nil {
+		return fmt.Errorf("error encoding log entry: %w", err)
+	}
+	out = append(out, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = h.w.Write(out)
+	return err
+}
+
+// spanTrace returns the trace of the span of ctx.
+func spanTrace(ctx context.Context) (TraceContext, bool) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return TraceContext{}, false
+	}
+	return TraceContext{
+		TraceID: sc.TraceID().String(),
+		SpanID:  sc.SpanID().String(),
+		Sampled: sc.IsSampled(),
+	}, true
+}
+
+// entry accumulates the fields of a log entry.
+type entry struct {
+	h       *Handler
+	payload map[string]any
+	labels  map[string]string
+}
+
+func (e *entry) add(groups []string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	// Labels and httpRequest are top-level fields wherever they are set.
+	switch a.Key {
+	case LabelsKey:
+		for _, l := range a.Value.Group() {
+			e.labels[l.Key] = l.Value.Resolve().String()
+		}
+		return
+	case HTTPRequestKey:
+		e.payload[HTTPRequestKey] = e.value(a.Key, a.Value)
+		return
+	}
+
+	if a.Key == "" && a.Value.Kind() == slog.KindGroup {
+		for _, child := range a.Value.Group() {
+			e.add(groups, child)
+		}
+		return
+	}
+
+	m := e.payload
+	for _, g := range groups {
+		sub, ok := m[g].(map[string]any)
+		if !ok {
+			sub = map[string]any{}
+			m[g] = sub
+		}
+		m = sub
+	}
+	m[a.Key] = e.value(a.Key, a.Value)
+}
+
+// value converts v, the value of key, to a value encoded the way Cloud
+// Logging displays it.
+func (e *entry) value(key string, v slog.Value) any {
+	if e.h.redact[key] && v.Kind() != slog.KindGroup {
+		return e.h.redactValue(v.String())
+	}
+
+	switch v.Kind() {
+	case slog.KindGroup:
+		m := make(map[string]any, len(v.Group()))
+		for _, a := range v.Group() {
+			a.Value = a.Value.Resolve()
+			if a.Key == "" && a.Value.Kind() == slog.KindGroup {
+				for k, child := range e.value("", a.Value).(map[string]any) {
+					m[k] = child
+				}
+				continue
+			}
+			m[a.Key] = e.value(a.Key, a.Value)
+		}
+		return m
+	case slog.KindTime:
+		return v.Time().Format(time.RFC3339Nano)
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return err.Error()
+		}
+		return v.Any()
+	default:
+		return v.Any()
+	}
+}
+
+func (h *Handler) redactValue(v string) string {
+	if v == "" {
+		return ""
+	}
+	if h.opts.Redaction == RedactRemove {
+		return "[REDACTED]"
+	}
+	mac := hmac.New(sha256.New, h.opts.HashKey)
+	mac.Write([]byte(v))
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// sampler counts the entries of each message over the current tick.
+type sampler struct {
+	Sampling
+
+	mu     sync.Mutex
+	start  time.Time
+	counts map[samplerKey]int
+}
+
+type samplerKey struct {
+	level   slog.Level
+	message string
+}
+
+func newSampler(s Sampling) *sampler {
+	if s.Tick <= 0 {
+		s.Tick = time.Second
+	}
+	return &sampler{Sampling: s, counts: make(map[samplerKey]int)}
+}
+
+// allow reports whether an entry logged at t should be written.
+func (s *sampler) allow(level slog.Level, message string, t time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.Sub(s.start) >= s.Tick || t.Before(s.start) {
+		s.start = t
+		clear(s.counts)
+	}
+	key := samplerKey{level: level, message: message}
+	s.counts[key]++
+	n := s.counts[key]
+	if n <= s.First {
+		return true
+	}
+	return s.Thereafter > 0 && (n-s.First)%s.Thereafter == 0
+}
+
+// severity maps a slog level to the Cloud Logging severity.
+func severity(level slog.Level) string {
+	switch {
+	case level >= LevelCritical:
+		return "CRITICAL"
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+type attrsKey struct{}
+
+// With returns a copy of ctx carrying the given attributes, added to every
+// entry logged with the context. args are key-value pairs or slog.Attr
+// values, as for slog.Logger.With.
+func With(ctx context.Context, args ...any) context.Context {
+	attrs := slices.Clip(contextAttrs(ctx))
+	attrs = append(attrs, slog.Group("", args...).Value.Group()...)
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+func contextAttrs(ctx context.Context) []slog.Attr {
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// Labels returns an attribute setting the Cloud Logging labels given as
+// key-value pairs. A trailing key without value is ignored.
+func Labels(kv ...string) slog.Attr {
+	attrs := make([]any, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		attrs = append(attrs, slog.String(kv[i], kv[i+1]))
+	}
+	return slog.Group(LabelsKey, attrs...)
+}
+
+// httpRequest is the HttpRequest structure of Cloud Logging.
+type httpRequest struct {
+	RequestMethod string `json:"requestMethod,omitempty"`
+	RequestURL    string `json:"requestUrl,omitempty"`
+	RequestSize   string `json:"requestSize,omitempty"`
+	UserAgent     string `json:"userAgent,omitempty"`
+	RemoteIP      string `json:"remoteIp,omitempty"`
+	Referer       string `json:"referer,omitempty"`
+	Protocol      string `json:"protocol,omitempty"`
+}
+
+// HTTPRequest returns an attribute describing r as the httpRequest of the
+// entry.
+func HTTPRequest(r *http.Request) slog.Attr {
+	req := httpRequest{
+		RequestMethod: r.Method,
+		RequestURL:    r.URL.String(),
+		UserAgent:     r.UserAgent(),
+		RemoteIP:      remoteIP(r),
+		Referer:       r.Referer(),
+		Protocol:      r.Proto,
+	}
+	if r.ContentLength > 0 {
+		req.RequestSize = strconv.FormatInt(r.ContentLength, 10)
+	}
+	return slog.Any(HTTPRequestKey, req)
+}
+
+// remoteIP returns the client address of r, as forwarded by the load
+// balancer in front of Cloud Run when present.
+func remoteIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		first, _, _ := strings.Cut(fwd, ",")
+		return strings.TrimSpace(first)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
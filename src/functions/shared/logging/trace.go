@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// TraceParentHeader is the W3C Trace Context header.
+	TraceParentHeader = "traceparent"
+	// CloudTraceHeader is the legacy header set by Google Cloud load
+	// balancers and Cloud Run: TRACE_ID/SPAN_ID;o=OPTIONS.
+	CloudTraceHeader = "X-Cloud-Trace-Context"
+
+	// TraceParentAttribute is the message attribute carrying the trace of
+	// the placement, in the traceparent format.
+	TraceParentAttribute = "traceparent"
+)
+
+// TraceContext identifies the trace a request or message belongs to.
+type TraceContext struct {
+	// TraceID is 32 lowercase hex characters.
+	TraceID string
+	// SpanID is 16 lowercase hex characters.
+	SpanID  string
+	Sampled bool
+}
+
+var cloudTraceRe = regexp.MustCompile(`^([0-9a-fA-F]{32})(?:/([0-9]+))?(?:;o=([0-9]+))?$`)
+
+// Valid reports whether tc identifies a trace.
+func (tc TraceContext) Valid() bool {
+	return tc.TraceID != "" && strings.Trim(tc.TraceID, "0") != ""
+}
+
+// ParseCloudTraceContext parses an X-Cloud-Trace-Context header value. Its
+// span ID is decimal and is converted to the hex form used by traceparent.
+func ParseCloudTraceContext(v string) (TraceContext, bool) {
+	m := cloudTraceRe.FindStringSubmatch(strings.TrimSpace(v))
+	if m == nil {
+		return TraceContext{}, false
+	}
+	tc := TraceContext{TraceID: strings.ToLower(m[1]), Sampled: m[3] == "1"}
+	if m[2] != "" {
+		span, err := strconv.ParseUint(m[2], 10, 64)
+		if err != nil {
+			return TraceContext{}, false
+		}
+		tc.SpanID = fmt.Sprintf("%016x", span)
+	}
+	return tc, tc.Valid()
+}
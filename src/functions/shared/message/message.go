@@ -0,0 +1,251 @@
+// Package message holds the schemas of the messages exchanged by the
+// functions and the decoding of Pub/Sub push requests.
+package message
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"example.com/shared/bus"
+	"example.com/shared/canvas"
+)
+
+var (
+	// ErrInvalidEnvelope is returned when a push request body is not a valid
+	// Pub/Sub push envelope.
+	ErrInvalidEnvelope = errors.New("message: invalid push envelope")
+
+	// ErrInvalidBase64 is returned when the message data is not valid base64.
+	ErrInvalidBase64 = errors.New("message: invalid base64 data")
+
+	// ErrInvalidPayload is returned when the decoded data does not match the
+	// expected schema.
+	ErrInvalidPayload = errors.New("message: invalid payload")
+
+	// ErrInvalidPixel is returned by PixelInfo.Validate for a placement that
+	// cannot be drawn.
+	ErrInvalidPixel = errors.New("message: invalid pixel")
+)
+
+// CanvasAttribute is the message attribute naming the canvas a placement,
+// user or chunk message is about, so subscriptions can filter on it. It is
+// not set for the default canvas.
+const CanvasAttribute = "canvas"
+
+// CanvasAttributes returns the attributes of a message about the canvas.
+func CanvasAttributes(canvasID string) map[string]string {
+	if canvasID == canvas.Default {
+		return nil
+	}
+	return map[string]string{CanvasAttribute: canvasID}
+}
+
+// EventAttribute is the message attribute naming the event carried by the
+// messages of PIXEL_UPDATE_TOPIC that are not a ChunkUpdate, which have none.
+const EventAttribute = "event"
+
+// Events published on PIXEL_UPDATE_TOPIC besides chunk updates.
+const (
+	// EventCanvasResized carries a CanvasResized.
+	EventCanvasResized = "canvas_resized"
+
+	// EventCanvasCleared carries a CanvasCleared.
+	EventCanvasCleared = "canvas_cleared"
+)
+
+// EventAttributes returns the attributes of a message carrying event about
+// the canvas.
+func EventAttributes(canvasID, event string) map[string]string {
+	attrs := map[string]string{EventAttribute: event}
+	if canvasID != canvas.Default {
+		attrs[CanvasAttribute] = canvasID
+	}
+	return attrs
+}
+
+// CanvasResized is published on PIXEL_UPDATE_TOPIC when a canvas is
+// expanded, so clients grow the board they display.
+type CanvasResized struct {
+	// Canvas is the ID of the canvas, empty for the default canvas.
+	Canvas string `json:"canvas,omitempty"`
+
+	// Width and Height are the bounds the canvas grew to, from
+	// PreviousWidth and PreviousHeight.
+	Width          int `json:"width"`
+	Height         int `json:"height"`
+	PreviousWidth  int `json:"previousWidth"`
+	PreviousHeight int `json:"previousHeight"`
+
+	// At is when the canvas grew, in RFC 3339 format.
+	At string `json:"at"`
+}
+
+// CanvasCleared is published on PIXEL_UPDATE_TOPIC when every pixel of a
+// canvas is erased, so clients blank the board they display.
+type CanvasCleared struct {
+	// Canvas is the ID of the canvas, empty for the default canvas.
+	Canvas string `json:"canvas,omitempty"`
+
+	// Archive is the season archive the pixels were copied to.
+	Archive string `json:"archive"`
+
+	// CooldownsReset reports whether the users may place a pixel at once.
+	CooldownsReset bool `json:"cooldownsReset"`
+
+	// Width and Height are the bounds of the cleared canvas, which differ
+	// from those it had when its bounds were reset. They are omitted for
+	// an unbounded canvas.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// At is when the canvas was cleared, in RFC 3339 format.
+	At string `json:"at"`
+}
+
+// PubSubMessage is the body of a Pub/Sub push request.
+type PubSubMessage struct {
+	Message struct {
+		Data        string            `json:"data"`
+		Attributes  map[string]string `json:"attributes"`
+		MessageID   string            `json:"messageId"`
+		PublishTime string            `json:"publishTime,omitempty"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// PixelInfo is a pixel placement, sent by clients to the proxy and published
+// on DRAW_PIXEL_TOPIC.
+type PixelInfo struct {
+	X         int32  `firestore:"x" json:"x"`
+	Y         int32  `firestore:"y" json:"y"`
+	Color     uint8  `firestore:"color" json:"color"`
+	User      string `firestore:"user" json:"user"`
+	Timestamp string `firestore:"timestamp" json:"timestamp"`
+
+	// Canvas is the ID of the canvas the pixel is placed on, empty for the
+	// default canvas.
+	Canvas string `firestore:"canvas" json:"canvas,omitempty"`
+
+	// PlacedAt is when the proxy accepted the placement, in Unix nanoseconds.
+	// It orders placements of the same pixel, as messages are delivered in
+	// any order. Any value sent by clients is overwritten.
+	PlacedAt int64 `firestore:"placedAt" json:"placedAt,omitempty"`
+}
+
+// LogValue logs the placement field by field, so the user can be redacted.
+func (p PixelInfo) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("x", int(p.X)),
+		slog.Int("y", int(p.Y)),
+		slog.Int("color", int(p.Color)),
+		slog.String("user", p.User),
+		slog.String("timestamp", p.Timestamp),
+		slog.String("canvas", p.Canvas),
+		slog.Int64("placedAt", p.PlacedAt),
+	)
+}
+
+// Validate reports whether the placement can be drawn on the canvas
+// configured by c: its coordinates must be within bounds, its color in the
+// palette and its user a numeric ID.
+func (p PixelInfo) Validate(c canvas.Config) error {
+	if !c.Contains(int(p.X), int(p.Y)) {
+		return fmt.Errorf("%w: coordinates (%d, %d) out of the canvas", ErrInvalidPixel, p.X, p.Y)
+	}
+	if !c.AllowsColor(p.Color) {
+		return fmt.Errorf("%w: color %d out of the palette", ErrInvalidPixel, p.Color)
+	}
+	if _, err := strconv.ParseInt(p.User, 10, 64); err != nil {
+		return fmt.Errorf("%w: user %q is not a numeric ID", ErrInvalidPixel, p.User)
+	}
+	return nil
+}
+
+// UserInfo identifies a user that placed a pixel, published on ADD_USER_TOPIC.
+type UserInfo struct {
+	UserID string `firestore:"userID" json:"userID"`
+
+	// Canvas is the ID of the canvas the user placed the pixel on, empty
+	// for the default canvas.
+	Canvas string `firestore:"canvas" json:"canvas,omitempty"`
+}
+
+// LogValue logs the user field by field, so it can be redacted.
+func (u UserInfo) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("userID", u.UserID), slog.String("canvas", u.Canvas))
+}
+
+// ChunkPixel is a pixel of a ChunkUpdate.
+type ChunkPixel struct {
+	Color uint8 `json:"color"`
+	User  int64 `json:"user"`
+}
+
+// ChunkUpdate is the state of a chunk published on PIXEL_UPDATE_TOPIC after
+// it changed. Pixels are keyed by their coordinates local to the chunk, "x_y".
+type ChunkUpdate struct {
+	// Canvas is the ID of the canvas of the chunk, empty for the default
+	// canvas.
+	Canvas      string                `json:"canvas,omitempty"`
+	ChunkX      int                   `json:"chunkX"`
+	ChunkY      int                   `json:"chunkY"`
+	Size        int32                 `json:"size"`
+	Pixels      map[string]ChunkPixel `json:"pixels"`
+	LastUpdated string                `json:"lastUpdated,omitempty"`
+
+	// Shards is set when the chunk is split into that many documents by
+	// rows. Pixels then only holds those of shard Shard.
+	Shards int `json:"shards,omitempty"`
+	Shard  int `json:"shard,omitempty"`
+}
+
+// ParsePush parses the body of a Pub/Sub push request.
+func ParsePush(body []byte) (*PubSubMessage, error) {
+	var msg PubSubMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	return &msg, nil
+}
+
+// Payload returns the decoded message data.
+func (m *PubSubMessage) Payload() ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(m.Message.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBase64, err)
+	}
+	return data, nil
+}
+
+// Decode decodes the message data as JSON into v.
+func (m *PubSubMessage) Decode(v any) error {
+	data, err := m.Payload()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	return nil
+}
+
+// BusMessage returns the pushed message as a bus.Message, to dead-letter it.
+// Data that is not valid base64 is kept as received.
+func (m *PubSubMessage) BusMessage() *bus.Message {
+	data, err := base64.StdEncoding.DecodeString(m.Message.Data)
+	if err != nil {
+		data = []byte(m.Message.Data)
+	}
+	publishTime, _ := time.Parse(time.RFC3339Nano, m.Message.PublishTime)
+	return &bus.Message{
+		ID:          m.Message.MessageID,
+		Data:        data,
+		Attributes:  m.Message.Attributes,
+		PublishTime: publishTime,
+	}
+}
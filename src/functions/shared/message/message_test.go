@@ -0,0 +1,215 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"example.com/shared/canvas"
+)
+
+// These tests lock the JSON produced and accepted by the functions: changing
+// them means clients, the frontend and in-flight messages break.
+
+func TestPixelInfoWireFormat(t *testing.T) {
+	const want = `{"x":12,"y":-3,"color":7,"user":"123456789","timestamp":"2025-01-02T03:04:05Z"}`
+
+	got, err := json.Marshal(PixelInfo{X: 12, Y: -3, Color: 7, User: "123456789", Timestamp: "2025-01-02T03:04:05Z"})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("json.Marshal(PixelInfo) = %s, want %s", got, want)
+	}
+
+	var p PixelInfo
+	if err := json.Unmarshal([]byte(want), &p); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if p.X != 12 || p.Y != -3 || p.Color != 7 || p.User != "123456789" || p.Timestamp != "2025-01-02T03:04:05Z" {
+		t.Errorf("json.Unmarshal(%s) = %+v", want, p)
+	}
+}
+
+func TestPixelInfoRejectsColorOutOfRange(t *testing.T) {
+	var p PixelInfo
+	if err := json.Unmarshal([]byte(`{"x":0,"y":0,"color":256,"user":"1"}`), &p); err == nil {
+		t.Errorf("json.Unmarshal accepted color 256: %+v", p)
+	}
+}
+
+func TestUserInfoWireFormat(t *testing.T) {
+	const want = `{"userID":"123456789"}`
+
+	got, err := json.Marshal(UserInfo{UserID: "123456789"})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("json.Marshal(UserInfo) = %s, want %s", got, want)
+	}
+}
+
+func TestChunkUpdateWireFormat(t *testing.T) {
+	const want = `{"chunkX":1,"chunkY":2,"size":64,"pixels":{"3_4":{"color":5,"user":42}},"lastUpdated":"2025-01-02T03:04:05.000000006Z"}`
+
+	got, err := json.Marshal(ChunkUpdate{
+		ChunkX:      1,
+		ChunkY:      2,
+		Size:        64,
+		Pixels:      map[string]ChunkPixel{"3_4": {Color: 5, User: 42}},
+		LastUpdated: "2025-01-02T03:04:05.000000006Z",
+	})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("json.Marshal(ChunkUpdate) = %s, want %s", got, want)
+	}
+}
+
+func TestCanvasResizedWireFormat(t *testing.T) {
+	const want = `{"canvas":"season-2","width":512,"height":256,"previousWidth":256,"previousHeight":256,"at":"2025-01-02T03:04:05Z"}`
+
+	got, err := json.Marshal(CanvasResized{Canvas: "season-2", Width: 512, Height: 256, PreviousWidth: 256, PreviousHeight: 256, At: "2025-01-02T03:04:05Z"})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("json.Marshal(CanvasResized) = %s, want %s", got, want)
+	}
+	if attrs := EventAttributes("season-2", EventCanvasResized); attrs[EventAttribute] != "canvas_resized" || attrs[CanvasAttribute] != "season-2" {
+		t.Errorf("EventAttributes = %v, want the event and canvas attributes", attrs)
+	}
+}
+
+func TestCanvasClearedWireFormat(t *testing.T) {
+	const want = `{"archive":"season-1","cooldownsReset":true,"at":"2025-01-02T03:04:05Z"}`
+
+	got, err := json.Marshal(CanvasCleared{Archive: "season-1", CooldownsReset: true, At: "2025-01-02T03:04:05Z"})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("json.Marshal(CanvasCleared) = %s, want %s", got, want)
+	}
+	if attrs := EventAttributes("", EventCanvasCleared); attrs[EventAttribute] != "canvas_cleared" || len(attrs) != 1 {
+		t.Errorf("EventAttributes = %v, want only the event attribute", attrs)
+	}
+}
+
+func TestParsePush(t *testing.T) {
+	// A push request as sent by Pub/Sub, including the snake_case duplicates.
+	body := []byte(`{
+		"message": {
+			"attributes": {"key": "value"},
+			"data": "eyJ4IjoxLCJ5IjoyLCJjb2xvciI6MywidXNlciI6IjQyIn0=",
+			"messageId": "2070443601311540",
+			"message_id": "2070443601311540",
+			"publishTime": "2021-02-26T19:13:55.749Z",
+			"publish_time": "2021-02-26T19:13:55.749Z"
+		},
+		"subscription": "projects/myproject/subscriptions/mysubscription"
+	}`)
+
+	msg, err := ParsePush(body)
+	if err != nil {
+		t.Fatalf("ParsePush: %v", err)
+	}
+	if msg.Message.MessageID != "2070443601311540" || msg.Message.PublishTime != "2021-02-26T19:13:55.749Z" {
+		t.Errorf("ParsePush message = %+v", msg.Message)
+	}
+	if msg.Message.Attributes["key"] != "value" {
+		t.Errorf("ParsePush attributes = %v", msg.Message.Attributes)
+	}
+	if msg.Subscription != "projects/myproject/subscriptions/mysubscription" {
+		t.Errorf("ParsePush subscription = %q", msg.Subscription)
+	}
+
+	var p PixelInfo
+	if err := msg.Decode(&p); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if want := (PixelInfo{X: 1, Y: 2, Color: 3, User: "42"}); p != want {
+		t.Errorf("Decode = %+v, want %+v", p, want)
+	}
+}
+
+func TestParsePushErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want error
+	}{
+		{"not json", `not json`, ErrInvalidEnvelope},
+		{"bad base64", `{"message":{"data":"%%%"}}`, ErrInvalidBase64},
+		{"bad payload", `{"message":{"data":"bm90IGpzb24="}}`, ErrInvalidPayload},
+		{"wrong payload type", `{"message":{"data":"eyJ4IjoiYSJ9"}}`, ErrInvalidPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ParsePush([]byte(tt.body))
+			if err == nil {
+				var p PixelInfo
+				err = msg.Decode(&p)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPixelInfoValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		pixel  PixelInfo
+		config canvas.Config
+		valid  bool
+	}{
+		{"valid", PixelInfo{X: 0, Y: 10, Color: 3, User: "42"}, canvas.Config{}, true},
+		{"negative x", PixelInfo{X: -1, Y: 10, User: "42"}, canvas.Config{}, false},
+		{"negative y", PixelInfo{X: 1, Y: -10, User: "42"}, canvas.Config{}, false},
+		{"negative unbounded", PixelInfo{X: -1, Y: -10, User: "42"}, canvas.Config{Bounds: canvas.Bounds{Unbounded: true}}, true},
+		{"past width", PixelInfo{X: 100, Y: 0, User: "42"}, canvas.Config{Bounds: canvas.Bounds{Width: 100, Height: 200}}, false},
+		{"within height", PixelInfo{X: 0, Y: 150, User: "42"}, canvas.Config{Bounds: canvas.Bounds{Width: 100, Height: 200}}, true},
+		{"in palette", PixelInfo{X: 1, Y: 1, Color: 15, User: "42"}, canvas.Config{Palette: 16}, true},
+		{"out of palette", PixelInfo{X: 1, Y: 1, Color: 16, User: "42"}, canvas.Config{Palette: 16}, false},
+		{"non numeric user", PixelInfo{X: 1, Y: 1, User: "bob"}, canvas.Config{}, false},
+		{"missing user", PixelInfo{X: 1, Y: 1}, canvas.Config{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.pixel.Validate(tt.config)
+			if tt.valid && err != nil {
+				t.Errorf("Validate() = %v, want nil", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidPixel) {
+				t.Errorf("Validate() = %v, want %v", err, ErrInvalidPixel)
+			}
+		})
+	}
+}
+
+func TestBusMessageKeepsInvalidData(t *testing.T) {
+	msg, err := ParsePush([]byte(`{"message":{"data":"%%%","messageId":"1","attributes":{"key":"value"}}}`))
+	if err != nil {
+		t.Fatalf("ParsePush: %v", err)
+	}
+	m := msg.BusMessage()
+	if string(m.Data) != "%%%" || m.ID != "1" || m.Attributes["key"] != "value" {
+		t.Errorf("BusMessage() = %+v", m)
+	}
+}
+
+func TestPixelInfoPlacedAt(t *testing.T) {
+	const want = `{"x":1,"y":2,"color":3,"user":"42","timestamp":"","placedAt":1735787045000000006}`
+
+	got, err := json.Marshal(PixelInfo{X: 1, Y: 2, Color: 3, User: "42", PlacedAt: 1735787045000000006})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("json.Marshal(PixelInfo) = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,191 @@
+// Package metrics holds the OpenTelemetry instruments of the placement
+// pipeline and the setup of their export.
+//
+// Every measurement carries the component recording it. Requests and
+// messages are counted by the reason they were accepted ("ok") or rejected,
+// publishes and store operations are timed with their outcome.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// Attribute keys of the measurements.
+const (
+	ComponentKey = attribute.Key("component")
+	ReasonKey    = attribute.Key("reason")
+	OutcomeKey   = attribute.Key("outcome")
+	TopicKey     = attribute.Key("topic")
+	OperationKey = attribute.Key("operation")
+)
+
+// Reasons pixels received are not written, recorded by PixelsSkipped.
+const (
+	// SkipStale is a pixel older than the one stored, rejected by
+	// last-writer-wins.
+	SkipStale = "stale"
+
+	// SkipSuperseded is a pixel replaced by a later placement of the same
+	// pixel written in the same batch.
+	SkipSuperseded = "superseded"
+)
+
+// ReasonOK is the reason of requests and messages handled successfully.
+const ReasonOK = "ok"
+
+// Config selects how the measurements are exported.
+type Config struct {
+	// Exporter is "otlp", pushing to the collector configured by the
+	// standard OTEL_EXPORTER_OTLP_* variables, "prometheus", registering
+	// with the default Prometheus registry, or "" to not export.
+	Exporter string
+
+	// ServiceName is the service.name resource attribute.
+	ServiceName string
+}
+
+var (
+	setupOnce sync.Once
+	setupErr  error
+	provider  *sdkmetric.MeterProvider
+)
+
+// Setup installs the global MeterProvider. Only the first call in a process
+// has an effect, so functions sharing a process share one provider.
+func Setup(ctx context.Context, cfg Config) error {
+	setupOnce.Do(func() {
+		var reader sdkmetric.Reader
+		switch cfg.Exporter {
+		case "", "none":
+			return
+		case "otlp":
+			exp, err := otlpmetricgrpc.New(ctx)
+			if err != nil {
+				setupErr = fmt.Errorf("error creating OTLP metric exporter: %w", err)
+				return
+			}
+			reader = sdkmetric.NewPeriodicReader(exp)
+		case "prometheus":
+			exp, err := prometheus.New()
+			if err != nil {
+				setupErr = fmt.Errorf("error creating Prometheus metric exporter: %w", err)
+				return
+			}
+			reader = exp
+		default:
+			setupErr = fmt.Errorf("metrics: unknown exporter %q", cfg.Exporter)
+			return
+		}
+
+		res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+			attribute.String("service.name", cfg.ServiceName),
+		))
+		if err != nil {
+			setupErr = fmt.Errorf("error building metric resource: %w", err)
+			return
+		}
+		provider = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithResource(res))
+		otel.SetMeterProvider(provider)
+	})
+	return setupErr
+}
+
+// Shutdown flushes the pending measurements and stops the provider
+// installed by Setup.
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
+
+// Instruments are created from the global provider, which forwards them to
+// the provider installed by Setup.
+var (
+	meter = otel.Meter("example.com/shared/metrics")
+
+	handled = must(meter.Int64Counter("airplace.messages.handled",
+		metric.WithDescription("Requests and messages handled, by the reason they were accepted or rejected."),
+		metric.WithUnit("{message}")))
+	pixels = must(meter.Int64Counter("airplace.pixels.written",
+		metric.WithDescription("Pixels written to the canvas."),
+		metric.WithUnit("{pixel}")))
+	skipped = must(meter.Int64Counter("airplace.pixels.skipped",
+		metric.WithDescription("Pixels received but not written, by the reason they were skipped."),
+		metric.WithUnit("{pixel}")))
+	coalesced = must(meter.Int64Histogram("airplace.chunk.coalesced",
+		metric.WithDescription("Placements merged into each chunk write; its sum over its count is the coalescing ratio."),
+		metric.WithUnit("{placement}"),
+		metric.WithExplicitBucketBoundaries(1, 2, 5, 10, 20, 50, 100, 200, 500)))
+	publishDuration = must(meter.Float64Histogram("airplace.publish.duration",
+		metric.WithDescription("Latency of message publishes."),
+		metric.WithUnit("s")))
+	storeDuration = must(meter.Float64Histogram("airplace.store.duration",
+		metric.WithDescription("Latency of canvas store operations."),
+		metric.WithUnit("s")))
+)
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		otel.Handle(err)
+	}
+	return v
+}
+
+// Handled counts a request or message handled by component, with the reason
+// it was accepted (ReasonOK) or rejected.
+func Handled(ctx context.Context, component, reason string) {
+	handled.Add(ctx, 1, metric.WithAttributes(ComponentKey.String(component), ReasonKey.String(reason)))
+}
+
+// PixelsWritten counts pixels written to the canvas by component.
+func PixelsWritten(ctx context.Context, component string, n int) {
+	pixels.Add(ctx, int64(n), metric.WithAttributes(ComponentKey.String(component)))
+}
+
+// PixelsSkipped counts pixels received by component but not written, for
+// reason SkipStale or SkipSuperseded.
+func PixelsSkipped(ctx context.Context, component, reason string, n int) {
+	skipped.Add(ctx, int64(n), metric.WithAttributes(ComponentKey.String(component), ReasonKey.String(reason)))
+}
+
+// Coalesced records a chunk write by component merging n placements.
+func Coalesced(ctx context.Context, component string, n int) {
+	coalesced.Record(ctx, int64(n), metric.WithAttributes(ComponentKey.String(component)))
+}
+
+// Published records the latency of a publish on topic started at start.
+func Published(ctx context.Context, component, topic string, start time.Time, err error) {
+	publishDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+		ComponentKey.String(component), TopicKey.String(topic), outcome(err)))
+}
+
+// StoreOperation records the latency of a canvas store operation started at
+// start.
+func StoreOperation(ctx context.Context, component, operation string, start time.Time, err error) {
+	storeDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+		ComponentKey.String(component), OperationKey.String(operation), outcome(err)))
+}
+
+func outcome(err error) attribute.KeyValue {
+	switch {
+	case err == nil:
+		return OutcomeKey.String("ok")
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return OutcomeKey.String("canceled")
+	default:
+		return OutcomeKey.String("error")
+	}
+}
@@ -0,0 +1,157 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"example.com/shared/canvas"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// archiveReadPage is how many chunk documents ArchiveChunks reads at once.
+const archiveReadPage = 100
+
+// archive returns the document of the archive of the season.
+func (s *FirestoreStore) archive(season string) *firestore.DocumentRef {
+	return s.client.Collection(ArchiveCollection).Doc(season)
+}
+
+// CreateArchive creates the archive document of the season, which Firestore
+// refuses if it exists.
+func (s *FirestoreStore) CreateArchive(ctx context.Context, season string, archive *Archive) error {
+	_, err := s.archive(season).Create(ctx, archive)
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrExists
+	}
+	if err != nil {
+		return fmt.Errorf("error creating archive %q: %w", season, err)
+	}
+	return nil
+}
+
+func (s *FirestoreStore) GetArchive(ctx context.Context, season string) (*Archive, error) {
+	doc, err := s.archive(season).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive %q: %w", season, err)
+	}
+	archive := &Archive{}
+	if err := doc.DataTo(archive); err != nil {
+		return nil, fmt.Errorf("error decoding archive %q: %w", season, err)
+	}
+	return archive, nil
+}
+
+// ArchiveChunks copies the chunk documents of the canvas, shards included, in
+// BulkWriter batches.
+func (s *FirestoreStore) ArchiveChunks(ctx context.Context, canvasID, season string) (int, error) {
+	refs, err := s.chunks(canvasID).DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("error listing chunks: %w", err)
+	}
+	dst := s.archive(season)
+	bw := s.client.BulkWriter(ctx)
+	var jobs []*firestore.BulkWriterJob
+	for page := range slices.Chunk(refs, archiveReadPage) {
+		docs, err := s.client.GetAll(ctx, page)
+		if err != nil {
+			bw.End()
+			return 0, fmt.Errorf("error reading chunks: %w", err)
+		}
+		for _, doc := range docs {
+			if !doc.Exists() {
+				continue
+			}
+			job, err := bw.Set(dst.Collection(canvas.CanvasChunks).Doc(doc.Ref.ID), doc.Data())
+			if err != nil {
+				bw.End()
+				return 0, fmt.Errorf("error archiving chunk %s: %w", doc.Ref.ID, err)
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	bw.End()
+	if err := bulkResults(jobs); err != nil {
+		return 0, fmt.Errorf("error archiving chunks: %w", err)
+	}
+
+	if _, err := dst.Update(ctx, []firestore.Update{
+		{Path: "documents", Value: len(jobs)},
+		{Path: "archivedAt", Value: time.Now()},
+	}); err != nil {
+		return 0, fmt.Errorf("error updating archive %q: %w", season, err)
+	}
+	return len(jobs), nil
+}
+
+func (s *FirestoreStore) SetArchiveCleared(ctx context.Context, season string, at time.Time) error {
+	if _, err := s.archive(season).Update(ctx, []firestore.Update{{Path: "clearedAt", Value: at}}); err != nil {
+		return fmt.Errorf("error updating archive %q: %w", season, err)
+	}
+	return nil
+}
+
+// DeleteChunks deletes every chunk document of the canvas, shards included,
+// in BulkWriter batches.
+func (s *FirestoreStore) DeleteChunks(ctx context.Context, canvasID string) (int, error) {
+	n, err := s.bulkDelete(ctx, s.chunks(canvasID))
+	if err != nil {
+		return n, fmt.Errorf("error deleting chunks: %w", err)
+	}
+	return n, nil
+}
+
+// DeleteUsers deletes every user of the canvas in BulkWriter batches.
+func (s *FirestoreStore) DeleteUsers(ctx context.Context, canvasID string) (int, error) {
+	n, err := s.bulkDelete(ctx, s.users(canvasID))
+	if err != nil {
+		return n, fmt.Errorf("error deleting users: %w", err)
+	}
+	return n, nil
+}
+
+// bulkDelete deletes every document of col in BulkWriter batches.
+func (s *FirestoreStore) bulkDelete(ctx context.Context, col *firestore.CollectionRef) (int, error) {
+	bw := s.client.BulkWriter(ctx)
+	var jobs []*firestore.BulkWriterJob
+	refs := col.DocumentRefs(ctx)
+	for {
+		ref, err := refs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			bw.End()
+			return 0, err
+		}
+		job, err := bw.Delete(ref)
+		if err != nil {
+			bw.End()
+			return 0, err
+		}
+		jobs = append(jobs, job)
+	}
+	bw.End()
+	if err := bulkResults(jobs); err != nil {
+		return 0, err
+	}
+	return len(jobs), nil
+}
+
+// bulkResults returns the first error of the BulkWriter jobs, which must be
+// flushed.
+func bulkResults(jobs []*firestore.BulkWriterJob) error {
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
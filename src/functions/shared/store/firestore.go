@@ -0,0 +1,596 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"example.com/shared/canvas"
+	"example.com/shared/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FirestoreStore is the CanvasStore backed by Cloud Firestore.
+type FirestoreStore struct {
+	client         *firestore.Client
+	userCollection string
+
+	// ChunkFormat is the encoding of the chunks written. Chunks stored in
+	// the other format are converted when next written. Defaults to
+	// FormatMap.
+	ChunkFormat ChunkFormat
+
+	// ShardThreshold is the size in bytes past which a chunk in FormatMap
+	// is split into several documents by rows, see CheckChunkSize. Sharded
+	// chunks stay in FormatMap whatever ChunkFormat. Zero never shards.
+	ShardThreshold int
+}
+
+var (
+	_ CanvasStore = (*FirestoreStore)(nil)
+	_ ChunkAdmin  = (*FirestoreStore)(nil)
+	_ Archiver    = (*FirestoreStore)(nil)
+)
+
+// NewFirestore connects to the given Firestore database. Users are stored in
+// userCollection, or "users" when it is empty.
+func NewFirestore(ctx context.Context, projectID, database, userCollection string) (*FirestoreStore, error) {
+	client, err := firestore.NewClientWithDatabase(ctx, projectID, database)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to Firestore: %w", err)
+	}
+	if userCollection == "" {
+		userCollection = "users"
+	}
+	return &FirestoreStore{client: client, userCollection: userCollection}, nil
+}
+
+// chunks returns the collection holding the chunks of the canvas.
+func (s *FirestoreStore) chunks(canvasID string) *firestore.CollectionRef {
+	if canvasID == canvas.Default {
+		return s.client.Collection(ChunkCollection)
+	}
+	return s.client.Collection(CanvasCollection).Doc(canvasID).Collection(canvas.CanvasChunks)
+}
+
+// meta returns the metadata document of the canvas.
+func (s *FirestoreStore) meta(canvasID string) *firestore.DocumentRef {
+	if canvasID == canvas.Default {
+		return s.client.Collection(CanvasCollection).Doc(canvas.DefaultMetadataID)
+	}
+	return s.client.Collection(CanvasCollection).Doc(canvasID)
+}
+
+// users returns the collection holding the users of the canvas.
+func (s *FirestoreStore) users(canvasID string) *firestore.CollectionRef {
+	if canvasID == canvas.Default {
+		return s.client.Collection(s.userCollection)
+	}
+	return s.client.Collection(CanvasCollection).Doc(canvasID).Collection(canvas.CanvasUsers)
+}
+
+func (s *FirestoreStore) GetChunk(ctx context.Context, canvasID, id string) (*Chunk, error) {
+	doc, err := s.chunks(canvasID).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading chunk %s: %w", id, err)
+	}
+
+	docs := []*firestore.DocumentSnapshot{doc}
+	if shards := shardCount(doc.Data()); shards > 1 {
+		refs := make([]*firestore.DocumentRef, 0, shards-1)
+		for shard := 1; shard < shards; shard++ {
+			refs = append(refs, s.chunks(canvasID).Doc(canvas.ShardID(id, shard)))
+		}
+		shardDocs, err := s.client.GetAll(ctx, refs)
+		if err != nil {
+			return nil, fmt.Errorf("error reading shards of chunk %s: %w", id, err)
+		}
+		docs = append(docs, shardDocs...)
+	}
+
+	chunk := &Chunk{Canvas: canvasID, ID: id, Pixels: map[string]Pixel{}}
+	if size, ok := doc.Data()["size"].(int64); ok {
+		chunk.Size = int32(size)
+	}
+	for _, doc := range docs {
+		if !doc.Exists() {
+			continue
+		}
+		data := doc.Data()
+		pixels, _, err := decodeChunkPixels(data)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding chunk %s: %w", id, err)
+		}
+		maps.Copy(chunk.Pixels, pixels)
+		// The chunk was last updated when any of its shards was.
+		if lastUpdated, ok := data["lastUpdated"].(time.Time); ok && lastUpdated.After(chunk.LastUpdated) {
+			chunk.LastUpdated = lastUpdated
+			chunk.Trace, _ = data["trace"].(string)
+		}
+	}
+	return chunk, nil
+}
+
+func (s *FirestoreStore) SetChunkPixels(ctx context.Context, updates []ChunkUpdate) (written int, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "firestore SetChunkPixels",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system.name", "gcp.firestore"),
+			attribute.String("db.collection.name", ChunkCollection),
+			attribute.Int("airplace.chunks", len(updates)),
+		))
+	defer func() { tracing.End(span, err) }()
+
+	for _, update := range updates {
+		applied, err := s.setChunk(ctx, update)
+		if err != nil {
+			return written, err
+		}
+		written += applied
+	}
+	span.SetAttributes(attribute.Int("airplace.pixels", written))
+	return written, nil
+}
+
+// setChunk merges the pixels of update newer than the stored ones in a
+// transaction, and returns how many were written.
+func (s *FirestoreStore) setChunk(ctx context.Context, update ChunkUpdate) (int, error) {
+	col := s.chunks(update.Canvas)
+	docRef := col.Doc(update.ID)
+	format := s.format()
+
+	var applied int
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// The function is retried on contention, with the chunk read again.
+		applied = 0
+
+		doc, err := tx.Get(docRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		stored, storedFormat, shards := map[string]Pixel{}, format, 1
+		if doc.Exists() {
+			if stored, storedFormat, err = decodeChunkPixels(doc.Data()); err != nil {
+				return err
+			}
+			shards = shardCount(doc.Data())
+		}
+		if shards > 1 {
+			// Every shard is read, in case the chunk must be split further.
+			refs := make([]*firestore.DocumentRef, 0, shards-1)
+			for shard := 1; shard < shards; shard++ {
+				refs = append(refs, col.Doc(canvas.ShardID(update.ID, shard)))
+			}
+			shardDocs, err := tx.GetAll(refs)
+			if err != nil {
+				return err
+			}
+			for _, shardDoc := range shardDocs {
+				if !shardDoc.Exists() {
+					continue
+				}
+				pixels, _, err := decodeChunkPixels(shardDoc.Data())
+				if err != nil {
+					return err
+				}
+				maps.Copy(stored, pixels)
+			}
+		}
+
+		changed := make(map[string]Pixel, len(update.Pixels))
+		for key, p := range update.Pixels {
+			if old, ok := stored[key]; ok && !p.newer(old) {
+				continue
+			}
+			changed[key] = p
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		applied = len(changed)
+
+		fields := map[string]any{
+			"size":        update.Size,
+			"lastUpdated": firestore.ServerTimestamp,
+			"trace":       update.Trace,
+		}
+		if shards > 1 || (storedFormat == FormatMap && format == FormatMap && s.ShardThreshold > 0) {
+			return s.setShards(tx, col, update, stored, changed, shards)
+		}
+		if format == FormatMap && storedFormat == FormatMap {
+			pixels, err := pixelFields(FormatMap, update.Size, changed)
+			if err != nil {
+				return err
+			}
+			maps.Copy(fields, pixels)
+			return tx.Set(docRef, fields, firestore.MergeAll)
+		}
+
+		// Packed chunks, and chunks changing format, are rewritten in full.
+		maps.Copy(stored, changed)
+		pixels, err := pixelFields(format, update.Size, stored)
+		if err != nil {
+			return err
+		}
+		maps.Copy(fields, pixels)
+		return tx.Set(docRef, fields)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error writing chunk %s: %w", update.ID, err)
+	}
+	return applied, nil
+}
+
+// setShards writes the changed pixels of a chunk in FormatMap stored in
+// shards documents, splitting it further if that takes one of them past
+// ShardThreshold. When the chunk is split, every shard is rewritten,
+// otherwise the changed pixels are merged into theirs.
+func (s *FirestoreStore) setShards(tx *firestore.Transaction, col *firestore.CollectionRef, update ChunkUpdate, stored, changed map[string]Pixel, shards int) error {
+	size := int(update.Size)
+	all := maps.Clone(stored)
+	maps.Copy(all, changed)
+	split, err := shardsFor(all, size, s.ShardThreshold, shards)
+	if err != nil {
+		return err
+	}
+
+	pixels, opts := changed, []firestore.SetOption{firestore.MergeAll}
+	if split != shards {
+		pixels, opts = all, nil
+	}
+	byShard, err := splitShards(pixels, size, split)
+	if err != nil {
+		return err
+	}
+	for shard, shardPixels := range byShard {
+		if len(shardPixels) == 0 && split == shards {
+			continue
+		}
+		fields, err := pixelFields(FormatMap, update.Size, shardPixels)
+		if err != nil {
+			return err
+		}
+		fields["size"] = update.Size
+		fields["lastUpdated"] = firestore.ServerTimestamp
+		fields["trace"] = update.Trace
+		if split > 1 {
+			fields[shardsField] = split
+		}
+		if shard > 0 {
+			fields[shardField] = shard
+		}
+		if err := tx.Set(col.Doc(canvas.ShardID(update.ID, shard)), fields, opts...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardCount returns the number of documents of the chunk whose first
+// document holds data.
+func shardCount(data map[string]any) int {
+	if shards, ok := data[shardsField].(int64); ok && shards > 1 {
+		return int(shards)
+	}
+	return 1
+}
+
+func (s *FirestoreStore) format() ChunkFormat {
+	if s.ChunkFormat == "" {
+		return FormatMap
+	}
+	return s.ChunkFormat
+}
+
+// Fields of a chunk document holding its pixels: pixelsField in FormatMap,
+// the others in FormatPacked, where formatField is set.
+const (
+	formatField   = "format"
+	pixelsField   = "pixels"
+	colorsField   = "colors"
+	ownersField   = "owners"
+	usersField    = "users"
+	placedAtField = "placedAt"
+)
+
+// decodeChunkPixels decodes the pixels of a chunk document in either format,
+// and returns the format.
+func decodeChunkPixels(data map[string]any) (map[string]Pixel, ChunkFormat, error) {
+	if format, _ := data[formatField].(string); format == string(FormatPacked) {
+		size, _ := data["size"].(int64)
+		c := &PackedChunk{Size: int32(size)}
+		c.Colors, _ = data[colorsField].([]byte)
+		c.Owners, _ = data[ownersField].([]byte)
+		c.PlacedAt, _ = data[placedAtField].([]byte)
+		users, _ := data[usersField].([]any)
+		for _, u := range users {
+			user, _ := u.(int64)
+			c.Users = append(c.Users, user)
+		}
+		pixels, err := c.Unpack()
+		return pixels, FormatPacked, err
+	}
+
+	stored, _ := data[pixelsField].(map[string]any)
+	pixels := make(map[string]Pixel, len(stored))
+	for key, v := range stored {
+		if p, ok := pixelFromData(v); ok {
+			pixels[key] = p
+		}
+	}
+	return pixels, FormatMap, nil
+}
+
+// pixelFields returns the fields holding the pixels of a chunk in format.
+func pixelFields(format ChunkFormat, size int32, pixels map[string]Pixel) (map[string]any, error) {
+	if format == FormatPacked {
+		c, err := Pack(size, pixels)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{
+			formatField:   string(FormatPacked),
+			colorsField:   c.Colors,
+			ownersField:   c.Owners,
+			usersField:    c.Users,
+			placedAtField: c.PlacedAt,
+		}, nil
+	}
+
+	fields := make(map[string]any, len(pixels))
+	for key, p := range pixels {
+		fields[key] = map[string]any{
+			"color":    p.Color,
+			"user":     p.User,
+			"placedAt": p.PlacedAt,
+		}
+	}
+	return map[string]any{pixelsField: fields}, nil
+}
+
+// pixelFromData decodes a pixel of a chunk document in FormatMap.
+func pixelFromData(v any) (Pixel, bool) {
+	p, ok := v.(map[string]any)
+	if !ok {
+		return Pixel{}, false
+	}
+	color, _ := p["color"].(int64)
+	user, _ := p["user"].(int64)
+	placedAt, _ := p["placedAt"].(int64)
+	return Pixel{Color: uint8(color), User: user, PlacedAt: placedAt}, true
+}
+
+// ChunkIDs returns the IDs of the chunks of the canvas, without those of the
+// other documents of sharded chunks.
+func (s *FirestoreStore) ChunkIDs(ctx context.Context, canvasID string) ([]string, error) {
+	refs, err := s.chunks(canvasID).DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("error listing chunks: %w", err)
+	}
+	ids := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		if _, shard := canvas.SplitShardID(ref.ID); shard == 0 {
+			ids = append(ids, ref.ID)
+		}
+	}
+	return ids, nil
+}
+
+// DeleteChunk deletes the chunk of the canvas with all its shards. Deleting
+// a chunk that does not exist is not an error.
+func (s *FirestoreStore) DeleteChunk(ctx context.Context, canvasID, id string) error {
+	col := s.chunks(canvasID)
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(col.Doc(id))
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for shard := range shardCount(doc.Data()) {
+			if err := tx.Delete(col.Doc(canvas.ShardID(id, shard))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting chunk %s: %w", id, err)
+	}
+	return nil
+}
+
+// ConvertChunk rewrites the chunk of the canvas in format, leaving its pixels
+// and last update time as they are. It reports whether the chunk was
+// rewritten, false if it does not exist, is already in format or is sharded.
+func (s *FirestoreStore) ConvertChunk(ctx context.Context, canvasID, id string, format ChunkFormat) (bool, error) {
+	docRef := s.chunks(canvasID).Doc(id)
+
+	var converted bool
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		converted = false
+
+		doc, err := tx.Get(docRef)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data := doc.Data()
+		pixels, stored, err := decodeChunkPixels(data)
+		if err != nil || stored == format {
+			return err
+		}
+		// Sharded chunks stay in FormatMap.
+		if shardCount(data) > 1 {
+			return nil
+		}
+
+		size, _ := data["size"].(int64)
+		fields, err := pixelFields(format, int32(size), pixels)
+		if err != nil {
+			return err
+		}
+		for _, f := range []string{formatField, pixelsField, colorsField, ownersField, usersField, placedAtField} {
+			delete(data, f)
+		}
+		maps.Copy(data, fields)
+		converted = true
+		return tx.Set(docRef, data)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error converting chunk %s: %w", id, err)
+	}
+	return converted, nil
+}
+
+func (s *FirestoreStore) GetUser(ctx context.Context, canvas, id string) (*User, error) {
+	doc, err := s.users(canvas).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading user %s: %w", id, err)
+	}
+
+	user := &User{ID: id}
+	switch v := doc.Data()["lastUpdated"].(type) {
+	case time.Time:
+		user.LastUpdated = v
+	case *time.Time:
+		if v != nil {
+			user.LastUpdated = *v
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("unexpected type for lastUpdated of user %s: %T", id, v)
+	}
+	return user, nil
+}
+
+func (s *FirestoreStore) UpdateUser(ctx context.Context, canvas, id string) error {
+	if _, err := s.users(canvas).Doc(id).Set(ctx, map[string]any{
+		"lastUpdated": firestore.ServerTimestamp,
+	}); err != nil {
+		return fmt.Errorf("error writing user %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *FirestoreStore) GetCanvasMeta(ctx context.Context, canvasID string) (*CanvasMeta, error) {
+	doc, err := s.meta(canvasID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata of canvas %q: %w", canvasID, err)
+	}
+	meta := &CanvasMeta{}
+	if err := doc.DataTo(meta); err != nil {
+		return nil, fmt.Errorf("error decoding metadata of canvas %q: %w", canvasID, err)
+	}
+	return meta, nil
+}
+
+func (s *FirestoreStore) SetCanvasMeta(ctx context.Context, canvasID string, meta *CanvasMeta) error {
+	if _, err := s.meta(canvasID).Set(ctx, meta); err != nil {
+		return fmt.Errorf("error writing metadata of canvas %q: %w", canvasID, err)
+	}
+	return nil
+}
+
+func (s *FirestoreStore) UpdateCanvasMeta(ctx context.Context, canvasID string, fn func(meta *CanvasMeta) error) (*CanvasMeta, error) {
+	docRef := s.meta(canvasID)
+	var meta *CanvasMeta
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		meta = &CanvasMeta{}
+		doc, err := tx.Get(docRef)
+		switch {
+		case status.Code(err) == codes.NotFound:
+		case err != nil:
+			return err
+		default:
+			if err := doc.DataTo(meta); err != nil {
+				return err
+			}
+		}
+		if err := fn(meta); err != nil {
+			return err
+		}
+		return tx.Set(docRef, meta)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error updating metadata of canvas %q: %w", canvasID, err)
+	}
+	return meta, nil
+}
+
+func (s *FirestoreStore) RecordAudit(ctx context.Context, entry *AuditEntry) error {
+	if _, err := s.client.Collection(AuditCollection).Doc(entry.ID).Set(ctx, entry); err != nil {
+		return fmt.Errorf("error writing audit entry %s: %w", entry.ID, err)
+	}
+	return nil
+}
+
+func (s *FirestoreStore) GetAuditEntry(ctx context.Context, id string) (*AuditEntry, error) {
+	doc, err := s.client.Collection(AuditCollection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading audit entry %s: %w", id, err)
+	}
+	entry := &AuditEntry{}
+	if err := doc.DataTo(entry); err != nil {
+		return nil, fmt.Errorf("error decoding audit entry %s: %w", id, err)
+	}
+	entry.ID = id
+	return entry, nil
+}
+
+func (s *FirestoreStore) WriteTrigger(ctx context.Context, name string, req ResetRequest, interval time.Duration) (last time.Time, written bool, err error) {
+	data := map[string]any{
+		"reason":        req.Reason,
+		"requestedBy":   req.RequestedBy,
+		"lastTriggered": firestore.ServerTimestamp,
+	}
+	if !req.Time.IsZero() {
+		data["time"] = req.Time
+	}
+	if req.Prune {
+		data["prune"] = true
+	}
+	docRef := s.client.Collection(name).Doc(name)
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(docRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			if v, ok := doc.Data()["lastTriggered"].(time.Time); ok && time.Since(v) < interval {
+				last, written = v, false
+				return nil
+			}
+		}
+		last, written = time.Now(), true
+		return tx.Set(docRef, data)
+	})
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error writing trigger document %s: %w", name, err)
+	}
+	return last, written, nil
+}
+
+func (s *FirestoreStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,343 @@
+package store
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a CanvasStore kept in process memory, for tests and local runs.
+type MemoryStore struct {
+	mu       sync.Mutex
+	chunks   map[string]*Chunk
+	users    map[string]*User
+	triggers map[string]time.Time
+	meta     map[string]CanvasMeta
+	audit    map[string]AuditEntry
+	archives map[string]*memoryArchive
+
+	// Now returns the time recorded on writes. Defaults to time.Now.
+	Now func() time.Time
+}
+
+var (
+	_ CanvasStore = (*MemoryStore)(nil)
+	_ ChunkAdmin  = (*MemoryStore)(nil)
+	_ Archiver    = (*MemoryStore)(nil)
+)
+
+// NewMemory returns an empty MemoryStore.
+func NewMemory() *MemoryStore {
+	return &MemoryStore{
+		chunks:   make(map[string]*Chunk),
+		users:    make(map[string]*User),
+		triggers: make(map[string]time.Time),
+		meta:     make(map[string]CanvasMeta),
+		audit:    make(map[string]AuditEntry),
+		archives: make(map[string]*memoryArchive),
+		Now:      time.Now,
+	}
+}
+
+func (s *MemoryStore) GetChunk(_ context.Context, canvas, id string) (*Chunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chunk, ok := s.chunks[canvasKey(canvas, id)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := *chunk
+	out.Pixels = maps.Clone(chunk.Pixels)
+	return &out, nil
+}
+
+func (s *MemoryStore) SetChunkPixels(_ context.Context, updates []ChunkUpdate) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.Now()
+	written := 0
+	for _, update := range updates {
+		key := canvasKey(update.Canvas, update.ID)
+		chunk, ok := s.chunks[key]
+		if !ok {
+			chunk = &Chunk{Canvas: update.Canvas, ID: update.ID, Pixels: make(map[string]Pixel)}
+		}
+		applied := 0
+		for key, p := range update.Pixels {
+			if old, ok := chunk.Pixels[key]; ok && !p.newer(old) {
+				continue
+			}
+			chunk.Pixels[key] = p
+			applied++
+		}
+		if applied == 0 {
+			continue
+		}
+		s.chunks[key] = chunk
+		chunk.Size = update.Size
+		chunk.Trace = update.Trace
+		chunk.LastUpdated = now
+		written += applied
+	}
+	return written, nil
+}
+
+func (s *MemoryStore) ChunkIDs(_ context.Context, canvas string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []string
+	for _, chunk := range s.chunks {
+		if chunk.Canvas == canvas {
+			ids = append(ids, chunk.ID)
+		}
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) DeleteChunk(_ context.Context, canvas, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.chunks, canvasKey(canvas, id))
+	return nil
+}
+
+func (s *MemoryStore) GetUser(_ context.Context, canvas, id string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[canvasKey(canvas, id)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := *user
+	return &out, nil
+}
+
+func (s *MemoryStore) UpdateUser(_ context.Context, canvas, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[canvasKey(canvas, id)] = &User{ID: id, LastUpdated: s.Now()}
+	return nil
+}
+
+func (s *MemoryStore) GetCanvasMeta(_ context.Context, canvas string) (*CanvasMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, ok := s.meta[canvas]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneMeta(meta), nil
+}
+
+func (s *MemoryStore) SetCanvasMeta(_ context.Context, canvas string, meta *CanvasMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.meta[canvas] = *cloneMeta(*meta)
+	return nil
+}
+
+func (s *MemoryStore) UpdateCanvasMeta(_ context.Context, canvas string, fn func(meta *CanvasMeta) error) (*CanvasMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta := cloneMeta(s.meta[canvas])
+	if err := fn(meta); err != nil {
+		return nil, err
+	}
+	s.meta[canvas] = *cloneMeta(*meta)
+	return meta, nil
+}
+
+// cloneMeta copies meta, so the stored one is not shared with callers.
+func cloneMeta(meta CanvasMeta) *CanvasMeta {
+	if meta.Rechunk != nil {
+		r := *meta.Rechunk
+		meta.Rechunk = &r
+	}
+	if meta.Expansion != nil {
+		e := *meta.Expansion
+		meta.Expansion = &e
+	}
+	return &meta
+}
+
+func (s *MemoryStore) RecordAudit(_ context.Context, entry *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *entry
+	stored.Details = maps.Clone(entry.Details)
+	s.audit[entry.ID] = stored
+	return nil
+}
+
+func (s *MemoryStore) GetAuditEntry(_ context.Context, id string) (*AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.audit[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	entry.Details = maps.Clone(entry.Details)
+	return &entry, nil
+}
+
+// memoryArchive is the archive of a season with the chunks copied to it.
+type memoryArchive struct {
+	Archive
+	chunks map[string]*Chunk
+}
+
+func (s *MemoryStore) CreateArchive(_ context.Context, season string, archive *Archive) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.archives[season]; ok {
+		return ErrExists
+	}
+	s.archives[season] = &memoryArchive{Archive: *cloneArchive(*archive)}
+	return nil
+}
+
+func (s *MemoryStore) GetArchive(_ context.Context, season string) (*Archive, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	archive, ok := s.archives[season]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneArchive(archive.Archive), nil
+}
+
+func (s *MemoryStore) ArchiveChunks(_ context.Context, canvas, season string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	archive, ok := s.archives[season]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	archive.chunks = make(map[string]*Chunk)
+	for _, chunk := range s.chunks {
+		if chunk.Canvas == canvas {
+			copied := *chunk
+			copied.Pixels = maps.Clone(chunk.Pixels)
+			archive.chunks[chunk.ID] = &copied
+		}
+	}
+	now := s.Now()
+	archive.Documents, archive.ArchivedAt = len(archive.chunks), &now
+	return archive.Documents, nil
+}
+
+// ArchivedChunk returns the copy of the chunk in the archive of the season,
+// or ErrNotFound.
+func (s *MemoryStore) ArchivedChunk(_ context.Context, season, id string) (*Chunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	archive, ok := s.archives[season]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	chunk, ok := archive.chunks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := *chunk
+	out.Pixels = maps.Clone(chunk.Pixels)
+	return &out, nil
+}
+
+func (s *MemoryStore) SetArchiveCleared(_ context.Context, season string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	archive, ok := s.archives[season]
+	if !ok {
+		return ErrNotFound
+	}
+	archive.ClearedAt = &at
+	return nil
+}
+
+func (s *MemoryStore) DeleteChunks(_ context.Context, canvas string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for key, chunk := range s.chunks {
+		if chunk.Canvas == canvas {
+			delete(s.chunks, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStore) DeleteUsers(_ context.Context, canvas string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Users are keyed by canvasKey: those of the default canvas by their ID
+	// alone.
+	deleted := 0
+	for key := range s.users {
+		if canvas == "" && !strings.Contains(key, "/") || canvas != "" && strings.HasPrefix(key, canvas+"/") {
+			delete(s.users, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// cloneArchive copies archive, so the stored one is not shared with callers.
+func cloneArchive(archive Archive) *Archive {
+	if archive.ArchivedAt != nil {
+		t := *archive.ArchivedAt
+		archive.ArchivedAt = &t
+	}
+	if archive.ClearedAt != nil {
+		t := *archive.ClearedAt
+		archive.ClearedAt = &t
+	}
+	return &archive
+}
+
+// WriteTrigger only records when the trigger was written: no reset function
+// watches this backend.
+func (s *MemoryStore) WriteTrigger(_ context.Context, name string, _ ResetRequest, interval time.Duration) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.Now()
+	if last, ok := s.triggers[name]; ok && now.Sub(last) < interval {
+		return last, false, nil
+	}
+	s.triggers[name] = now
+	return now, true, nil
+}
+
+// LastTriggered returns when the trigger was last written, or the zero time.
+func (s *MemoryStore) LastTriggered(name string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.triggers[name]
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
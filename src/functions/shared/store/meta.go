@@ -0,0 +1,74 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"example.com/shared/canvas"
+)
+
+// DefaultMetaTTL is how long the functions keep the metadata of a canvas
+// before reading it again, so expanding a canvas takes up to that long to
+// reach every instance. Scheduled expansions are not delayed by it.
+const DefaultMetaTTL = 30 * time.Second
+
+// Bounds returns the bounds of the canvas at now, given those it is
+// configured with: the width and height of a bounded canvas are replaced by
+// those recorded, then grown to those of the scheduled expansion once it is
+// due. A nil meta leaves configured as it is.
+func (m *CanvasMeta) Bounds(configured canvas.Bounds, now time.Time) canvas.Bounds {
+	if m == nil || configured.Unbounded {
+		return configured
+	}
+	if m.Width != 0 && m.Height != 0 {
+		configured.Width, configured.Height = m.Width, m.Height
+	}
+	if e := m.Expansion; e != nil && !now.Before(e.At) {
+		configured.Width = max(configured.Width, e.Width)
+		configured.Height = max(configured.Height, e.Height)
+	}
+	return configured
+}
+
+// MetaCache keeps the metadata of the canvases read from a store for a while,
+// so placements can be checked against it without a read each.
+type MetaCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]cachedMeta
+}
+
+type cachedMeta struct {
+	meta *CanvasMeta
+	read time.Time
+}
+
+// NewMetaCache returns a MetaCache keeping metadata for ttl.
+func NewMetaCache(ttl time.Duration) *MetaCache {
+	return &MetaCache{ttl: ttl, entries: make(map[string]cachedMeta)}
+}
+
+// Get returns the metadata of the canvas, reading it from st if it was not
+// read in the last ttl. It returns nil for a canvas without metadata.
+func (c *MetaCache) Get(ctx context.Context, st CanvasStore, canvasID string) (*CanvasMeta, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[canvasID]
+	c.mu.Unlock()
+	if ok && time.Since(entry.read) < c.ttl {
+		return entry.meta, nil
+	}
+
+	meta, err := st.GetCanvasMeta(ctx, canvasID)
+	if errors.Is(err, ErrNotFound) {
+		meta, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[canvasID] = cachedMeta{meta: meta, read: time.Now()}
+	c.mu.Unlock()
+	return meta, nil
+}
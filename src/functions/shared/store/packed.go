@@ -0,0 +1,124 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"example.com/shared/canvas"
+)
+
+// ChunkFormat is how the Firestore backend encodes the pixels of a chunk
+// document. Chunks are read in either format, whatever the one written.
+type ChunkFormat string
+
+const (
+	// FormatMap keeps the pixels in a "pixels" map of "x_y" keys to
+	// {color, user, placedAt} maps, which pixel writes merge into.
+	FormatMap ChunkFormat = "map"
+
+	// FormatPacked keeps them in the arrays of a PackedChunk, several times
+	// smaller but rewritten in full on every write.
+	FormatPacked ChunkFormat = "packed"
+)
+
+// ParseChunkFormat returns the format named s, FormatMap if s is empty.
+func ParseChunkFormat(s string) (ChunkFormat, error) {
+	switch f := ChunkFormat(s); f {
+	case "":
+		return FormatMap, nil
+	case FormatMap, FormatPacked:
+		return f, nil
+	default:
+		return "", fmt.Errorf("store: unknown chunk format %q", s)
+	}
+}
+
+// Widths of the entries of the arrays of a PackedChunk.
+const (
+	ownerWidth    = 4
+	placedAtWidth = 8
+)
+
+// ErrInvalidPackedChunk is returned when unpacking inconsistent arrays.
+var ErrInvalidPackedChunk = errors.New("store: invalid packed chunk")
+
+// PackedChunk holds the pixels of a chunk of Size pixels a side as arrays
+// indexed by y*Size+x.
+type PackedChunk struct {
+	Size int32
+
+	// Colors holds the color of each pixel.
+	Colors []byte
+
+	// Owners holds for each pixel, as a little-endian uint32, the index in
+	// Users of the user that placed it plus one, or zero if it is blank.
+	Owners []byte
+
+	// Users lists the users owning pixels of the chunk, each once.
+	Users []int64
+
+	// PlacedAt holds the PlacedAt of each pixel as a little-endian int64.
+	PlacedAt []byte
+}
+
+// Pack encodes the pixels of a chunk of the given size. Pixel keys must be
+// within the chunk.
+func Pack(size int32, pixels map[string]Pixel) (*PackedChunk, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: size %d", ErrInvalidPackedChunk, size)
+	}
+	n := int(size) * int(size)
+	c := &PackedChunk{
+		Size:     size,
+		Colors:   make([]byte, n),
+		Owners:   make([]byte, n*ownerWidth),
+		PlacedAt: make([]byte, n*placedAtWidth),
+	}
+	owners := make(map[int64]uint32)
+	for key, p := range pixels {
+		x, y, err := canvas.ParsePixelKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if x < 0 || y < 0 || x >= int(size) || y >= int(size) {
+			return nil, fmt.Errorf("%w: pixel %s outside of a chunk of size %d", ErrInvalidPackedChunk, key, size)
+		}
+		owner, ok := owners[p.User]
+		if !ok {
+			c.Users = append(c.Users, p.User)
+			owner = uint32(len(c.Users))
+			owners[p.User] = owner
+		}
+
+		i := y*int(size) + x
+		c.Colors[i] = p.Color
+		binary.LittleEndian.PutUint32(c.Owners[i*ownerWidth:], owner)
+		binary.LittleEndian.PutUint64(c.PlacedAt[i*placedAtWidth:], uint64(p.PlacedAt))
+	}
+	return c, nil
+}
+
+// Unpack decodes the pixels of the chunk, keyed like Chunk.Pixels.
+func (c *PackedChunk) Unpack() (map[string]Pixel, error) {
+	n := int(c.Size) * int(c.Size)
+	if c.Size <= 0 || len(c.Colors) != n || len(c.Owners) != n*ownerWidth || len(c.PlacedAt) != n*placedAtWidth {
+		return nil, fmt.Errorf("%w: arrays do not match size %d", ErrInvalidPackedChunk, c.Size)
+	}
+	pixels := make(map[string]Pixel)
+	for i := range n {
+		owner := binary.LittleEndian.Uint32(c.Owners[i*ownerWidth:])
+		if owner == 0 {
+			continue
+		}
+		if int(owner) > len(c.Users) {
+			return nil, fmt.Errorf("%w: owner %d of %d users", ErrInvalidPackedChunk, owner, len(c.Users))
+		}
+		pixels[canvas.PixelKey(i%int(c.Size), i/int(c.Size))] = Pixel{
+			Color:    c.Colors[i],
+			User:     c.Users[owner-1],
+			PlacedAt: int64(binary.LittleEndian.Uint64(c.PlacedAt[i*placedAtWidth:])),
+		}
+	}
+	return pixels, nil
+}
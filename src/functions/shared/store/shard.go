@@ -0,0 +1,140 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+
+	"example.com/shared/canvas"
+)
+
+// MaxDocumentSize is the largest document Firestore stores, in bytes.
+const MaxDocumentSize = 1 << 20
+
+// Sizes used to estimate chunk documents, following Firestore's storage size
+// calculation: a field counts its name plus one byte and its value, an
+// integer or timestamp 8 bytes, a map the sum of its fields.
+const (
+	// chunkDocOverhead bounds the name of a chunk document and its fields
+	// other than the pixels.
+	chunkDocOverhead = 512
+
+	// mapPixelSize is the value of a pixel in FormatMap:
+	// {color, user, placedAt}.
+	mapPixelSize = len("color") + 1 + 8 + len("user") + 1 + 8 + len("placedAt") + 1 + 8
+
+	// packedPixelSize is the space of a pixel in the arrays of FormatPacked,
+	// its owner in Users included.
+	packedPixelSize = 1 + ownerWidth + placedAtWidth + 8
+)
+
+// Fields of the documents of a sharded chunk.
+const (
+	// shardsField is the number of documents of a sharded chunk.
+	shardsField = "shards"
+
+	// shardField is the index of a document of a sharded chunk, absent on
+	// the first one.
+	shardField = "shard"
+)
+
+// MaxChunkDocumentSize returns the size in bytes a document holding rows
+// rows of a fully painted chunk of size pixels a side can reach in format.
+func MaxChunkDocumentSize(format ChunkFormat, size, rows int) int {
+	if format == FormatPacked {
+		return chunkDocOverhead + size*size*packedPixelSize
+	}
+	// Keys are "x_y", with coordinates of up to as many digits as size-1.
+	keySize := 2*len(strconv.Itoa(size-1)) + 1
+	return chunkDocOverhead + rows*size*(keySize+1+mapPixelSize)
+}
+
+// CheckChunkSize returns an error if chunks of size pixels a side can grow
+// past MaxDocumentSize once fully painted. Chunks in FormatMap are sharded
+// when they grow past shardThreshold bytes, down to one row per document,
+// if it is not zero; those in FormatPacked are never sharded.
+func CheckChunkSize(format ChunkFormat, size, shardThreshold int) error {
+	switch {
+	case size <= 0:
+		return fmt.Errorf("store: invalid chunk size %d", size)
+	case shardThreshold < 0 || shardThreshold > MaxDocumentSize:
+		return fmt.Errorf("store: shard threshold %d is not between 0 and %d bytes", shardThreshold, MaxDocumentSize)
+	case format == FormatPacked:
+		if max := MaxChunkDocumentSize(format, size, size); max > MaxDocumentSize {
+			return fmt.Errorf("store: packed chunks of size %d can reach %d bytes, over the %d bytes limit", size, max, MaxDocumentSize)
+		}
+	case shardThreshold == 0:
+		if max := MaxChunkDocumentSize(format, size, size); max > MaxDocumentSize {
+			return fmt.Errorf("store: chunks of size %d can reach %d bytes, over the %d bytes limit; set a shard threshold or a smaller size", size, max, MaxDocumentSize)
+		}
+	default:
+		if max := MaxChunkDocumentSize(format, size, 1); max > MaxDocumentSize {
+			return fmt.Errorf("store: a row of a chunk of size %d can reach %d bytes, over the %d bytes limit", size, max, MaxDocumentSize)
+		}
+	}
+	return nil
+}
+
+// mapDocumentSize estimates the size of a chunk document holding pixels in
+// FormatMap.
+func mapDocumentSize(pixels map[string]Pixel) int {
+	n := chunkDocOverhead
+	for key := range pixels {
+		n += len(key) + 1 + mapPixelSize
+	}
+	return n
+}
+
+// shardOf returns the shard holding the pixel key of a chunk of size pixels a
+// side split in shards documents. Shards hold consecutive rows.
+func shardOf(key string, size, shards int) (int, error) {
+	_, y, err := canvas.ParsePixelKey(key)
+	if err != nil {
+		return 0, err
+	}
+	if y < 0 || y >= size {
+		return 0, fmt.Errorf("store: pixel %s outside of a chunk of size %d", key, size)
+	}
+	return y * shards / size, nil
+}
+
+// splitShards splits the pixels of a chunk of size pixels a side into shards
+// documents.
+func splitShards(pixels map[string]Pixel, size, shards int) ([]map[string]Pixel, error) {
+	split := make([]map[string]Pixel, shards)
+	for i := range split {
+		split[i] = make(map[string]Pixel)
+	}
+	for key, p := range pixels {
+		shard, err := shardOf(key, size, shards)
+		if err != nil {
+			return nil, err
+		}
+		split[shard][key] = p
+	}
+	return split, nil
+}
+
+// shardsFor returns how many documents the pixels of a chunk of size pixels
+// a side need so that none is estimated over threshold, at least current.
+// The count doubles until it fits, up to one row per document.
+func shardsFor(pixels map[string]Pixel, size, threshold, current int) (int, error) {
+	shards := max(current, 1)
+	for threshold > 0 && shards < size {
+		split, err := splitShards(pixels, size, shards)
+		if err != nil {
+			return 0, err
+		}
+		fits := true
+		for _, shard := range split {
+			if mapDocumentSize(shard) > threshold {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			break
+		}
+		shards = min(2*shards, size)
+	}
+	return shards, nil
+}
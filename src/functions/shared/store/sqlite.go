@@ -0,0 +1,707 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order to bring a database to the latest schema.
+// The number of applied migrations is tracked in PRAGMA user_version, so
+// existing entries must never be edited: append a new one instead.
+var migrations = []string{
+	`CREATE TABLE chunks (
+		id           TEXT PRIMARY KEY,
+		size         INTEGER NOT NULL,
+		last_updated INTEGER NOT NULL
+	);
+	CREATE TABLE pixels (
+		chunk_id TEXT NOT NULL REFERENCES chunks(id) ON DELETE CASCADE,
+		key      TEXT NOT NULL,
+		color    INTEGER NOT NULL,
+		user_id  INTEGER NOT NULL,
+		PRIMARY KEY (chunk_id, key)
+	);
+	CREATE TABLE users (
+		id           TEXT PRIMARY KEY,
+		last_updated INTEGER NOT NULL
+	);
+	CREATE TABLE triggers (
+		name           TEXT PRIMARY KEY,
+		last_triggered INTEGER NOT NULL
+	);`,
+	`CREATE TABLE placements (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		chunk_id  TEXT NOT NULL,
+		key       TEXT NOT NULL,
+		color     INTEGER NOT NULL,
+		user_id   INTEGER NOT NULL,
+		placed_at INTEGER NOT NULL
+	);
+	CREATE INDEX placements_placed_at ON placements (placed_at);
+	CREATE INDEX placements_user_id ON placements (user_id);`,
+	`CREATE TABLE changes (last INTEGER NOT NULL);
+	INSERT INTO changes (last) VALUES (0);
+	ALTER TABLE chunks ADD COLUMN change INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX chunks_change ON chunks (change);
+	ALTER TABLE triggers ADD COLUMN change INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE chunks ADD COLUMN trace TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE pixels ADD COLUMN placed_at INTEGER NOT NULL DEFAULT 0;`,
+	`CREATE TABLE canvas_meta (
+		canvas TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);`,
+	`CREATE TABLE audit (
+		id TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);`,
+	`ALTER TABLE triggers ADD COLUMN data TEXT NOT NULL DEFAULT '{}';`,
+	`CREATE TABLE archives (
+		season TEXT PRIMARY KEY,
+		data   TEXT NOT NULL
+	);
+	CREATE TABLE archive_chunks (
+		season TEXT NOT NULL REFERENCES archives(season) ON DELETE CASCADE,
+		id     TEXT NOT NULL,
+		data   TEXT NOT NULL,
+		PRIMARY KEY (season, id)
+	);`,
+}
+
+// SQLiteStore is the CanvasStore backed by an embedded SQLite database, for
+// running AirPlace on a single machine. On top of the current canvas it keeps
+// the history of every placement.
+type SQLiteStore struct {
+	db *sql.DB
+
+	// Now returns the time recorded on writes. Defaults to time.Now.
+	Now func() time.Time
+}
+
+var (
+	_ CanvasStore = (*SQLiteStore)(nil)
+	_ ChunkAdmin  = (*SQLiteStore)(nil)
+	_ Archiver    = (*SQLiteStore)(nil)
+)
+
+// NewSQLite opens the database file at path, creating it if needed, and
+// applies any pending migration.
+func NewSQLite(ctx context.Context, path string) (*SQLiteStore, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening SQLite database %s: %w", path, err)
+	}
+
+	s := &SQLiteStore{db: db, Now: time.Now}
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLiteStore) migrate(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting migration: %w", err)
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("error reading schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			return fmt.Errorf("error applying migration %d: %w", i+1, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", len(migrations))); err != nil {
+		return fmt.Errorf("error updating schema version: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetChunk(ctx context.Context, canvas, id string) (*Chunk, error) {
+	chunk := &Chunk{Canvas: canvas, ID: id, Pixels: map[string]Pixel{}}
+	var lastUpdated int64
+	err := s.db.QueryRowContext(ctx, "SELECT size, last_updated, trace FROM chunks WHERE id = ?", canvasKey(canvas, id)).Scan(&chunk.Size, &lastUpdated, &chunk.Trace)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading chunk %s: %w", id, err)
+	}
+	chunk.LastUpdated = time.Unix(0, lastUpdated).UTC()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT key, color, user_id, placed_at FROM pixels WHERE chunk_id = ?", canvasKey(canvas, id))
+	if err != nil {
+		return nil, fmt.Errorf("error reading pixels of chunk %s: %w", id, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var p Pixel
+		if err := rows.Scan(&key, &p.Color, &p.User, &p.PlacedAt); err != nil {
+			return nil, fmt.Errorf("error reading pixels of chunk %s: %w", id, err)
+		}
+		chunk.Pixels[key] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading pixels of chunk %s: %w", id, err)
+	}
+	return chunk, nil
+}
+
+func (s *SQLiteStore) SetChunkPixels(ctx context.Context, updates []ChunkUpdate) (int, error) {
+	now := s.Now().UnixNano()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting chunk update: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The chunk row is only written once one of its pixels applied, after
+	// them, so the pixels reference it at commit time.
+	if _, err := tx.ExecContext(ctx, "PRAGMA defer_foreign_keys = ON"); err != nil {
+		return 0, fmt.Errorf("error starting chunk update: %w", err)
+	}
+
+	written := 0
+	var change int64
+	for _, update := range updates {
+		// The chunks of every canvas share the table, keyed by canvas and ID.
+		chunkID := canvasKey(update.Canvas, update.ID)
+		applied := 0
+		for key, p := range update.Pixels {
+			res, err := tx.ExecContext(ctx, `INSERT INTO pixels (chunk_id, key, color, user_id, placed_at) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT (chunk_id, key) DO UPDATE SET color = excluded.color, user_id = excluded.user_id, placed_at = excluded.placed_at
+				WHERE excluded.placed_at > pixels.placed_at`,
+				chunkID, key, p.Color, p.User, p.PlacedAt)
+			if err != nil {
+				return 0, fmt.Errorf("error writing pixel %s of chunk %s: %w", key, update.ID, err)
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return 0, fmt.Errorf("error writing pixel %s of chunk %s: %w", key, update.ID, err)
+			}
+			if n == 0 {
+				continue
+			}
+			applied++
+
+			placedAt := p.PlacedAt
+			if placedAt == 0 {
+				placedAt = now
+			}
+			if _, err := tx.ExecContext(ctx, `INSERT INTO placements (chunk_id, key, color, user_id, placed_at) VALUES (?, ?, ?, ?, ?)`,
+				chunkID, key, p.Color, p.User, placedAt); err != nil {
+				return 0, fmt.Errorf("error recording placement %s of chunk %s: %w", key, update.ID, err)
+			}
+		}
+		if applied == 0 {
+			continue
+		}
+		written += applied
+
+		if change == 0 {
+			if change, err = nextChange(ctx, tx); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO chunks (id, size, last_updated, trace, change) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET size = excluded.size, last_updated = excluded.last_updated, trace = excluded.trace, change = excluded.change`,
+			chunkID, update.Size, now, update.Trace, change); err != nil {
+			return 0, fmt.Errorf("error writing chunk %s: %w", update.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing chunk update: %w", err)
+	}
+	return written, nil
+}
+
+// canvasRows returns the condition selecting the rows of the canvas in the
+// chunks or users table, keyed by canvasKey.
+func canvasRows(canvas string) (string, []any) {
+	// The rows of the default canvas are keyed by their ID alone, those of
+	// the others by the canvas and ID.
+	if canvas == "" {
+		return "instr(id, '/') = 0", nil
+	}
+	prefix := canvasKey(canvas, "")
+	return "substr(id, 1, ?) = ?", []any{len(prefix), prefix}
+}
+
+func (s *SQLiteStore) ChunkIDs(ctx context.Context, canvas string) ([]string, error) {
+	where, args := canvasRows(canvas)
+	rows, err := s.db.QueryContext(ctx, "SELECT substr(id, ?) FROM chunks WHERE "+where,
+		append([]any{len(canvasKey(canvas, "")) + 1}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error listing chunks: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing chunks: %w", err)
+	}
+	return ids, nil
+}
+
+func (s *SQLiteStore) DeleteChunk(ctx context.Context, canvas, id string) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM chunks WHERE id = ?", canvasKey(canvas, id)); err != nil {
+		return fmt.Errorf("error deleting chunk %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetUser(ctx context.Context, canvas, id string) (*User, error) {
+	var lastUpdated int64
+	err := s.db.QueryRowContext(ctx, "SELECT last_updated FROM users WHERE id = ?", canvasKey(canvas, id)).Scan(&lastUpdated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading user %s: %w", id, err)
+	}
+	return &User{ID: id, LastUpdated: time.Unix(0, lastUpdated).UTC()}, nil
+}
+
+func (s *SQLiteStore) UpdateUser(ctx context.Context, canvas, id string) error {
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO users (id, last_updated) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET last_updated = excluded.last_updated`,
+		canvasKey(canvas, id), s.Now().UnixNano()); err != nil {
+		return fmt.Errorf("error writing user %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetCanvasMeta(ctx context.Context, canvas string) (*CanvasMeta, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, "SELECT data FROM canvas_meta WHERE canvas = ?", canvas).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata of canvas %q: %w", canvas, err)
+	}
+	meta := &CanvasMeta{}
+	if err := json.Unmarshal([]byte(data), meta); err != nil {
+		return nil, fmt.Errorf("error decoding metadata of canvas %q: %w", canvas, err)
+	}
+	return meta, nil
+}
+
+func (s *SQLiteStore) SetCanvasMeta(ctx context.Context, canvas string, meta *CanvasMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("error encoding metadata of canvas %q: %w", canvas, err)
+	}
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO canvas_meta (canvas, data) VALUES (?, ?)
+		ON CONFLICT (canvas) DO UPDATE SET data = excluded.data`,
+		canvas, string(data)); err != nil {
+		return fmt.Errorf("error writing metadata of canvas %q: %w", canvas, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) UpdateCanvasMeta(ctx context.Context, canvas string, fn func(meta *CanvasMeta) error) (*CanvasMeta, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	meta := &CanvasMeta{}
+	var data string
+	err = tx.QueryRowContext(ctx, "SELECT data FROM canvas_meta WHERE canvas = ?", canvas).Scan(&data)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return nil, fmt.Errorf("error reading metadata of canvas %q: %w", canvas, err)
+	default:
+		if err := json.Unmarshal([]byte(data), meta); err != nil {
+			return nil, fmt.Errorf("error decoding metadata of canvas %q: %w", canvas, err)
+		}
+	}
+	if err := fn(meta); err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding metadata of canvas %q: %w", canvas, err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO canvas_meta (canvas, data) VALUES (?, ?)
+		ON CONFLICT (canvas) DO UPDATE SET data = excluded.data`,
+		canvas, string(encoded)); err != nil {
+		return nil, fmt.Errorf("error writing metadata of canvas %q: %w", canvas, err)
+	}
+	return meta, tx.Commit()
+}
+
+func (s *SQLiteStore) RecordAudit(ctx context.Context, entry *AuditEntry) error {
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding audit entry %s: %w", entry.ID, err)
+	}
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO audit (id, data) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data`,
+		entry.ID, string(encoded)); err != nil {
+		return fmt.Errorf("error writing audit entry %s: %w", entry.ID, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetAuditEntry(ctx context.Context, id string) (*AuditEntry, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, "SELECT data FROM audit WHERE id = ?", id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading audit entry %s: %w", id, err)
+	}
+	entry := &AuditEntry{}
+	if err := json.Unmarshal([]byte(data), entry); err != nil {
+		return nil, fmt.Errorf("error decoding audit entry %s: %w", id, err)
+	}
+	entry.ID = id
+	return entry, nil
+}
+
+func (s *SQLiteStore) CreateArchive(ctx context.Context, season string, archive *Archive) error {
+	encoded, err := json.Marshal(archive)
+	if err != nil {
+		return fmt.Errorf("error encoding archive %q: %w", season, err)
+	}
+	res, err := s.db.ExecContext(ctx, "INSERT INTO archives (season, data) VALUES (?, ?) ON CONFLICT (season) DO NOTHING",
+		season, string(encoded))
+	if err != nil {
+		return fmt.Errorf("error creating archive %q: %w", season, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error creating archive %q: %w", season, err)
+	} else if n == 0 {
+		return ErrExists
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetArchive(ctx context.Context, season string) (*Archive, error) {
+	return scanArchive(s.db.QueryRowContext(ctx, "SELECT data FROM archives WHERE season = ?", season), season)
+}
+
+// scanArchive decodes the archive of the season read by row.
+func scanArchive(row *sql.Row, season string) (*Archive, error) {
+	var data string
+	err := row.Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive %q: %w", season, err)
+	}
+	archive := &Archive{}
+	if err := json.Unmarshal([]byte(data), archive); err != nil {
+		return nil, fmt.Errorf("error decoding archive %q: %w", season, err)
+	}
+	return archive, nil
+}
+
+// updateArchive applies fn to the archive of the season in tx.
+func updateArchive(ctx context.Context, tx *sql.Tx, season string, fn func(archive *Archive)) error {
+	archive, err := scanArchive(tx.QueryRowContext(ctx, "SELECT data FROM archives WHERE season = ?", season), season)
+	if err != nil {
+		return err
+	}
+	fn(archive)
+	encoded, err := json.Marshal(archive)
+	if err != nil {
+		return fmt.Errorf("error encoding archive %q: %w", season, err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE archives SET data = ? WHERE season = ?", string(encoded), season); err != nil {
+		return fmt.Errorf("error writing archive %q: %w", season, err)
+	}
+	return nil
+}
+
+// ArchiveChunks reads the chunks of the canvas, pixels included, then writes
+// their copies in one transaction.
+func (s *SQLiteStore) ArchiveChunks(ctx context.Context, canvas, season string) (int, error) {
+	ids, err := s.ChunkIDs(ctx, canvas)
+	if err != nil {
+		return 0, err
+	}
+	copies := make(map[string]string, len(ids))
+	for _, id := range ids {
+		chunk, err := s.GetChunk(ctx, canvas, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		encoded, err := json.Marshal(chunk)
+		if err != nil {
+			return 0, fmt.Errorf("error encoding chunk %s: %w", id, err)
+		}
+		copies[id] = string(encoded)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting archive: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM archive_chunks WHERE season = ?", season); err != nil {
+		return 0, fmt.Errorf("error archiving chunks: %w", err)
+	}
+	for id, data := range copies {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO archive_chunks (season, id, data) VALUES (?, ?, ?)",
+			season, id, data); err != nil {
+			return 0, fmt.Errorf("error archiving chunk %s: %w", id, err)
+		}
+	}
+	now := s.Now()
+	if err := updateArchive(ctx, tx, season, func(archive *Archive) {
+		archive.Documents, archive.ArchivedAt = len(copies), &now
+	}); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing archive: %w", err)
+	}
+	return len(copies), nil
+}
+
+// ArchivedChunk returns the copy of the chunk in the archive of the season,
+// or ErrNotFound.
+func (s *SQLiteStore) ArchivedChunk(ctx context.Context, season, id string) (*Chunk, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, "SELECT data FROM archive_chunks WHERE season = ? AND id = ?", season, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading archived chunk %s: %w", id, err)
+	}
+	chunk := &Chunk{}
+	if err := json.Unmarshal([]byte(data), chunk); err != nil {
+		return nil, fmt.Errorf("error decoding archived chunk %s: %w", id, err)
+	}
+	return chunk, nil
+}
+
+func (s *SQLiteStore) SetArchiveCleared(ctx context.Context, season string, at time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting archive update: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := updateArchive(ctx, tx, season, func(archive *Archive) { archive.ClearedAt = &at }); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteChunks deletes the chunks of the canvas, their pixels with them. The
+// placement history is kept.
+func (s *SQLiteStore) DeleteChunks(ctx context.Context, canvas string) (int, error) {
+	where, args := canvasRows(canvas)
+	return s.deleteRows(ctx, "DELETE FROM chunks WHERE "+where, args, "chunks")
+}
+
+func (s *SQLiteStore) DeleteUsers(ctx context.Context, canvas string) (int, error) {
+	where, args := canvasRows(canvas)
+	return s.deleteRows(ctx, "DELETE FROM users WHERE "+where, args, "users")
+}
+
+// deleteRows runs the delete query and returns the number of rows deleted.
+func (s *SQLiteStore) deleteRows(ctx context.Context, query string, args []any, what string) (int, error) {
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting %s: %w", what, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error deleting %s: %w", what, err)
+	}
+	return int(n), nil
+}
+
+// WriteTrigger records req, which the dev server polls through Changes: no
+// Firestore trigger watches this backend.
+func (s *SQLiteStore) WriteTrigger(ctx context.Context, name string, req ResetRequest, interval time.Duration) (time.Time, bool, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error encoding trigger %s: %w", name, err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error writing trigger %s: %w", name, err)
+	}
+	defer tx.Rollback()
+
+	// The change number is taken first, so the transaction holds the write
+	// lock while reading when the trigger was last written.
+	change, err := nextChange(ctx, tx)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	now := s.Now()
+	var lastTriggered int64
+	err = tx.QueryRowContext(ctx, "SELECT last_triggered FROM triggers WHERE name = ?", name).Scan(&lastTriggered)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return time.Time{}, false, fmt.Errorf("error reading trigger %s: %w", name, err)
+	default:
+		if last := time.Unix(0, lastTriggered).UTC(); now.Sub(last) < interval {
+			return last, false, nil
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO triggers (name, last_triggered, change, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET last_triggered = excluded.last_triggered, change = excluded.change, data = excluded.data`,
+		name, now.UnixNano(), change, string(data)); err != nil {
+		return time.Time{}, false, fmt.Errorf("error writing trigger %s: %w", name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, false, fmt.Errorf("error writing trigger %s: %w", name, err)
+	}
+	return now, true, nil
+}
+
+// nextChange numbers a write of chunks or triggers. Writes are serialized by
+// the database, so the numbers follow the order of their commits.
+func nextChange(ctx context.Context, tx *sql.Tx) (int64, error) {
+	var change int64
+	if err := tx.QueryRowContext(ctx, "UPDATE changes SET last = last + 1 RETURNING last").Scan(&change); err != nil {
+		return 0, fmt.Errorf("error numbering change: %w", err)
+	}
+	return change, nil
+}
+
+// Trigger is a write of a trigger document.
+type Trigger struct {
+	Name          string
+	LastTriggered time.Time
+	Request       ResetRequest
+}
+
+// Changes lists the chunks and triggers written after a change.
+type Changes struct {
+	// Chunks are the chunks written, as they are now.
+	Chunks []*Chunk
+
+	// Triggers are the triggers written.
+	Triggers []Trigger
+
+	// Last numbers the last change listed, to pass to the next call.
+	Last int64
+}
+
+// LastChange returns the number of the last write of chunks or triggers, for
+// Changes to list those made after it.
+func (s *SQLiteStore) LastChange(ctx context.Context) (int64, error) {
+	var last int64
+	if err := s.db.QueryRowContext(ctx, "SELECT last FROM changes").Scan(&last); err != nil {
+		return 0, fmt.Errorf("error reading last change: %w", err)
+	}
+	return last, nil
+}
+
+// Changes returns the chunks and triggers written after the change numbered
+// after, in the order they were written. Nothing watches this backend like
+// the Firestore triggers do, so the dev server polls it instead.
+func (s *SQLiteStore) Changes(ctx context.Context, after int64) (*Changes, error) {
+	changes := &Changes{Last: after}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT id, change FROM chunks WHERE change > ? ORDER BY change", after)
+	if err != nil {
+		return nil, fmt.Errorf("error listing written chunks: %w", err)
+	}
+	type written struct {
+		key    string
+		change int64
+	}
+	var chunks []written
+	for rows.Next() {
+		var w written
+		if err := rows.Scan(&w.key, &w.change); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error listing written chunks: %w", err)
+		}
+		chunks = append(chunks, w)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing written chunks: %w", err)
+	}
+	for _, w := range chunks {
+		canvas, id, ok := strings.Cut(w.key, "/")
+		if !ok {
+			canvas, id = "", w.key
+		}
+		chunk, err := s.GetChunk(ctx, canvas, id)
+		if err != nil {
+			return nil, err
+		}
+		changes.Chunks = append(changes.Chunks, chunk)
+		changes.Last = max(changes.Last, w.change)
+	}
+
+	rows, err = s.db.QueryContext(ctx, "SELECT name, last_triggered, change, data FROM triggers WHERE change > ? ORDER BY change", after)
+	if err != nil {
+		return nil, fmt.Errorf("error listing written triggers: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t Trigger
+		var lastTriggered, change int64
+		var data string
+		if err := rows.Scan(&t.Name, &lastTriggered, &change, &data); err != nil {
+			return nil, fmt.Errorf("error listing written triggers: %w", err)
+		}
+		if err := json.Unmarshal([]byte(data), &t.Request); err != nil {
+			return nil, fmt.Errorf("error decoding trigger %s: %w", t.Name, err)
+		}
+		t.LastTriggered = time.Unix(0, lastTriggered).UTC()
+		changes.Triggers = append(changes.Triggers, t)
+		changes.Last = max(changes.Last, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing written triggers: %w", err)
+	}
+	return changes, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
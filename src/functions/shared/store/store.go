@@ -0,0 +1,347 @@
+// Package store defines the persistence operations of the canvas, independent
+// of the backend holding the chunks and users.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"example.com/shared/canvas"
+)
+
+// ChunkCollection is the collection (or table) holding the chunks of the
+// default canvas. The chunks of the other canvases are kept under
+// canvases/{canvas}/chunks.
+const ChunkCollection = canvas.ChunkCollection
+
+// CanvasCollection holds the metadata document of each canvas, with the
+// chunks and users of the canvases other than the default one in its
+// subcollections.
+const CanvasCollection = canvas.CanvasCollection
+
+// AuditCollection holds an entry for each admin operation performed, such as
+// a reset of the update subscriptions.
+const AuditCollection = "audit"
+
+// ArchiveCollection holds the season archives. The document archives/{season}
+// records the canvas archived, and its chunks subcollection holds a copy of
+// the chunk documents of the canvas as they were.
+const ArchiveCollection = "archives"
+
+// ErrNotFound is returned when a chunk or user does not exist.
+var ErrNotFound = errors.New("store: not found")
+
+// ErrExists is returned when creating an archive that already exists.
+var ErrExists = errors.New("store: already exists")
+
+// Pixel is a single placed pixel as stored in a chunk.
+type Pixel struct {
+	Color uint8 `firestore:"color" json:"color"`
+	User  int64 `firestore:"user" json:"user"`
+
+	// PlacedAt is when the placement was accepted, in Unix nanoseconds. A
+	// pixel only replaces a stored one placed strictly before it.
+	PlacedAt int64 `firestore:"placedAt" json:"placedAt"`
+}
+
+// newer reports whether p should replace the stored pixel old.
+func (p Pixel) newer(old Pixel) bool {
+	return p.PlacedAt > old.PlacedAt
+}
+
+// Chunk is a square region of the canvas. Pixels are keyed by their
+// coordinates local to the chunk, formatted as "x_y".
+type Chunk struct {
+	// Canvas is the ID of the canvas holding the chunk, empty for the default
+	// one.
+	Canvas      string
+	ID          string
+	Size        int32
+	Pixels      map[string]Pixel
+	LastUpdated time.Time
+
+	// Trace is the traceparent of the placement that last updated the chunk,
+	// so functions triggered by the write can correlate their logs with it.
+	Trace string
+}
+
+// ChunkUpdate is a set of pixels to merge into a chunk, creating it if needed.
+type ChunkUpdate struct {
+	Canvas string
+	ID     string
+	Size   int32
+	Pixels map[string]Pixel
+
+	// Trace is recorded as the chunk's Trace.
+	Trace string
+}
+
+// User holds the placement state of a user on a canvas.
+type User struct {
+	ID          string
+	LastUpdated time.Time
+}
+
+// CanvasMeta is the metadata document of a canvas, checked by the functions
+// on startup.
+type CanvasMeta struct {
+	// ChunkSize is the size of the chunks of the canvas, in pixels a side.
+	ChunkSize int `firestore:"chunkSize" json:"chunkSize"`
+
+	// Rechunk is the migration of the canvas to another chunk size under way,
+	// nil if there is none.
+	Rechunk *Rechunk `firestore:"rechunk,omitempty" json:"rechunk,omitempty"`
+
+	// Width and Height are the bounds of a bounded canvas. Draw records
+	// those the canvas is configured with the first time it checks it, and
+	// expansions grow them. Once recorded they replace the configured
+	// bounds, so a redeploy with other CANVAS_WIDTH and CANVAS_HEIGHT does
+	// not undo an expansion: grow a canvas by expanding it instead.
+	Width  int `firestore:"width,omitempty" json:"width,omitempty"`
+	Height int `firestore:"height,omitempty" json:"height,omitempty"`
+
+	// Expansion is an expansion of the canvas scheduled for later, nil if
+	// there is none.
+	Expansion *Expansion `firestore:"expansion,omitempty" json:"expansion,omitempty"`
+}
+
+// Rechunk records the progress of a migration of a canvas to another chunk
+// size, so an interrupted one resumes where it stopped.
+type Rechunk struct {
+	// To is the chunk size migrated to.
+	To int `firestore:"to" json:"to"`
+
+	// Phase is the step of the migration under way.
+	Phase string `firestore:"phase" json:"phase"`
+
+	// After is the ID of the last chunk done in Phase, chunks being handled
+	// in ID order, empty if none is.
+	After string `firestore:"after" json:"after"`
+}
+
+// Expansion is a scheduled growth of a bounded canvas.
+type Expansion struct {
+	// Width and Height are the bounds the canvas grows to.
+	Width  int `firestore:"width" json:"width"`
+	Height int `firestore:"height" json:"height"`
+
+	// At is when the canvas grows. Placements are checked against Width
+	// and Height from then on, whether or not the expansion was applied to
+	// the metadata.
+	At time.Time `firestore:"at" json:"at"`
+}
+
+// AuditEntry records an admin operation performed.
+type AuditEntry struct {
+	// ID identifies the entry. Recording an entry again with the same ID
+	// replaces it, so an operation retried is recorded once.
+	ID string `firestore:"-" json:"-"`
+
+	// Operation is the operation performed, such as "reset".
+	Operation string `firestore:"operation" json:"operation"`
+
+	// Canvas is the canvas the operation applies to, empty for the default
+	// one or for operations not bound to a canvas.
+	Canvas string `firestore:"canvas,omitempty" json:"canvas,omitempty"`
+
+	// RequestedBy and Reason are who asked for the operation and why.
+	RequestedBy string `firestore:"requestedBy" json:"requestedBy"`
+	Reason      string `firestore:"reason" json:"reason"`
+
+	At time.Time `firestore:"at" json:"at"`
+
+	// Details reports the outcome of the operation, such as the outcome of
+	// the reset of each subscription.
+	Details map[string]string `firestore:"details,omitempty" json:"details,omitempty"`
+
+	// Error is why the operation failed, empty if it succeeded.
+	Error string `firestore:"error,omitempty" json:"error,omitempty"`
+}
+
+// Archive records the archive of a canvas at the end of a season.
+type Archive struct {
+	// Canvas is the ID of the canvas archived, empty for the default one.
+	Canvas string `firestore:"canvas" json:"canvas"`
+
+	// ChunkSize, Width and Height are those of the canvas when it was
+	// archived, so the archive can be drawn after the canvas changed. Width
+	// and Height are zero for an unbounded canvas.
+	ChunkSize int `firestore:"chunkSize,omitempty" json:"chunkSize,omitempty"`
+	Width     int `firestore:"width,omitempty" json:"width,omitempty"`
+	Height    int `firestore:"height,omitempty" json:"height,omitempty"`
+
+	// Documents is the number of chunk documents copied, shards included.
+	Documents int `firestore:"documents" json:"documents"`
+
+	CreatedAt time.Time `firestore:"createdAt" json:"createdAt"`
+
+	// ArchivedAt is when the chunks were copied, nil until then.
+	ArchivedAt *time.Time `firestore:"archivedAt,omitempty" json:"archivedAt,omitempty"`
+
+	// ClearedAt is when the canvas was cleared after being archived, nil
+	// until then.
+	ClearedAt *time.Time `firestore:"clearedAt,omitempty" json:"clearedAt,omitempty"`
+}
+
+// ResetRequest asks the reset function to seek the subscriptions of the
+// update topic, through the trigger document it watches.
+type ResetRequest struct {
+	// Reason and RequestedBy are why and by whom the reset is asked for.
+	Reason      string `json:"reason"`
+	RequestedBy string `json:"requestedBy"`
+
+	// Time is the time to seek to, zero for now: the updates published
+	// before it are dropped.
+	Time time.Time `json:"time,omitzero"`
+
+	// Prune marks the requests of draw pruning the backlog, rather than
+	// replaying updates: the subscriptions retaining acknowledged messages
+	// are not seeked back to Time, which would redeliver them.
+	Prune bool `json:"prune,omitempty"`
+}
+
+// canvasKey qualifies id with its canvas, for backends keeping the chunks or
+// users of every canvas together.
+func canvasKey(canvas, id string) string {
+	if canvas == "" {
+		return id
+	}
+	return canvas + "/" + id
+}
+
+// CanvasStore is the storage used by the functions for chunks and users.
+type CanvasStore interface {
+	// GetChunk returns the chunk of the canvas with the given ID, or
+	// ErrNotFound.
+	GetChunk(ctx context.Context, canvas, id string) (*Chunk, error)
+
+	// SetChunkPixels merges the given pixels into their chunks, leaving the
+	// other pixels untouched, and sets each chunk's last update time. Each
+	// chunk is updated atomically and a pixel is skipped unless it is newer
+	// than the one stored, so delayed placements cannot overwrite later ones.
+	// A chunk none of whose pixels are newer is left untouched. It returns
+	// the number of pixels written.
+	SetChunkPixels(ctx context.Context, updates []ChunkUpdate) (int, error)
+
+	// GetUser returns the user with the given ID on the canvas, or
+	// ErrNotFound.
+	GetUser(ctx context.Context, canvas, id string) (*User, error)
+
+	// UpdateUser records that the user just placed a pixel on the canvas.
+	UpdateUser(ctx context.Context, canvas, id string) error
+
+	// GetCanvasMeta returns the metadata of the canvas, or ErrNotFound.
+	GetCanvasMeta(ctx context.Context, canvas string) (*CanvasMeta, error)
+
+	// SetCanvasMeta replaces the metadata of the canvas.
+	SetCanvasMeta(ctx context.Context, canvas string, meta *CanvasMeta) error
+
+	// UpdateCanvasMeta atomically applies fn to the metadata of the canvas,
+	// an empty one if it has none, and stores the result, unless fn fails.
+	// It returns the metadata stored.
+	UpdateCanvasMeta(ctx context.Context, canvas string, fn func(meta *CanvasMeta) error) (*CanvasMeta, error)
+
+	// RecordAudit records the audit entry of an admin operation, replacing
+	// the entry with the same ID if there is one.
+	RecordAudit(ctx context.Context, entry *AuditEntry) error
+
+	// GetAuditEntry returns the audit entry with the given ID, or
+	// ErrNotFound.
+	GetAuditEntry(ctx context.Context, id string) (*AuditEntry, error)
+
+	// WriteTrigger writes req to the trigger document watched by the reset
+	// function, unless the document was written less than interval ago. The
+	// check and the write are one transaction, so the instances sharing the
+	// document write it at most once per interval between them. It returns
+	// when the document was last written, and whether req was written.
+	WriteTrigger(ctx context.Context, name string, req ResetRequest, interval time.Duration) (last time.Time, written bool, err error)
+
+	Close() error
+}
+
+// ChunkAdmin is implemented by the stores whose chunks can be listed and
+// deleted one by one, as the admin tools rewriting whole canvases need.
+type ChunkAdmin interface {
+	// ChunkIDs returns the IDs of the chunks of the canvas.
+	ChunkIDs(ctx context.Context, canvas string) ([]string, error)
+
+	// DeleteChunk deletes the chunk of the canvas. Deleting a chunk that
+	// does not exist is not an error.
+	DeleteChunk(ctx context.Context, canvas, id string) error
+}
+
+// Archiver is implemented by the stores that can archive a canvas and wipe
+// it, as clearing it at the end of a season needs.
+type Archiver interface {
+	// CreateArchive records the archive of the season before anything is
+	// copied to it, or fails with ErrExists if the season has one, so a
+	// season is archived by a single clear.
+	CreateArchive(ctx context.Context, season string, archive *Archive) error
+
+	// GetArchive returns the archive of the season, or ErrNotFound.
+	GetArchive(ctx context.Context, season string) (*Archive, error)
+
+	// ArchiveChunks copies the chunks of the canvas to the archive of the
+	// season, which must have been created, and records how many were
+	// copied and when. Archiving again overwrites the copies made before.
+	// Pixels placed meanwhile may or may not be archived. It returns the
+	// number of documents copied.
+	ArchiveChunks(ctx context.Context, canvas, season string) (int, error)
+
+	// SetArchiveCleared records that the canvas of the archive of the
+	// season was cleared at the given time.
+	SetArchiveCleared(ctx context.Context, season string, at time.Time) error
+
+	// DeleteChunks deletes every chunk of the canvas. It returns the number
+	// of documents deleted.
+	DeleteChunks(ctx context.Context, canvas string) (int, error)
+
+	// DeleteUsers deletes every user of the canvas, so they may all place a
+	// pixel at once. It returns the number of users deleted.
+	DeleteUsers(ctx context.Context, canvas string) (int, error)
+}
+
+// Config selects and configures the backend returned by Open.
+type Config struct {
+	// Backend is "firestore" (the default) or "sqlite".
+	Backend string
+
+	// ProjectID, Database and UserCollection configure the Firestore backend.
+	ProjectID      string
+	Database       string
+	UserCollection string
+
+	// ChunkFormat is the encoding of the chunks written by the Firestore
+	// backend, FormatMap if empty.
+	ChunkFormat ChunkFormat
+
+	// ShardThreshold is the size in bytes past which the Firestore backend
+	// splits a chunk into several documents, zero to never split it.
+	ShardThreshold int
+
+	// SQLitePath is the database file of the SQLite backend.
+	SQLitePath string
+}
+
+// Open opens the backend selected by cfg.
+func Open(ctx context.Context, cfg Config) (CanvasStore, error) {
+	switch cfg.Backend {
+	case "", "firestore":
+		s, err := NewFirestore(ctx, cfg.ProjectID, cfg.Database, cfg.UserCollection)
+		if err != nil {
+			return nil, err
+		}
+		s.ChunkFormat = cfg.ChunkFormat
+		s.ShardThreshold = cfg.ShardThreshold
+		return s, nil
+	case "sqlite":
+		if cfg.SQLitePath == "" {
+			return nil, errors.New("store: SQLite backend requires a database path")
+		}
+		return NewSQLite(ctx, cfg.SQLitePath)
+	default:
+		return nil, fmt.Errorf("store: unknown backend %q", cfg.Backend)
+	}
+}
@@ -0,0 +1,635 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"example.com/shared/canvas"
+)
+
+// stores returns every backend that runs without external services.
+func stores(t *testing.T) map[string]CanvasStore {
+	t.Helper()
+	sqlite, err := NewSQLite(context.Background(), filepath.Join(t.TempDir(), "canvas.db"))
+	if err != nil {
+		t.Fatalf("NewSQLite: %v", err)
+	}
+	t.Cleanup(func() { sqlite.Close() })
+	return map[string]CanvasStore{
+		"memory": NewMemory(),
+		"sqlite": sqlite,
+	}
+}
+
+func TestSetChunkPixelsLastWriterWins(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			set := func(key string, p Pixel) int {
+				t.Helper()
+				n, err := st.SetChunkPixels(ctx, []ChunkUpdate{{ID: "c", Size: 8, Pixels: map[string]Pixel{key: p}}})
+				if err != nil {
+					t.Fatalf("SetChunkPixels: %v", err)
+				}
+				return n
+			}
+
+			if n := set("1_1", Pixel{Color: 1, User: 1, PlacedAt: 200}); n != 1 {
+				t.Errorf("first placement wrote %d pixels, want 1", n)
+			}
+			// Delivered late: placed before the stored pixel.
+			if n := set("1_1", Pixel{Color: 2, User: 2, PlacedAt: 100}); n != 0 {
+				t.Errorf("older placement wrote %d pixels, want 0", n)
+			}
+			// Redelivered: same placement time.
+			if n := set("1_1", Pixel{Color: 3, User: 3, PlacedAt: 200}); n != 0 {
+				t.Errorf("redelivered placement wrote %d pixels, want 0", n)
+			}
+			if n := set("1_1", Pixel{Color: 4, User: 4, PlacedAt: 300}); n != 1 {
+				t.Errorf("newer placement wrote %d pixels, want 1", n)
+			}
+
+			chunk, err := st.GetChunk(ctx, "", "c")
+			if err != nil {
+				t.Fatalf("GetChunk: %v", err)
+			}
+			if want := (Pixel{Color: 4, User: 4, PlacedAt: 300}); chunk.Pixels["1_1"] != want {
+				t.Errorf("pixel 1_1 = %+v, want %+v", chunk.Pixels["1_1"], want)
+			}
+		})
+	}
+}
+
+func TestSetChunkPixelsWithoutPixelsCreatesNoChunk(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			n, err := st.SetChunkPixels(ctx, []ChunkUpdate{{ID: "c", Size: 8, Pixels: map[string]Pixel{}}})
+			if err != nil {
+				t.Fatalf("SetChunkPixels: %v", err)
+			}
+			if n != 0 {
+				t.Errorf("wrote %d pixels, want 0", n)
+			}
+			if _, err := st.GetChunk(ctx, "", "c"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetChunk error = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestCanvasesAreIndependent(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i, canvas := range []string{"", "event"} {
+				_, err := st.SetChunkPixels(ctx, []ChunkUpdate{{
+					Canvas: canvas,
+					ID:     "c",
+					Size:   8,
+					Pixels: map[string]Pixel{"0_0": {Color: uint8(i + 1), User: 1, PlacedAt: 100}},
+				}})
+				if err != nil {
+					t.Fatalf("SetChunkPixels(%q): %v", canvas, err)
+				}
+			}
+			for i, canvas := range []string{"", "event"} {
+				chunk, err := st.GetChunk(ctx, canvas, "c")
+				if err != nil {
+					t.Fatalf("GetChunk(%q): %v", canvas, err)
+				}
+				if got := chunk.Pixels["0_0"].Color; got != uint8(i+1) {
+					t.Errorf("canvas %q pixel 0_0 color = %d, want %d", canvas, got, i+1)
+				}
+			}
+
+			if err := st.UpdateUser(ctx, "event", "1"); err != nil {
+				t.Fatalf("UpdateUser: %v", err)
+			}
+			if _, err := st.GetUser(ctx, "", "1"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetUser on the default canvas = %v, want %v", err, ErrNotFound)
+			}
+			if _, err := st.GetUser(ctx, "event", "1"); err != nil {
+				t.Errorf("GetUser on the event canvas: %v", err)
+			}
+		})
+	}
+}
+
+func TestSQLiteChanges(t *testing.T) {
+	ctx := context.Background()
+	st, err := NewSQLite(ctx, filepath.Join(t.TempDir(), "canvas.db"))
+	if err != nil {
+		t.Fatalf("NewSQLite: %v", err)
+	}
+	defer st.Close()
+
+	if _, err := st.SetChunkPixels(ctx, []ChunkUpdate{{ID: "old", Size: 8, Pixels: map[string]Pixel{"0_0": {Color: 1, User: 1, PlacedAt: 100}}}}); err != nil {
+		t.Fatalf("SetChunkPixels: %v", err)
+	}
+	last, err := st.LastChange(ctx)
+	if err != nil {
+		t.Fatalf("LastChange: %v", err)
+	}
+
+	// Skipped: older than the stored pixel.
+	if _, err := st.SetChunkPixels(ctx, []ChunkUpdate{{ID: "old", Size: 8, Pixels: map[string]Pixel{"0_0": {Color: 2, User: 2, PlacedAt: 50}}}}); err != nil {
+		t.Fatalf("SetChunkPixels: %v", err)
+	}
+	if _, err := st.SetChunkPixels(ctx, []ChunkUpdate{{Canvas: "s2", ID: "c", Size: 8, Pixels: map[string]Pixel{"1_1": {Color: 3, User: 3, PlacedAt: 200}}}}); err != nil {
+		t.Fatalf("SetChunkPixels: %v", err)
+	}
+	req := ResetRequest{Reason: "prune", RequestedBy: "draw", Time: time.Unix(10, 0).UTC(), Prune: true}
+	if _, _, err := st.WriteTrigger(ctx, "trigger", req, 0); err != nil {
+		t.Fatalf("WriteTrigger: %v", err)
+	}
+
+	changes, err := st.Changes(ctx, last)
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	if len(changes.Chunks) != 1 || changes.Chunks[0].Canvas != "s2" || changes.Chunks[0].ID != "c" {
+		t.Fatalf("chunks = %+v, want chunk c of s2", changes.Chunks)
+	}
+	if want := (Pixel{Color: 3, User: 3, PlacedAt: 200}); changes.Chunks[0].Pixels["1_1"] != want {
+		t.Errorf("pixel 1_1 = %+v, want %+v", changes.Chunks[0].Pixels["1_1"], want)
+	}
+	if len(changes.Triggers) != 1 || changes.Triggers[0].Name != "trigger" || changes.Triggers[0].Request != req {
+		t.Fatalf("triggers = %+v, want %+v", changes.Triggers, req)
+	}
+
+	again, err := st.Changes(ctx, changes.Last)
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	if len(again.Chunks) != 0 || len(again.Triggers) != 0 || again.Last != changes.Last {
+		t.Errorf("changes after the last one = %+v, want none", again)
+	}
+}
+
+func TestChunkAdmin(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			admin := st.(ChunkAdmin)
+			for _, c := range []struct{ canvas, id string }{{"", "0_0"}, {"", "1_0"}, {"event", "0_0"}, {"event-2", "5_5"}} {
+				if _, err := st.SetChunkPixels(ctx, []ChunkUpdate{{
+					Canvas: c.canvas,
+					ID:     c.id,
+					Size:   8,
+					Pixels: map[string]Pixel{"0_0": {Color: 1, User: 1, PlacedAt: 100}},
+				}}); err != nil {
+					t.Fatalf("SetChunkPixels: %v", err)
+				}
+			}
+
+			for canvas, want := range map[string][]string{"": {"0_0", "1_0"}, "event": {"0_0"}, "event-2": {"5_5"}, "none": nil} {
+				ids, err := admin.ChunkIDs(ctx, canvas)
+				if err != nil {
+					t.Fatalf("ChunkIDs(%q): %v", canvas, err)
+				}
+				slices.Sort(ids)
+				if !slices.Equal(ids, want) {
+					t.Errorf("ChunkIDs(%q) = %v, want %v", canvas, ids, want)
+				}
+			}
+
+			for range 2 {
+				if err := admin.DeleteChunk(ctx, "event", "0_0"); err != nil {
+					t.Fatalf("DeleteChunk: %v", err)
+				}
+			}
+			if _, err := st.GetChunk(ctx, "event", "0_0"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetChunk of the deleted chunk = %v, want %v", err, ErrNotFound)
+			}
+			if _, err := st.GetChunk(ctx, "", "0_0"); err != nil {
+				t.Errorf("GetChunk of the chunk with the same ID on the default canvas: %v", err)
+			}
+
+			// A chunk written again starts without the pixels deleted.
+			if _, err := st.SetChunkPixels(ctx, []ChunkUpdate{{
+				Canvas: "event",
+				ID:     "0_0",
+				Size:   8,
+				Pixels: map[string]Pixel{"1_1": {Color: 2, User: 1, PlacedAt: 50}},
+			}}); err != nil {
+				t.Fatalf("SetChunkPixels: %v", err)
+			}
+			chunk, err := st.GetChunk(ctx, "event", "0_0")
+			if err != nil {
+				t.Fatalf("GetChunk: %v", err)
+			}
+			if len(chunk.Pixels) != 1 {
+				t.Errorf("chunk written again has pixels %v, want 1_1 only", chunk.Pixels)
+			}
+		})
+	}
+}
+
+func TestArchiver(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			archiver := st.(Archiver)
+			archived := st.(interface {
+				ArchivedChunk(ctx context.Context, season, id string) (*Chunk, error)
+			})
+			for _, c := range []struct{ canvas, id string }{{"", "0_0"}, {"event", "0_0"}, {"event", "1_0"}} {
+				if _, err := st.SetChunkPixels(ctx, []ChunkUpdate{{
+					Canvas: c.canvas,
+					ID:     c.id,
+					Size:   8,
+					Pixels: map[string]Pixel{"1_1": {Color: 3, User: 1, PlacedAt: 100}},
+				}}); err != nil {
+					t.Fatalf("SetChunkPixels: %v", err)
+				}
+			}
+			for _, u := range []struct{ canvas, id string }{{"", "1"}, {"event", "1"}, {"event", "2"}, {"event-2", "1"}} {
+				if err := st.UpdateUser(ctx, u.canvas, u.id); err != nil {
+					t.Fatalf("UpdateUser: %v", err)
+				}
+			}
+
+			if _, err := archiver.GetArchive(ctx, "s1"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("GetArchive before it is created = %v, want %v", err, ErrNotFound)
+			}
+			created := time.Date(2025, 6, 1, 18, 0, 0, 0, time.UTC)
+			if err := archiver.CreateArchive(ctx, "s1", &Archive{Canvas: "event", ChunkSize: 8, Width: 16, Height: 8, CreatedAt: created}); err != nil {
+				t.Fatalf("CreateArchive: %v", err)
+			}
+			if err := archiver.CreateArchive(ctx, "s1", &Archive{Canvas: "other"}); !errors.Is(err, ErrExists) {
+				t.Errorf("CreateArchive of the same season = %v, want %v", err, ErrExists)
+			}
+
+			for range 2 {
+				n, err := archiver.ArchiveChunks(ctx, "event", "s1")
+				if err != nil {
+					t.Fatalf("ArchiveChunks: %v", err)
+				}
+				if n != 2 {
+					t.Errorf("ArchiveChunks copied %d chunks, want 2", n)
+				}
+			}
+			if chunk, err := archived.ArchivedChunk(ctx, "s1", "1_0"); err != nil || chunk.Pixels["1_1"].Color != 3 {
+				t.Errorf("ArchivedChunk = %+v, %v, want the chunk copied", chunk, err)
+			}
+
+			if n, err := archiver.DeleteChunks(ctx, "event"); err != nil || n != 2 {
+				t.Errorf("DeleteChunks = %d, %v, want 2 deleted", n, err)
+			}
+			if _, err := st.GetChunk(ctx, "event", "0_0"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetChunk of a deleted chunk = %v, want %v", err, ErrNotFound)
+			}
+			if _, err := st.GetChunk(ctx, "", "0_0"); err != nil {
+				t.Errorf("GetChunk of the default canvas: %v", err)
+			}
+			if chunk, err := archived.ArchivedChunk(ctx, "s1", "0_0"); err != nil || len(chunk.Pixels) != 1 {
+				t.Errorf("ArchivedChunk after the clear = %+v, %v, want the copy kept", chunk, err)
+			}
+
+			if n, err := archiver.DeleteUsers(ctx, "event"); err != nil || n != 2 {
+				t.Errorf("DeleteUsers = %d, %v, want 2 deleted", n, err)
+			}
+			if _, err := st.GetUser(ctx, "event", "1"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetUser of a deleted user = %v, want %v", err, ErrNotFound)
+			}
+			for _, canvasID := range []string{"", "event-2"} {
+				if _, err := st.GetUser(ctx, canvasID, "1"); err != nil {
+					t.Errorf("GetUser of canvas %q: %v", canvasID, err)
+				}
+			}
+
+			cleared := created.Add(time.Hour)
+			if err := archiver.SetArchiveCleared(ctx, "s1", cleared); err != nil {
+				t.Fatalf("SetArchiveCleared: %v", err)
+			}
+			got, err := archiver.GetArchive(ctx, "s1")
+			if err != nil {
+				t.Fatalf("GetArchive: %v", err)
+			}
+			if got.Canvas != "event" || got.ChunkSize != 8 || got.Width != 16 || got.Height != 8 || got.Documents != 2 ||
+				!got.CreatedAt.Equal(created) || got.ArchivedAt == nil || got.ClearedAt == nil || !got.ClearedAt.Equal(cleared) {
+				t.Errorf("GetArchive = %+v, want the archive created, copied and cleared", got)
+			}
+			if err := archiver.SetArchiveCleared(ctx, "none", cleared); !errors.Is(err, ErrNotFound) {
+				t.Errorf("SetArchiveCleared of a missing archive = %v, want %v", err, ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestCanvasMeta(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := st.GetCanvasMeta(ctx, ""); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("GetCanvasMeta before any write = %v, want %v", err, ErrNotFound)
+			}
+
+			want := &CanvasMeta{ChunkSize: 64, Rechunk: &Rechunk{To: 128, Phase: "copy", After: "chunk_1_0"}}
+			if err := st.SetCanvasMeta(ctx, "", want); err != nil {
+				t.Fatalf("SetCanvasMeta: %v", err)
+			}
+			if err := st.SetCanvasMeta(ctx, "event", &CanvasMeta{ChunkSize: 32}); err != nil {
+				t.Fatalf("SetCanvasMeta: %v", err)
+			}
+			got, err := st.GetCanvasMeta(ctx, "")
+			if err != nil {
+				t.Fatalf("GetCanvasMeta: %v", err)
+			}
+			if got.ChunkSize != want.ChunkSize || got.Rechunk == nil || *got.Rechunk != *want.Rechunk {
+				t.Errorf("GetCanvasMeta = %+v, want %+v", got, want)
+			}
+
+			if err := st.SetCanvasMeta(ctx, "", &CanvasMeta{ChunkSize: 128}); err != nil {
+				t.Fatalf("SetCanvasMeta: %v", err)
+			}
+			if got, err := st.GetCanvasMeta(ctx, ""); err != nil || got.ChunkSize != 128 || got.Rechunk != nil {
+				t.Errorf("GetCanvasMeta after the migration = %+v, %v, want size 128 and no migration", got, err)
+			}
+			if got, err := st.GetCanvasMeta(ctx, "event"); err != nil || got.ChunkSize != 32 {
+				t.Errorf("GetCanvasMeta(event) = %+v, %v, want size 32", got, err)
+			}
+		})
+	}
+}
+
+func TestUpdateCanvasMeta(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			meta, err := st.UpdateCanvasMeta(ctx, "", func(meta *CanvasMeta) error {
+				if meta.ChunkSize != 0 {
+					t.Errorf("new metadata has chunk size %d, want 0", meta.ChunkSize)
+				}
+				meta.Width, meta.Height = 512, 256
+				return nil
+			})
+			if err != nil || meta.Width != 512 || meta.Height != 256 {
+				t.Fatalf("UpdateCanvasMeta = %+v, %v, want 512x256", meta, err)
+			}
+
+			errAbort := errors.New("abort")
+			if _, err := st.UpdateCanvasMeta(ctx, "", func(meta *CanvasMeta) error {
+				meta.Width = 1024
+				return errAbort
+			}); !errors.Is(err, errAbort) {
+				t.Errorf("UpdateCanvasMeta with a failing update = %v, want %v", err, errAbort)
+			}
+			if got, err := st.GetCanvasMeta(ctx, ""); err != nil || got.Width != 512 || got.Height != 256 {
+				t.Errorf("GetCanvasMeta after a failed update = %+v, %v, want 512x256", got, err)
+			}
+		})
+	}
+}
+
+func TestAuditEntries(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := st.GetAuditEntry(ctx, "1"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("GetAuditEntry before any write = %v, want %v", err, ErrNotFound)
+			}
+
+			at := time.Date(2025, 6, 1, 18, 0, 0, 0, time.UTC)
+			entry := &AuditEntry{
+				ID:          "1",
+				Operation:   "reset",
+				RequestedBy: "admin@example.com",
+				Reason:      "replay after outage",
+				At:          at,
+				Details:     map[string]string{"pixel-update-tail": "seeked"},
+			}
+			if err := st.RecordAudit(ctx, entry); err != nil {
+				t.Fatalf("RecordAudit: %v", err)
+			}
+			entry.Details["pixel-update-tail"] = "changed after recording"
+
+			got, err := st.GetAuditEntry(ctx, "1")
+			if err != nil {
+				t.Fatalf("GetAuditEntry: %v", err)
+			}
+			if got.ID != "1" || got.Operation != "reset" || got.RequestedBy != "admin@example.com" || !got.At.Equal(at) ||
+				!maps.Equal(got.Details, map[string]string{"pixel-update-tail": "seeked"}) {
+				t.Errorf("GetAuditEntry = %+v, want the entry recorded", got)
+			}
+
+			if err := st.RecordAudit(ctx, &AuditEntry{ID: "1", Operation: "reset", Error: "failed"}); err != nil {
+				t.Fatalf("RecordAudit again: %v", err)
+			}
+			if got, err := st.GetAuditEntry(ctx, "1"); err != nil || got.Error != "failed" || got.Details != nil {
+				t.Errorf("GetAuditEntry after recording again = %+v, %v, want the entry replaced", got, err)
+			}
+		})
+	}
+}
+
+func TestWriteTriggerInterval(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Unix(1000, 0).UTC()
+			switch s := st.(type) {
+			case *MemoryStore:
+				s.Now = func() time.Time { return now }
+			case *SQLiteStore:
+				s.Now = func() time.Time { return now }
+			}
+			write := func() (time.Time, bool) {
+				t.Helper()
+				last, written, err := st.WriteTrigger(ctx, "trigger", ResetRequest{Reason: "prune", RequestedBy: "draw"}, time.Minute)
+				if err != nil {
+					t.Fatalf("WriteTrigger: %v", err)
+				}
+				return last, written
+			}
+
+			if last, written := write(); !written || !last.Equal(now) {
+				t.Errorf("first write = %v, %v, want %v, true", last, written, now)
+			}
+			first := now
+			now = now.Add(30 * time.Second)
+			if last, written := write(); written || !last.Equal(first) {
+				t.Errorf("write within the interval = %v, %v, want %v, false", last, written, first)
+			}
+			now = now.Add(30 * time.Second)
+			if last, written := write(); !written || !last.Equal(now) {
+				t.Errorf("write after the interval = %v, %v, want %v, true", last, written, now)
+			}
+		})
+	}
+}
+
+func TestCanvasMetaBounds(t *testing.T) {
+	now := time.Unix(1000, 0)
+	configured := canvas.Bounds{Width: 256, Height: 128}
+	tests := []struct {
+		name string
+		meta *CanvasMeta
+		want canvas.Bounds
+	}{
+		{"no metadata", nil, configured},
+		{"bounds not recorded", &CanvasMeta{ChunkSize: 64}, configured},
+		{"bounds recorded", &CanvasMeta{Width: 512, Height: 256}, canvas.Bounds{Width: 512, Height: 256}},
+		{"bounds recorded smaller", &CanvasMeta{Width: 128, Height: 128}, canvas.Bounds{Width: 128, Height: 128}},
+		{"expansion due", &CanvasMeta{Width: 512, Height: 256, Expansion: &Expansion{Width: 1024, Height: 256, At: now}}, canvas.Bounds{Width: 1024, Height: 256}},
+		{"expansion later", &CanvasMeta{Width: 512, Height: 256, Expansion: &Expansion{Width: 1024, Height: 1024, At: now.Add(time.Second)}}, canvas.Bounds{Width: 512, Height: 256}},
+	}
+	for _, tt := range tests {
+		if got := tt.meta.Bounds(configured, now); got != tt.want {
+			t.Errorf("%s: Bounds = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	unbounded := canvas.Bounds{Unbounded: true}
+	if got := (&CanvasMeta{Width: 512, Height: 512}).Bounds(unbounded, now); got != unbounded {
+		t.Errorf("Bounds of an unbounded canvas = %+v, want it unchanged", got)
+	}
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	pixels := map[string]Pixel{
+		"0_0": {Color: 0, User: 7, PlacedAt: 100},
+		"3_1": {Color: 255, User: 8, PlacedAt: 200},
+		"1_3": {Color: 12, User: 7, PlacedAt: -1},
+	}
+	packed, err := Pack(4, pixels)
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	if len(packed.Users) != 2 {
+		t.Errorf("Pack kept %d users, want 2", len(packed.Users))
+	}
+	got, err := packed.Unpack()
+	if err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if !maps.Equal(got, pixels) {
+		t.Errorf("Unpack() = %v, want %v", got, pixels)
+	}
+
+	if _, err := Pack(4, map[string]Pixel{"4_0": {}}); !errors.Is(err, ErrInvalidPackedChunk) {
+		t.Errorf("Pack of a pixel outside the chunk error = %v, want %v", err, ErrInvalidPackedChunk)
+	}
+	packed.Colors = packed.Colors[1:]
+	if _, err := packed.Unpack(); !errors.Is(err, ErrInvalidPackedChunk) {
+		t.Errorf("Unpack of truncated colors error = %v, want %v", err, ErrInvalidPackedChunk)
+	}
+}
+
+func TestChunkFieldsRoundTrip(t *testing.T) {
+	pixels := map[string]Pixel{
+		"2_5": {Color: 3, User: 42, PlacedAt: 1000},
+		"7_7": {Color: 9, User: 43, PlacedAt: 2000},
+	}
+	for _, format := range []ChunkFormat{FormatMap, FormatPacked} {
+		fields, err := pixelFields(format, 8, pixels)
+		if err != nil {
+			t.Fatalf("pixelFields(%s): %v", format, err)
+		}
+		// Decode the fields the way Firestore returns them.
+		data := map[string]any{"size": int64(8)}
+		for k, v := range fields {
+			switch v := v.(type) {
+			case []int64:
+				users := make([]any, len(v))
+				for i, u := range v {
+					users[i] = u
+				}
+				data[k] = users
+			case map[string]any:
+				decoded := make(map[string]any, len(v))
+				for key, p := range v {
+					p := p.(map[string]any)
+					decoded[key] = map[string]any{
+						"color":    int64(p["color"].(uint8)),
+						"user":     p["user"],
+						"placedAt": p["placedAt"],
+					}
+				}
+				data[k] = decoded
+			default:
+				data[k] = v
+			}
+		}
+
+		got, gotFormat, err := decodeChunkPixels(data)
+		if err != nil {
+			t.Fatalf("decodeChunkPixels(%s): %v", format, err)
+		}
+		if gotFormat != format || !maps.Equal(got, pixels) {
+			t.Errorf("decodeChunkPixels(%s) = %v, %s, want %v", format, got, gotFormat, pixels)
+		}
+	}
+}
+
+func TestCheckChunkSize(t *testing.T) {
+	tests := []struct {
+		format    ChunkFormat
+		size      int
+		threshold int
+		ok        bool
+	}{
+		{FormatMap, 64, 0, true},
+		{FormatMap, 128, 0, true},
+		{FormatMap, 256, 0, false},
+		{FormatMap, 256, 800_000, true},
+		{FormatMap, 64, MaxDocumentSize + 1, false},
+		{FormatPacked, 128, 0, true},
+		{FormatPacked, 256, 800_000, false},
+		{FormatMap, 0, 0, false},
+	}
+	for _, tt := range tests {
+		if err := CheckChunkSize(tt.format, tt.size, tt.threshold); (err == nil) != tt.ok {
+			t.Errorf("CheckChunkSize(%s, %d, %d) = %v, want ok %v", tt.format, tt.size, tt.threshold, err, tt.ok)
+		}
+	}
+}
+
+func TestShardsFor(t *testing.T) {
+	pixels := make(map[string]Pixel)
+	for y := range 16 {
+		for x := range 16 {
+			pixels[canvas.PixelKey(x, y)] = Pixel{Color: 1, User: 1}
+		}
+	}
+	full := mapDocumentSize(pixels)
+	quarters, err := splitShards(pixels, 16, 4)
+	if err != nil {
+		t.Fatalf("splitShards: %v", err)
+	}
+	quarter := 0
+	for _, shardPixels := range quarters {
+		quarter = max(quarter, mapDocumentSize(shardPixels))
+	}
+
+	tests := []struct {
+		threshold, current, want int
+	}{
+		{0, 1, 1},
+		{full, 1, 1},
+		{full - 1, 1, 2},
+		{full, 4, 4},
+		{quarter, 1, 4},
+		{1, 1, 16},
+	}
+	for _, tt := range tests {
+		got, err := shardsFor(pixels, 16, tt.threshold, tt.current)
+		if err != nil || got != tt.want {
+			t.Errorf("shardsFor(threshold %d, current %d) = %d, %v, want %d", tt.threshold, tt.current, got, err, tt.want)
+		}
+	}
+
+	for shard, shardPixels := range quarters {
+		if len(shardPixels) != 64 {
+			t.Errorf("shard %d holds %d pixels, want 64", shard, len(shardPixels))
+		}
+		if _, ok := shardPixels[canvas.PixelKey(0, 4*shard)]; !ok {
+			t.Errorf("shard %d does not hold its first row", shard)
+		}
+	}
+}
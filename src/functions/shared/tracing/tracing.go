@@ -0,0 +1,168 @@
+// Package tracing sets up OpenTelemetry tracing for the functions and
+// propagates the trace of a placement through message attributes, so its
+// spans link up across the Pub/Sub hops and Firestore triggers.
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"example.com/shared/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Config selects how the spans are exported.
+type Config struct {
+	// Exporter is "otlp", pushing to the collector configured by the
+	// standard OTEL_EXPORTER_OTLP_* variables, or "" to record spans without
+	// exporting them, which still correlates the logs.
+	Exporter string
+
+	// ServiceName is the service.name resource attribute.
+	ServiceName string
+}
+
+// Propagator carries the trace in message attributes and HTTP headers:
+// traceparent, falling back to X-Cloud-Trace-Context on incoming requests.
+var Propagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(
+	cloudTraceContext{},
+	propagation.TraceContext{},
+)
+
+var (
+	setupOnce sync.Once
+	setupErr  error
+	provider  *sdktrace.TracerProvider
+)
+
+// Setup installs the global TracerProvider and propagator. Only the first
+// call in a process has an effect, so functions sharing a process share one
+// provider.
+func Setup(ctx context.Context, cfg Config) error {
+	setupOnce.Do(func() {
+		res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+			attribute.String("service.name", cfg.ServiceName),
+		))
+		if err != nil {
+			setupErr = fmt.Errorf("error building trace resource: %w", err)
+			return
+		}
+		opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+
+		switch cfg.Exporter {
+		case "", "none":
+		case "otlp":
+			exp, err := otlptracegrpc.New(ctx)
+			if err != nil {
+				setupErr = fmt.Errorf("error creating OTLP trace exporter: %w", err)
+				return
+			}
+			opts = append(opts, sdktrace.WithBatcher(exp))
+		default:
+			setupErr = fmt.Errorf("tracing: unknown exporter %q", cfg.Exporter)
+			return
+		}
+
+		provider = sdktrace.NewTracerProvider(opts...)
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(Propagator)
+	})
+	return setupErr
+}
+
+// Shutdown flushes the pending spans and stops the provider installed by
+// Setup.
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
+
+// Tracer returns the tracer of the pipeline spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer("example.com/shared/tracing")
+}
+
+// End records err, if any, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject adds the trace of ctx to the message attributes attrs.
+func Inject(ctx context.Context, attrs map[string]string) {
+	Propagator.Inject(ctx, propagation.MapCarrier(attrs))
+}
+
+// Extract returns a copy of ctx carrying the remote trace found in the
+// message attributes attrs, if any.
+func Extract(ctx context.Context, attrs map[string]string) context.Context {
+	return Propagator.Extract(ctx, propagation.MapCarrier(attrs))
+}
+
+// ExtractHTTP returns a copy of ctx carrying the remote trace found in the
+// request headers, if any.
+func ExtractHTTP(ctx context.Context, r *http.Request) context.Context {
+	return Propagator.Extract(ctx, propagation.HeaderCarrier(r.Header))
+}
+
+// TraceParent returns the traceparent of the span of ctx, or "" when there
+// is none.
+func TraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get(logging.TraceParentHeader)
+}
+
+// cloudTraceContext extracts the X-Cloud-Trace-Context header set by Google
+// Cloud in front of Cloud Run. It is never injected: traceparent is.
+type cloudTraceContext struct{}
+
+func (cloudTraceContext) Inject(context.Context, propagation.TextMapCarrier) {}
+
+func (cloudTraceContext) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	tc, ok := logging.ParseCloudTraceContext(carrier.Get(logging.CloudTraceHeader))
+	if !ok || tc.SpanID == "" {
+		return ctx
+	}
+	var cfg trace.SpanContextConfig
+	if _, err := hex.Decode(cfg.TraceID[:], []byte(tc.TraceID)); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(cfg.SpanID[:], []byte(tc.SpanID)); err != nil {
+		return ctx
+	}
+	if tc.Sampled {
+		cfg.TraceFlags = trace.FlagsSampled
+	}
+	cfg.Remote = true
+	return trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(cfg))
+}
+
+func (cloudTraceContext) Fields() []string {
+	return []string{logging.CloudTraceHeader}
+}
+
+// EndWithReason records on span the reason a request or message was
+// accepted ("ok") or rejected, as counted by the metrics, and ends it.
+func EndWithReason(span trace.Span, reason string) {
+	span.SetAttributes(attribute.String("airplace.reason", reason))
+	if reason != "ok" {
+		span.SetStatus(codes.Error, reason)
+	}
+	span.End()
+}
@@ -0,0 +1,121 @@
+// Decoding of the chunk documents written by the draw function. The pixels of
+// a chunk are kept either in a "pixels" map of "x_y" keys, or packed in arrays
+// indexed by y*size+x when its format is "packed": one byte of color, a
+// little-endian uint32 owner (index in users plus one, 0 when blank) and a
+// little-endian int64 placedAt per pixel.
+
+const OWNER_WIDTH = 4;
+const PLACED_AT_WIDTH = 8;
+
+// bytesOf returns the content of a Firestore bytes field as a Uint8Array,
+// whether it was read by firebase-admin (a Buffer) or the web SDK (Bytes).
+function bytesOf(value) {
+  if (!value) return new Uint8Array();
+  if (typeof value.toUint8Array === 'function') return value.toUint8Array();
+  if (value instanceof Uint8Array) return value;
+  return Uint8Array.from(value);
+}
+
+// decodeChunkPixels returns the pixels of a chunk document, in either format,
+// as {x, y, color, user, placedAt} with coordinates within the chunk.
+export function decodeChunkPixels(data = {}) {
+  if (data.format === 'packed') {
+    return unpackPixels(data);
+  }
+  const pixels = [];
+  for (const [key, value] of Object.entries(data.pixels ?? {})) {
+    const match = /^(-?\d+)_(-?\d+)$/.exec(key);
+    if (!match || value?.color === undefined || value?.color === null) continue;
+    pixels.push({
+      x: Number(match[1]),
+      y: Number(match[2]),
+      color: Number(value.color),
+      user: value.user,
+      placedAt: Number(value.placedAt ?? 0),
+    });
+  }
+  return pixels;
+}
+
+// unpackPixels decodes a chunk in the packed format, throwing if its arrays
+// do not match its size.
+function unpackPixels(data) {
+  const size = Number(data.size);
+  const n = size * size;
+  const colors = bytesOf(data.colors);
+  const owners = bytesOf(data.owners);
+  const placedAt = bytesOf(data.placedAt);
+  const users = data.users ?? [];
+  if (!(size > 0) || colors.length !== n || owners.length !== n * OWNER_WIDTH || placedAt.length !== n * PLACED_AT_WIDTH) {
+    throw new Error(`invalid packed chunk: arrays do not match size ${data.size}`);
+  }
+  const ownerView = new DataView(owners.buffer, owners.byteOffset, owners.byteLength);
+  const placedAtView = new DataView(placedAt.buffer, placedAt.byteOffset, placedAt.byteLength);
+  const pixels = [];
+  for (let i = 0; i < n; i++) {
+    const owner = ownerView.getUint32(i * OWNER_WIDTH, true);
+    if (owner === 0) continue;
+    if (owner > users.length) {
+      throw new Error(`invalid packed chunk: owner ${owner} of ${users.length} users`);
+    }
+    pixels.push({
+      x: i % size,
+      y: Math.floor(i / size),
+      color: colors[i],
+      user: users[owner - 1],
+      placedAt: Number(placedAtView.getBigInt64(i * PLACED_AT_WIDTH, true)),
+    });
+  }
+  return pixels;
+}
+
+const CHUNK_ID = /^canvas_chunks_(-?\d+)_(-?\d+)(?:_s(\d+))?$/;
+
+// parseChunkId returns the coordinates of the chunk a document ID belongs to,
+// with its shard: 0 for the chunk document itself, n for the "_sn" documents
+// holding the other rows of a chunk split in several. It returns null for IDs
+// of other documents.
+export function parseChunkId(id) {
+  const match = CHUNK_ID.exec(id);
+  if (!match) return null;
+  const shard = Number(match[3] ?? 0);
+  if (match[3] !== undefined && shard <= 0) return null;
+  return { chunkX: Number(match[1]), chunkY: Number(match[2]), shard };
+}
+
+// mergeChunks decodes chunk documents, given as {id, data}, and merges the
+// shards of each chunk. It returns the chunks as {chunkX, chunkY, size,
+// pixels}. Shards past the count recorded on the chunk document, left over
+// from an earlier split, are ignored, as are those of chunks without a chunk
+// document. Documents that fail to decode are passed to onInvalid and
+// skipped.
+export function mergeChunks(docs, onInvalid = () => {}) {
+  const chunks = new Map();
+  for (const { id, data } of docs) {
+    const parsed = parseChunkId(id);
+    if (!parsed) continue;
+    const key = `${parsed.chunkX}_${parsed.chunkY}`;
+    if (!chunks.has(key)) {
+      chunks.set(key, { chunkX: parsed.chunkX, chunkY: parsed.chunkY, shards: new Map() });
+    }
+    chunks.get(key).shards.set(parsed.shard, { id, data });
+  }
+
+  const merged = [];
+  for (const { chunkX, chunkY, shards } of chunks.values()) {
+    const first = shards.get(0);
+    if (!first) continue;
+    const count = Number(first.data.shards) > 1 ? Number(first.data.shards) : 1;
+    const chunk = { chunkX, chunkY, size: Number(first.data.size), pixels: [] };
+    for (const [shard, { id, data }] of shards) {
+      if (shard >= count) continue;
+      try {
+        chunk.pixels.push(...decodeChunkPixels(data));
+      } catch (err) {
+        onInvalid(id, err);
+      }
+    }
+    merged.push(chunk);
+  }
+  return merged;
+}
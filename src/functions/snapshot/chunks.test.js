@@ -0,0 +1,83 @@
+import { test } from 'node:test';
+import assert from 'node:assert/strict';
+import { decodeChunkPixels, mergeChunks, parseChunkId } from './chunks.js';
+
+// packed encodes pixels like store.Pack of the draw function.
+function packed(size, pixels) {
+  const n = size * size;
+  const colors = Buffer.alloc(n);
+  const owners = Buffer.alloc(n * 4);
+  const placedAt = Buffer.alloc(n * 8);
+  const users = [];
+  for (const p of pixels) {
+    if (!users.includes(p.user)) users.push(p.user);
+    const i = p.y * size + p.x;
+    colors[i] = p.color;
+    owners.writeUInt32LE(users.indexOf(p.user) + 1, i * 4);
+    placedAt.writeBigInt64LE(BigInt(p.placedAt), i * 8);
+  }
+  return { format: 'packed', size, colors, owners, users, placedAt };
+}
+
+test('decodes a chunk in the map format', () => {
+  const got = decodeChunkPixels({
+    size: 4,
+    pixels: {
+      '1_2': { color: 3, user: 42, placedAt: 10 },
+      'bad': { color: 1 },
+    },
+  });
+  assert.deepEqual(got, [{ x: 1, y: 2, color: 3, user: 42, placedAt: 10 }]);
+});
+
+test('decodes a packed chunk', () => {
+  const pixels = [
+    { x: 0, y: 0, color: 5, user: 42, placedAt: 10 },
+    { x: 3, y: 1, color: 0, user: 7, placedAt: 20 },
+    { x: 1, y: 3, color: 9, user: 42, placedAt: 30 },
+  ];
+  const got = decodeChunkPixels(packed(4, pixels));
+  assert.deepEqual(got, [...pixels].sort((a, b) => a.y * 4 + a.x - (b.y * 4 + b.x)));
+});
+
+test('refuses a packed chunk not matching its size', () => {
+  const chunk = packed(4, []);
+  chunk.size = 8;
+  assert.throws(() => decodeChunkPixels(chunk), /invalid packed chunk/);
+});
+
+test('parses chunk and shard IDs', () => {
+  assert.deepEqual(parseChunkId('canvas_chunks_-1_2'), { chunkX: -1, chunkY: 2, shard: 0 });
+  assert.deepEqual(parseChunkId('canvas_chunks_3_4_s2'), { chunkX: 3, chunkY: 4, shard: 2 });
+  assert.equal(parseChunkId('canvas_chunks_3_4_s0'), null);
+  assert.equal(parseChunkId('canvas_meta'), null);
+});
+
+test('merges the shards of a chunk', () => {
+  const pixel = (x, y) => ({ color: 1, user: 42, placedAt: 10 * y + x });
+  const docs = [
+    { id: 'canvas_chunks_1_0_s1', data: { size: 4, shards: 2, shard: 1, pixels: { '3_2': pixel(3, 2) } } },
+    { id: 'canvas_chunks_1_0', data: { size: 4, shards: 2, pixels: { '0_0': pixel(0, 0), '1_1': pixel(1, 1) } } },
+    // Left over from a split in 4 since merged back into 2.
+    { id: 'canvas_chunks_1_0_s3', data: { size: 4, shards: 4, shard: 3, pixels: { '2_3': pixel(2, 3) } } },
+    // Shard of a chunk whose chunk document is gone.
+    { id: 'canvas_chunks_5_5_s1', data: { size: 4, shards: 2, shard: 1, pixels: { '0_3': pixel(0, 3) } } },
+    { id: 'canvas_chunks_0_0', data: packed(4, [{ x: 2, y: 1, color: 7, user: 7, placedAt: 1 }]) },
+  ];
+
+  const got = mergeChunks(docs);
+  const coords = got.map(c => ({ ...c, pixels: c.pixels.map(p => `${p.x}_${p.y}`).sort() }));
+  assert.deepEqual(coords, [
+    { chunkX: 1, chunkY: 0, size: 4, pixels: ['0_0', '1_1', '3_2'] },
+    { chunkX: 0, chunkY: 0, size: 4, pixels: ['2_1'] },
+  ]);
+});
+
+test('skips the shards that fail to decode', () => {
+  const invalid = [];
+  const got = mergeChunks([
+    { id: 'canvas_chunks_0_0', data: { size: 4, format: 'packed', colors: Buffer.alloc(1) } },
+  ], id => invalid.push(id));
+  assert.deepEqual(invalid, ['canvas_chunks_0_0']);
+  assert.deepEqual(got, [{ chunkX: 0, chunkY: 0, size: 4, pixels: [] }]);
+});
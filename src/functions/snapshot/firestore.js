@@ -1,5 +1,6 @@
 import { initializeApp, applicationDefault } from "firebase-admin/app";
 import { getFirestore } from "firebase-admin/firestore";
+import { mergeChunks } from "./chunks.js";
 
 const app = initializeApp({ credential: applicationDefault() });
 const db = getFirestore(app, process.env.FIRESTORE_ID);
@@ -11,32 +12,18 @@ export async function fetchAllPixels(collectionName = "canvas_chunks") {
   const snapshot = await db.collection(collectionName).get();
   console.info(`[snapshot-make] docs=${snapshot.size}`, snapshot.docs.map(doc => doc.id));
 
-  for (const doc of snapshot.docs) {
-    const match = /^canvas_chunks_(-?\d+)_(-?\d+)$/.exec(doc.id);
-    if (!match) continue;
-    console.info(`[snapshot-make] processing doc=${doc.id}`);
-    const [_, chunkXStr, chunkYStr] = match;
-    const chunkX = Number(chunkXStr);
-    const chunkY = Number(chunkYStr);
-
-    const pixelMap = doc.get("pixels");
-    if (!pixelMap) continue;
-    console.info(`[snapshot-make] pixel entries=${Object.keys(pixelMap)} in doc=${doc.id}`);
-    for (const [key, { color } = {}] of Object.entries(pixelMap)) {
-      if (!/^-?\d+_-?\d+$/.test(key)) continue;
-
-        const [pxStr, pyStr] = key.split("_");
-        console.info(`[snapshot-make] processing pixel key=${key} in doc=${doc.id}`);
-        const px = Number(pxStr);
-        const py = Number(pyStr);
-      if (color === undefined || color === null) continue;
-          pixels.push({
-            x: chunkX * CHUNK_SIZE + px,
-            y: chunkY * CHUNK_SIZE + py,
-            color,
-          });
-          console.info(`[snapshot-make] added pixel x=${chunkX * CHUNK_SIZE + px} y=${chunkY * CHUNK_SIZE + py} color=${color} from key=${key} in doc=${doc.id}`);
-        }
+  const docs = snapshot.docs.map(doc => ({ id: doc.id, data: doc.data() }));
+  const chunks = mergeChunks(docs, (id, err) => console.warn(`[snapshot-make] skipping doc=${id}`, err));
+  for (const { chunkX, chunkY, size, pixels: chunkPixels } of chunks) {
+    const chunkSize = size || CHUNK_SIZE;
+    console.info(`[snapshot-make] pixels=${chunkPixels.length} in chunk=${chunkX}_${chunkY}`);
+    for (const { x, y, color } of chunkPixels) {
+      pixels.push({
+        x: chunkX * chunkSize + x,
+        y: chunkY * chunkSize + y,
+        color,
+      });
+    }
   }
 
   console.info(`[snapshot-make] total=${pixels.length}`);
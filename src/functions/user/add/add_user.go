@@ -2,110 +2,194 @@ package add_user
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
-
-	"cloud.google.com/go/firestore"
-	"example.com/logging"
+	"time"
+
+	"example.com/shared/bus"
+	"example.com/shared/canvas"
+	"example.com/shared/logging"
+	"example.com/shared/message"
+	"example.com/shared/metrics"
+	"example.com/shared/store"
+	"example.com/shared/tracing"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type PubSubMessage struct {
-	Message struct {
-		Data       string            `json:"data"`
-		Attributes map[string]string `json:"attributes"`
-		MessageID  string            `json:"messageId"`
-	} `json:"message"`
-	Subscription string `json:"subscription"`
-}
-
-type UserInfo struct {
-	UserID string `firestore:"userID" json:"userID"`
-}
-
 var (
 	projectId         string
 	firestoreDatabase string
+	storeBackend      string
+	sqlitePath        string
+	busBackend        string
+	natsURL           string
+	deadLetterTopicID string
+	metricsExporter   string
+	tracesExporter    string
+	logger            *slog.Logger
 )
 
+// openStore opens the canvas store holding the users.
+var openStore = func(ctx context.Context) (store.CanvasStore, error) {
+	return store.Open(ctx, store.Config{
+		Backend:        storeBackend,
+		ProjectID:      projectId,
+		Database:       firestoreDatabase,
+		UserCollection: "users",
+		SQLitePath:     sqlitePath,
+	})
+}
+
+// openBus connects to the message bus rejected messages are dead-lettered on.
+var openBus = func(ctx context.Context) (bus.Publisher, error) {
+	return bus.Open(ctx, bus.Config{
+		Backend:   busBackend,
+		ProjectID: projectId,
+		NATSURL:   natsURL,
+	})
+}
+
 func init() {
 	projectId = os.Getenv("PROJECT_ID")
 	firestoreDatabase = os.Getenv("FIRESTORE_DATABASE")
+	storeBackend = os.Getenv("STORE_BACKEND")
+	sqlitePath = os.Getenv("SQLITE_PATH")
+	busBackend = os.Getenv("BUS_BACKEND")
+	natsURL = os.Getenv("NATS_URL")
+	deadLetterTopicID = os.Getenv("DEAD_LETTER_TOPIC")
+	metricsExporter = os.Getenv("METRICS_EXPORTER")
+	tracesExporter = os.Getenv("TRACES_EXPORTER")
+	logger = logging.New(logging.ConfigFromEnv(projectId, "add_user"))
+	if err := metrics.Setup(context.Background(), metrics.Config{Exporter: metricsExporter, ServiceName: "add_user"}); err != nil {
+		logger.Error("Error setting up metrics", "error", err)
+	}
+	if err := tracing.Setup(context.Background(), tracing.Config{Exporter: tracesExporter, ServiceName: "add_user"}); err != nil {
+		logger.Error("Error setting up tracing", "error", err)
+	}
 	log.SetFlags(0)
 
 	functions.HTTP("addUser", addUser)
 }
 
 func addUser(w http.ResponseWriter, r *http.Request) {
-	logging.Info("add_user", "Adding user...")
+	reason := metrics.ReasonOK
+	defer func() { metrics.Handled(r.Context(), "add_user", reason) }()
+
+	// Until the message is read, correlate with the push request itself.
+	ctx := tracing.ExtractHTTP(context.Background(), r)
+
+	logger.InfoContext(ctx, "Adding user...")
 
 	if projectId == "" || firestoreDatabase == "" {
-		logging.Error("add_user", "Environment variables are not set", nil)
+		logger.ErrorContext(ctx, "Environment variables are not set")
+		reason = "config_error"
 		http.Error(w, "Environment variables are not set", http.StatusInternalServerError)
 		return
 	}
 
-	ctx := context.Background()
-	client, err := firestore.NewClientWithDatabase(ctx, projectId, firestoreDatabase)
+	st, err := openStore(ctx)
 	if err != nil {
-		logging.Error("add_user", "Error connecting to Firestore", err)
+		logger.ErrorContext(ctx, "Error opening canvas store", "error", err)
+		reason = "store_error"
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	defer client.Close()
+	defer st.Close()
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		logging.Error("add_user", "Error while reading the request body", err)
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		logger.ErrorContext(ctx, "Error while reading the request body", "error", err)
+		reason = "read_error"
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
 		return
 	}
 	defer r.Body.Close()
 
 	// Read and deserialize the PubSubMessage
-	var msg PubSubMessage
-	if err := json.Unmarshal(body, &msg); err != nil {
-		logging.Error("add_user", "Error while retrieving Pub Sub Message", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+	msg, err := message.ParsePush(body)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error while retrieving Pub Sub Message", "error", err)
+		reason = reject(ctx, w, "", &bus.Message{Data: body}, bus.Permanent("invalid_envelope", err))
 		return
 	}
 
-	logging.InfoF("add_user", "PubSubMessage: %+v", msg)
+	// Continue the placement's trace, carried by the message.
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, msg.Message.Attributes), "addUser",
+		trace.WithSpanKind(trace.SpanKindConsumer))
+	defer func() { tracing.EndWithReason(span, reason) }()
+	ctx = logging.With(ctx, "messageId", msg.Message.MessageID)
+
+	logger.DebugContext(ctx, "PubSubMessage", "pubsubMessage", msg)
 
 	// Decode the base64 data
-	decodedData, err := base64.StdEncoding.DecodeString(msg.Message.Data)
+	decodedData, err := msg.Payload()
 	if err != nil {
-		logging.Error("add_user", "Error decoding base64", err)
-		http.Error(w, "Bad request: invalid base64", http.StatusBadRequest)
+		logger.ErrorContext(ctx, "Error decoding base64", "error", err)
+		reason = reject(ctx, w, msg.Subscription, msg.BusMessage(), bus.Permanent("invalid_base64", err))
 		return
 	}
 
-	logging.InfoF("add_user", "Decoded data: %s", decodedData)
+	logger.DebugContext(ctx, "Decoded data", "data", string(decodedData))
 
 	// Deserialize the UserInfo
-	var userInfo UserInfo
+	var userInfo message.UserInfo
 	if err := json.Unmarshal(decodedData, &userInfo); err != nil {
-		logging.Error("add_user", "Error while deserialize user info from body", err)
-		http.Error(w, "Bad Request: invalid body", http.StatusBadRequest)
+		logger.ErrorContext(ctx, "Error while deserialize user info from body", "error", err)
+		reason = reject(ctx, w, msg.Subscription, msg.BusMessage(), bus.Permanent("invalid_body", err))
+		return
+	}
+	if userInfo.UserID == "" {
+		logger.ErrorContext(ctx, "Missing user ID")
+		reason = reject(ctx, w, msg.Subscription, msg.BusMessage(), bus.Permanent("invalid_user", errors.New("missing user ID")))
+		return
+	}
+
+	if userInfo.Canvas != canvas.Default && !canvas.ValidID(userInfo.Canvas) {
+		logger.ErrorContext(ctx, "Invalid canvas ID", "canvas", userInfo.Canvas)
+		reason = reject(ctx, w, msg.Subscription, msg.BusMessage(), bus.Permanent("invalid_canvas", fmt.Errorf("invalid canvas ID %q", userInfo.Canvas)))
 		return
 	}
 
-	logging.InfoF("add_user", "UserInfo: %+v", userInfo)
+	ctx = logging.With(ctx, "user", userInfo.UserID, "canvas", userInfo.Canvas)
+	logger.DebugContext(ctx, "UserInfo", "userInfo", userInfo)
 
-	if _, err := client.Collection("users").Doc(userInfo.UserID).Set(ctx, map[string]any{
-		"lastUpdated": firestore.ServerTimestamp,
-	}); err != nil {
-		logging.Error("add_user", "Error queuing user document", err)
+	start := time.Now()
+	err = st.UpdateUser(ctx, userInfo.Canvas, userInfo.UserID)
+	metrics.StoreOperation(ctx, "add_user", "update_user", start, err)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error updating user document", "error", err)
+		reason = "write_error"
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	logging.Info("add_user", "User added successfully")
+	logger.InfoContext(ctx, "User added successfully")
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "User added successfully")
 }
+
+// reject acknowledges a message that failed permanently, so Pub/Sub stops
+// redelivering it, after publishing it on the dead-letter topic. If that
+// publish fails the message is left to be retried. It returns the reason to
+// record.
+func reject(ctx context.Context, w http.ResponseWriter, subscription string, m *bus.Message, err error) string {
+	var pub bus.Publisher
+	if deadLetterTopicID != "" {
+		msgBus, err := openBus(ctx)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error connecting to message bus", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return "bus_error"
+		}
+		defer msgBus.Close()
+		pub = msgBus
+	}
+	return bus.RejectPush(ctx, w, logger, "add_user", pub, deadLetterTopicID, subscription, m, err)
+}
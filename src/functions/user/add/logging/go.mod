@@ -1,3 +0,0 @@
-module example.com/logging
-
-go 1.25.4
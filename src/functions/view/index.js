@@ -86,7 +86,11 @@ async function pullAllMessagesFast() {
     const parsePromises = messages.map(async (rm) => {
       try {
         if (!rm.message?.data) return null;
-        return Buffer.from(rm.message.data, "base64").toString("utf8");
+        return {
+          data: Buffer.from(rm.message.data, "base64").toString("utf8"),
+          attributes: rm.message.attributes || {},
+          publishTime: timestampMillis(rm.message.publishTime),
+        };
       } catch (err) {
         console.warn(`[pullAllMessages] Failed to parse message:`, err);
         return null;
@@ -136,6 +140,13 @@ async function resetAckDeadlineOptimized(ackIds) {
   console.info(`[resetAckDeadline] Restored ${ackIds.length} messages`);
 }
 
+// timestampMillis converts a protobuf Timestamp to milliseconds since the
+// epoch, 0 if it is missing.
+function timestampMillis(ts) {
+  if (!ts) return 0;
+  return Number(ts.seconds || 0) * 1000 + Math.floor(Number(ts.nanos || 0) / 1e6);
+}
+
 function tryParseJson(str) {
   try {
     return JSON.parse(str);
@@ -144,18 +155,47 @@ function tryParseJson(str) {
   }
 }
 
-function parseMessagesToPixels(messageStrings) {
-  const out = [];
-  if (!Array.isArray(messageStrings) || messageStrings.length === 0) return out;
-
-  for (const msgStr of messageStrings) {
-    if (!msgStr) continue;
-    const obj = tryParseJson(msgStr);
+// parseMessagesToPixels replays the messages of PIXEL_UPDATE_TOPIC about the
+// default canvas in publish order. Chunk updates add their pixels; a
+// canvas_cleared event drops those before it, the snapshot included, and a
+// canvas_resized event grows the image. It returns the pixels to draw, whether
+// to draw them on a blank image instead of the snapshot, and the bounds the
+// canvas was resized or cleared to, if any.
+function parseMessagesToPixels(messages) {
+  const view = { pixels: [], cleared: false, width: null, height: null };
+  if (!Array.isArray(messages) || messages.length === 0) return view;
+
+  const ordered = [...messages].sort((a, b) => a.publishTime - b.publishTime);
+  for (const { data, attributes = {} } of ordered) {
+    if (!data) continue;
+    // Other canvases are not part of the snapshot.
+    if (attributes.canvas) continue;
+    const obj = tryParseJson(data);
     if (!obj) {
       console.warn('[parseMessagesToPixels] invalid json message, skipping');
       continue;
     }
 
+    switch (attributes.event) {
+      case undefined:
+        break;
+      case 'canvas_cleared':
+        view.pixels = [];
+        view.cleared = true;
+        if (obj.width && obj.height) {
+          view.width = obj.width;
+          view.height = obj.height;
+        }
+        continue;
+      case 'canvas_resized':
+        view.width = obj.width;
+        view.height = obj.height;
+        continue;
+      default:
+        console.warn(`[parseMessagesToPixels] unknown event ${attributes.event}, skipping`);
+        continue;
+    }
+
     const { chunkX, chunkY, size = CHUNK_SIZE, pixels } = obj;
     if (typeof chunkX !== 'number' || typeof chunkY !== 'number' || !pixels || typeof pixels !== 'object') {
       console.warn('[parseMessagesToPixels] message missing expected fields (chunkX,chunkY,pixels), skipping', { hasChunkX: typeof chunkX === 'number', hasChunkY: typeof chunkY === 'number', hasPixels: !!pixels });
@@ -177,10 +217,10 @@ function parseMessagesToPixels(messageStrings) {
       const globalX = chunkX * size + px;
       const globalY = chunkY * size + py;
 
-      out.push({ x: globalX, y: globalY, color: colorHex });
+      view.pixels.push({ x: globalX, y: globalY, color: colorHex });
     }
   }
-  return out;
+  return view;
 }
 
 function hexToRgba(hex) {
@@ -205,16 +245,41 @@ function hexToRgba(hex) {
   return [0, 0, 0, 255];
 }
 
-async function renderSnapshot(newPixels) {
+// baseImage returns the image the pixels of the view are drawn on, as raw
+// RGBA: the snapshot, or a blank image once the canvas was cleared, at the
+// bounds the canvas was last resized or cleared to.
+async function baseImage({ cleared, width: newWidth, height: newHeight }) {
+  const channels = 4;
+  if (cleared) {
+    const width = newWidth ?? Number(process.env.IMAGE_WIDTH || 100);
+    const height = newHeight ?? Number(process.env.IMAGE_HEIGHT || 100);
+    return { raw: Buffer.alloc(width * height * channels, 255), width, height };
+  }
+
   const bucket = storage.bucket(SNAPSHOT_BUCKET);
   const file = bucket.file(SNAPSHOT_NAME);
   const [buffer] = await file.download();
-  const img = sharpMod(buffer);
+  let img = sharpMod(buffer);
   const metadata = await img.metadata();
-  const width = metadata.width ?? (process.env.IMAGE_WIDTH || 100);
-  const height = metadata.height ?? (process.env.IMAGE_HEIGHT || 100);
+  let width = metadata.width ?? Number(process.env.IMAGE_WIDTH || 100);
+  let height = metadata.height ?? Number(process.env.IMAGE_HEIGHT || 100);
+  if ((newWidth && newWidth > width) || (newHeight && newHeight > height)) {
+    img = img.extend({
+      right: Math.max(0, (newWidth ?? width) - width),
+      bottom: Math.max(0, (newHeight ?? height) - height),
+      background: '#FFFFFF',
+    });
+    width = Math.max(width, newWidth ?? width);
+    height = Math.max(height, newHeight ?? height);
+  }
   const raw = await img.ensureAlpha().raw().toBuffer();
+  return { raw, width, height };
+}
+
+async function renderSnapshot(view) {
+  const { raw, width, height } = await baseImage(view);
   const channels = 4;
+  const newPixels = view.pixels;
 
   if (Array.isArray(newPixels) && newPixels.length > 0) {
     for (const p of newPixels) {
@@ -239,14 +304,14 @@ export async function generateView() {
   try {
     pulled = await pullAllMessagesFast();
   console.info(`[generateView] received ${pulled.collectedMessages.length} messages`);
-  console.info(`[generateView] received ${pulled.collectedMessages} messages`);
   } catch (err) {
     console.error('[generateView] pull failed', err);
   }
 
+  let view = { pixels: [], cleared: false, width: null, height: null };
   try {
-  var parsedPixels = parseMessagesToPixels(pulled.collectedMessages);
-  console.info(`[generateView] Parsed pixels: ${parsedPixels.length} items. Sample:`, parsedPixels);
+    view = parseMessagesToPixels(pulled.collectedMessages);
+    console.info(`[generateView] Parsed pixels: ${view.pixels.length} items, cleared=${view.cleared}. Sample:`, view.pixels);
   } catch (err) {
     console.error('[generateView] Failed to parse messages to pixels', err);
   }
@@ -258,7 +323,7 @@ export async function generateView() {
   }
 
   try {
-  return await renderSnapshot(parsedPixels);
+  return await renderSnapshot(view);
   } catch (err) {
     console.error('[generateView] Rendering failed', err);
     throw err;